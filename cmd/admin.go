@@ -0,0 +1,278 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles the admin socket and the commands that manage sessions through it
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+	"github.com/spf13/viper"
+
+	"gitlab.com/elixxir/remoteSyncServer/server"
+	"gitlab.com/xx_network/primitives/utils"
+)
+
+const (
+	adminSocketPathTag = "adminSocketPath"
+
+	// Paths and query parameters of the admin endpoints
+	adminSessionsPath = "/sessions"
+	adminRevokePath   = "/sessions/revoke"
+	adminUsernameKey  = "username"
+	adminSessionIDKey = "id"
+
+	// adminTimeout is the maximum time to wait for a response from the admin
+	// socket.
+	adminTimeout = 30 * time.Second
+)
+
+func init() {
+	sessionsCmd.AddCommand(sessionsListCmd, sessionsRevokeCmd)
+	rootCmd.AddCommand(sessionsCmd)
+}
+
+var sessionsCmd = &cobra.Command{
+	Use:   "sessions",
+	Short: "Manages the sessions of a running server through its admin socket",
+}
+
+var sessionsListCmd = &cobra.Command{
+	Use:   "list <username>",
+	Short: "Lists the active sessions of the user, oldest first",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		initConfig(configFilePath)
+
+		query := url.Values{adminUsernameKey: {args[0]}}
+		var sessions []server.SessionInfo
+		if err := adminRequest(
+			http.MethodGet, adminSessionsPath, query, &sessions); err != nil {
+			jww.FATAL.Panicf("Failed to list sessions: %+v", err)
+		}
+
+		for _, s := range sessions {
+			fmt.Printf("%s\tcreated %s\texpires %s\n", s.ID,
+				s.Created.Format(time.RFC3339), s.Expires.Format(time.RFC3339))
+		}
+	},
+}
+
+var sessionsRevokeCmd = &cobra.Command{
+	Use:   "revoke <username> [sessionID]",
+	Short: "Revokes the session of the user with the ID immediately",
+	Long: "Revokes the session of the user with the ID immediately. If no " +
+		"session ID is given, all sessions of the user are revoked.",
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		initConfig(configFilePath)
+
+		query := url.Values{adminUsernameKey: {args[0]}}
+		if len(args) > 1 {
+			query.Set(adminSessionIDKey, args[1])
+		}
+		var resp adminRevokeResponse
+		if err := adminRequest(
+			http.MethodPost, adminRevokePath, query, &resp); err != nil {
+			jww.FATAL.Panicf("Failed to revoke sessions: %+v", err)
+		}
+		fmt.Printf("Revoked %d sessions of user %s.\n", resp.Revoked, args[0])
+	},
+}
+
+// sessionAdmin manages the sessions of a running server. It is implemented by
+// server.Server.
+type sessionAdmin interface {
+	ListSessions(username string) []server.SessionInfo
+	RevokeSession(username, id string) error
+	RevokeUser(username string) int
+}
+
+// adminRevokeResponse is the response of the revoke endpoint.
+type adminRevokeResponse struct {
+	Revoked int `json:"revoked"`
+}
+
+// adminErrorResponse is the response of an admin endpoint that failed.
+type adminErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// startAdminServer serves the admin endpoints on a Unix socket at the path,
+// which is only accessible by the user running the server. A socket left at
+// the path by a previous run is replaced.
+func startAdminServer(admin sessionAdmin, path string) (*http.Server, error) {
+	path, err := utils.ExpandPath(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s", adminSocketPathTag)
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err = os.Remove(path); err != nil {
+			return nil, errors.Wrapf(err, "failed to remove old socket %s", path)
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to listen on %s", path)
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		_ = l.Close()
+		return nil, errors.Wrapf(err, "failed to restrict access to %s", path)
+	}
+
+	srv := &http.Server{
+		Handler:           newAdminHandler(admin),
+		ReadHeaderTimeout: adminTimeout,
+	}
+	go func() {
+		if err := srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+			jww.ERROR.Printf("Admin socket %s stopped: %+v", path, err)
+		}
+	}()
+
+	jww.INFO.Printf("Serving admin endpoints on %s.", path)
+	return srv, nil
+}
+
+// newAdminHandler returns the handler of the admin endpoints.
+func newAdminHandler(admin sessionAdmin) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminSessionsPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeAdminError(w, http.StatusMethodNotAllowed,
+				errors.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		username := r.URL.Query().Get(adminUsernameKey)
+		if username == "" {
+			writeAdminError(w, http.StatusBadRequest,
+				errors.Errorf("no %s set", adminUsernameKey))
+			return
+		}
+		writeAdminResponse(w, http.StatusOK, admin.ListSessions(username))
+	})
+	mux.HandleFunc(adminRevokePath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeAdminError(w, http.StatusMethodNotAllowed,
+				errors.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		username := r.URL.Query().Get(adminUsernameKey)
+		id := r.URL.Query().Get(adminSessionIDKey)
+		if username == "" {
+			writeAdminError(w, http.StatusBadRequest,
+				errors.Errorf("no %s set", adminUsernameKey))
+			return
+		} else if id == "" {
+			// Without a session ID, all sessions of the user are revoked
+			writeAdminResponse(w, http.StatusOK,
+				adminRevokeResponse{Revoked: admin.RevokeUser(username)})
+			return
+		}
+
+		err := admin.RevokeSession(username, id)
+		if errors.Is(err, server.SessionNotFoundErr) {
+			writeAdminError(w, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeAdminResponse(w, http.StatusOK, adminRevokeResponse{Revoked: 1})
+	})
+	return mux
+}
+
+// writeAdminResponse writes the value as the JSON body of the response.
+func writeAdminResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		jww.WARN.Printf("Failed to write admin response: %+v", err)
+	}
+}
+
+// writeAdminError writes the error as the JSON body of the response.
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminResponse(w, status, adminErrorResponse{Error: err.Error()})
+}
+
+// adminRequest sends a request to the endpoint on the admin socket in the
+// config and decodes the JSON response into v. Returns the error of the
+// endpoint if it fails.
+func adminRequest(method, path string, query url.Values, v interface{}) error {
+	socketPath, err := utils.ExpandPath(viper.GetString(adminSocketPathTag))
+	if err != nil {
+		return errors.Wrapf(err, "invalid %s", adminSocketPathTag)
+	} else if socketPath == "" {
+		return errors.Errorf("no %s configured", adminSocketPathTag)
+	}
+	return newAdminClient(socketPath).request(method, path, query, v)
+}
+
+// adminClient sends requests to the admin socket.
+type adminClient struct {
+	http.Client
+}
+
+// newAdminClient returns an adminClient that connects to the Unix socket at
+// the path.
+func newAdminClient(socketPath string) *adminClient {
+	return &adminClient{http.Client{
+		Timeout: adminTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}}
+}
+
+// request sends a request to the endpoint and decodes the JSON response into
+// v. Returns the error of the endpoint if it fails.
+func (c *adminClient) request(
+	method, path string, query url.Values, v interface{}) error {
+	// The host is ignored since all connections are made to the socket
+	u := url.URL{Scheme: "http", Host: "admin", Path: path,
+		RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to reach admin socket")
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "failed to read response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e adminErrorResponse
+		if err = json.Unmarshal(body, &e); err != nil || e.Error == "" {
+			return errors.Errorf("admin socket returned %s", resp.Status)
+		}
+		return errors.New(e.Error)
+	}
+	return errors.Wrap(json.Unmarshal(body, v), "invalid response")
+}
@@ -0,0 +1,146 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package cmd
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"gitlab.com/elixxir/remoteSyncServer/server"
+)
+
+// Tests that server.Server adheres to the sessionAdmin interface.
+var _ sessionAdmin = (*server.Server)(nil)
+
+// Tests that the sessions listed and revoked through the admin socket are
+// those of the server and that the socket is only accessible by its owner.
+func Test_startAdminServer(t *testing.T) {
+	now := time.Date(2022, 8, 1, 0, 0, 0, 0, time.UTC)
+	admin := &testSessionAdmin{sessions: map[string][]server.SessionInfo{
+		"waldo": {
+			{ID: "a1", Created: now, Expires: now.Add(time.Hour)},
+			{ID: "b2", Created: now, Expires: now.Add(2 * time.Hour)},
+		},
+	}}
+	c := newTestAdminClient(admin, t)
+
+	var sessions []server.SessionInfo
+	err := c.request(http.MethodGet, adminSessionsPath,
+		url.Values{adminUsernameKey: {"waldo"}}, &sessions)
+	if err != nil {
+		t.Fatalf("Failed to list sessions: %+v", err)
+	} else if !reflect.DeepEqual(admin.sessions["waldo"], sessions) {
+		t.Errorf("Unexpected sessions.\nexpected: %+v\nreceived: %+v",
+			admin.sessions["waldo"], sessions)
+	}
+
+	var resp adminRevokeResponse
+	err = c.request(http.MethodPost, adminRevokePath, url.Values{
+		adminUsernameKey: {"waldo"}, adminSessionIDKey: {"a1"}}, &resp)
+	if err != nil {
+		t.Fatalf("Failed to revoke session: %+v", err)
+	} else if resp.Revoked != 1 || len(admin.sessions["waldo"]) != 1 {
+		t.Errorf("Session not revoked: %+v", admin.sessions)
+	}
+
+	err = c.request(http.MethodPost, adminRevokePath,
+		url.Values{adminUsernameKey: {"waldo"}}, &resp)
+	if err != nil {
+		t.Fatalf("Failed to revoke sessions of user: %+v", err)
+	} else if resp.Revoked != 1 || len(admin.sessions["waldo"]) != 0 {
+		t.Errorf("Unexpected number of sessions revoked."+
+			"\nexpected: %d\nreceived: %d", 1, resp.Revoked)
+	}
+}
+
+// Error path: Tests that the admin endpoints return the error of the server
+// and reject invalid requests.
+func Test_startAdminServer_Error(t *testing.T) {
+	c := newTestAdminClient(&testSessionAdmin{}, t)
+
+	err := c.request(http.MethodPost, adminRevokePath, url.Values{
+		adminUsernameKey: {"waldo"}, adminSessionIDKey: {"a1"}}, nil)
+	if err == nil || !strings.Contains(err.Error(),
+		server.SessionNotFoundErr.Error()) {
+		t.Errorf("Unexpected error for unknown session."+
+			"\nexpected: %v\nreceived: %+v", server.SessionNotFoundErr, err)
+	}
+
+	err = c.request(http.MethodGet, adminSessionsPath, url.Values{}, nil)
+	if err == nil {
+		t.Errorf("Failed to error for missing username.")
+	}
+
+	err = c.request(http.MethodPost, adminRevokePath, url.Values{
+		adminSessionIDKey: {"a1"}}, nil)
+	if err == nil {
+		t.Errorf("Failed to error for revoke without username.")
+	}
+
+	err = c.request(http.MethodGet, adminRevokePath, url.Values{
+		adminUsernameKey: {"waldo"}, adminSessionIDKey: {"a1"}}, nil)
+	if err == nil {
+		t.Errorf("Failed to error for revoke with GET.")
+	}
+}
+
+// newTestAdminClient starts an admin server for the admin on a socket in a
+// temporary directory and returns a client connected to it.
+func newTestAdminClient(admin sessionAdmin, t testing.TB) *adminClient {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	srv, err := startAdminServer(admin, path)
+	if err != nil {
+		t.Fatalf("Failed to start admin server: %+v", err)
+	}
+	t.Cleanup(func() { _ = srv.Close() })
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat socket: %+v", err)
+	} else if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("Unexpected socket permissions.\nexpected: %o\nreceived: %o",
+			0600, perm)
+	}
+
+	return newAdminClient(path)
+}
+
+// testSessionAdmin is a sessionAdmin with the sessions of each user.
+type testSessionAdmin struct {
+	sessions map[string][]server.SessionInfo
+}
+
+func (a *testSessionAdmin) ListSessions(username string) []server.SessionInfo {
+	return a.sessions[username]
+}
+
+func (a *testSessionAdmin) RevokeSession(username, id string) error {
+	for i, s := range a.sessions[username] {
+		if s.ID == id {
+			a.sessions[username] = append(
+				a.sessions[username][:i], a.sessions[username][i+1:]...)
+			return nil
+		}
+	}
+	return errors.Wrapf(server.SessionNotFoundErr, "user %s has no session %s",
+		username, id)
+}
+
+func (a *testSessionAdmin) RevokeUser(username string) int {
+	n := len(a.sessions[username])
+	delete(a.sessions, username)
+	return n
+}
@@ -0,0 +1,70 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles selection of the authentication backend
+
+package cmd
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+
+	"gitlab.com/elixxir/remoteSyncServer/server"
+	"gitlab.com/xx_network/primitives/utils"
+)
+
+const (
+	authBackendTag = "authBackend"
+
+	passwordFilePathTag = "passwordFile.path"
+
+	sqlDriverTag     = "sql.driver"
+	sqlDataSourceTag = "sql.dataSource"
+	sqlQueryTag      = "sql.query"
+)
+
+// Authentication backends selectable with authBackendTag.
+const (
+	csvAuthBackend          = "csv"
+	passwordFileAuthBackend = "passwordFile"
+	sqlAuthBackend          = "sql"
+)
+
+// loadAuthenticator returns the authenticator of the authentication backend in
+// the config. Returns nil for the CSV backend, which is the default if none is
+// configured, since the server authenticates against the credentials CSV when
+// no authenticator is set.
+func loadAuthenticator() (server.Authenticator, error) {
+	switch backend := viper.GetString(authBackendTag); backend {
+	case "", csvAuthBackend:
+		return nil, nil
+	case passwordFileAuthBackend:
+		path, err := utils.ExpandPath(viper.GetString(passwordFilePathTag))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", passwordFilePathTag)
+		}
+		a, err := server.NewPasswordFileAuthenticator(path)
+		if err != nil {
+			return nil, err
+		}
+		return a, nil
+	case sqlAuthBackend:
+		a, err := server.NewSQLAuthenticator(server.SQLParams{
+			Driver:     viper.GetString(sqlDriverTag),
+			DataSource: viper.GetString(sqlDataSourceTag),
+			Query:      viper.GetString(sqlQueryTag),
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid SQL configuration")
+		}
+		return a, nil
+	default:
+		return nil, errors.Errorf("invalid %s %q; expected %q, %q, or %q",
+			authBackendTag, backend, csvAuthBackend, passwordFileAuthBackend,
+			sqlAuthBackend)
+	}
+}
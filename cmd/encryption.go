@@ -0,0 +1,133 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles configuration of encryption at rest and rotation of master keys
+
+package cmd
+
+import (
+	"encoding/base64"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+	"github.com/spf13/viper"
+
+	"gitlab.com/elixxir/remoteSyncServer/store"
+)
+
+const (
+	encryptionKeysTag = "encryptionKeys"
+	obfuscatePathsTag = "obfuscatePaths"
+)
+
+func init() {
+	rootCmd.AddCommand(rotateKeysCmd)
+}
+
+var rotateKeysCmd = &cobra.Command{
+	Use: "rotateKeys",
+	Short: "Re-encrypts the files of every user in the storage backend with " +
+		"the newest encryption key. The server must not be running.",
+	Run: func(cmd *cobra.Command, args []string) {
+		initConfig(configFilePath)
+		initLog(viper.GetString(logPathFlag), viper.GetUint(logLevelFlag))
+
+		params, err := loadEncryptionParams()
+		if err != nil {
+			jww.FATAL.Panicf("%+v", err)
+		} else if params == nil {
+			jww.FATAL.Panicf("No encryption keys configured in %s.",
+				encryptionKeysTag)
+		}
+		backend, err := loadStorageBackend()
+		if err != nil {
+			jww.FATAL.Panicf("%+v", err)
+		}
+		newStore, err := store.NewEncryptedStore(backend, *params)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to initialize encrypted storage: %+v", err)
+		}
+
+		// Users are listed from storage rather than the authenticator so that
+		// the files of users who can no longer log in are also re-encrypted
+		usernames, err := listStorageUsers()
+		if err != nil {
+			jww.FATAL.Panicf("Failed to list users in storage: %+v", err)
+		}
+
+		storageDir := viper.GetString(storageDirTag)
+		var total int
+		for _, username := range usernames {
+			s, err := newStore(storageDir, username)
+			if err != nil {
+				jww.FATAL.Panicf("Failed to open storage for user %s: %+v",
+					username, err)
+			}
+			rotated, err := s.(*store.EncryptedStore).Rotate()
+			_ = s.(io.Closer).Close()
+			if err != nil {
+				jww.FATAL.Panicf("Failed to rotate keys for user %s after "+
+					"re-encrypting %d files and versions: %+v",
+					username, rotated, err)
+			}
+			jww.INFO.Printf("Re-encrypted %d files and versions for user %s.",
+				rotated, username)
+			total += rotated
+		}
+
+		jww.INFO.Printf("Re-encrypted %d files and versions for %d users.",
+			total, len(usernames))
+	},
+}
+
+// loadEncryptionParams returns the encryption parameters in the config. Returns
+// nil if no encryption keys are configured.
+func loadEncryptionParams() (*store.EncryptionParams, error) {
+	encodedKeys := viper.GetStringSlice(encryptionKeysTag)
+	if len(encodedKeys) == 0 {
+		return nil, nil
+	}
+
+	params := &store.EncryptionParams{
+		Keys:           make([]store.MasterKey, len(encodedKeys)),
+		ObfuscatePaths: viper.GetBool(obfuscatePathsTag),
+	}
+	for i, encodedKey := range encodedKeys {
+		key, err := parseMasterKey(encodedKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid key %d in %s",
+				i, encryptionKeysTag)
+		}
+		params.Keys[i] = key
+	}
+
+	return params, nil
+}
+
+// parseMasterKey parses a master key in the format "<id>:<base64 key>".
+func parseMasterKey(s string) (store.MasterKey, error) {
+	idStr, keyStr, found := strings.Cut(s, ":")
+	if !found {
+		return store.MasterKey{}, errors.New(
+			`expected format "<id>:<base64 key>"`)
+	}
+
+	id, err := strconv.ParseUint(strings.TrimSpace(idStr), 10, 32)
+	if err != nil {
+		return store.MasterKey{}, errors.Wrap(err, "invalid key ID")
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(keyStr))
+	if err != nil {
+		return store.MasterKey{}, errors.Wrap(err, "invalid base64 key")
+	}
+
+	return store.MasterKey{ID: uint32(id), Key: key}, nil
+}
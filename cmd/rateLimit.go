@@ -0,0 +1,95 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles configuration of the per-user rate limits
+
+package cmd
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+
+	"gitlab.com/elixxir/remoteSyncServer/server"
+)
+
+const (
+	rateLimitTag      = "rateLimit"
+	rateLimitUsersTag = "rateLimit.users"
+
+	// Keys of the limits within the rateLimit section and each of its users
+	usernameKey            = "username"
+	readsPerSecondKey      = "readsPerSecond"
+	readBurstKey           = "readBurst"
+	writesPerSecondKey     = "writesPerSecond"
+	writeBurstKey          = "writeBurst"
+	writeBytesPerSecondKey = "writeBytesPerSecond"
+	writeBytesBurstKey     = "writeBytesBurst"
+)
+
+// loadRateLimits returns the default rate limits in the rateLimit section of
+// the config and the limits of each user in its users list. Users are listed,
+// rather than keyed on their username, since config keys are not case
+// sensitive.
+func loadRateLimits() (server.RateLimitParams, error) {
+	var params server.RateLimitParams
+	if v := viper.Sub(rateLimitTag); v != nil {
+		params.Default = parseRateLimits(v)
+	}
+
+	users, _ := viper.Get(rateLimitUsersTag).([]interface{})
+	if len(users) == 0 {
+		return params, nil
+	}
+	params.Users = make(map[string]server.RateLimits, len(users))
+	for i, user := range users {
+		m, ok := user.(map[string]interface{})
+		if !ok {
+			return server.RateLimitParams{}, errors.Errorf(
+				"invalid entry %d of %s", i, rateLimitUsersTag)
+		}
+		v := viper.New()
+		if err := v.MergeConfigMap(m); err != nil {
+			return server.RateLimitParams{}, errors.Wrapf(err,
+				"invalid entry %d of %s", i, rateLimitUsersTag)
+		}
+		username := v.GetString(usernameKey)
+		if username == "" {
+			return server.RateLimitParams{}, errors.Errorf(
+				"entry %d of %s has no %s", i, rateLimitUsersTag, usernameKey)
+		}
+		params.Users[username] = parseRateLimits(v)
+	}
+
+	return params, nil
+}
+
+// parseRateLimits returns the rate limits set in the config. The byte limits
+// accept a size suffix.
+func parseRateLimits(v *viper.Viper) server.RateLimits {
+	limits := server.RateLimits{
+		Reads: server.RateLimit{
+			Rate:  v.GetFloat64(readsPerSecondKey),
+			Burst: v.GetFloat64(readBurstKey),
+		},
+		Writes: server.RateLimit{
+			Rate:  v.GetFloat64(writesPerSecondKey),
+			Burst: v.GetFloat64(writeBurstKey),
+		},
+		WriteBytes: server.RateLimit{
+			Rate:  float64(v.GetSizeInBytes(writeBytesPerSecondKey)),
+			Burst: float64(v.GetSizeInBytes(writeBytesBurstKey)),
+		},
+	}
+
+	// Sizes cannot be negative, so check for a user without a byte limit
+	// separately
+	if v.GetFloat64(writeBytesPerSecondKey) < 0 {
+		limits.WriteBytes.Rate = -1
+	}
+
+	return limits
+}
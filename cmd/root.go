@@ -8,20 +8,26 @@
 package cmd
 
 import (
+	"context"
 	"encoding/csv"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	jww "github.com/spf13/jwalterweatherman"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 
 	"gitlab.com/elixxir/remoteSyncServer/server"
+	"gitlab.com/elixxir/remoteSyncServer/store"
 	"gitlab.com/xx_network/primitives/id"
 	"gitlab.com/xx_network/primitives/utils"
 )
@@ -36,11 +42,28 @@ const (
 	signedKeyPathTag  = "signedKeyPath"
 	portTag           = "port"
 
-	tokenTtlTag        = "tokenTTL"
-	credentialsPathTag = "credentialsCsvPath"
-	storageDirTag      = "storageDir"
+	tokenTtlTag            = "tokenTTL"
+	slidingExpiryTag       = "slidingExpiry"
+	maxTokenLifetimeTag    = "maxTokenLifetime"
+	sessionsPathTag        = "sessionsPath"
+	maxLoginFailuresTag    = "maxLoginFailures"
+	loginLockoutTag        = "loginLockout"
+	maxLoginLockoutTag     = "maxLoginLockout"
+	sessionReapIntervalTag = "sessionReapInterval"
+	maxSessionsTag         = "maxSessionsPerUser"
+	credentialsPathTag     = "credentialsCsvPath"
+	storageDirTag          = "storageDir"
+	shutdownTimeoutTag     = "shutdownTimeout"
+	quotaBytesTag          = "quotaBytes"
+	quotaFilesTag          = "quotaFiles"
+	versionCountTag        = "versionRetentionCount"
+	versionAgeTag          = "versionRetentionAge"
 )
 
+// defaultShutdownTimeout is the maximum time to wait for in-progress requests
+// to complete on shutdown if none is configured.
+const defaultShutdownTimeout = 30 * time.Second
+
 // Execute initialises all config files, flags, and logging and then starts the
 // server.
 func Execute() {
@@ -61,8 +84,55 @@ var rootCmd = &cobra.Command{
 		// Obtain parameters
 		signedCertPath := viper.GetString(signedCertPathTag)
 		signedKeyPath := viper.GetString(signedKeyPathTag)
-		storageDir := viper.GetString(storageDirTag)
-		tokenTTL := viper.GetDuration(tokenTtlTag)
+		newStore, err := loadStorageBackend()
+		if err != nil {
+			jww.FATAL.Panicf("%+v", err)
+		}
+		encryption, err := loadEncryptionParams()
+		if err != nil {
+			jww.FATAL.Panicf("%+v", err)
+		}
+		authenticator, err := loadAuthenticator()
+		if err != nil {
+			jww.FATAL.Panicf("%+v", err)
+		}
+		rateLimits, err := loadRateLimits()
+		if err != nil {
+			jww.FATAL.Panicf("%+v", err)
+		}
+		var sessionStore server.SessionStore
+		if sessionsPath := viper.GetString(sessionsPathTag); sessionsPath != "" {
+			sessionStore, err = server.NewFileSessionStore(sessionsPath)
+			if err != nil {
+				jww.FATAL.Panicf("Failed to open sessions file: %+v", err)
+			}
+		}
+		params := server.Params{
+			StorageDir:          viper.GetString(storageDirTag),
+			NewStore:            newStore,
+			TokenTTL:            viper.GetDuration(tokenTtlTag),
+			SlidingExpiry:       viper.GetBool(slidingExpiryTag),
+			MaxTokenLifetime:    viper.GetDuration(maxTokenLifetimeTag),
+			SessionReapInterval: viper.GetDuration(sessionReapIntervalTag),
+			MaxSessionsPerUser:  viper.GetInt(maxSessionsTag),
+			RateLimits:          rateLimits,
+			LoginThrottle: server.LoginThrottleParams{
+				MaxFailures: viper.GetInt(maxLoginFailuresTag),
+				Lockout:     viper.GetDuration(loginLockoutTag),
+				MaxLockout:  viper.GetDuration(maxLoginLockoutTag),
+			},
+			DefaultQuota: store.Quota{
+				MaxBytes: int64(viper.GetSizeInBytes(quotaBytesTag)),
+				MaxFiles: viper.GetInt64(quotaFilesTag),
+			},
+			Retention: store.RetentionPolicy{
+				MaxVersions: viper.GetInt(versionCountTag),
+				MaxAge:      viper.GetDuration(versionAgeTag),
+			},
+			Encryption:    encryption,
+			SessionStore:  sessionStore,
+			Authenticator: authenticator,
+		}
 		credentialsCsvPath := viper.GetString(credentialsPathTag)
 		localAddress :=
 			net.JoinHostPort("0.0.0.0", strconv.Itoa(viper.GetInt(portTag)))
@@ -79,26 +149,15 @@ var rootCmd = &cobra.Command{
 				signedKeyPath, err)
 		}
 
-		// Obtain credentials from CSV
-		csvPath, err := utils.ExpandPath(credentialsCsvPath)
-		if err != nil {
-			jww.FATAL.Panicf("Unable to expand path %s: %+v",
-				credentialsCsvPath, err)
-		}
-		f, err := os.Open(csvPath)
-		if err != nil {
-			jww.FATAL.Panicf("Unable to read input file %s: %+v",
-				csvPath, err)
+		// Obtain credentials from CSV. It is only required when authenticating
+		// against it; otherwise, it optionally sets the quotas of users.
+		var records [][]string
+		if authenticator == nil || credentialsCsvPath != "" {
+			records = readCredentialsCsv(credentialsCsvPath)
 		}
-		records, err := csv.NewReader(f).ReadAll()
-		if err != nil {
-			jww.FATAL.Panicf("Unable to parse file as CSV for %s: %+v",
-				credentialsCsvPath, err)
-		}
-		_ = f.Close()
 
 		// Start comms
-		s, err := server.NewServer(storageDir, tokenTTL, records,
+		s, err := server.NewServer(params, records,
 			&id.DummyUser, localAddress, signedCert, signedKey)
 		if err != nil {
 			jww.FATAL.Panicf("Failed to create new server: %+v", err)
@@ -107,9 +166,97 @@ var rootCmd = &cobra.Command{
 		if err != nil {
 			jww.FATAL.Panicf("Failed to start server: %+v", err)
 		}
+
+		if adminSocketPath := viper.GetString(adminSocketPathTag); adminSocketPath != "" {
+			admin, err := startAdminServer(s, adminSocketPath)
+			if err != nil {
+				jww.FATAL.Panicf("Failed to start admin socket: %+v", err)
+			}
+			defer func() { _ = admin.Close() }()
+		}
+
+		shutdownTimeout := viper.GetDuration(shutdownTimeoutTag)
+		if shutdownTimeout <= 0 {
+			shutdownTimeout = defaultShutdownTimeout
+		}
+		waitForSignals(s, credentialsCsvPath, shutdownTimeout)
 	},
 }
 
+// waitForSignals reloads the credentials CSV, if set, and the authenticator
+// each time the process receives SIGHUP. It blocks until the process receives
+// SIGINT or SIGTERM and then gracefully shuts down the server, waiting up to the
+// timeout for in-progress requests to complete.
+func waitForSignals(
+	s *server.Server, credentialsCsvPath string, timeout time.Duration) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	sig := <-sigCh
+	for ; sig == syscall.SIGHUP; sig = <-sigCh {
+		jww.INFO.Printf("Received %s signal. Reloading credentials.", sig)
+		var records [][]string
+		var err error
+		if credentialsCsvPath != "" {
+			records, err = loadCredentialsCsv(credentialsCsvPath)
+		}
+		if err == nil {
+			err = s.ReloadCredentials(records)
+		}
+		if err != nil {
+			jww.ERROR.Printf("Failed to reload credentials; keeping existing "+
+				"credentials: %+v", err)
+		}
+	}
+	signal.Stop(sigCh)
+
+	jww.INFO.Printf("Received %s signal. Shutting down server with a %s "+
+		"timeout.", sig, timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		jww.ERROR.Printf("Failed to gracefully shut down server: %+v", err)
+		return
+	}
+	jww.INFO.Printf("Server shut down.")
+}
+
+// readCredentialsCsv reads the username/password records from the credentials
+// CSV at the given path. Panics on error.
+func readCredentialsCsv(credentialsCsvPath string) [][]string {
+	records, err := loadCredentialsCsv(credentialsCsvPath)
+	if err != nil {
+		jww.FATAL.Panicf("%+v", err)
+	}
+	return records
+}
+
+// loadCredentialsCsv reads the username/password records from the credentials
+// CSV at the given path.
+func loadCredentialsCsv(credentialsCsvPath string) ([][]string, error) {
+	csvPath, err := utils.ExpandPath(credentialsCsvPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to expand path %s",
+			credentialsCsvPath)
+	}
+	f, err := os.Open(csvPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read input file %s", csvPath)
+	}
+	defer func() { _ = f.Close() }()
+
+	// Records may have different numbers of fields since the quota fields are
+	// optional
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse file as CSV for %s",
+			credentialsCsvPath)
+	}
+
+	return records, nil
+}
+
 // initConfig reads in config file from the file path.
 func initConfig(filePath string) {
 	// Use default config location if none is passed
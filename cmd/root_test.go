@@ -0,0 +1,39 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Tests that loadCredentialsCsv reads a CSV where only some records have the
+// optional quota fields.
+func Test_loadCredentialsCsv_MixedWidths(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.csv")
+	data := "waldo,hunter2\ncarmen,hunter3,5368709120\nsandiego,hunter4,,1000\n"
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("Failed to write CSV: %+v", err)
+	}
+
+	expected := [][]string{
+		{"waldo", "hunter2"},
+		{"carmen", "hunter3", "5368709120"},
+		{"sandiego", "hunter4", "", "1000"},
+	}
+	records, err := loadCredentialsCsv(path)
+	if err != nil {
+		t.Fatalf("Failed to load CSV: %+v", err)
+	}
+	if !reflect.DeepEqual(expected, records) {
+		t.Errorf("Unexpected records.\nexpected: %q\nreceived: %q",
+			expected, records)
+	}
+}
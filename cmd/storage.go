@@ -0,0 +1,81 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles selection of the storage backend
+
+package cmd
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+
+	"gitlab.com/elixxir/remoteSyncServer/store"
+)
+
+const (
+	storageBackendTag = "storageBackend"
+
+	s3BucketTag          = "s3.bucket"
+	s3PrefixTag          = "s3.prefix"
+	s3EndpointTag        = "s3.endpoint"
+	s3RegionTag          = "s3.region"
+	s3AccessKeyIDTag     = "s3.accessKeyID"
+	s3SecretAccessKeyTag = "s3.secretAccessKey"
+	s3UsePathStyleTag    = "s3.usePathStyle"
+)
+
+// Storage backends selectable with storageBackendTag.
+const (
+	fileBackend   = "file"
+	sqliteBackend = "sqlite"
+	s3Backend     = "s3"
+)
+
+// loadStorageBackend returns the constructor of the storage backend in the
+// config. Defaults to the file backend if none is configured.
+func loadStorageBackend() (store.NewStore, error) {
+	switch backend := viper.GetString(storageBackendTag); backend {
+	case "", fileBackend:
+		return store.NewFileStore, nil
+	case sqliteBackend:
+		return store.NewSQLiteStore, nil
+	case s3Backend:
+		newStore, err := store.NewS3Store(loadS3Params())
+		return newStore, errors.Wrap(err, "invalid S3 configuration")
+	default:
+		return nil, errors.Errorf("invalid %s %q; expected %q, %q, or %q",
+			storageBackendTag, backend, fileBackend, sqliteBackend, s3Backend)
+	}
+}
+
+// listStorageUsers returns the usernames of all users with storage in the
+// storage backend in the config, including users that can no longer log in.
+func listStorageUsers() ([]string, error) {
+	switch backend := viper.GetString(storageBackendTag); backend {
+	case "", fileBackend, sqliteBackend:
+		return store.ListBaseDirs(viper.GetString(storageDirTag))
+	case s3Backend:
+		usernames, err := store.ListS3BaseDirs(loadS3Params())
+		return usernames, errors.Wrap(err, "failed to list S3 users")
+	default:
+		return nil, errors.Errorf("invalid %s %q; expected %q, %q, or %q",
+			storageBackendTag, backend, fileBackend, sqliteBackend, s3Backend)
+	}
+}
+
+// loadS3Params returns the parameters of the S3 storage backend in the config.
+func loadS3Params() store.S3Params {
+	return store.S3Params{
+		Bucket:          viper.GetString(s3BucketTag),
+		Prefix:          viper.GetString(s3PrefixTag),
+		Endpoint:        viper.GetString(s3EndpointTag),
+		Region:          viper.GetString(s3RegionTag),
+		AccessKeyID:     viper.GetString(s3AccessKeyIDTag),
+		SecretAccessKey: viper.GetString(s3SecretAccessKeyTag),
+		UsePathStyle:    viper.GetBool(s3UsePathStyleTag),
+	}
+}
@@ -0,0 +1,57 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package server
+
+// Authenticator verifies the credentials of users logging in.
+type Authenticator interface {
+	// Authenticate returns nil if the password hash matches the user's
+	// password hashed with the salt. Returns InvalidCredentialsErr if the user does not
+	// exist or the hash does not match, or another error if the credentials
+	// could not be looked up.
+	Authenticate(username string, passwordHash, salt []byte) error
+
+	// HasUser returns true if the user exists. It is used to invalidate the
+	// sessions of removed users when the credentials are reloaded.
+	HasUser(username string) (bool, error)
+}
+
+// Reloader is implemented by an Authenticator that caches its users and can
+// reload them from their source. Reload is called each time the server's
+// credentials are reloaded. If it returns an error, the existing users must be
+// kept.
+type Reloader interface {
+	Reload() error
+}
+
+// csvAuthenticator authenticates users against the credentials parsed from the
+// records of the credentials CSV. It is immutable; reloading the CSV replaces
+// it.
+type csvAuthenticator map[string]string
+
+// newCSVAuthenticator returns a csvAuthenticator for the users in the records
+// from the credentials CSV. Returns an error if the records are invalid.
+func newCSVAuthenticator(records [][]string) (csvAuthenticator, error) {
+	return userRecordsToMap(records)
+}
+
+// Authenticate returns InvalidCredentialsErr if the user is not in the CSV or
+// the password hash does not match their password.
+func (a csvAuthenticator) Authenticate(
+	username string, passwordHash, salt []byte) error {
+	password, exists := a[username]
+	if !exists || !verifyPassword(password, passwordHash, salt) {
+		return InvalidCredentialsErr
+	}
+	return nil
+}
+
+// HasUser returns true if the user is in the CSV.
+func (a csvAuthenticator) HasUser(username string) (bool, error) {
+	_, exists := a[username]
+	return exists, nil
+}
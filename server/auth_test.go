@@ -0,0 +1,235 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package server
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"gitlab.com/elixxir/remoteSyncServer/store"
+	"gitlab.com/xx_network/primitives/netTime"
+)
+
+// Tests that each Authenticator adheres to the Authenticator interface.
+var (
+	_ Authenticator = csvAuthenticator{}
+	_ Authenticator = (*PasswordFileAuthenticator)(nil)
+	_ Authenticator = (*SQLAuthenticator)(nil)
+	_ Reloader      = (*PasswordFileAuthenticator)(nil)
+)
+
+// Tests that csvAuthenticator.Authenticate accepts the password hashes of the
+// users and rejects an invalid password hash and an unknown user.
+func Test_csvAuthenticator_Authenticate(t *testing.T) {
+	prng := rand.New(rand.NewSource(5629))
+	salt := make([]byte, 32)
+	prng.Read(salt)
+
+	a, err := newCSVAuthenticator(
+		[][]string{{"waldo", "hunter2"}, {"carmen", "hunter3"}})
+	if err != nil {
+		t.Fatalf("Failed to make authenticator: %+v", err)
+	}
+
+	checkAuthenticator(a, salt, t)
+}
+
+// Error path: Tests that newCSVAuthenticator returns an error for invalid
+// records.
+func Test_newCSVAuthenticator_InvalidRecordsError(t *testing.T) {
+	_, err := newCSVAuthenticator([][]string{{"waldo"}})
+	if err == nil {
+		t.Errorf("Failed to error for invalid records.")
+	}
+}
+
+// Tests that handler.Login authenticates users with the handler's
+// Authenticator instead of the credentials in the user records.
+func Test_handler_Login_Authenticator(t *testing.T) {
+	prng := rand.New(rand.NewSource(8613))
+	salt := make([]byte, 32)
+	prng.Read(salt)
+
+	a := &testAuthenticator{users: map[string]string{"carmen": "hunter3"}}
+	h, err := newHandler("tmp", time.Hour, [][]string{{"waldo", "hunter2"}},
+		a, store.NewMemStore, nil)
+	if err != nil {
+		t.Fatalf("Failed to make new handler: %+v", err)
+	}
+
+	for _, u := range []struct {
+		username, password string
+		err                error
+	}{
+		{"waldo", "hunter2", InvalidCredentialsErr},
+		{"carmen", "hunter3", nil},
+	} {
+		_, err = h.Login(&pb.RsAuthenticationRequest{
+			Username:     u.username,
+			PasswordHash: hashPassword(u.password, salt),
+			Salt:         salt,
+		})
+		if !errors.Is(err, u.err) {
+			t.Errorf("Unexpected error logging in as %s."+
+				"\nexpected: %v\nreceived: %+v", u.username, u.err, err)
+		}
+	}
+}
+
+// Error path: Tests that handler.verifyUser returns the error of an
+// Authenticator that fails to look up the user.
+func Test_handler_verifyUser_AuthenticatorError(t *testing.T) {
+	expected := errors.New("lookup failed")
+	h := &handler{authenticator: &testAuthenticator{err: expected}}
+
+	err := h.verifyUser("waldo", []byte("hash"), []byte("salt"))
+	if !errors.Is(err, expected) {
+		t.Errorf("Unexpected error.\nexpected: %v\nreceived: %+v", expected, err)
+	}
+}
+
+// Tests that handler.reloadCredentials reloads an Authenticator that is a
+// Reloader, invalidates the sessions of users it no longer has, and applies
+// the quotas in the records.
+func Test_handler_reloadCredentials_Reloader(t *testing.T) {
+	var closed int32
+	h := newReaperTestHandler(time.Hour, newTestClock(netTime.Now()), &closed)
+	a := &testAuthenticator{
+		users:  map[string]string{"waldo": "hunter2", "carmen": "hunter3"},
+		reload: map[string]string{"carmen": "hunter3"},
+	}
+	h.authenticator = a
+
+	if _, err := h.addSession("waldo"); err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+	kept, err := h.addSession("carmen")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+
+	n, err := h.reloadCredentials([][]string{{"carmen", "", "", "1"}})
+	if err != nil {
+		t.Fatalf("Failed to reload credentials: %+v", err)
+	} else if n != 1 {
+		t.Errorf("Unexpected number of sessions invalidated."+
+			"\nexpected: %d\nreceived: %d", 1, n)
+	} else if a.reloads != 1 {
+		t.Errorf("Unexpected number of reloads.\nexpected: %d\nreceived: %d",
+			1, a.reloads)
+	} else if h.authenticator != a {
+		t.Errorf("Authenticator replaced on reload.")
+	}
+
+	if err = kept.Write("a", []byte("1")); err != nil {
+		t.Errorf("Failed to write first file: %+v", err)
+	}
+	err = kept.Write("b", []byte("2"))
+	if !errors.Is(err, store.QuotaExceededErr) {
+		t.Errorf("Reloaded quota not applied to remaining user."+
+			"\nexpected: %v\nreceived: %+v", store.QuotaExceededErr, err)
+	}
+}
+
+// Error path: Tests that handler.reloadCredentials returns the error of an
+// Authenticator that fails to reload and keeps all sessions.
+func Test_handler_reloadCredentials_ReloaderError(t *testing.T) {
+	var closed int32
+	h := newReaperTestHandler(time.Hour, newTestClock(netTime.Now()), &closed)
+	expected := errors.New("reload failed")
+	h.authenticator = &testAuthenticator{
+		users: map[string]string{"waldo": "hunter2"}, err: expected}
+
+	s, err := h.addSession("waldo")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+
+	_, err = h.reloadCredentials(nil)
+	if !errors.Is(err, expected) {
+		t.Errorf("Unexpected error.\nexpected: %v\nreceived: %+v", expected, err)
+	}
+	if _, err = h.getSession(Token(s.Value)); err != nil {
+		t.Errorf("Session invalidated after failed reload: %+v", err)
+	}
+}
+
+// checkAuthenticator tests that the Authenticator accepts the password hashes
+// of the users waldo, with the password hunter2, and carmen, with the password
+// hunter3, and rejects all others.
+func checkAuthenticator(a Authenticator, salt []byte, t *testing.T) {
+	for i, tt := range []struct {
+		username     string
+		passwordHash []byte
+		err          error
+	}{
+		{"waldo", hashPassword("hunter2", salt), nil},
+		{"carmen", hashPassword("hunter3", salt), nil},
+		{"waldo", hashPassword("hunter3", salt), InvalidCredentialsErr},
+		{"carmen", hashPassword("hunter2", salt), InvalidCredentialsErr},
+		{"sandiego", hashPassword("hunter2", salt), InvalidCredentialsErr},
+	} {
+		err := a.Authenticate(tt.username, tt.passwordHash, salt)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("Unexpected error for user %s (%d)."+
+				"\nexpected: %v\nreceived: %+v", tt.username, i, tt.err, err)
+		}
+	}
+
+	for username, expected := range map[string]bool{
+		"waldo": true, "carmen": true, "sandiego": false} {
+		exists, err := a.HasUser(username)
+		if err != nil {
+			t.Errorf("Failed to look up user %s: %+v", username, err)
+		} else if exists != expected {
+			t.Errorf("Unexpected existence of user %s."+
+				"\nexpected: %t\nreceived: %t", username, expected, exists)
+		}
+	}
+}
+
+// testAuthenticator is an Authenticator and Reloader of users with cleartext
+// passwords. If err is set, all methods return it.
+type testAuthenticator struct {
+	users   map[string]string
+	reload  map[string]string // Users after Reload is called
+	reloads int
+	err     error
+}
+
+func (ta *testAuthenticator) Authenticate(
+	username string, passwordHash, salt []byte) error {
+	if ta.err != nil {
+		return ta.err
+	}
+	password, exists := ta.users[username]
+	if !exists {
+		return InvalidCredentialsErr
+	}
+	if !verifyPassword(password, passwordHash, salt) {
+		return InvalidCredentialsErr
+	}
+	return nil
+}
+
+func (ta *testAuthenticator) HasUser(username string) (bool, error) {
+	_, exists := ta.users[username]
+	return exists, ta.err
+}
+
+func (ta *testAuthenticator) Reload() error {
+	if ta.err != nil {
+		return ta.err
+	}
+	ta.reloads++
+	ta.users = ta.reload
+	return nil
+}
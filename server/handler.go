@@ -8,7 +8,9 @@
 package server
 
 import (
-	"bytes"
+	"context"
+	"crypto/subtle"
+	"io"
 	"sync"
 	"time"
 
@@ -20,6 +22,7 @@ import (
 	"gitlab.com/elixxir/remoteSyncServer/store"
 	"gitlab.com/xx_network/comms/messages"
 	"gitlab.com/xx_network/crypto/nonce"
+	"gitlab.com/xx_network/primitives/netTime"
 )
 
 var (
@@ -31,37 +34,148 @@ var (
 	// registered user or the password hashed with a salt does not match the
 	// expected password hash.
 	InvalidCredentialsErr = errors.New("invalid password or password")
+
+	// ShuttingDownErr is returned for all requests received after the server
+	// has started shutting down.
+	ShuttingDownErr = errors.New("server is shutting down")
 )
 
 // handler handles the server stores for each token/user.
+//
+// comms calls Login, Read, Write, GetLastModified, GetLastWrite, and ReadDir
+// through its remoteSync Handler interface. The following methods have no comms
+// RPC or protobuf messages yet, so clients cannot call them until comms adds
+// them:
+//   - Delete and DeleteDir
+//   - GetUsage
+//   - ListVersions and ReadVersion
+//   - WriteIf
+//   - ReadDirEntries
+//   - Manifest
+//   - GetChanges
+//   - Logout
+//   - Refresh
 type handler struct {
-	storageDir    string
-	tokenTTL      time.Duration
-	sessions      map[Token]*userSession
-	userTokens    map[string]Token  // Map of username to token
-	userPasswords map[string]string // Map of username to password (from CSV)
-	newStore      store.NewStore
-	mux           sync.Mutex
+	storageDir string
+	tokenTTL   time.Duration
+	sessions   map[Token]*userSession
+	userTokens map[string][]Token // Map of username to tokens, oldest first
+	newStore   store.NewStore
+
+	// stores are the open stores of users, keyed on username, shared by all
+	// sessions of the user. closingStores are the stores whose last reference
+	// has been released but that have not finished closing; a user's store is
+	// not reopened until it has.
+	stores        map[string]*userStore
+	closingStores map[string]*userStore
+
+	// maxSessions is the maximum number of sessions each user may have at
+	// once. When a user logs in with the maximum number of sessions, their
+	// oldest session is removed. A value of 0 means no limit.
+	maxSessions int
+
+	// slidingExpiry, when true, extends the expiry of a session to tokenTTL
+	// after each successful request.
+	slidingExpiry bool
+
+	// maxTokenLifetime is the maximum time after login that a session may be
+	// extended to, either by sliding expiry or by refreshing its token. A
+	// value of 0 means no limit.
+	maxTokenLifetime time.Duration
+
+	// sessionStore persists the sessions so that they remain valid after a
+	// restart. It is nil if sessions are not persisted.
+	sessionStore SessionStore
+
+	// restored are the unexpired sessions loaded from the session store that
+	// have not yet been used, keyed on the hash of their token. Since only the
+	// hash is saved, each is restored into sessions when its token is first
+	// presented.
+	restored map[string]PersistedSession
+
+	// authenticator verifies the credentials of users logging in.
+	authenticator Authenticator
+
+	// rateLimits are the rate limits applied to each user. limiters enforce
+	// them and are keyed on username so that they are shared by all sessions
+	// of the user and kept when they log in again. A user without limits has
+	// no limiter.
+	rateLimits RateLimitParams
+	limiters   map[string]*userLimiter
+
+	// loginThrottle locks out usernames after too many failed logins. It is
+	// nil if logins are not throttled.
+	loginThrottle *loginThrottle
+
+	// defaultQuota is the storage quota of each user unless overridden in
+	// userQuotas.
+	defaultQuota store.Quota
+	userQuotas   map[string]quotaOverride // Map of username to quota (from CSV)
+
+	// retention determines which previous versions of files are kept in each
+	// user's store.
+	retention store.RetentionPolicy
+
+	// now returns the current time. It is used to determine when sessions have
+	// expired and can be replaced in tests.
+	now func() time.Time
+
+	// reaper is the background goroutine that removes expired sessions. It is
+	// nil when not running.
+	reaper *sessionReaper
+
+	// closing is true once shutdown has been called. No new requests are
+	// accepted after it is set.
+	closing bool
+
+	mux     sync.Mutex
+	saveMux sync.Mutex
 }
 
-// newHandler generates a new store handler.
+// newHandler generates a new store handler. If authenticator is nil, users are
+// authenticated against the credentials in the user records. If sessionStore
+// is not nil, the sessions saved in it are loaded so that their tokens remain
+// valid, and all changes to sessions are saved to it.
 //
 // Pass in Store.NewMemStore into newStore for testing.
 func newHandler(storageDir string, tokenTTL time.Duration,
-	userRecords [][]string, newStore store.NewStore) (*handler, error) {
-	userPasswords, err := userRecordsToMap(userRecords)
+	userRecords [][]string, authenticator Authenticator,
+	newStore store.NewStore, sessionStore SessionStore) (*handler, error) {
+	if authenticator == nil {
+		csvAuth, err := newCSVAuthenticator(userRecords)
+		if err != nil {
+			return nil, err
+		}
+		authenticator = csvAuth
+	}
+	userQuotas, err := userRecordsToQuotas(userRecords)
 	if err != nil {
 		return nil, err
 	}
 
-	return &handler{
+	h := &handler{
 		storageDir:    storageDir,
 		tokenTTL:      tokenTTL,
 		sessions:      make(map[Token]*userSession),
-		userTokens:    make(map[string]Token),
-		userPasswords: userPasswords,
+		userTokens:    make(map[string][]Token),
+		limiters:      make(map[string]*userLimiter),
 		newStore:      newStore,
-	}, nil
+		stores:        make(map[string]*userStore),
+		closingStores: make(map[string]*userStore),
+		sessionStore:  sessionStore,
+		restored:      make(map[string]PersistedSession),
+		authenticator: authenticator,
+		userQuotas:    userQuotas,
+		now:           netTime.Now,
+	}
+
+	if sessionStore != nil {
+		if err = h.loadSessions(); err != nil {
+			return nil, err
+		}
+	}
+
+	return h, nil
 }
 
 // userRecordsToMap converts the username/password records from a CSV to a map
@@ -88,13 +202,32 @@ func userRecordsToMap(records [][]string) (map[string]string, error) {
 // expiration time. When a token expires, a user must log in again to get issues
 // a new token.
 //
-// Returns [InvalidCredentialsErr] for invalid username or password.
+// Returns [InvalidCredentialsErr] for invalid username or password and
+// [LoginLockedErr] if the username is locked out after too many failed logins.
 func (h *handler) Login(
 	msg *pb.RsAuthenticationRequest) (*pb.RsAuthenticationResponse, error) {
 	jww.DEBUG.Printf("Received Login message: %s", msg)
 
+	username := msg.GetUsername()
+	if h.loginThrottle != nil {
+		if err := h.loginThrottle.attempt(username, h.now()); err != nil {
+			jww.INFO.Printf("Rejected login of user %s: %v", username, err)
+			return nil, err
+		}
+	}
+
 	// Verify user exists and password is correct
-	err := h.verifyUser(msg.GetUsername(), msg.GetPasswordHash(), msg.GetSalt())
+	err := h.verifyUser(username, msg.GetPasswordHash(), msg.GetSalt())
+	if h.loginThrottle != nil {
+		switch {
+		case err == nil:
+			h.loginThrottle.succeed(username)
+		case errors.Is(err, InvalidCredentialsErr):
+			h.loginThrottle.fail(username, h.now())
+		default:
+			h.loginThrottle.abandon(username)
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -107,6 +240,33 @@ func (h *handler) Login(
 
 	jww.INFO.Printf("Added store for user %s that expires at %s",
 		msg.GetUsername(), s.ExpiryTime)
+	h.saveSessions()
+
+	return &pb.RsAuthenticationResponse{
+		Token:     s.Value[:],
+		ExpiresAt: s.ExpiryTime.UnixNano(),
+	}, nil
+}
+
+// Refresh exchanges a still-valid token for a new one that expires tokenTTL
+// from now, so that long-running clients can keep their session without
+// logging in again. The presented token is invalidated. The new expiry is
+// limited to the handler's maximum token lifetime after the user logged in.
+//
+// Returns [InvalidTokenErr] for an invalid or expired token and
+// [ShuttingDownErr] if the handler is shutting down.
+func (h *handler) Refresh(
+	msg *pb.RsLastWriteRequest) (*pb.RsAuthenticationResponse, error) {
+	jww.DEBUG.Printf("Received Refresh message: %s", msg)
+
+	s, err := h.refreshSession(UnmarshalToken(msg.GetToken()))
+	if err != nil {
+		return nil, err
+	}
+
+	jww.INFO.Printf("Refreshed session of user %s that now expires at %s",
+		s.username, s.ExpiryTime)
+	h.saveSessions()
 
 	return &pb.RsAuthenticationResponse{
 		Token:     s.Value[:],
@@ -114,6 +274,38 @@ func (h *handler) Login(
 	}, nil
 }
 
+// Logout is called when a user ends their session. It invalidates the token
+// immediately so that it can no longer be used. The user's other sessions are
+// unaffected. The user's store is closed if it was their last session.
+//
+// Returns [InvalidTokenErr] for an invalid token and [ShuttingDownErr] if the
+// handler is shutting down.
+func (h *handler) Logout(msg *pb.RsLastWriteRequest) (*messages.Ack, error) {
+	jww.DEBUG.Printf("Received Logout message: %s", msg)
+
+	token := UnmarshalToken(msg.GetToken())
+	h.mux.Lock()
+	if h.closing {
+		h.mux.Unlock()
+		return nil, ShuttingDownErr
+	}
+	if _, err := h.lookupSession(token); err != nil {
+		h.mux.Unlock()
+		return nil, err
+	}
+	s, us := h.removeSession(token)
+	h.mux.Unlock()
+
+	jww.INFO.Printf("Logged out session %s of user %s.",
+		sessionID(token), s.username)
+	if us != nil {
+		h.closeStore(us)
+	}
+	h.saveSessions()
+
+	return &messages.Ack{}, nil
+}
+
 // Read reads from the provided file path and returns the data in the file
 // at that path.
 //
@@ -123,10 +315,11 @@ func (h *handler) Login(
 func (h *handler) Read(msg *pb.RsReadRequest) (*pb.RsReadResponse, error) {
 	jww.TRACE.Printf("Received Read message: %s", msg)
 
-	s, err := h.getSession(UnmarshalToken(msg.GetToken()))
+	s, err := h.getLimitedSession(UnmarshalToken(msg.GetToken()), readOp, 0)
 	if err != nil {
 		return nil, err
 	}
+	defer h.endRequest(s)
 
 	data, err := s.Read(msg.GetPath())
 	if err != nil {
@@ -139,14 +332,17 @@ func (h *handler) Read(msg *pb.RsReadRequest) (*pb.RsReadResponse, error) {
 // Write writes the provided data to the file path.
 //
 // An error is returned if the write fails. Returns [store.NonLocalFileErr] if
-// the file is outside the base path, [InvalidTokenErr] for an invalid token.
+// the file is outside the base path, [store.QuotaExceededErr] if the write
+// would exceed the user's quota, [InvalidTokenErr] for an invalid token.
 func (h *handler) Write(msg *pb.RsWriteRequest) (*messages.Ack, error) {
 	jww.TRACE.Printf("Received Write message: %s", msg)
 
-	s, err := h.getSession(UnmarshalToken(msg.GetToken()))
+	s, err := h.getLimitedSession(
+		UnmarshalToken(msg.GetToken()), writeOp, len(msg.GetData()))
 	if err != nil {
 		return nil, err
 	}
+	defer h.endRequest(s)
 
 	err = s.Write(msg.GetPath(), msg.GetData())
 	if err != nil {
@@ -156,6 +352,33 @@ func (h *handler) Write(msg *pb.RsWriteRequest) (*messages.Ack, error) {
 	return &messages.Ack{}, nil
 }
 
+// WriteIf writes the provided data to the file path only if the file matches
+// the precondition, which is typically the modification time or content hash
+// of the file when the client last read it.
+//
+// Returns a *[store.ConflictError] describing the current file if it does not
+// match the precondition, [store.NonLocalFileErr] if the file is outside the
+// base path, [store.QuotaExceededErr] if the write would exceed the user's
+// quota, [InvalidTokenErr] for an invalid token.
+func (h *handler) WriteIf(
+	msg *pb.RsWriteRequest, cond store.Precondition) (*messages.Ack, error) {
+	jww.TRACE.Printf("Received WriteIf message: %s", msg)
+
+	s, err := h.getLimitedSession(
+		UnmarshalToken(msg.GetToken()), writeOp, len(msg.GetData()))
+	if err != nil {
+		return nil, err
+	}
+	defer h.endRequest(s)
+
+	err = s.WriteIf(msg.GetPath(), msg.GetData(), cond)
+	if err != nil {
+		return nil, err
+	}
+
+	return &messages.Ack{}, nil
+}
+
 // GetLastModified returns the last modification time for the file at the
 // given file.
 //
@@ -165,10 +388,11 @@ func (h *handler) GetLastModified(
 	msg *pb.RsReadRequest) (*pb.RsTimestampResponse, error) {
 	jww.TRACE.Printf("Received GetLastModified message: %s", msg)
 
-	s, err := h.getSession(UnmarshalToken(msg.GetToken()))
+	s, err := h.getLimitedSession(UnmarshalToken(msg.GetToken()), readOp, 0)
 	if err != nil {
 		return nil, err
 	}
+	defer h.endRequest(s)
 
 	lastModified, err := s.GetLastModified(msg.GetPath())
 	if err != nil {
@@ -186,10 +410,11 @@ func (h *handler) GetLastWrite(
 	msg *pb.RsLastWriteRequest) (*pb.RsTimestampResponse, error) {
 	jww.TRACE.Printf("Received GetLastWrite message: %s", msg)
 
-	s, err := h.getSession(UnmarshalToken(msg.GetToken()))
+	s, err := h.getLimitedSession(UnmarshalToken(msg.GetToken()), readOp, 0)
 	if err != nil {
 		return nil, err
 	}
+	defer h.endRequest(s)
 
 	lastModified, err := s.GetLastWrite()
 	if err != nil {
@@ -208,10 +433,11 @@ func (h *handler) ReadDir(
 	msg *pb.RsReadRequest) (*pb.RsReadDirResponse, error) {
 	jww.TRACE.Printf("Received ReadDir message: %s", msg)
 
-	s, err := h.getSession(UnmarshalToken(msg.GetToken()))
+	s, err := h.getLimitedSession(UnmarshalToken(msg.GetToken()), readOp, 0)
 	if err != nil {
 		return nil, err
 	}
+	defer h.endRequest(s)
 
 	directories, err := s.ReadDir(msg.GetPath())
 	if err != nil {
@@ -221,22 +447,185 @@ func (h *handler) ReadDir(
 	return &pb.RsReadDirResponse{Data: directories}, nil
 }
 
-// verifyUser verifies the username and password are correct. Returns
-// InvalidCredentialsErr for incorrect username or password.
-func (h *handler) verifyUser(username string, passwordHash, salt []byte) error {
-	h.mux.Lock()
-	defer h.mux.Unlock()
+// ReadDirEntries reads the directory at the provided path, returning all the
+// files and directories it contains with their size and modification time.
+//
+// Returns [store.NonLocalFileErr] if the directory is outside the base path,
+// [InvalidTokenErr] for an invalid token.
+func (h *handler) ReadDirEntries(msg *pb.RsReadRequest) ([]store.DirEntry, error) {
+	jww.TRACE.Printf("Received ReadDirEntries message: %s", msg)
 
-	clearTextPassword, exists := h.userPasswords[username]
-	if !exists {
-		return InvalidCredentialsErr
+	s, err := h.getLimitedSession(UnmarshalToken(msg.GetToken()), readOp, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer h.endRequest(s)
+
+	return s.ReadDirEntries(msg.GetPath())
+}
+
+// Manifest returns every file under the directory at the provided path with
+// its size, modification time, and content hash. If since is not zero, only
+// files modified at or after since are returned.
+//
+// Returns [store.NonLocalFileErr] if the directory is outside the base path,
+// [InvalidTokenErr] for an invalid token.
+func (h *handler) Manifest(
+	msg *pb.RsReadRequest, since time.Time) ([]store.ManifestEntry, error) {
+	jww.TRACE.Printf("Received Manifest message since %s: %s", since, msg)
+
+	s, err := h.getLimitedSession(UnmarshalToken(msg.GetToken()), readOp, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer h.endRequest(s)
+
+	return s.Manifest(msg.GetPath(), since)
+}
+
+// GetChanges returns the ID of the user's journal and all changes to the
+// user's files with a sequence number greater than after, in order. The
+// journalID is the one returned with after.
+//
+// Returns [store.JournalCompactedErr] if any of the requested changes are no
+// longer available, after is past the last change, or the journal was
+// restarted since, [InvalidTokenErr] for an invalid token.
+func (h *handler) GetChanges(msg *pb.RsLastWriteRequest, journalID string,
+	after uint64) (string, []store.Change, error) {
+	jww.TRACE.Printf("Received GetChanges message after %s/%d: %s",
+		journalID, after, msg)
+
+	s, err := h.getLimitedSession(UnmarshalToken(msg.GetToken()), readOp, 0)
+	if err != nil {
+		return "", nil, err
+	}
+	defer h.endRequest(s)
+
+	return s.GetChanges(journalID, after)
+}
+
+// GetUsage returns the storage currently used by the user.
+//
+// Returns [InvalidTokenErr] for an invalid token.
+func (h *handler) GetUsage(msg *pb.RsLastWriteRequest) (store.Usage, error) {
+	jww.TRACE.Printf("Received GetUsage message: %s", msg)
+
+	s, err := h.getLimitedSession(UnmarshalToken(msg.GetToken()), readOp, 0)
+	if err != nil {
+		return store.Usage{}, err
+	}
+	defer h.endRequest(s)
+
+	return s.GetUsage(), nil
+}
+
+// ListVersions returns the previous versions of the file at the provided path,
+// sorted from newest to oldest.
+//
+// Returns [store.NonLocalFileErr] if the file is outside the base path,
+// [InvalidTokenErr] for an invalid token.
+func (h *handler) ListVersions(msg *pb.RsReadRequest) ([]store.Version, error) {
+	jww.TRACE.Printf("Received ListVersions message: %s", msg)
+
+	s, err := h.getLimitedSession(UnmarshalToken(msg.GetToken()), readOp, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer h.endRequest(s)
+
+	return s.ListVersions(msg.GetPath())
+}
+
+// ReadVersion returns the contents of the previous version of the file at the
+// provided path with the given ID.
+//
+// Returns [store.NonLocalFileErr] if the file is outside the base path,
+// [store.VersionNotFoundErr] if the version does not exist, [InvalidTokenErr]
+// for an invalid token.
+func (h *handler) ReadVersion(
+	msg *pb.RsReadRequest, id int64) (*pb.RsReadResponse, error) {
+	jww.TRACE.Printf("Received ReadVersion message for version %d: %s", id, msg)
+
+	s, err := h.getLimitedSession(UnmarshalToken(msg.GetToken()), readOp, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer h.endRequest(s)
+
+	data, err := s.ReadVersion(msg.GetPath(), id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.RsReadResponse{Data: data}, nil
+}
+
+// Delete deletes the file at the provided path.
+//
+// An error is returned if the file does not exist or is a directory. Returns
+// [store.NonLocalFileErr] if the file is outside the base path,
+// [InvalidTokenErr] for an invalid token.
+func (h *handler) Delete(msg *pb.RsReadRequest) (*messages.Ack, error) {
+	jww.TRACE.Printf("Received Delete message: %s", msg)
+
+	s, err := h.getLimitedSession(UnmarshalToken(msg.GetToken()), writeOp, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer h.endRequest(s)
+
+	err = s.Delete(msg.GetPath())
+	if err != nil {
+		return nil, err
+	}
+
+	return &messages.Ack{}, nil
+}
+
+// DeleteDir deletes the directory at the provided path and everything it
+// contains.
+//
+// An error is returned if the directory does not exist. Returns
+// [store.NonLocalFileErr] if the directory is outside the base path,
+// [InvalidTokenErr] for an invalid token.
+func (h *handler) DeleteDir(msg *pb.RsReadRequest) (*messages.Ack, error) {
+	jww.TRACE.Printf("Received DeleteDir message: %s", msg)
+
+	s, err := h.getLimitedSession(UnmarshalToken(msg.GetToken()), writeOp, 0)
+	if err != nil {
+		return nil, err
 	}
+	defer h.endRequest(s)
 
-	if !bytes.Equal(hashPassword(clearTextPassword, salt), passwordHash) {
-		return InvalidCredentialsErr
+	err = s.DeleteDir(msg.GetPath())
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	return &messages.Ack{}, nil
+}
+
+// verifyUser verifies the username and password are correct using the
+// handler's Authenticator. Returns InvalidCredentialsErr for incorrect username
+// or password.
+func (h *handler) verifyUser(username string, passwordHash, salt []byte) error {
+	h.mux.Lock()
+	authenticator := h.authenticator
+	h.mux.Unlock()
+
+	// The authenticator is called outside the lock since it may block on I/O
+	err := authenticator.Authenticate(username, passwordHash, salt)
+	if err != nil && !errors.Is(err, InvalidCredentialsErr) {
+		jww.ERROR.Printf("Failed to authenticate user %s: %+v", username, err)
+	}
+	return err
+}
+
+// verifyPassword returns true if the password hash matches the cleartext
+// password hashed with the salt.
+func verifyPassword(clearTextPassword string, passwordHash, salt []byte) bool {
+	return subtle.ConstantTimeCompare(
+		hashPassword(clearTextPassword, salt), passwordHash) == 1
 }
 
 func hashPassword(clearTextPassword string, salt []byte) []byte {
@@ -246,67 +635,341 @@ func hashPassword(clearTextPassword string, salt []byte) []byte {
 	return h.Sum(nil)
 }
 
-// getSession returns the store for the given token. Returns [InvalidTokenErr]
-// for an invalid token.
-func (h *handler) getSession(token Token) (store.Store, error) {
+// getSession returns the session for the given token without applying rate
+// limits or holding a reference to its store. Returns [InvalidTokenErr] for an
+// invalid token and [ShuttingDownErr] if the handler is shutting down.
+func (h *handler) getSession(token Token) (*userSession, error) {
+	s, err := h.getLimitedSession(token, noOp, 0)
+	if err != nil {
+		return nil, err
+	}
+	h.endRequest(s)
+	return s, nil
+}
+
+// getLimitedSession returns the session for the given token after taking an
+// operation of the class that writes the number of bytes from the user's rate
+// limits. The limits are checked before the session's expiry is extended, so a
+// rejected request does not keep the session alive. A reference to the store is
+// held for the request so that it is not closed while in use, even if the
+// session is removed; the caller must release it with endRequest.
+//
+// Returns [RateLimitedErr] if the user has exceeded their rate limit,
+// [InvalidTokenErr] for an invalid token, and [ShuttingDownErr] if the handler
+// is shutting down.
+func (h *handler) getLimitedSession(
+	token Token, op operation, bytes int) (*userSession, error) {
 	h.mux.Lock()
-	defer h.mux.Unlock()
 
-	s, exists := h.sessions[token]
-	if !exists {
-		return nil, InvalidTokenErr
+	if h.closing {
+		h.mux.Unlock()
+		return nil, ShuttingDownErr
 	}
 
-	// If the store is no longer valid, then delete it and its token from their
-	// respective maps
-	if !s.IsValid() {
-		delete(h.sessions, token)
-		delete(h.userTokens, s.username)
+	s, err := h.lookupSession(token)
+	if err != nil {
+		h.mux.Unlock()
+		return nil, err
+	}
+
+	// If the session is no longer valid, then delete it and its token from
+	// their respective maps
+	if s.isExpired(h.now()) {
+		_, us := h.removeSession(token)
+		h.mux.Unlock()
+		if us != nil {
+			h.closeStore(us)
+		}
 		return nil, InvalidTokenErr
 	}
 
+	if l := h.limiters[s.username]; l != nil {
+		if err = l.allow(op, bytes, h.now()); err != nil {
+			h.mux.Unlock()
+			jww.DEBUG.Printf("Rate limited session %s of user %s: %v",
+				sessionID(token), s.username, err)
+			return nil, err
+		}
+	}
+
+	if h.slidingExpiry {
+		s.ExpiryTime = h.extendedExpiry(s, h.now())
+	}
+
+	// The session holds a reference, so the store is open
+	h.stores[s.username].refs++
+
+	h.mux.Unlock()
 	return s, nil
 }
 
-// addSession generates a new Token and expiration time. On first login, it
-// initializes a new storage directory for user. On subsequent logins, it
-// overwrites the token with the new token gives access to the user's directory.
+// lookupSession returns the session with the token, restoring it if it was
+// loaded from the session store. The session may be expired. If the store of
+// the user of a loaded session is still being closed, the lock is released
+// until it has closed.
+//
+// Returns [InvalidTokenErr] if no session has the token and [ShuttingDownErr]
+// if the handler starts shutting down while waiting. Must be called with the
+// lock held.
+func (h *handler) lookupSession(token Token) (*userSession, error) {
+	for {
+		if s, exists := h.sessions[token]; exists {
+			return s, nil
+		}
+
+		s, err := h.restoreSession(token)
+		if !h.waitForStore(err) {
+			return s, err
+		} else if h.closing {
+			return nil, ShuttingDownErr
+		}
+	}
+}
+
+// refreshSession replaces the token of the session with a new token that
+// expires tokenTTL from now, limited by the maximum token lifetime. The new
+// session keeps the position of the old one in the user's sessions. Returns
+// [InvalidTokenErr] for an invalid or expired token and [ShuttingDownErr] if
+// the handler is shutting down.
+func (h *handler) refreshSession(token Token) (*userSession, error) {
+	h.mux.Lock()
+
+	if h.closing {
+		h.mux.Unlock()
+		return nil, ShuttingDownErr
+	}
+
+	s, err := h.lookupSession(token)
+	if err != nil {
+		h.mux.Unlock()
+		return nil, err
+	}
+
+	now := h.now()
+	if s.isExpired(now) {
+		_, us := h.removeSession(token)
+		h.mux.Unlock()
+		if us != nil {
+			h.closeStore(us)
+		}
+		return nil, InvalidTokenErr
+	}
+	defer h.mux.Unlock()
+
+	newToken, n, err := h.newToken(now)
+	if err != nil {
+		return nil, err
+	}
+	n.ExpiryTime = h.extendedExpiry(s, now)
+	refreshed := &userSession{
+		username: s.username,
+		Nonce:    n,
+		Store:    s.Store,
+		loggedIn: s.loggedIn,
+	}
+
+	delete(h.sessions, token)
+	h.sessions[newToken] = refreshed
+	tokens := h.userTokens[s.username]
+	for i := range tokens {
+		if tokens[i] == token {
+			tokens[i] = newToken
+			break
+		}
+	}
+
+	return refreshed, nil
+}
+
+// extendedExpiry returns the expiry of the session extended to tokenTTL after
+// now, limited to maxTokenLifetime after the user logged in. The expiry is
+// never moved earlier. Must be called with the lock held.
+func (h *handler) extendedExpiry(s *userSession, now time.Time) time.Time {
+	expiry := now.Add(h.tokenTTL)
+	if h.maxTokenLifetime > 0 {
+		if limit := s.loggedIn.Add(h.maxTokenLifetime); expiry.After(limit) {
+			expiry = limit
+		}
+	}
+	if expiry.Before(s.ExpiryTime) {
+		return s.ExpiryTime
+	}
+	return expiry
+}
+
+// addSession generates a new Token and expiration time. On the first login of
+// a user, it initializes a new store for their storage directory. On subsequent
+// logins, the new session shares the store of the user's existing sessions, so
+// each device that logs in gets its own token. If the user's previous store is
+// still being closed, it waits for the close to finish before opening a new
+// one. If the user has more than the maximum number of sessions, their oldest
+// session is removed. Returns [ShuttingDownErr] if the handler is shutting
+// down.
 func (h *handler) addSession(username string) (*userSession, error) {
 	h.mux.Lock()
 	defer h.mux.Unlock()
 
+	var s *userSession
+	for {
+		if h.closing {
+			return nil, ShuttingDownErr
+		}
+
+		token, n, err := h.newToken(h.now())
+		if err != nil {
+			return nil, err
+		}
+
+		s, err = h.insertSession(username, token, n, n.GenTime)
+		if h.waitForStore(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	// Remove the oldest sessions over the limit. The store is never closed
+	// since it is shared with the new session.
+	for h.maxSessions > 0 && len(h.userTokens[username]) > h.maxSessions {
+		oldest := h.userTokens[username][0]
+		jww.INFO.Printf("Removed oldest session %s of user %s that exceeded "+
+			"the limit of %d sessions.", sessionID(oldest), username,
+			h.maxSessions)
+		h.removeSession(oldest)
+	}
+
+	return s, nil
+}
+
+// insertSession adds a session with the token and nonce for the user, who
+// logged in at loggedIn. The session holds a reference to the user's store,
+// which is opened if the user has no other sessions. Returns a
+// [storeClosingErr] if the user's previous store is still being closed. Must be
+// called with the lock held.
+func (h *handler) insertSession(username string, token Token, n nonce.Nonce,
+	loggedIn time.Time) (*userSession, error) {
+	s, err := h.acquireStore(username)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := h.userTokens[username]
+	jww.DEBUG.Printf("Adding session %d for user %s.", len(tokens)+1, username)
+	h.sessions[token] = &userSession{
+		username: username,
+		Nonce:    n,
+		Store:    s,
+		loggedIn: loggedIn,
+	}
+	if _, exists := h.limiters[username]; !exists {
+		l := newUserLimiter(h.rateLimits.userRateLimits(username), h.now())
+		if l != nil {
+			h.limiters[username] = l
+		}
+	}
+	h.userTokens[username] = append(tokens, token)
+
+	return h.sessions[token], nil
+}
+
+// newToken generates a new token that is not in use and its nonce, which is
+// generated at now and expires tokenTTL later. Must be called with the lock
+// held.
+func (h *handler) newToken(now time.Time) (Token, nonce.Nonce, error) {
 	var token Token
 	var n nonce.Nonce
 	var err error
 	for exists := true; exists; _, exists = h.sessions[token] {
-		// Generate a new nonce and token
 		n, err = nonce.NewNonce(uint(h.tokenTTL.Seconds()))
 		if err != nil {
 			// This error cannot currently happen
-			return nil, err
+			return Token{}, nonce.Nonce{}, err
 		}
 		token = Token(n.Value)
 	}
 
-	if oldToken, exists := h.userTokens[username]; exists {
-		// If an old token is registered, update the token in the sessions map
-		jww.DEBUG.Printf("Updating token for user %s.", username)
-		h.sessions[token] = h.sessions[oldToken]
-		h.sessions[token].Value = nonce.Value(token)
-		delete(h.sessions, oldToken)
-	} else {
-		// If no token exists, create a new store instance and put in the map
-		jww.DEBUG.Printf("Creating new token for user %s.", username)
+	// Base the expiry on the handler's clock
+	n.GenTime = now
+	n.ExpiryTime = n.GenTime.Add(n.TTL)
 
-		us, err := newUserSession(h.storageDir, username, n, h.newStore)
-		if err != nil {
-			return nil, err
+	return token, n, nil
+}
+
+// removeSession removes the session with the token from the sessions and token
+// maps and releases its reference to the user's store. Returns the removed
+// session and, if it held the last reference, the store, which the caller must
+// close with closeStore once the lock is released. Must be called with the lock
+// held.
+func (h *handler) removeSession(token Token) (*userSession, *userStore) {
+	s, exists := h.sessions[token]
+	if !exists {
+		return nil, nil
+	}
+	delete(h.sessions, token)
+
+	tokens := h.userTokens[s.username]
+	for i := range tokens {
+		if tokens[i] == token {
+			tokens = append(tokens[:i:i], tokens[i+1:]...)
+			break
 		}
-		h.sessions[token] = &us
 	}
+	if len(tokens) == 0 {
+		delete(h.userTokens, s.username)
+	} else {
+		h.userTokens[s.username] = tokens
+	}
+	return s, h.releaseStore(s.username)
+}
+
+// shutdown stops the handler from accepting new requests, stops the session
+// reaper, saves the sessions if they are persisted, closes the authenticator if
+// it is an io.Closer, and closes the stores of all users, which waits for any
+// in-progress writes to complete. Returns an error if the context is done
+// before all stores are closed, including those already being closed.
+func (h *handler) shutdown(ctx context.Context) error {
+	h.mux.Lock()
+	h.closing = true
+	authenticator := h.authenticator
+	pending := make([]*userStore, 0, len(h.closingStores))
+	for _, us := range h.closingStores {
+		pending = append(pending, us)
+	}
+	stores := make([]*userStore, 0, len(h.stores))
+	for username, us := range h.stores {
+		delete(h.stores, username)
+		h.closingStores[username] = us
+		stores = append(stores, us)
+	}
+	h.mux.Unlock()
 
-	// Update to the newest token
-	h.userTokens[username] = token
+	h.stopSessionReaper()
+	h.saveSessions()
 
-	return h.sessions[token], nil
+	if c, ok := authenticator.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			jww.WARN.Printf("Failed to close authenticator: %+v", err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, us := range stores {
+			h.closeStore(us)
+		}
+		for _, us := range pending {
+			<-us.closed
+		}
+	}()
+
+	select {
+	case <-done:
+		jww.INFO.Printf("Closed %d user stores.", len(stores))
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(),
+			"timed out waiting for user stores to close")
+	}
 }
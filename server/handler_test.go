@@ -9,11 +9,13 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"math/rand"
 	"os"
 	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -29,15 +31,26 @@ func Test_newHandler(t *testing.T) {
 		storageDir:    "storageDir",
 		tokenTTL:      5 * time.Hour,
 		sessions:      make(map[Token]*userSession),
-		userTokens:    make(map[string]Token),
-		userPasswords: map[string]string{"user": "pass"},
+		userTokens:    make(map[string][]Token),
+		stores:        make(map[string]*userStore),
+		closingStores: make(map[string]*userStore),
+		limiters:      make(map[string]*userLimiter),
+		restored:      make(map[string]PersistedSession),
+		authenticator: csvAuthenticator{"user": "pass"},
+		userQuotas:    map[string]quotaOverride{},
 	}
 
 	h, err := newHandler(expected.storageDir, expected.tokenTTL,
-		[][]string{{"user", "pass"}}, nil)
+		[][]string{{"user", "pass"}}, nil, nil, nil)
 	if err != nil {
-		t.Errorf("Failed to make new handler: %+v", err)
+		t.Fatalf("Failed to make new handler: %+v", err)
+	}
+
+	// Functions cannot be compared, so check and then clear the clock
+	if h.now == nil {
+		t.Errorf("Clock not set.")
 	}
+	h.now = nil
 
 	if !reflect.DeepEqual(expected, h) {
 		t.Errorf("Unexpected new handler.\nexpected: %#v\nreceived: %#v",
@@ -47,7 +60,8 @@ func Test_newHandler(t *testing.T) {
 
 // Error path: Tests that newHandler returns an error for invalid user records
 func Test_newHandler_UserError(t *testing.T) {
-	_, err := newHandler("", 0, [][]string{{"user", "pass"}, {"user2"}}, nil)
+	_, err := newHandler(
+		"", 0, [][]string{{"user", "pass"}, {"user2"}}, nil, nil, nil)
 	if err == nil {
 		t.Errorf("Failed to error for invalid records.")
 	}
@@ -110,8 +124,8 @@ func Test_handler_Login(t *testing.T) {
 	salt := make([]byte, 32)
 	prng.Read(salt)
 
-	h, _ := newHandler(
-		"tmp", time.Hour, [][]string{{username, password}}, store.NewMemStore)
+	h, _ := newHandler("tmp", time.Hour,
+		[][]string{{username, password}}, nil, store.NewMemStore, nil)
 
 	msg, err := h.Login(&pb.RsAuthenticationRequest{
 		Username:     username,
@@ -145,8 +159,8 @@ func Test_handler_Login_InvalidUsernameError(t *testing.T) {
 
 	passwordHash := hashPassword(password, salt)
 
-	h, _ := newHandler(
-		"tmp", time.Hour, [][]string{{username, password}}, store.NewMemStore)
+	h, _ := newHandler("tmp", time.Hour,
+		[][]string{{username, password}}, nil, store.NewMemStore, nil)
 
 	_, err := h.Login(&pb.RsAuthenticationRequest{
 		Username:     username + "extra junk",
@@ -168,8 +182,8 @@ func Test_handler_Login_NonLocalPathError(t *testing.T) {
 	salt := make([]byte, 32)
 	prng.Read(salt)
 
-	h, _ := newHandler(
-		"tmp", time.Hour, [][]string{{username, password}}, store.NewFileStore)
+	h, _ := newHandler("tmp", time.Hour,
+		[][]string{{username, password}}, nil, store.NewFileStore, nil)
 
 	_, err := h.Login(&pb.RsAuthenticationRequest{
 		Username:     username,
@@ -481,6 +495,431 @@ func Test_handler_ReadDir_InvalidTokenError(t *testing.T) {
 	}
 }
 
+// Tests that handler.GetUsage returns the usage of the user's store and that
+// handler.Write returns store.QuotaExceededErr once the user's quota from the
+// CSV is exceeded.
+func Test_handler_GetUsage_Quota(t *testing.T) {
+	prng := rand.New(rand.NewSource(7345))
+	salt := make([]byte, 32)
+	prng.Read(salt)
+
+	h, err := newHandler("tmp", time.Hour,
+		[][]string{{"waldo", "hunter2", "", "1"}}, nil, store.NewMemStore, nil)
+	if err != nil {
+		t.Fatalf("Failed to make new handler: %+v", err)
+	}
+	h.defaultQuota = store.Quota{MaxBytes: 100}
+
+	msg, err := h.Login(&pb.RsAuthenticationRequest{
+		Username:     "waldo",
+		PasswordHash: hashPassword("hunter2", salt),
+		Salt:         salt,
+	})
+	if err != nil {
+		t.Fatalf("Failed to login: %+v", err)
+	}
+
+	_, err = h.Write(&pb.RsWriteRequest{
+		Path:  "fileA.txt",
+		Data:  []byte("Lorem ipsum"),
+		Token: msg.GetToken(),
+	})
+	if err != nil {
+		t.Errorf("Failed to write: %+v", err)
+	}
+
+	usage, err := h.GetUsage(&pb.RsLastWriteRequest{Token: msg.GetToken()})
+	if err != nil {
+		t.Errorf("Failed to get usage: %+v", err)
+	} else if expected := (store.Usage{Bytes: 11, Files: 1}); usage != expected {
+		t.Errorf("Unexpected usage.\nexpected: %+v\nreceived: %+v",
+			expected, usage)
+	}
+
+	_, err = h.Write(&pb.RsWriteRequest{
+		Path:  "fileB.txt",
+		Data:  []byte("Lorem ipsum"),
+		Token: msg.GetToken(),
+	})
+	if !errors.Is(err, store.QuotaExceededErr) {
+		t.Errorf("Unexpected error for write exceeding quota."+
+			"\nexpected: %v\nreceived: %+v", store.QuotaExceededErr, err)
+	}
+}
+
+// Error path: Tests that handler.GetUsage returns InvalidTokenErr for a token
+// that is not found.
+func Test_handler_GetUsage_InvalidTokenError(t *testing.T) {
+	prng := rand.New(rand.NewSource(7345))
+	h, token := newHandlerLogin(time.Hour, "waldo", "hunter2", prng, t)
+
+	prng.Read(token[:])
+	_, err := h.GetUsage(&pb.RsLastWriteRequest{Token: token.Marshal()})
+	if !errors.Is(err, InvalidTokenErr) {
+		t.Errorf("Unexpected error for invalid token."+
+			"\nexpected: %v\nreceived: %+v", InvalidTokenErr, err)
+	}
+}
+
+// Tests that handler.ReadDirEntries returns the files and directories written
+// to the directory.
+func Test_handler_ReadDirEntries(t *testing.T) {
+	h, token := newHandlerLogin(
+		time.Hour, "waldo", "hunter2", rand.New(rand.NewSource(4596)), t)
+
+	for _, path := range []string{"dir1/fileA.txt", "dir1/dir2/fileB.txt"} {
+		_, err := h.Write(&pb.RsWriteRequest{
+			Path:  path,
+			Data:  []byte("Lorem ipsum"),
+			Token: token.Marshal(),
+		})
+		if err != nil {
+			t.Fatalf("Failed to write %s: %+v", path, err)
+		}
+	}
+
+	entries, err := h.ReadDirEntries(
+		&pb.RsReadRequest{Path: "dir1", Token: token.Marshal()})
+	if err != nil {
+		t.Fatalf("Failed to read directory: %+v", err)
+	}
+
+	if len(entries) != 2 || entries[0].Name != "dir2" || !entries[0].IsDir ||
+		entries[1].Name != "fileA.txt" || entries[1].IsDir ||
+		entries[1].Size != int64(len("Lorem ipsum")) {
+		t.Errorf("Unexpected entries: %+v", entries)
+	}
+}
+
+// Tests that handler.Manifest returns only the files modified since the given
+// time.
+func Test_handler_Manifest(t *testing.T) {
+	h, token := newHandlerLogin(
+		time.Hour, "waldo", "hunter2", rand.New(rand.NewSource(4596)), t)
+
+	var since time.Time
+	for i, path := range []string{"dir1/fileA.txt", "dir1/dir2/fileB.txt"} {
+		if i == 1 {
+			since = netTime.Now()
+		}
+		_, err := h.Write(&pb.RsWriteRequest{
+			Path:  path,
+			Data:  []byte("Lorem ipsum"),
+			Token: token.Marshal(),
+		})
+		if err != nil {
+			t.Fatalf("Failed to write %s: %+v", path, err)
+		}
+	}
+
+	msg := &pb.RsReadRequest{Path: "dir1", Token: token.Marshal()}
+	entries, err := h.Manifest(msg, time.Time{})
+	if err != nil {
+		t.Fatalf("Failed to get manifest: %+v", err)
+	} else if len(entries) != 2 {
+		t.Errorf("Unexpected manifest: %+v", entries)
+	}
+
+	entries, err = h.Manifest(msg, since)
+	if err != nil {
+		t.Fatalf("Failed to get manifest: %+v", err)
+	} else if len(entries) != 1 || entries[0].Path != "dir1/dir2/fileB.txt" ||
+		!bytes.Equal(entries[0].Hash, store.ContentHash([]byte("Lorem ipsum"))) {
+		t.Errorf("Unexpected manifest since %s: %+v", since, entries)
+	}
+}
+
+// Tests that handler.GetChanges returns the changes made after the given
+// sequence number of the journal.
+func Test_handler_GetChanges(t *testing.T) {
+	h, token := newHandlerLogin(
+		time.Hour, "waldo", "hunter2", rand.New(rand.NewSource(4596)), t)
+
+	_, err := h.Write(&pb.RsWriteRequest{
+		Path:  "dir1/fileA.txt",
+		Data:  []byte("Lorem ipsum"),
+		Token: token.Marshal(),
+	})
+	if err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+	_, err = h.Delete(
+		&pb.RsReadRequest{Path: "dir1/fileA.txt", Token: token.Marshal()})
+	if err != nil {
+		t.Fatalf("Failed to delete: %+v", err)
+	}
+
+	msg := &pb.RsLastWriteRequest{Token: token.Marshal()}
+	journalID, _, err := h.GetChanges(msg, "", 0)
+	if err != nil {
+		t.Fatalf("Failed to get journal ID: %+v", err)
+	}
+	_, changes, err := h.GetChanges(msg, journalID, 1)
+	if err != nil {
+		t.Fatalf("Failed to get changes: %+v", err)
+	} else if len(changes) != 1 || changes[0].Seq != 2 ||
+		changes[0].Type != store.ChangeDelete ||
+		changes[0].Path != "dir1/fileA.txt" {
+		t.Errorf("Unexpected changes: %+v", changes)
+	}
+}
+
+// Tests that handler.WriteIf writes when the precondition matches and returns
+// store.ConflictErr when it does not.
+func Test_handler_WriteIf(t *testing.T) {
+	h, token := newHandlerLogin(
+		time.Hour, "waldo", "hunter2", rand.New(rand.NewSource(4596)), t)
+
+	msg := &pb.RsWriteRequest{
+		Path:  "dir1/fileA.txt",
+		Data:  []byte("Lorem ipsum"),
+		Token: token.Marshal(),
+	}
+	_, err := h.WriteIf(msg, store.Precondition{NotExist: true})
+	if err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+
+	msg.Data = []byte("dolor sit amet")
+	_, err = h.WriteIf(msg, store.Precondition{NotExist: true})
+	if !errors.Is(err, store.ConflictErr) {
+		t.Errorf("Unexpected error for stale precondition."+
+			"\nexpected: %v\nreceived: %+v", store.ConflictErr, err)
+	}
+
+	_, err = h.WriteIf(msg,
+		store.Precondition{Hash: store.ContentHash([]byte("Lorem ipsum"))})
+	if err != nil {
+		t.Errorf("Failed to write with matching precondition: %+v", err)
+	}
+}
+
+// Tests that handler.ListVersions lists the previous contents of an overwritten
+// file and that handler.ReadVersion returns them.
+func Test_handler_ListVersions_ReadVersion(t *testing.T) {
+	prng := rand.New(rand.NewSource(8523))
+	salt := make([]byte, 32)
+	prng.Read(salt)
+
+	h, err := newHandler("tmp", time.Hour,
+		[][]string{{"waldo", "hunter2"}}, nil, store.NewMemStore, nil)
+	if err != nil {
+		t.Fatalf("Failed to make new handler: %+v", err)
+	}
+	h.retention = store.RetentionPolicy{MaxVersions: 2}
+
+	msg, err := h.Login(&pb.RsAuthenticationRequest{
+		Username:     "waldo",
+		PasswordHash: hashPassword("hunter2", salt),
+		Salt:         salt,
+	})
+	if err != nil {
+		t.Fatalf("Failed to login: %+v", err)
+	}
+
+	contents := []string{"version 1", "version 2", "version 3", "version 4"}
+	for _, data := range contents {
+		_, err = h.Write(&pb.RsWriteRequest{
+			Path:  "fileA.txt",
+			Data:  []byte(data),
+			Token: msg.GetToken(),
+		})
+		if err != nil {
+			t.Fatalf("Failed to write %q: %+v", data, err)
+		}
+	}
+
+	req := &pb.RsReadRequest{Path: "fileA.txt", Token: msg.GetToken()}
+	versions, err := h.ListVersions(req)
+	if err != nil {
+		t.Fatalf("Failed to list versions: %+v", err)
+	} else if len(versions) != 2 {
+		t.Fatalf("Unexpected number of versions.\nexpected: %d\nreceived: %d",
+			2, len(versions))
+	}
+
+	for i, expected := range []string{"version 3", "version 2"} {
+		resp, err := h.ReadVersion(req, versions[i].ID)
+		if err != nil {
+			t.Errorf("Failed to read version %d: %+v", i, err)
+		} else if string(resp.GetData()) != expected {
+			t.Errorf("Unexpected data for version %d."+
+				"\nexpected: %q\nreceived: %q", i, expected, resp.GetData())
+		}
+	}
+}
+
+// Error path: Tests that handler.ReadVersion returns store.VersionNotFoundErr
+// for a version that does not exist.
+func Test_handler_ReadVersion_VersionNotFoundError(t *testing.T) {
+	h, token := newHandlerLogin(
+		time.Hour, "waldo", "hunter2", rand.New(rand.NewSource(4596)), t)
+
+	_, err := h.ReadVersion(
+		&pb.RsReadRequest{Path: "fileA.txt", Token: token.Marshal()}, 5)
+	if !errors.Is(err, store.VersionNotFoundErr) {
+		t.Errorf("Unexpected error for missing version."+
+			"\nexpected: %v\nreceived: %+v", store.VersionNotFoundErr, err)
+	}
+}
+
+// Error path: Tests that handler.ListVersions returns InvalidTokenErr for a
+// token that is not found.
+func Test_handler_ListVersions_InvalidTokenError(t *testing.T) {
+	prng := rand.New(rand.NewSource(7345))
+	h, token := newHandlerLogin(time.Hour, "waldo", "hunter2", prng, t)
+
+	prng.Read(token[:])
+	_, err := h.ListVersions(
+		&pb.RsReadRequest{Path: "fileA.txt", Token: token.Marshal()})
+	if !errors.Is(err, InvalidTokenErr) {
+		t.Errorf("Unexpected error for invalid token."+
+			"\nexpected: %v\nreceived: %+v", InvalidTokenErr, err)
+	}
+}
+
+// Tests that a file written by handler.Write can no longer be read after being
+// deleted with handler.Delete.
+func Test_handler_Delete(t *testing.T) {
+	h, token := newHandlerLogin(
+		time.Hour, "waldo", "hunter2", rand.New(rand.NewSource(4596)), t)
+
+	filePath := "dir1/dir2/fileA.txt"
+	_, err := h.Write(&pb.RsWriteRequest{
+		Path:  filePath,
+		Data:  []byte("Lorem ipsum and such as it goes."),
+		Token: token.Marshal(),
+	})
+	if err != nil {
+		t.Errorf("Failed to write: %+v", err)
+	}
+
+	ack, err := h.Delete(&pb.RsReadRequest{
+		Path:  filePath,
+		Token: token.Marshal(),
+	})
+	if err != nil {
+		t.Errorf("Failed to delete: %+v", err)
+	} else if ack == nil {
+		t.Errorf("Received no ack: %+v", ack)
+	}
+
+	_, err = h.Read(&pb.RsReadRequest{
+		Path:  filePath,
+		Token: token.Marshal(),
+	})
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error for deleted file."+
+			"\nexpected: %v\nreceived: %+v", os.ErrNotExist, err)
+	}
+}
+
+// Error path: Tests that handler.Delete returns InvalidTokenErr for a token
+// that is not found.
+func Test_handler_Delete_InvalidTokenError(t *testing.T) {
+	prng := rand.New(rand.NewSource(8532))
+	h, token := newHandlerLogin(time.Hour, "waldo", "hunter2", prng, t)
+
+	prng.Read(token[:])
+	_, err := h.Delete(&pb.RsReadRequest{Token: token.Marshal()})
+	if !errors.Is(err, InvalidTokenErr) {
+		t.Errorf("Unexpected error for invalid token."+
+			"\nexpected: %v\nreceived: %+v", InvalidTokenErr, err)
+	}
+}
+
+// Error path: Tests that handler.Delete returns store.NonLocalFileErr for a
+// file path that is not local to the user's directory.
+func Test_handler_Delete_NonLocalFileError(t *testing.T) {
+	prng := rand.New(rand.NewSource(8532))
+	h, token, closeFn := newHandlerStoreLogin(
+		time.Hour, "waldo", "hunter2", prng, store.NewFileStore, t)
+	defer closeFn()
+
+	_, err := h.Delete(&pb.RsReadRequest{
+		Path:  "domeDir/../../../user/file",
+		Token: token.Marshal(),
+	})
+	if !errors.Is(err, store.NonLocalFileErr) {
+		t.Errorf("Unexpected error for a non-local file path."+
+			"\nexpected: %v\nreceived: %+v", store.NonLocalFileErr, err)
+	}
+}
+
+// Tests that a directory deleted with handler.DeleteDir no longer appears in
+// handler.ReadDir.
+func Test_handler_DeleteDir(t *testing.T) {
+	h, token := newHandlerLogin(
+		time.Hour, "waldo", "hunter2", rand.New(rand.NewSource(4596)), t)
+
+	for _, filePath := range []string{"dir1/dir2/fileA.txt", "dir1/dir3/b"} {
+		_, err := h.Write(&pb.RsWriteRequest{
+			Path:  filePath,
+			Data:  []byte("Lorem ipsum and such as it goes."),
+			Token: token.Marshal(),
+		})
+		if err != nil {
+			t.Errorf("Failed to write %s: %+v", filePath, err)
+		}
+	}
+
+	ack, err := h.DeleteDir(&pb.RsReadRequest{
+		Path:  "dir1/dir2",
+		Token: token.Marshal(),
+	})
+	if err != nil {
+		t.Errorf("Failed to delete directory: %+v", err)
+	} else if ack == nil {
+		t.Errorf("Received no ack: %+v", ack)
+	}
+
+	msg, err := h.ReadDir(&pb.RsReadRequest{
+		Path:  "dir1/",
+		Token: token.Marshal(),
+	})
+	if err != nil {
+		t.Errorf("Failed to read dir %s: %+v", "dir1/", err)
+	}
+
+	expected := []string{"dir3"}
+	if !reflect.DeepEqual(msg.GetData(), expected) {
+		t.Errorf("Unexpected directories.\nexpected: %s\nreceived: %s",
+			expected, msg.GetData())
+	}
+}
+
+// Error path: Tests that handler.DeleteDir returns InvalidTokenErr for a token
+// that is not found.
+func Test_handler_DeleteDir_InvalidTokenError(t *testing.T) {
+	prng := rand.New(rand.NewSource(9021))
+	h, token := newHandlerLogin(time.Hour, "waldo", "hunter2", prng, t)
+
+	prng.Read(token[:])
+	_, err := h.DeleteDir(&pb.RsReadRequest{Token: token.Marshal()})
+	if !errors.Is(err, InvalidTokenErr) {
+		t.Errorf("Unexpected error for invalid token."+
+			"\nexpected: %v\nreceived: %+v", InvalidTokenErr, err)
+	}
+}
+
+// Error path: Tests that handler.DeleteDir returns store.NonLocalFileErr for a
+// path that is not local to the user's directory.
+func Test_handler_DeleteDir_NonLocalFileError(t *testing.T) {
+	prng := rand.New(rand.NewSource(9021))
+	h, token, closeFn := newHandlerStoreLogin(
+		time.Hour, "waldo", "hunter2", prng, store.NewFileStore, t)
+	defer closeFn()
+
+	_, err := h.DeleteDir(&pb.RsReadRequest{
+		Path:  "..",
+		Token: token.Marshal(),
+	})
+	if !errors.Is(err, store.NonLocalFileErr) {
+		t.Errorf("Unexpected error for a non-local path."+
+			"\nexpected: %v\nreceived: %+v", store.NonLocalFileErr, err)
+	}
+}
+
 // Tests handler.verifyUser with valid user.
 func Test_handler_verifyUser(t *testing.T) {
 	prng := rand.New(rand.NewSource(2))
@@ -490,7 +929,7 @@ func Test_handler_verifyUser(t *testing.T) {
 	prng.Read(salt)
 	passwordHash := hashPassword(password, salt)
 	h := &handler{
-		userPasswords: map[string]string{
+		authenticator: csvAuthenticator{
 			username: password,
 		},
 	}
@@ -511,7 +950,7 @@ func Test_handler_verifyUser_InvalidUsernameError(t *testing.T) {
 	prng.Read(salt)
 	passwordHash := hashPassword(password, salt)
 	h := &handler{
-		userPasswords: map[string]string{
+		authenticator: csvAuthenticator{
 			username: password,
 		},
 	}
@@ -533,7 +972,7 @@ func Test_handler_verifyUser_InvalidPasswordError(t *testing.T) {
 	prng.Read(salt)
 	passwordHash := hashPassword(password, salt)
 	h := &handler{
-		userPasswords: map[string]string{
+		authenticator: csvAuthenticator{
 			username: password,
 		},
 	}
@@ -548,10 +987,13 @@ func Test_handler_verifyUser_InvalidPasswordError(t *testing.T) {
 // Unit test of handler.getSession.
 func Test_handler_getSession(t *testing.T) {
 	h := &handler{
-		tokenTTL:   time.Hour,
-		sessions:   make(map[Token]*userSession),
-		userTokens: make(map[string]Token),
-		newStore:   store.NewMemStore,
+		tokenTTL:      time.Hour,
+		sessions:      make(map[Token]*userSession),
+		userTokens:    make(map[string][]Token),
+		stores:        make(map[string]*userStore),
+		closingStores: make(map[string]*userStore),
+		newStore:      store.NewMemStore,
+		now:           netTime.Now,
 	}
 	si1, err := h.addSession("waldo")
 	if err != nil {
@@ -587,10 +1029,13 @@ func Test_handler_getSession_InvalidTokenError(t *testing.T) {
 // expired token.
 func Test_handler_getSession_ExpiredTokenError(t *testing.T) {
 	h := &handler{
-		tokenTTL:   time.Second,
-		sessions:   make(map[Token]*userSession),
-		userTokens: make(map[string]Token),
-		newStore:   store.NewMemStore,
+		tokenTTL:      time.Second,
+		sessions:      make(map[Token]*userSession),
+		userTokens:    make(map[string][]Token),
+		stores:        make(map[string]*userStore),
+		closingStores: make(map[string]*userStore),
+		newStore:      store.NewMemStore,
+		now:           netTime.Now,
 	}
 
 	si, err := h.addSession("waldo")
@@ -608,33 +1053,400 @@ func Test_handler_getSession_ExpiredTokenError(t *testing.T) {
 }
 
 // Tests that when called twice on the same username, handler.addSession returns
-// the same userSession with a different token.
+// two independent sessions with different tokens that share the same store.
 func Test_handler_addSession(t *testing.T) {
 	h := &handler{
-		tokenTTL:   time.Hour,
-		sessions:   make(map[Token]*userSession),
-		userTokens: make(map[string]Token),
-		newStore:   store.NewMemStore,
+		tokenTTL:      time.Hour,
+		sessions:      make(map[Token]*userSession),
+		userTokens:    make(map[string][]Token),
+		stores:        make(map[string]*userStore),
+		closingStores: make(map[string]*userStore),
+		newStore:      store.NewMemStore,
+		now:           netTime.Now,
 	}
 
 	si1, err := h.addSession("waldo")
 	if err != nil {
 		t.Errorf("Failed to add store with the same username: %+v", err)
 	}
-	oldToken := si1.Value
-
 	si2, err := h.addSession("waldo")
 	if err != nil {
 		t.Errorf("Failed to add store with the same username: %+v", err)
 	}
 
-	if oldToken == si2.Value {
-		t.Errorf("Did not get new token.\nold: %X\nnew: %X", oldToken, si2.Value)
+	if si1.Value == si2.Value {
+		t.Errorf("Did not get new token.\nold: %X\nnew: %X", si1.Value, si2.Value)
+	}
+	if si1 == si2 {
+		t.Errorf("Session replaced instead of new session created.")
+	}
+	if si1.Store != si2.Store {
+		t.Errorf("Sessions of the same user do not share a store.")
 	}
 
-	if si1 != si2 {
-		t.Errorf("New userSession created.\nold: %+v\nnew: %+v", si1, si2)
+	for i, si := range []*userSession{si1, si2} {
+		if _, err = h.getSession(Token(si.Value)); err != nil {
+			t.Errorf("Failed to get session %d: %+v", i, err)
+		}
+	}
+	expected := []Token{Token(si1.Value), Token(si2.Value)}
+	if !reflect.DeepEqual(expected, h.userTokens["waldo"]) {
+		t.Errorf("Unexpected tokens.\nexpected: %X\nreceived: %X",
+			expected, h.userTokens["waldo"])
+	}
+}
+
+// Tests that handler.addSession removes the oldest sessions of a user over the
+// maximum without closing the shared store.
+func Test_handler_addSession_MaxSessions(t *testing.T) {
+	var closed int32
+	h := newReaperTestHandler(time.Hour, newTestClock(netTime.Now()), &closed)
+	h.maxSessions = 2
+
+	sessions := make([]*userSession, 3)
+	for i := range sessions {
+		var err error
+		if sessions[i], err = h.addSession("waldo"); err != nil {
+			t.Fatalf("Failed to add session %d: %+v", i, err)
+		}
+	}
+
+	_, err := h.getSession(Token(sessions[0].Value))
+	if !errors.Is(err, InvalidTokenErr) {
+		t.Errorf("Unexpected error for oldest session."+
+			"\nexpected: %v\nreceived: %+v", InvalidTokenErr, err)
+	}
+	for i, s := range sessions[1:] {
+		if _, err = h.getSession(Token(s.Value)); err != nil {
+			t.Errorf("Failed to get session %d: %+v", i+1, err)
+		}
+	}
+	if n := atomic.LoadInt32(&closed); n != 0 {
+		t.Errorf("Shared store closed %d times.", n)
+	}
+}
+
+// Tests that with sliding expiry, handler.getSession extends the expiry of the
+// session on each request up to the maximum token lifetime.
+func Test_handler_getSession_SlidingExpiry(t *testing.T) {
+	clock := newTestClock(netTime.Now())
+	var closed int32
+	h := newReaperTestHandler(time.Hour, clock, &closed)
+	h.slidingExpiry = true
+	h.maxTokenLifetime = 150 * time.Minute
+
+	s, err := h.addSession("waldo")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+	loggedIn := s.GenTime
+
+	for i, expected := range []time.Time{
+		loggedIn.Add(90 * time.Minute),
+		loggedIn.Add(120 * time.Minute),
+		loggedIn.Add(150 * time.Minute),
+	} {
+		clock.add(30 * time.Minute)
+		if _, err = h.getSession(Token(s.Value)); err != nil {
+			t.Fatalf("Failed to get session (%d): %+v", i, err)
+		}
+		if !s.ExpiryTime.Equal(expected) {
+			t.Errorf("Unexpected expiry (%d).\nexpected: %s\nreceived: %s",
+				i, expected, s.ExpiryTime)
+		}
+	}
+
+	clock.add(time.Hour)
+	_, err = h.getSession(Token(s.Value))
+	if !errors.Is(err, InvalidTokenErr) {
+		t.Errorf("Unexpected error after maximum token lifetime."+
+			"\nexpected: %v\nreceived: %+v", InvalidTokenErr, err)
+	}
+}
+
+// Tests that without sliding expiry, handler.getSession does not change the
+// expiry of the session.
+func Test_handler_getSession_FixedExpiry(t *testing.T) {
+	clock := newTestClock(netTime.Now())
+	var closed int32
+	h := newReaperTestHandler(time.Hour, clock, &closed)
+
+	s, err := h.addSession("waldo")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+	expected := s.ExpiryTime
+
+	clock.add(30 * time.Minute)
+	if _, err = h.getSession(Token(s.Value)); err != nil {
+		t.Fatalf("Failed to get session: %+v", err)
+	}
+	if !s.ExpiryTime.Equal(expected) {
+		t.Errorf("Expiry changed.\nexpected: %s\nreceived: %s",
+			expected, s.ExpiryTime)
+	}
+}
+
+// Tests that handler.Refresh returns a new token that expires tokenTTL from now
+// and shares the user's store, and that the old token is invalidated.
+func Test_handler_Refresh(t *testing.T) {
+	clock := newTestClock(netTime.Now())
+	var closed int32
+	h := newReaperTestHandler(time.Hour, clock, &closed)
+
+	s1, err := h.addSession("waldo")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+	s2, err := h.addSession("waldo")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+
+	clock.add(45 * time.Minute)
+	resp, err := h.Refresh(&pb.RsLastWriteRequest{Token: s1.Value[:]})
+	if err != nil {
+		t.Fatalf("Failed to refresh: %+v", err)
 	}
+	expected := clock.now().Add(time.Hour)
+	if resp.GetExpiresAt() != expected.UnixNano() {
+		t.Errorf("Unexpected expiry.\nexpected: %s\nreceived: %s",
+			expected, time.Unix(0, resp.GetExpiresAt()))
+	}
+
+	_, err = h.getSession(Token(s1.Value))
+	if !errors.Is(err, InvalidTokenErr) {
+		t.Errorf("Unexpected error for refreshed token."+
+			"\nexpected: %v\nreceived: %+v", InvalidTokenErr, err)
+	}
+	refreshed, err := h.getSession(UnmarshalToken(resp.GetToken()))
+	if err != nil {
+		t.Fatalf("Failed to get refreshed session: %+v", err)
+	}
+	if refreshed.Store != s2.Store {
+		t.Errorf("Refreshed session does not share the user's store.")
+	}
+
+	expectedTokens := []Token{UnmarshalToken(resp.GetToken()), Token(s2.Value)}
+	if !reflect.DeepEqual(expectedTokens, h.userTokens["waldo"]) {
+		t.Errorf("Unexpected user tokens.\nexpected: %v\nreceived: %v",
+			expectedTokens, h.userTokens["waldo"])
+	}
+	if n := atomic.LoadInt32(&closed); n != 0 {
+		t.Errorf("Store closed on refresh.")
+	}
+}
+
+// Tests that handler.Refresh limits the expiry of the new token to the maximum
+// token lifetime after the user logged in, across refreshes.
+func Test_handler_Refresh_MaxTokenLifetime(t *testing.T) {
+	clock := newTestClock(netTime.Now())
+	var closed int32
+	h := newReaperTestHandler(time.Hour, clock, &closed)
+	h.maxTokenLifetime = 100 * time.Minute
+
+	s, err := h.addSession("waldo")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+	limit := s.GenTime.Add(h.maxTokenLifetime)
+
+	token := s.Value[:]
+	for i := 0; i < 2; i++ {
+		clock.add(30 * time.Minute)
+		resp, err := h.Refresh(&pb.RsLastWriteRequest{Token: token})
+		if err != nil {
+			t.Fatalf("Failed to refresh (%d): %+v", i, err)
+		}
+		token = resp.GetToken()
+		expected := clock.now().Add(time.Hour)
+		if expected.After(limit) {
+			expected = limit
+		}
+		if resp.GetExpiresAt() != expected.UnixNano() {
+			t.Errorf("Unexpected expiry (%d).\nexpected: %s\nreceived: %s",
+				i, expected, time.Unix(0, resp.GetExpiresAt()))
+		}
+	}
+}
+
+// Error path: Tests that handler.Refresh returns InvalidTokenErr for an
+// unknown token and an expired token and closes the store of the expired
+// session.
+func Test_handler_Refresh_InvalidTokenError(t *testing.T) {
+	clock := newTestClock(netTime.Now())
+	var closed int32
+	h := newReaperTestHandler(time.Hour, clock, &closed)
+
+	_, err := h.Refresh(&pb.RsLastWriteRequest{Token: []byte{1, 2, 3}})
+	if !errors.Is(err, InvalidTokenErr) {
+		t.Errorf("Unexpected error for unknown token."+
+			"\nexpected: %v\nreceived: %+v", InvalidTokenErr, err)
+	}
+
+	s, err := h.addSession("waldo")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+	clock.add(time.Hour)
+	_, err = h.Refresh(&pb.RsLastWriteRequest{Token: s.Value[:]})
+	if !errors.Is(err, InvalidTokenErr) {
+		t.Errorf("Unexpected error for expired token."+
+			"\nexpected: %v\nreceived: %+v", InvalidTokenErr, err)
+	}
+	if n := atomic.LoadInt32(&closed); n != 1 {
+		t.Errorf("Unexpected number of stores closed."+
+			"\nexpected: %d\nreceived: %d", 1, n)
+	}
+}
+
+// Tests that handler.Logout invalidates only the presented token and closes
+// the user's store after their last session is logged out.
+func Test_handler_Logout(t *testing.T) {
+	var closed int32
+	h := newReaperTestHandler(time.Hour, newTestClock(netTime.Now()), &closed)
+
+	s1, err := h.addSession("waldo")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+	s2, err := h.addSession("waldo")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+
+	_, err = h.Logout(&pb.RsLastWriteRequest{Token: s1.Value[:]})
+	if err != nil {
+		t.Fatalf("Failed to log out: %+v", err)
+	}
+	_, err = h.GetUsage(&pb.RsLastWriteRequest{Token: s1.Value[:]})
+	if !errors.Is(err, InvalidTokenErr) {
+		t.Errorf("Unexpected error for logged out token."+
+			"\nexpected: %v\nreceived: %+v", InvalidTokenErr, err)
+	}
+	_, err = h.GetUsage(&pb.RsLastWriteRequest{Token: s2.Value[:]})
+	if err != nil {
+		t.Errorf("Failed to use other session: %+v", err)
+	}
+	if n := atomic.LoadInt32(&closed); n != 0 {
+		t.Errorf("Store closed while a session remains.")
+	}
+
+	_, err = h.Logout(&pb.RsLastWriteRequest{Token: s2.Value[:]})
+	if err != nil {
+		t.Fatalf("Failed to log out: %+v", err)
+	}
+	if n := atomic.LoadInt32(&closed); n != 1 {
+		t.Errorf("Unexpected number of stores closed."+
+			"\nexpected: %d\nreceived: %d", 1, n)
+	}
+	if len(h.sessions) != 0 || len(h.userTokens) != 0 {
+		t.Errorf("Sessions not removed.\nsessions:   %v\nuserTokens: %v",
+			h.sessions, h.userTokens)
+	}
+}
+
+// Error path: Tests that handler.Logout returns InvalidTokenErr for a token
+// that is not found.
+func Test_handler_Logout_InvalidTokenError(t *testing.T) {
+	var closed int32
+	h := newReaperTestHandler(time.Hour, newTestClock(netTime.Now()), &closed)
+
+	_, err := h.Logout(&pb.RsLastWriteRequest{Token: []byte{1, 2, 3}})
+	if !errors.Is(err, InvalidTokenErr) {
+		t.Errorf("Unexpected error for invalid token."+
+			"\nexpected: %v\nreceived: %+v", InvalidTokenErr, err)
+	}
+}
+
+// Tests that after handler.shutdown all user stores are closed and all new
+// requests return ShuttingDownErr.
+func Test_handler_shutdown(t *testing.T) {
+	prng := rand.New(rand.NewSource(3568))
+	var closed int32
+	h := newReaperTestHandler(time.Hour, newTestClock(netTime.Now()), &closed)
+	h.authenticator = csvAuthenticator{"waldo": "pass"}
+
+	s, err := h.addSession("waldo")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+	if _, err = h.addSession("carmen"); err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+	h.startSessionReaper(time.Hour)
+
+	if err = h.shutdown(context.Background()); err != nil {
+		t.Fatalf("Failed to shutdown: %+v", err)
+	}
+
+	if closed != 2 {
+		t.Errorf("Unexpected number of stores closed."+
+			"\nexpected: %d\nreceived: %d", 2, closed)
+	}
+	if h.reaper != nil {
+		t.Errorf("Session reaper not stopped.")
+	}
+
+	_, err = h.Write(&pb.RsWriteRequest{Token: s.Value[:]})
+	if !errors.Is(err, ShuttingDownErr) {
+		t.Errorf("Unexpected error for write after shutdown."+
+			"\nexpected: %v\nreceived: %+v", ShuttingDownErr, err)
+	}
+
+	salt := make([]byte, 32)
+	prng.Read(salt)
+	_, err = h.Login(&pb.RsAuthenticationRequest{
+		Username:     "waldo",
+		PasswordHash: hashPassword("pass", salt),
+		Salt:         salt,
+	})
+	if !errors.Is(err, ShuttingDownErr) {
+		t.Errorf("Unexpected error for login after shutdown."+
+			"\nexpected: %v\nreceived: %+v", ShuttingDownErr, err)
+	}
+}
+
+// Error path: Tests that handler.shutdown returns an error when the context is
+// done before the user stores have closed.
+func Test_handler_shutdown_TimeoutError(t *testing.T) {
+	h := &handler{
+		tokenTTL:      time.Hour,
+		sessions:      make(map[Token]*userSession),
+		userTokens:    make(map[string][]Token),
+		stores:        make(map[string]*userStore),
+		closingStores: make(map[string]*userStore),
+		newStore: func(storageDir, baseDir string) (store.Store, error) {
+			s, err := store.NewMemStore(storageDir, baseDir)
+			return &blockingCloserStore{s, make(chan struct{})}, err
+		},
+		now: netTime.Now,
+	}
+	s, err := h.addSession("waldo")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+	defer close(s.Store.(*blockingCloserStore).unblock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = h.shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Unexpected error for timed out shutdown."+
+			"\nexpected: %v\nreceived: %+v", context.DeadlineExceeded, err)
+	}
+}
+
+// blockingCloserStore is a store.Store whose Close blocks until unblock is
+// closed.
+type blockingCloserStore struct {
+	store.Store
+	unblock chan struct{}
+}
+
+func (bcs *blockingCloserStore) Close() error {
+	<-bcs.unblock
+	return nil
 }
 
 func newHandlerLogin(ttl time.Duration, username, password string,
@@ -659,7 +1471,7 @@ func newHandlerStoreLogin(ttl time.Duration, username, password string,
 	}
 
 	h, err := newHandler(
-		testDir, ttl, [][]string{{username, password}}, newStore)
+		testDir, ttl, [][]string{{username, password}}, nil, newStore, nil)
 	if err != nil {
 		closeFn()
 		t.Fatalf("Failed to make new handler: %+v", err)
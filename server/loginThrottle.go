@@ -0,0 +1,207 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+// LoginLockedErr is returned when a login is rejected without checking the
+// credentials because of too many recent failed logins for the username.
+var LoginLockedErr = errors.New(
+	"too many failed login attempts, try again later")
+
+const (
+	// DefaultMaxLoginFailures is the number of consecutive failed logins
+	// allowed before a lockout used when none is configured.
+	DefaultMaxLoginFailures = 5
+
+	// DefaultLoginLockout is the duration of the first lockout used when none
+	// is configured.
+	DefaultLoginLockout = time.Minute
+
+	// DefaultMaxLoginLockout is the maximum duration of a lockout used when
+	// none is configured.
+	DefaultMaxLoginLockout = time.Hour
+)
+
+// LoginThrottleParams configures the protection of logins against password
+// guessing. Failed logins are counted for each username only.
+//
+// Failures are not counted per source address because the server never sees
+// it. The comms remoteSync endpoints drop the gRPC context, which holds the
+// peer, before calling the Handler, and the gRPC server is created by comms
+// without a way to add an interceptor. Per-address tracking needs comms to
+// pass the peer address to the Handler.
+type LoginThrottleParams struct {
+	// MaxFailures is the number of consecutive failed logins for a username
+	// after which it is locked out. Defaults to DefaultMaxLoginFailures if 0.
+	// A negative value disables throttling.
+	MaxFailures int
+
+	// Lockout is the duration of the first lockout. Each subsequent lockout
+	// of the same username is twice as long as the last. Defaults to
+	// DefaultLoginLockout if not set.
+	Lockout time.Duration
+
+	// MaxLockout is the maximum duration of a lockout. Failures and previous
+	// lockouts are forgotten once this long has passed since the last failure
+	// and the end of the last lockout. Defaults to DefaultMaxLoginLockout if
+	// not set.
+	MaxLockout time.Duration
+}
+
+// loginThrottle tracks failed logins and locks out usernames with too many
+// consecutive failures.
+type loginThrottle struct {
+	params   LoginThrottleParams
+	attempts map[string]*loginAttempts // Map of username to its attempts
+	mux      sync.Mutex
+}
+
+// loginAttempts is the failed login state of one username.
+type loginAttempts struct {
+	failures    int       // Consecutive failures since the last lockout
+	pending     int       // Logins started but not yet ended
+	lockouts    int       // Number of lockouts, which determines their length
+	lockedUntil time.Time // Time when the current lockout ends
+	lastFailure time.Time // Time of the most recent failure
+}
+
+// newLoginThrottle returns a loginThrottle with the parameters, applying the
+// defaults to unset values. Returns nil if throttling is disabled.
+func newLoginThrottle(params LoginThrottleParams) *loginThrottle {
+	if params.MaxFailures < 0 {
+		return nil
+	} else if params.MaxFailures == 0 {
+		params.MaxFailures = DefaultMaxLoginFailures
+	}
+	if params.Lockout <= 0 {
+		params.Lockout = DefaultLoginLockout
+	}
+	if params.MaxLockout <= 0 {
+		params.MaxLockout = DefaultMaxLoginLockout
+	}
+	if params.MaxLockout < params.Lockout {
+		params.MaxLockout = params.Lockout
+	}
+
+	return &loginThrottle{
+		params:   params,
+		attempts: make(map[string]*loginAttempts),
+	}
+}
+
+// attempt starts a login for the username at the given time. Each started
+// login must be ended with one call to fail, succeed, or abandon once its
+// credentials are checked.
+//
+// Returns [LoginLockedErr] if the username is locked out or if its failures
+// and the logins already started would reach the maximum number of failures.
+// Counting started logins under the same lock as the check prevents concurrent
+// logins from exceeding the maximum before any of them fail.
+func (lt *loginThrottle) attempt(username string, now time.Time) error {
+	lt.mux.Lock()
+	defer lt.mux.Unlock()
+
+	a, exists := lt.attempts[username]
+	if !exists || (a.pending == 0 && lt.forgotten(a, now)) {
+		a = &loginAttempts{}
+		lt.attempts[username] = a
+	}
+
+	if now.Before(a.lockedUntil) {
+		return errors.Wrapf(LoginLockedErr, "retry after %s",
+			a.lockedUntil.Format(time.RFC3339))
+	} else if a.failures+a.pending >= lt.params.MaxFailures {
+		return errors.Wrap(LoginLockedErr, "too many logins in progress")
+	}
+	a.pending++
+	return nil
+}
+
+// fail ends a login started with attempt as a failure. If the username reaches
+// the maximum number of failures, it is locked out for twice as long as its
+// previous lockout, up to the maximum lockout.
+func (lt *loginThrottle) fail(username string, now time.Time) {
+	lt.mux.Lock()
+	defer lt.mux.Unlock()
+
+	// The attempts are removed if another login succeeded in the meantime
+	a, exists := lt.attempts[username]
+	if !exists {
+		a = &loginAttempts{}
+		lt.attempts[username] = a
+	} else if a.pending > 0 {
+		a.pending--
+	}
+	a.lastFailure = now
+	a.failures++
+	if a.failures < lt.params.MaxFailures {
+		return
+	}
+
+	lockout := lt.params.Lockout
+	for i := 0; i < a.lockouts && lockout < lt.params.MaxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > lt.params.MaxLockout {
+		lockout = lt.params.MaxLockout
+	}
+	a.lockouts++
+	a.failures = 0
+	a.lockedUntil = now.Add(lockout)
+	jww.WARN.Printf("Locked out user %s for %s after %d failed logins "+
+		"(lockout %d).", username, lockout, lt.params.MaxFailures, a.lockouts)
+}
+
+// succeed ends a login started with attempt as a success and clears the failed
+// logins of the username.
+func (lt *loginThrottle) succeed(username string) {
+	lt.mux.Lock()
+	defer lt.mux.Unlock()
+	delete(lt.attempts, username)
+}
+
+// abandon ends a login started with attempt whose credentials could not be
+// checked, such as when the authentication backend is unreachable, without
+// counting it as a failure.
+func (lt *loginThrottle) abandon(username string) {
+	lt.mux.Lock()
+	defer lt.mux.Unlock()
+	if a, exists := lt.attempts[username]; exists && a.pending > 0 {
+		a.pending--
+	}
+}
+
+// prune removes the state of usernames whose failures and lockouts have been
+// forgotten at the given time and that have no logins in progress.
+func (lt *loginThrottle) prune(now time.Time) {
+	lt.mux.Lock()
+	defer lt.mux.Unlock()
+
+	for username, a := range lt.attempts {
+		if a.pending == 0 && lt.forgotten(a, now) {
+			delete(lt.attempts, username)
+		}
+	}
+}
+
+// forgotten returns true if the failures and lockouts are old enough at the
+// given time to be forgotten.
+func (lt *loginThrottle) forgotten(a *loginAttempts, now time.Time) bool {
+	last := a.lastFailure
+	if a.lockedUntil.After(last) {
+		last = a.lockedUntil
+	}
+	return now.Sub(last) >= lt.params.MaxLockout
+}
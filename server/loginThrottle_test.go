@@ -0,0 +1,186 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package server
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"gitlab.com/elixxir/remoteSyncServer/store"
+	"gitlab.com/xx_network/primitives/netTime"
+)
+
+// Tests that newLoginThrottle applies the defaults to unset parameters and
+// returns nil when throttling is disabled.
+func Test_newLoginThrottle(t *testing.T) {
+	expected := LoginThrottleParams{
+		MaxFailures: DefaultMaxLoginFailures,
+		Lockout:     DefaultLoginLockout,
+		MaxLockout:  DefaultMaxLoginLockout,
+	}
+	lt := newLoginThrottle(LoginThrottleParams{})
+	if lt.params != expected {
+		t.Errorf("Unexpected params.\nexpected: %+v\nreceived: %+v",
+			expected, lt.params)
+	}
+
+	if lt = newLoginThrottle(LoginThrottleParams{MaxFailures: -1}); lt != nil {
+		t.Errorf("Throttle not disabled: %+v", lt)
+	}
+}
+
+// Tests that loginThrottle locks out a username after the maximum number of
+// failures, doubles each following lockout up to the maximum, and forgets the
+// failures after the maximum lockout has passed.
+func Test_loginThrottle_fail(t *testing.T) {
+	lt := newLoginThrottle(LoginThrottleParams{
+		MaxFailures: 3, Lockout: time.Minute, MaxLockout: 3 * time.Minute})
+	now := netTime.Now()
+
+	for i, lockout := range []time.Duration{
+		time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		for j := 0; j < 3; j++ {
+			if err := lt.attempt("waldo", now); err != nil {
+				t.Fatalf("Locked out after %d failures (%d): %+v", j, i, err)
+			}
+			lt.fail("waldo", now)
+		}
+
+		err := lt.attempt("waldo", now.Add(lockout-time.Nanosecond))
+		if !errors.Is(err, LoginLockedErr) {
+			t.Errorf("Unexpected error before end of lockout %d."+
+				"\nexpected: %v\nreceived: %+v", i, LoginLockedErr, err)
+		}
+		now = now.Add(lockout)
+		if err = lt.attempt("waldo", now); err != nil {
+			t.Errorf("Locked out after end of lockout %d: %+v", i, err)
+		}
+		lt.abandon("waldo")
+	}
+
+	// After the maximum lockout, the next lockout is back to the first length
+	now = now.Add(3 * time.Minute)
+	for j := 0; j < 3; j++ {
+		if err := lt.attempt("waldo", now); err != nil {
+			t.Fatalf("Locked out after %d failures: %+v", j, err)
+		}
+		lt.fail("waldo", now)
+	}
+	if err := lt.attempt("waldo", now.Add(time.Minute)); err != nil {
+		t.Errorf("Previous lockouts not forgotten: %+v", err)
+	}
+}
+
+// Error path: Tests that loginThrottle.attempt counts logins in progress
+// towards the maximum number of failures, so that concurrent logins cannot
+// make more guesses than the maximum, and that succeed and abandon end them.
+func Test_loginThrottle_attempt_InProgressError(t *testing.T) {
+	lt := newLoginThrottle(LoginThrottleParams{MaxFailures: 3})
+	now := netTime.Now()
+
+	lt.fail("waldo", now)
+	for i := 0; i < 2; i++ {
+		if err := lt.attempt("waldo", now); err != nil {
+			t.Fatalf("Failed to start login %d: %+v", i, err)
+		}
+	}
+	err := lt.attempt("waldo", now)
+	if !errors.Is(err, LoginLockedErr) {
+		t.Errorf("Unexpected error for login over the maximum in progress."+
+			"\nexpected: %v\nreceived: %+v", LoginLockedErr, err)
+	}
+
+	lt.abandon("waldo")
+	if err = lt.attempt("waldo", now); err != nil {
+		t.Errorf("Failed to start login after one was abandoned: %+v", err)
+	}
+
+	lt.succeed("waldo")
+	for i := 0; i < 3; i++ {
+		if err = lt.attempt("waldo", now); err != nil {
+			t.Errorf("Failed to start login %d after success: %+v", i, err)
+		}
+	}
+}
+
+// Tests that loginThrottle.prune removes only the forgotten failures of
+// usernames without logins in progress.
+func Test_loginThrottle_prune(t *testing.T) {
+	lt := newLoginThrottle(LoginThrottleParams{
+		MaxFailures: 1, Lockout: time.Hour, MaxLockout: time.Hour})
+	now := netTime.Now()
+
+	lt.fail("waldo", now)
+	lt.fail("carmen", now.Add(time.Hour))
+	if err := lt.attempt("sandiego", now); err != nil {
+		t.Fatalf("Failed to start login: %+v", err)
+	}
+
+	lt.prune(now.Add(90 * time.Minute))
+	if _, exists := lt.attempts["waldo"]; !exists {
+		t.Errorf("Removed failures of user still within the forget period.")
+	}
+
+	lt.prune(now.Add(2 * time.Hour))
+	if _, exists := lt.attempts["waldo"]; exists {
+		t.Errorf("Failed to remove forgotten failures.")
+	}
+	if _, exists := lt.attempts["carmen"]; !exists {
+		t.Errorf("Removed failures of locked out user.")
+	}
+	if _, exists := lt.attempts["sandiego"]; !exists {
+		t.Errorf("Removed user with login in progress.")
+	}
+}
+
+// Error path: Tests that handler.Login returns LoginLockedErr, even for the
+// correct password, once the maximum number of failed logins is reached and
+// accepts the password after the lockout ends.
+func Test_handler_Login_LoginLockedError(t *testing.T) {
+	prng := rand.New(rand.NewSource(6123))
+	salt := make([]byte, 32)
+	prng.Read(salt)
+
+	h, err := newHandler("tmp", time.Hour, [][]string{{"waldo", "hunter2"}},
+		nil, store.NewMemStore, nil)
+	if err != nil {
+		t.Fatalf("Failed to make new handler: %+v", err)
+	}
+	clock := newTestClock(netTime.Now())
+	h.now = clock.now
+	h.loginThrottle = newLoginThrottle(
+		LoginThrottleParams{MaxFailures: 2, Lockout: time.Minute})
+
+	msg := &pb.RsAuthenticationRequest{
+		Username:     "waldo",
+		PasswordHash: hashPassword("hunter3", salt),
+		Salt:         salt,
+	}
+	for i := 0; i < 2; i++ {
+		_, err = h.Login(msg)
+		if !errors.Is(err, InvalidCredentialsErr) {
+			t.Errorf("Unexpected error for failure %d."+
+				"\nexpected: %v\nreceived: %+v", i, InvalidCredentialsErr, err)
+		}
+	}
+
+	msg.PasswordHash = hashPassword("hunter2", salt)
+	_, err = h.Login(msg)
+	if !errors.Is(err, LoginLockedErr) {
+		t.Errorf("Unexpected error for locked out user."+
+			"\nexpected: %v\nreceived: %+v", LoginLockedErr, err)
+	}
+
+	clock.add(time.Minute)
+	if _, err = h.Login(msg); err != nil {
+		t.Errorf("Failed to log in after lockout: %+v", err)
+	}
+}
@@ -0,0 +1,118 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+// hashedPasswordPrefixes are the prefixes of common password hashes, such as
+// those produced by the htpasswd tool, which the server cannot verify.
+var hashedPasswordPrefixes = []string{"$2a$", "$2b$", "$2y$", "$apr1$",
+	"$1$", "$5$", "$6$", "{SHA}"}
+
+// PasswordFileAuthenticator authenticates users against a password file.
+//
+// Each line of the file is a username and password separated by a colon.
+// Blank lines and lines starting with # are ignored. Like in the credentials
+// CSV, the password is the cleartext password. The file is not compatible with
+// htpasswd files; password hashes, such as those generated by the htpasswd
+// tool, are rejected. The file is read when the authenticator is created and
+// again each time Reload is called.
+type PasswordFileAuthenticator struct {
+	path  string
+	users csvAuthenticator
+	mux   sync.RWMutex
+}
+
+// NewPasswordFileAuthenticator returns an PasswordFileAuthenticator for the users in
+// the file at the path. Returns an error if the file cannot be read or is
+// invalid.
+func NewPasswordFileAuthenticator(path string) (*PasswordFileAuthenticator, error) {
+	a := &PasswordFileAuthenticator{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Authenticate returns InvalidCredentialsErr if the user is not in the file or
+// the password hash does not match their password.
+func (a *PasswordFileAuthenticator) Authenticate(
+	username string, passwordHash, salt []byte) error {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+	return a.users.Authenticate(username, passwordHash, salt)
+}
+
+// HasUser returns true if the user is in the file.
+func (a *PasswordFileAuthenticator) HasUser(username string) (bool, error) {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+	return a.users.HasUser(username)
+}
+
+// Reload rereads the users from the file. If the file cannot be read or is
+// invalid, an error is returned and the existing users are kept.
+func (a *PasswordFileAuthenticator) Reload() error {
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read password file %s", a.path)
+	}
+	records, err := parsePasswordFile(data)
+	if err != nil {
+		return errors.Wrapf(err, "invalid password file %s", a.path)
+	}
+	users, err := newCSVAuthenticator(records)
+	if err != nil {
+		return errors.Wrapf(err, "invalid password file %s", a.path)
+	}
+
+	a.mux.Lock()
+	a.users = users
+	a.mux.Unlock()
+
+	jww.INFO.Printf("Loaded %d users from password file %s.", len(users), a.path)
+	return nil
+}
+
+// parsePasswordFile parses the lines of a password file into username/password
+// records in the same format as the credentials CSV.
+func parsePasswordFile(data []byte) ([][]string, error) {
+	var records [][]string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		username, password, found := strings.Cut(text, ":")
+		if !found || username == "" {
+			return nil, errors.Errorf("line %d is not in the format "+
+				"username:password", line)
+		}
+		for _, prefix := range hashedPasswordPrefixes {
+			if strings.HasPrefix(password, prefix) {
+				return nil, errors.Errorf("unsupported password hash %q for "+
+					"user %q on line %d; only cleartext passwords are "+
+					"supported", prefix, username, line)
+			}
+		}
+		records = append(records, []string{username, password})
+	}
+
+	return records, errors.Wrap(scanner.Err(), "failed to read lines")
+}
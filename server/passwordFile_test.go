@@ -0,0 +1,131 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package server
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Tests that PasswordFileAuthenticator.Authenticate accepts the password hashes of
+// the users in the file and rejects an invalid password hash and an unknown
+// user.
+func TestPasswordFileAuthenticator_Authenticate(t *testing.T) {
+	prng := rand.New(rand.NewSource(4527))
+	salt := make([]byte, 32)
+	prng.Read(salt)
+
+	path := writeTestPasswordFile(
+		"# Users\nwaldo:hunter2\n\ncarmen:hunter3\n", t)
+	a, err := NewPasswordFileAuthenticator(path)
+	if err != nil {
+		t.Fatalf("Failed to make authenticator: %+v", err)
+	}
+
+	checkAuthenticator(a, salt, t)
+}
+
+// Tests that PasswordFileAuthenticator.Reload replaces the users with those in the
+// modified file.
+func TestPasswordFileAuthenticator_Reload(t *testing.T) {
+	path := writeTestPasswordFile("waldo:hunter2\n", t)
+	a, err := NewPasswordFileAuthenticator(path)
+	if err != nil {
+		t.Fatalf("Failed to make authenticator: %+v", err)
+	}
+
+	if err = os.WriteFile(path, []byte("carmen:hunter3\n"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %+v", err)
+	}
+	if err = a.Reload(); err != nil {
+		t.Fatalf("Failed to reload: %+v", err)
+	}
+
+	for username, expected := range map[string]bool{
+		"waldo": false, "carmen": true} {
+		if exists, _ := a.HasUser(username); exists != expected {
+			t.Errorf("Unexpected existence of user %s after reload."+
+				"\nexpected: %t\nreceived: %t", username, expected, exists)
+		}
+	}
+}
+
+// Error path: Tests that PasswordFileAuthenticator.Reload returns an error for an
+// invalid file and keeps the existing users.
+func TestPasswordFileAuthenticator_Reload_InvalidFileError(t *testing.T) {
+	path := writeTestPasswordFile("waldo:hunter2\n", t)
+	a, err := NewPasswordFileAuthenticator(path)
+	if err != nil {
+		t.Fatalf("Failed to make authenticator: %+v", err)
+	}
+
+	if err = os.WriteFile(path, []byte("carmen\n"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %+v", err)
+	}
+	if err = a.Reload(); err == nil {
+		t.Errorf("Failed to error for invalid file.")
+	}
+
+	if exists, _ := a.HasUser("waldo"); !exists {
+		t.Errorf("Existing users replaced after failed reload.")
+	}
+}
+
+// Error path: Tests that NewPasswordFileAuthenticator returns an error for a file
+// that does not exist.
+func TestNewPasswordFileAuthenticator_MissingFileError(t *testing.T) {
+	_, err := NewPasswordFileAuthenticator(filepath.Join(t.TempDir(), "missing"))
+	if err == nil {
+		t.Errorf("Failed to error for missing file.")
+	}
+}
+
+// Tests that parsePasswordFile skips comments and blank lines and splits each
+// line on the first colon.
+func Test_parsePasswordFile(t *testing.T) {
+	data := "# comment\n\n  waldo:hunter2  \ncarmen:a:b\r\nsandiego:\n"
+	expected := [][]string{
+		{"waldo", "hunter2"}, {"carmen", "a:b"}, {"sandiego", ""}}
+
+	records, err := parsePasswordFile([]byte(data))
+	if err != nil {
+		t.Fatalf("Failed to parse: %+v", err)
+	} else if !reflect.DeepEqual(expected, records) {
+		t.Errorf("Unexpected records.\nexpected: %q\nreceived: %q",
+			expected, records)
+	}
+}
+
+// Error path: Tests that parsePasswordFile returns an error for malformed lines
+// and password hashes, such as those generated by the htpasswd tool.
+func Test_parsePasswordFile_InvalidLineError(t *testing.T) {
+	for _, data := range []string{
+		"waldo\n",
+		":hunter2\n",
+		"waldo:$2y$05$c4WoMPo3SXsafkva.HHa6uXQZWr7oboPiC2bT/r7q1BB8I2s0BRqC\n",
+		"waldo:$apr1$7fs0y6qk$Lg/3p1bNnBnnqRyWSKNTl.\n",
+		"waldo:{SHA}8Ko9dlLiz3F1r0IIBeNp91xG7ew=\n",
+	} {
+		if _, err := parsePasswordFile([]byte(data)); err == nil {
+			t.Errorf("Failed to error for line %q.", data)
+		}
+	}
+}
+
+// writeTestPasswordFile writes the data to a password file in a temporary
+// directory and returns its path.
+func writeTestPasswordFile(data string, t testing.TB) string {
+	path := filepath.Join(t.TempDir(), "passwords")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("Failed to write file: %+v", err)
+	}
+	return path
+}
@@ -0,0 +1,96 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package server
+
+import (
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"gitlab.com/elixxir/remoteSyncServer/store"
+)
+
+// Indexes of the optional quota fields in a credentials CSV record.
+const (
+	quotaBytesField = 2
+	quotaFilesField = 3
+)
+
+// quotaOverride is a user's quota from the credentials CSV. A nil limit uses
+// the limit of the default quota.
+type quotaOverride struct {
+	maxBytes *int64
+	maxFiles *int64
+}
+
+// apply returns the default quota with the overridden limits replaced.
+func (qo quotaOverride) apply(defaultQuota store.Quota) store.Quota {
+	if qo.maxBytes != nil {
+		defaultQuota.MaxBytes = *qo.maxBytes
+	}
+	if qo.maxFiles != nil {
+		defaultQuota.MaxFiles = *qo.maxFiles
+	}
+	return defaultQuota
+}
+
+// userRecordsToQuotas converts the optional quota fields of the records from
+// a CSV to a map of quota overrides keyed on each username. The third field of
+// a record is the maximum number of bytes and the fourth is the maximum number
+// of files. A missing or empty field uses the default quota; a limit of zero
+// is unlimited. Only users with at least one limit are added to the map.
+func userRecordsToQuotas(records [][]string) (map[string]quotaOverride, error) {
+	quotas := make(map[string]quotaOverride)
+	for i, line := range records {
+		if len(line) < 2 {
+			return nil, errors.Errorf("could not process record %d of %d",
+				i, len(records))
+		}
+
+		var qo quotaOverride
+		var err error
+		qo.maxBytes, err = parseQuotaField(line, quotaBytesField)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid byte quota for user %q in "+
+				"record %d of %d", line[0], i, len(records))
+		}
+		qo.maxFiles, err = parseQuotaField(line, quotaFilesField)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid file quota for user %q in "+
+				"record %d of %d", line[0], i, len(records))
+		}
+
+		if qo.maxBytes != nil || qo.maxFiles != nil {
+			quotas[line[0]] = qo
+		}
+	}
+
+	return quotas, nil
+}
+
+// parseQuotaField parses the quota limit at the index of the record. Returns
+// nil if the field is missing or empty.
+func parseQuotaField(line []string, i int) (*int64, error) {
+	if len(line) <= i || line[i] == "" {
+		return nil, nil
+	}
+
+	limit, err := strconv.ParseInt(line[i], 10, 64)
+	if err != nil {
+		return nil, err
+	} else if limit < 0 {
+		return nil, errors.Errorf("limit %d is negative", limit)
+	}
+
+	return &limit, nil
+}
+
+// userQuota returns the quota for the user. Must be called with h.mux held.
+func (h *handler) userQuota(username string) store.Quota {
+	return h.userQuotas[username].apply(h.defaultQuota)
+}
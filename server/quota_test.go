@@ -0,0 +1,65 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package server
+
+import (
+	"testing"
+
+	"gitlab.com/elixxir/remoteSyncServer/store"
+)
+
+// Tests that userRecordsToQuotas only returns overrides for users with quota
+// fields and that quotaOverride.apply replaces only the overridden limits.
+func Test_userRecordsToQuotas(t *testing.T) {
+	records := [][]string{
+		{"waldo", "pass"},
+		{"carmen", "pass", "500"},
+		{"bob", "pass", "", "20"},
+		{"alice", "pass", "0", "0"},
+		{"eve", "pass", "", ""},
+	}
+	defaultQuota := store.Quota{MaxBytes: 1000, MaxFiles: 10}
+	expected := map[string]store.Quota{
+		"waldo":  {MaxBytes: 1000, MaxFiles: 10},
+		"carmen": {MaxBytes: 500, MaxFiles: 10},
+		"bob":    {MaxBytes: 1000, MaxFiles: 20},
+		"alice":  {MaxBytes: 0, MaxFiles: 0},
+		"eve":    {MaxBytes: 1000, MaxFiles: 10},
+	}
+
+	quotas, err := userRecordsToQuotas(records)
+	if err != nil {
+		t.Fatalf("Failed to convert records: %+v", err)
+	}
+
+	if len(quotas) != 3 {
+		t.Errorf("Unexpected number of overrides.\nexpected: %d\nreceived: %d",
+			3, len(quotas))
+	}
+
+	for username, quota := range expected {
+		if q := quotas[username].apply(defaultQuota); q != quota {
+			t.Errorf("Unexpected quota for user %s."+
+				"\nexpected: %+v\nreceived: %+v", username, quota, q)
+		}
+	}
+}
+
+// Error path: Tests that userRecordsToQuotas returns an error for invalid quota
+// fields or records.
+func Test_userRecordsToQuotas_InvalidRecordError(t *testing.T) {
+	for i, records := range [][][]string{
+		{{"user", "pass"}, {"user2"}},
+		{{"user", "pass", "many"}},
+		{{"user", "pass", "", "-1"}},
+	} {
+		if _, err := userRecordsToQuotas(records); err == nil {
+			t.Errorf("Failed to error for invalid records %v (%d).", records, i)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RateLimitedErr is returned when a request is rejected because the user has
+// exceeded their rate limit. The client should back off and retry later.
+var RateLimitedErr = errors.New("rate limit exceeded, slow down")
+
+// RateLimit is the limit of a token bucket, which allows requests at an average
+// rate with bursts of up to a maximum size.
+type RateLimit struct {
+	// Rate is the number of operations, or bytes, allowed per second. A value
+	// of 0 means no limit; in a user's limits, it means the default limit is
+	// used. A negative value means no limit.
+	Rate float64
+
+	// Burst is the maximum number of operations, or bytes, allowed at once.
+	// Defaults to Rate, or 1 if Rate is less than 1, if not set.
+	Burst float64
+}
+
+// RateLimits are the rate limits of each class of operation.
+type RateLimits struct {
+	// Reads limits requests that read the user's files or metadata.
+	Reads RateLimit
+
+	// Writes limits requests that write or delete the user's files.
+	Writes RateLimit
+
+	// WriteBytes limits the number of bytes written.
+	WriteBytes RateLimit
+}
+
+// RateLimitParams configures the rate limits applied to each user. The limits
+// are shared by all sessions of the user, so that logging in again does not
+// reset them.
+type RateLimitParams struct {
+	// Default are the limits of all users without their own.
+	Default RateLimits
+
+	// Users are the limits of individual users keyed on their username. Each
+	// limit with a Rate of 0 uses the default limit.
+	Users map[string]RateLimits
+}
+
+// operation is the class of a request used to select its rate limit.
+type operation int
+
+const (
+	readOp operation = iota
+	writeOp
+
+	// noOp is not rate limited.
+	noOp
+)
+
+// apply returns the default limits with the limits overridden by the user's
+// limits replaced.
+func (rl RateLimits) apply(defaultLimits RateLimits) RateLimits {
+	if rl.Reads.Rate != 0 {
+		defaultLimits.Reads = rl.Reads
+	}
+	if rl.Writes.Rate != 0 {
+		defaultLimits.Writes = rl.Writes
+	}
+	if rl.WriteBytes.Rate != 0 {
+		defaultLimits.WriteBytes = rl.WriteBytes
+	}
+	return defaultLimits
+}
+
+// userRateLimits returns the rate limits of the user.
+func (p RateLimitParams) userRateLimits(username string) RateLimits {
+	return p.Users[username].apply(p.Default)
+}
+
+// userLimiter enforces the rate limits of a user.
+type userLimiter struct {
+	reads      *tokenBucket
+	writes     *tokenBucket
+	writeBytes *tokenBucket
+	mux        sync.Mutex
+}
+
+// newUserLimiter returns a userLimiter with full buckets at the given
+// time. Returns nil if none of the limits are set.
+func newUserLimiter(limits RateLimits, now time.Time) *userLimiter {
+	sl := &userLimiter{
+		reads:      newTokenBucket(limits.Reads, now),
+		writes:     newTokenBucket(limits.Writes, now),
+		writeBytes: newTokenBucket(limits.WriteBytes, now),
+	}
+	if sl.reads == nil && sl.writes == nil && sl.writeBytes == nil {
+		return nil
+	}
+	return sl
+}
+
+// allow takes the tokens for an operation of the class that writes the number
+// of bytes from the user's buckets at the given time. Returns
+// [RateLimitedErr] if any bucket has too few tokens, in which case none are
+// taken.
+func (sl *userLimiter) allow(op operation, bytes int, now time.Time) error {
+	sl.mux.Lock()
+	defer sl.mux.Unlock()
+
+	switch op {
+	case readOp:
+		if !sl.reads.take(1, now) {
+			return errors.Wrap(RateLimitedErr, "too many reads")
+		}
+	case writeOp:
+		// Check both buckets before taking from either so that a rejected
+		// write does not count against the other limit
+		if !sl.writes.has(1, now) {
+			return errors.Wrap(RateLimitedErr, "too many writes")
+		} else if !sl.writeBytes.has(float64(bytes), now) {
+			return errors.Wrap(RateLimitedErr, "too many bytes written")
+		}
+		sl.writes.take(1, now)
+		sl.writeBytes.take(float64(bytes), now)
+	}
+
+	return nil
+}
+
+// full returns true if all buckets are full at the given time, in which case
+// replacing the userLimiter with a new one does not reset any limits.
+func (sl *userLimiter) full(now time.Time) bool {
+	sl.mux.Lock()
+	defer sl.mux.Unlock()
+	for _, tb := range []*tokenBucket{sl.reads, sl.writes, sl.writeBytes} {
+		if tb != nil && !tb.has(tb.burst, now) {
+			return false
+		}
+	}
+	return true
+}
+
+// tokenBucket is a token bucket that refills at a constant rate. A nil
+// tokenBucket has no limit.
+type tokenBucket struct {
+	rate   float64   // Tokens added per second
+	burst  float64   // Maximum number of tokens
+	tokens float64   // Tokens available at the last update
+	last   time.Time // Time of the last update
+}
+
+// newTokenBucket returns a full tokenBucket for the limit at the given time.
+// Returns nil if the limit has no rate.
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = limit.Rate
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return &tokenBucket{
+		rate:   limit.Rate,
+		burst:  burst,
+		tokens: burst,
+		last:   now,
+	}
+}
+
+// refill adds the tokens accrued since the last update up to the burst.
+func (tb *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(tb.last); elapsed > 0 {
+		tb.tokens += elapsed.Seconds() * tb.rate
+		if tb.tokens > tb.burst {
+			tb.tokens = tb.burst
+		}
+		tb.last = now
+	}
+}
+
+// has returns true if n tokens can be taken at the given time. Taking more
+// tokens than the burst is allowed when the bucket is full, leaving it in debt
+// so that it takes longer to refill.
+func (tb *tokenBucket) has(n float64, now time.Time) bool {
+	if tb == nil {
+		return true
+	}
+	tb.refill(now)
+	if n > tb.burst {
+		n = tb.burst
+	}
+	return tb.tokens >= n
+}
+
+// take takes n tokens at the given time if it has them. Returns false if the
+// bucket has too few tokens.
+func (tb *tokenBucket) take(n float64, now time.Time) bool {
+	if tb == nil {
+		return true
+	} else if !tb.has(n, now) {
+		return false
+	}
+	tb.tokens -= n
+	return true
+}
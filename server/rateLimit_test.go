@@ -0,0 +1,288 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"gitlab.com/xx_network/primitives/netTime"
+)
+
+// Tests that RateLimitParams.userRateLimits replaces only the default limits
+// that the user overrides.
+func TestRateLimitParams_userRateLimits(t *testing.T) {
+	p := RateLimitParams{
+		Default: RateLimits{
+			Reads:      RateLimit{Rate: 10, Burst: 20},
+			Writes:     RateLimit{Rate: 5},
+			WriteBytes: RateLimit{Rate: 1000},
+		},
+		Users: map[string]RateLimits{
+			"waldo": {
+				Writes:     RateLimit{Rate: 50, Burst: 100},
+				WriteBytes: RateLimit{Rate: -1},
+			},
+		},
+	}
+
+	expected := RateLimits{
+		Reads:      RateLimit{Rate: 10, Burst: 20},
+		Writes:     RateLimit{Rate: 50, Burst: 100},
+		WriteBytes: RateLimit{Rate: -1},
+	}
+	if limits := p.userRateLimits("waldo"); limits != expected {
+		t.Errorf("Unexpected limits for user with overrides."+
+			"\nexpected: %+v\nreceived: %+v", expected, limits)
+	}
+	if limits := p.userRateLimits("carmen"); limits != p.Default {
+		t.Errorf("Unexpected limits for user without overrides."+
+			"\nexpected: %+v\nreceived: %+v", p.Default, limits)
+	}
+}
+
+// Tests that newUserLimiter returns nil when no limits are set.
+func Test_newUserLimiter_NoLimits(t *testing.T) {
+	limits := RateLimits{Reads: RateLimit{Rate: -1}}
+	if sl := newUserLimiter(limits, netTime.Now()); sl != nil {
+		t.Errorf("Limiter created without limits: %+v", sl)
+	}
+}
+
+// Tests that tokenBucket.take allows bursts up to the burst size, refills at
+// the rate, and allows a request larger than the burst from a full bucket,
+// leaving it in debt.
+func Test_tokenBucket_take(t *testing.T) {
+	now := netTime.Now()
+	tb := newTokenBucket(RateLimit{Rate: 2, Burst: 4}, now)
+
+	for i := 0; i < 4; i++ {
+		if !tb.take(1, now) {
+			t.Errorf("Token %d of burst not taken.", i)
+		}
+	}
+	if tb.take(1, now) {
+		t.Errorf("Token taken from empty bucket.")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if !tb.take(1, now) {
+		t.Errorf("Token not refilled after 1/rate seconds.")
+	}
+	if tb.take(1, now) {
+		t.Errorf("More tokens refilled than the rate.")
+	}
+
+	// Refill to the burst and take more than it
+	now = now.Add(time.Hour)
+	if !tb.take(10, now) {
+		t.Errorf("Request larger than burst not taken from full bucket.")
+	}
+	if tb.take(1, now.Add(3*time.Second)) {
+		t.Errorf("Token taken before debt was repaid.")
+	}
+	if !tb.take(1, now.Add(3500*time.Millisecond)) {
+		t.Errorf("Token not taken after debt was repaid.")
+	}
+}
+
+// Error path: Tests that userLimiter.allow returns RateLimitedErr when
+// either write limit is exceeded and takes no tokens from the other.
+func Test_userLimiter_allow_RateLimitedError(t *testing.T) {
+	now := netTime.Now()
+	sl := newUserLimiter(RateLimits{
+		Writes:     RateLimit{Rate: 1, Burst: 2},
+		WriteBytes: RateLimit{Rate: 100, Burst: 100},
+	}, now)
+
+	if err := sl.allow(writeOp, 60, now); err != nil {
+		t.Fatalf("Failed to allow write: %+v", err)
+	}
+	err := sl.allow(writeOp, 60, now)
+	if !errors.Is(err, RateLimitedErr) {
+		t.Errorf("Unexpected error for too many bytes."+
+			"\nexpected: %v\nreceived: %+v", RateLimitedErr, err)
+	}
+
+	// The rejected write must not have taken a write token
+	if err = sl.allow(writeOp, 40, now); err != nil {
+		t.Errorf("Failed to allow write: %+v", err)
+	}
+	err = sl.allow(writeOp, 0, now)
+	if !errors.Is(err, RateLimitedErr) {
+		t.Errorf("Unexpected error for too many writes."+
+			"\nexpected: %v\nreceived: %+v", RateLimitedErr, err)
+	}
+
+	if err = sl.allow(readOp, 0, now); err != nil {
+		t.Errorf("Read limited without a read limit: %+v", err)
+	}
+}
+
+// Tests that userLimiter.full returns true only once every bucket has refilled.
+func Test_userLimiter_full(t *testing.T) {
+	now := netTime.Now()
+	sl := newUserLimiter(RateLimits{
+		Reads:  RateLimit{Rate: 1, Burst: 2},
+		Writes: RateLimit{Rate: 1, Burst: 1},
+	}, now)
+
+	if !sl.full(now) {
+		t.Errorf("New limiter not full.")
+	}
+	if err := sl.allow(readOp, 0, now); err != nil {
+		t.Fatalf("Failed to allow read: %+v", err)
+	}
+	if sl.full(now.Add(500 * time.Millisecond)) {
+		t.Errorf("Limiter full before its buckets refilled.")
+	}
+	if !sl.full(now.Add(time.Second)) {
+		t.Errorf("Limiter not full after its buckets refilled.")
+	}
+}
+
+// Error path: Tests that the handler rejects requests of a user over their
+// rate limit with RateLimitedErr across all of their sessions, that neither
+// refreshing the token nor logging in again resets the limits, and that other
+// users are not affected.
+func Test_handler_RateLimitedError(t *testing.T) {
+	clock := newTestClock(netTime.Now())
+	var closed int32
+	h := newReaperTestHandler(time.Hour, clock, &closed)
+	h.rateLimits = RateLimitParams{
+		Default: RateLimits{Reads: RateLimit{Rate: 1, Burst: 2}},
+		Users: map[string]RateLimits{
+			"carmen": {Reads: RateLimit{Rate: -1}}},
+	}
+
+	s1, err := h.addSession("waldo")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+
+	msg := &pb.RsReadRequest{Token: s1.Value[:], Path: "file.txt"}
+	for i := 0; i < 2; i++ {
+		if _, err = h.GetLastModified(msg); errors.Is(err, RateLimitedErr) {
+			t.Errorf("Read %d rate limited: %+v", i, err)
+		}
+	}
+	_, err = h.GetLastModified(msg)
+	if !errors.Is(err, RateLimitedErr) {
+		t.Errorf("Unexpected error for read over limit."+
+			"\nexpected: %v\nreceived: %+v", RateLimitedErr, err)
+	}
+
+	// Refreshing must not reset the limits
+	resp, err := h.Refresh(&pb.RsLastWriteRequest{Token: s1.Value[:]})
+	if err != nil {
+		t.Fatalf("Failed to refresh: %+v", err)
+	}
+	msg.Token = resp.GetToken()
+	_, err = h.GetLastModified(msg)
+	if !errors.Is(err, RateLimitedErr) {
+		t.Errorf("Unexpected error for read over limit after refresh."+
+			"\nexpected: %v\nreceived: %+v", RateLimitedErr, err)
+	}
+
+	// Logging in again must not reset the limits
+	s2, err := h.addSession("waldo")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+	msg.Token = s2.Value[:]
+	_, err = h.GetLastModified(msg)
+	if !errors.Is(err, RateLimitedErr) {
+		t.Errorf("Unexpected error for read over limit in new session."+
+			"\nexpected: %v\nreceived: %+v", RateLimitedErr, err)
+	}
+
+	clock.add(time.Second)
+	msg.Token = resp.GetToken()
+	if _, err = h.GetLastModified(msg); errors.Is(err, RateLimitedErr) {
+		t.Errorf("Read rate limited after refill: %+v", err)
+	}
+
+	s3, err := h.addSession("carmen")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+	if _, exists := h.limiters["carmen"]; exists {
+		t.Errorf("Limiter created for user without limits.")
+	}
+	msg.Token = s3.Value[:]
+	for i := 0; i < 3; i++ {
+		if _, err = h.GetLastModified(msg); errors.Is(err, RateLimitedErr) {
+			t.Errorf("Read %d of other user rate limited: %+v", i, err)
+		}
+	}
+}
+
+// Tests that a request rejected by the rate limits does not extend the expiry
+// of the session with sliding expiry.
+func Test_handler_RateLimitedError_NoSlidingExpiry(t *testing.T) {
+	clock := newTestClock(netTime.Now())
+	var closed int32
+	h := newReaperTestHandler(time.Hour, clock, &closed)
+	h.slidingExpiry = true
+	h.rateLimits = RateLimitParams{
+		Default: RateLimits{Reads: RateLimit{Rate: 1, Burst: 1}}}
+
+	s, err := h.addSession("waldo")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+	msg := &pb.RsReadRequest{Token: s.Value[:], Path: "file.txt"}
+	if _, err = h.GetLastModified(msg); errors.Is(err, RateLimitedErr) {
+		t.Fatalf("Read rate limited: %+v", err)
+	}
+	expiry := s.ExpiryTime
+
+	clock.add(100 * time.Millisecond)
+	_, err = h.GetLastModified(msg)
+	if !errors.Is(err, RateLimitedErr) {
+		t.Fatalf("Unexpected error for read over limit."+
+			"\nexpected: %v\nreceived: %+v", RateLimitedErr, err)
+	}
+	if !s.ExpiryTime.Equal(expiry) {
+		t.Errorf("Expiry extended by rejected request."+
+			"\nexpected: %s\nreceived: %s", expiry, s.ExpiryTime)
+	}
+}
+
+// Tests that reapSessions removes the limiters of users without sessions only
+// once they have refilled.
+func Test_handler_reapSessions_Limiters(t *testing.T) {
+	clock := newTestClock(netTime.Now())
+	var closed int32
+	h := newReaperTestHandler(time.Minute, clock, &closed)
+	h.rateLimits = RateLimitParams{
+		Default: RateLimits{Reads: RateLimit{Rate: 0.01, Burst: 1}}}
+
+	s, err := h.addSession("waldo")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+	msg := &pb.RsReadRequest{Token: s.Value[:], Path: "file.txt"}
+	if _, err = h.GetLastModified(msg); errors.Is(err, RateLimitedErr) {
+		t.Fatalf("Read rate limited: %+v", err)
+	}
+
+	clock.add(time.Minute)
+	h.reapSessions()
+	if _, exists := h.limiters["waldo"]; !exists {
+		t.Errorf("Limiter removed before it refilled.")
+	}
+
+	clock.add(100 * time.Second)
+	h.reapSessions()
+	if _, exists := h.limiters["waldo"]; exists {
+		t.Errorf("Limiter of user without sessions not removed.")
+	}
+}
@@ -0,0 +1,129 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package server
+
+import (
+	jww "github.com/spf13/jwalterweatherman"
+
+	"gitlab.com/elixxir/remoteSyncServer/store"
+)
+
+// reloadCredentials reloads the users of the handler. If users are
+// authenticated against the credentials CSV, the user table is replaced with
+// the users in the records; otherwise, the authenticator is reloaded if it is a
+// Reloader. The quotas are always replaced with those in the records. The
+// sessions of users that no longer exist are invalidated and their stores
+// closed. The quotas of remaining users with open stores are updated. If
+// the records cannot be parsed or the authenticator fails to reload, an error
+// is returned and the existing users are kept. Returns the number of sessions
+// invalidated.
+func (h *handler) reloadCredentials(records [][]string) (int, error) {
+	userQuotas, err := userRecordsToQuotas(records)
+	if err != nil {
+		return 0, err
+	}
+
+	h.mux.Lock()
+	authenticator := h.authenticator
+	h.mux.Unlock()
+
+	if _, isCSV := authenticator.(csvAuthenticator); isCSV {
+		if authenticator, err = newCSVAuthenticator(records); err != nil {
+			return 0, err
+		}
+	} else if r, ok := authenticator.(Reloader); ok {
+		if err = r.Reload(); err != nil {
+			return 0, err
+		}
+	}
+
+	// Look up the users with sessions outside the lock since the
+	// authenticator may block on I/O
+	h.mux.Lock()
+	usernames := make(map[string]bool, len(h.sessions))
+	for _, s := range h.sessions {
+		usernames[s.username] = true
+	}
+	for _, p := range h.restored {
+		usernames[p.Username] = true
+	}
+	h.mux.Unlock()
+	for username := range usernames {
+		exists, err := authenticator.HasUser(username)
+		if err != nil {
+			jww.WARN.Printf("Failed to look up user %s; keeping their "+
+				"session: %+v", username, err)
+			exists = true
+		}
+		usernames[username] = exists
+	}
+
+	h.mux.Lock()
+	h.authenticator = authenticator
+	h.userQuotas = userQuotas
+
+	var removed []*userSession
+	var closing []*userStore
+	for token, s := range h.sessions {
+		if exists, checked := usernames[s.username]; checked && !exists {
+			if _, us := h.removeSession(token); us != nil {
+				closing = append(closing, us)
+			}
+			removed = append(removed, s)
+		}
+	}
+
+	// A reference is held to each remaining store so that it stays open while
+	// its quota is set outside the lock
+	type storeQuota struct {
+		us    *userStore
+		quota store.Quota
+	}
+	quotas := make([]storeQuota, 0, len(h.stores))
+	for username, us := range h.stores {
+		us.refs++
+		quotas = append(quotas, storeQuota{us, h.userQuota(username)})
+	}
+	var removedRestored int
+	for username, exists := range usernames {
+		if !exists {
+			removedRestored += h.removeRestored(username)
+		}
+	}
+	h.mux.Unlock()
+
+	jww.INFO.Printf("Reloaded credentials and quotas from %d records.",
+		len(records))
+
+	for _, s := range removed {
+		jww.INFO.Printf("Invalidated session for removed user %s.", s.username)
+	}
+
+	// Quotas are set outside the lock since stores may block on I/O
+	for _, sq := range quotas {
+		sq.us.SetQuota(sq.quota)
+	}
+	h.mux.Lock()
+	for _, sq := range quotas {
+		if us := h.releaseStore(sq.us.username); us != nil {
+			closing = append(closing, us)
+		}
+	}
+	h.mux.Unlock()
+
+	// Stores are closed outside the lock since closing may block on I/O
+	for _, us := range closing {
+		h.closeStore(us)
+	}
+
+	if len(removed)+removedRestored > 0 {
+		h.saveSessions()
+	}
+
+	return len(removed) + removedRestored, nil
+}
@@ -0,0 +1,169 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package server
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"gitlab.com/elixxir/remoteSyncServer/store"
+	"gitlab.com/xx_network/primitives/netTime"
+)
+
+// Tests that handler.reloadCredentials invalidates the sessions of removed
+// users, keeps the sessions of remaining users, updates their quotas, and
+// allows newly added users to log in.
+func Test_handler_reloadCredentials(t *testing.T) {
+	prng := rand.New(rand.NewSource(6342))
+	var closed int32
+	h := newReaperTestHandler(time.Hour, newTestClock(netTime.Now()), &closed)
+	h.authenticator = csvAuthenticator{
+		"waldo":  "hunter2",
+		"carmen": "hunter3",
+	}
+
+	removed, err := h.addSession("waldo")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+	kept, err := h.addSession("carmen")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+
+	n, err := h.reloadCredentials([][]string{
+		{"carmen", "hunter3", "", "1"},
+		{"sandiego", "hunter4"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to reload credentials: %+v", err)
+	} else if n != 1 {
+		t.Errorf("Unexpected number of sessions invalidated."+
+			"\nexpected: %d\nreceived: %d", 1, n)
+	}
+
+	_, err = h.getSession(Token(removed.Value))
+	if !errors.Is(err, InvalidTokenErr) {
+		t.Errorf("Unexpected error for session of removed user."+
+			"\nexpected: %v\nreceived: %+v", InvalidTokenErr, err)
+	} else if _, exists := h.userTokens["waldo"]; exists {
+		t.Errorf("Token of removed user not removed from userTokens.")
+	}
+	if atomic.LoadInt32(&closed) != 1 {
+		t.Errorf("Unexpected number of stores closed."+
+			"\nexpected: %d\nreceived: %d", 1, closed)
+	}
+
+	if _, err = h.getSession(Token(kept.Value)); err != nil {
+		t.Errorf("Failed to get session of remaining user: %+v", err)
+	}
+	if err = kept.Write("a", []byte("1")); err != nil {
+		t.Errorf("Failed to write first file: %+v", err)
+	}
+	err = kept.Write("b", []byte("2"))
+	if !errors.Is(err, store.QuotaExceededErr) {
+		t.Errorf("Reloaded quota not applied to remaining user."+
+			"\nexpected: %v\nreceived: %+v", store.QuotaExceededErr, err)
+	}
+
+	salt := make([]byte, 32)
+	prng.Read(salt)
+	for _, u := range []struct {
+		username, password string
+		err                error
+	}{
+		{"waldo", "hunter2", InvalidCredentialsErr},
+		{"sandiego", "hunter4", nil},
+	} {
+		_, err = h.Login(&pb.RsAuthenticationRequest{
+			Username:     u.username,
+			PasswordHash: hashPassword(u.password, salt),
+			Salt:         salt,
+		})
+		if !errors.Is(err, u.err) {
+			t.Errorf("Unexpected error logging in as %s after reload."+
+				"\nexpected: %v\nreceived: %+v", u.username, u.err, err)
+		}
+	}
+}
+
+// Error path: Tests that handler.reloadCredentials returns an error for
+// invalid records and keeps the existing users and sessions.
+func Test_handler_reloadCredentials_InvalidRecordsError(t *testing.T) {
+	var closed int32
+	h := newReaperTestHandler(time.Hour, newTestClock(netTime.Now()), &closed)
+	h.authenticator = csvAuthenticator{"waldo": "pass"}
+
+	s, err := h.addSession("waldo")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+
+	_, err = h.reloadCredentials([][]string{{"carmen"}})
+	if err == nil {
+		t.Errorf("Failed to get error for invalid records.")
+	}
+
+	if exists, _ := h.authenticator.HasUser("waldo"); !exists {
+		t.Errorf("Existing users replaced after failed reload.")
+	}
+	if _, err = h.getSession(Token(s.Value)); err != nil {
+		t.Errorf("Session invalidated after failed reload: %+v", err)
+	}
+}
+
+// Tests that handler.reloadCredentials sets the quotas of the stores without
+// holding the handler's lock, since a store may block on I/O.
+func Test_handler_reloadCredentials_SetQuotaUnlocked(t *testing.T) {
+	h := newReaperTestHandler(time.Hour, newTestClock(netTime.Now()), new(int32))
+	h.authenticator = csvAuthenticator{"waldo": "pass"}
+	var locked []bool
+	h.newStore = func(storageDir, baseDir string) (store.Store, error) {
+		s, err := store.NewMemStore(storageDir, baseDir)
+		return &quotaLockStore{s, &h.mux, &locked}, err
+	}
+
+	if _, err := h.addSession("waldo"); err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+	locked = nil
+
+	_, err := h.reloadCredentials([][]string{{"waldo", "pass", "", "1"}})
+	if err != nil {
+		t.Fatalf("Failed to reload credentials: %+v", err)
+	}
+
+	if len(locked) != 1 {
+		t.Fatalf("Unexpected number of quotas set."+
+			"\nexpected: %d\nreceived: %d", 1, len(locked))
+	} else if locked[0] {
+		t.Errorf("Quota set with the handler's lock held.")
+	}
+}
+
+// quotaLockStore is a store.Store that records whether the lock is held when
+// its quota is set.
+type quotaLockStore struct {
+	store.Store
+	mux    *sync.Mutex
+	locked *[]bool
+}
+
+func (qls *quotaLockStore) SetQuota(quota store.Quota) {
+	unlocked := qls.mux.TryLock()
+	if unlocked {
+		qls.mux.Unlock()
+	}
+	*qls.locked = append(*qls.locked, !unlocked)
+	qls.Store.SetQuota(quota)
+}
@@ -8,10 +8,12 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
 	"time"
 
 	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
 
 	"gitlab.com/elixxir/comms/remoteSync/server"
 	"gitlab.com/elixxir/remoteSyncServer/store"
@@ -23,33 +25,166 @@ type Server struct {
 	h       *handler
 	comms   *server.Comms
 	keyPair tls.Certificate
+	params  Params
+}
+
+// Params contains the configurable parameters of the Server.
+type Params struct {
+	// StorageDir is the directory that each user's storage is created in.
+	StorageDir string
+
+	// NewStore creates the storage of each user. Defaults to
+	// store.NewFileStore if not set.
+	NewStore store.NewStore
+
+	// TokenTTL is the duration that logged-in sessions are valid.
+	TokenTTL time.Duration
+
+	// SlidingExpiry, when true, extends the expiry of a session to TokenTTL
+	// after each successful request, so that active clients are not logged
+	// out mid-sync.
+	SlidingExpiry bool
+
+	// MaxTokenLifetime is the maximum time after login that a session may be
+	// extended to by sliding expiry or by refreshing its token. After it, the
+	// user must log in again. A value of 0 means no limit.
+	MaxTokenLifetime time.Duration
+
+	// SessionReapInterval is the interval between removals of expired
+	// sessions. Defaults to DefaultSessionReapInterval if not set.
+	SessionReapInterval time.Duration
+
+	// MaxSessionsPerUser is the maximum number of sessions, one per logged-in
+	// device, that each user may have at once. When a user logs in with the
+	// maximum number of sessions, their oldest session is removed. A value of
+	// 0 means no limit.
+	MaxSessionsPerUser int
+
+	// DefaultQuota is the storage quota of users that do not have a quota set
+	// in the credentials CSV.
+	DefaultQuota store.Quota
+
+	// Retention determines which previous versions of each file are kept when
+	// it is overwritten or deleted.
+	Retention store.RetentionPolicy
+
+	// Encryption enables the encryption of each user's files at rest. Files
+	// are stored unencrypted if it is nil.
+	Encryption *store.EncryptionParams
+
+	// SessionStore persists sessions so that logged-in clients remain logged
+	// in after the server restarts. Sessions are not persisted if it is nil.
+	SessionStore SessionStore
+
+	// RateLimits are the rate limits of reads, writes, and bytes written
+	// applied to each user across all their sessions. Requests over the limit
+	// are rejected with RateLimitedErr.
+	RateLimits RateLimitParams
+
+	// LoginThrottle configures the lockout of usernames after too many failed
+	// logins. Unset values use their defaults.
+	LoginThrottle LoginThrottleParams
+
+	// Authenticator verifies the credentials of users logging in. If it is nil,
+	// users are authenticated against the credentials CSV. Otherwise, only the
+	// quotas in the credentials CSV are used. It is closed on shutdown if it
+	// is an io.Closer.
+	Authenticator Authenticator
 }
 
 // NewServer generates a new server with a remote sync comms server. Returns an
 // error if the key pair cannot be generated.
-func NewServer(storageDir string, tokenTTL time.Duration, userRecords [][]string,
-	id *id.ID, localServer string, certPem, keyPem []byte) (*Server, error) {
+func NewServer(params Params, userRecords [][]string, id *id.ID,
+	localServer string, certPem, keyPem []byte) (*Server, error) {
 	keyPair, err := tls.X509KeyPair(certPem, keyPem)
 	if err != nil {
 		return nil, errors.Errorf("failed to generate a public/private TLS "+
 			"key pair from the cert and key: %+v", err)
 	}
 
-	h, err := newHandler(storageDir, tokenTTL, userRecords, store.NewFileStore)
+	newStore := params.NewStore
+	if newStore == nil {
+		newStore = store.NewFileStore
+	}
+	if params.Encryption != nil {
+		newStore, err = store.NewEncryptedStore(newStore, *params.Encryption)
+		if err != nil {
+			return nil, errors.Errorf(
+				"failed to initialize encrypted storage: %+v", err)
+		}
+	}
+
+	h, err := newHandler(params.StorageDir, params.TokenTTL, userRecords,
+		params.Authenticator, newStore, params.SessionStore)
 	if err != nil {
 		return nil, errors.Errorf("failed to initialize new handler: %+v", err)
 	}
+	h.defaultQuota = params.DefaultQuota
+	h.retention = params.Retention
+	h.maxSessions = params.MaxSessionsPerUser
+	h.slidingExpiry = params.SlidingExpiry
+	h.maxTokenLifetime = params.MaxTokenLifetime
+	h.rateLimits = params.RateLimits
+	h.loginThrottle = newLoginThrottle(params.LoginThrottle)
 
 	s := &Server{
 		h:       h,
 		comms:   server.StartRemoteSync(id, localServer, h, certPem, keyPem),
 		keyPair: keyPair,
+		params:  params,
 	}
 
 	return s, nil
 }
 
-// Start starts the comms HTTPS server.
+// Start starts the comms HTTPS server and the removal of expired sessions.
 func (s *Server) Start() error {
+	s.h.startSessionReaper(s.params.SessionReapInterval)
 	return s.comms.ServeHttps(s.keyPair)
 }
+
+// ReloadCredentials replaces the server's users with the users in the records
+// from the credentials CSV or, when another Authenticator is used, reloads it if
+// it is a Reloader. Quotas are always replaced with those in the records.
+// Active sessions of users that no longer exist are invalidated immediately. If
+// the records are invalid or the reload fails, an error is returned and the
+// existing users are kept.
+func (s *Server) ReloadCredentials(userRecords [][]string) error {
+	removed, err := s.h.reloadCredentials(userRecords)
+	if err != nil {
+		return errors.Wrap(err, "failed to reload credentials")
+	}
+	if removed > 0 {
+		jww.INFO.Printf("Invalidated %d sessions of removed users.", removed)
+	}
+	return nil
+}
+
+// ListSessions returns the active sessions of the user, oldest first.
+func (s *Server) ListSessions(username string) []SessionInfo {
+	return s.h.listSessions(username)
+}
+
+// RevokeSession invalidates the user's session with the ID immediately. The
+// user's other sessions are unaffected. Returns [SessionNotFoundErr] if the
+// user has no session with the ID.
+func (s *Server) RevokeSession(username, id string) error {
+	return s.h.revokeSession(username, id)
+}
+
+// RevokeUser invalidates all sessions of the user immediately. The user may
+// log in again unless they are also removed from the credentials. Returns the
+// number of sessions revoked.
+func (s *Server) RevokeUser(username string) int {
+	return s.h.revokeUser(username)
+}
+
+// Shutdown gracefully stops the server. New requests are rejected, the comms
+// server is stopped, and all user stores are closed once their in-progress
+// writes have completed. Returns an error if the context is done before the
+// shutdown completes.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.h.shutdown(ctx)
+	s.comms.Shutdown()
+	return err
+}
@@ -0,0 +1,132 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package server
+
+import (
+	"time"
+
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+// DefaultSessionReapInterval is the interval between removals of expired
+// sessions used when none is configured.
+const DefaultSessionReapInterval = 10 * time.Minute
+
+// sessionReaper is the state of the background goroutine that removes expired
+// sessions.
+type sessionReaper struct {
+	quit chan struct{}
+	done chan struct{}
+}
+
+// startSessionReaper starts a goroutine that removes expired sessions and
+// forgotten failed logins every interval until stopSessionReaper is called.
+// Does nothing if the reaper is already running.
+func (h *handler) startSessionReaper(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultSessionReapInterval
+	}
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.reaper != nil {
+		return
+	}
+
+	r := &sessionReaper{
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	h.reaper = r
+
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		jww.DEBUG.Printf("Started session reaper running every %s.", interval)
+		for {
+			select {
+			case <-r.quit:
+				jww.DEBUG.Printf("Stopped session reaper.")
+				return
+			case <-ticker.C:
+				h.reapSessions()
+				if h.loginThrottle != nil {
+					h.loginThrottle.prune(h.now())
+				}
+			}
+		}
+	}()
+}
+
+// stopSessionReaper stops the session reaper goroutine and waits for it to
+// exit. Does nothing if the reaper is not running.
+func (h *handler) stopSessionReaper() {
+	h.mux.Lock()
+	r := h.reaper
+	h.reaper = nil
+	h.mux.Unlock()
+
+	if r == nil {
+		return
+	}
+
+	close(r.quit)
+	<-r.done
+}
+
+// reapSessions removes all sessions that have expired according to the
+// handler's clock from the sessions and token maps and closes the stores of
+// users left without a session. Expired sessions loaded from the session store
+// and the refilled rate limiters of users without sessions are also discarded
+// and the remaining sessions saved. Returns the number of sessions removed.
+func (h *handler) reapSessions() int {
+	h.mux.Lock()
+	now := h.now()
+	var expired []*userSession
+	var closing []*userStore
+	for token, s := range h.sessions {
+		if s.isExpired(now) {
+			if _, us := h.removeSession(token); us != nil {
+				closing = append(closing, us)
+			}
+			expired = append(expired, s)
+		}
+	}
+	for key, p := range h.restored {
+		if !now.Before(p.Expires) {
+			delete(h.restored, key)
+		}
+	}
+
+	// Limiters of users without sessions are only removed once they have
+	// refilled so that logging in again cannot reset them
+	for username, l := range h.limiters {
+		if len(h.userTokens[username]) == 0 && l.full(now) {
+			delete(h.limiters, username)
+		}
+	}
+	h.mux.Unlock()
+
+	for _, s := range expired {
+		jww.INFO.Printf("Evicted session for user %s that expired at %s.",
+			s.username, s.ExpiryTime)
+	}
+
+	// Stores are closed outside the lock since closing may block on I/O
+	for _, us := range closing {
+		h.closeStore(us)
+	}
+
+	// Sessions are saved even if none expired so that expiries extended by
+	// sliding expiry are persisted
+	h.saveSessions()
+
+	return len(expired)
+}
@@ -0,0 +1,151 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gitlab.com/elixxir/remoteSyncServer/store"
+)
+
+// Tests that handler.reapSessions only removes sessions that have expired
+// according to the handler's clock and that it closes their stores.
+func Test_handler_reapSessions(t *testing.T) {
+	clock := newTestClock(time.Now())
+	var closed int32
+	h := newReaperTestHandler(time.Hour, clock, &closed)
+
+	expiring, err := h.addSession("waldo")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+	clock.add(30 * time.Minute)
+	valid, err := h.addSession("carmen")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+
+	if n := h.reapSessions(); n != 0 {
+		t.Errorf("Removed %d sessions before any expired.", n)
+	}
+
+	clock.add(30 * time.Minute)
+	if n := h.reapSessions(); n != 1 {
+		t.Errorf("Unexpected number of sessions removed."+
+			"\nexpected: %d\nreceived: %d", 1, n)
+	}
+
+	if _, exists := h.sessions[Token(expiring.Value)]; exists {
+		t.Errorf("Expired session not removed from sessions.")
+	} else if _, exists = h.userTokens[expiring.username]; exists {
+		t.Errorf("Expired session not removed from userTokens.")
+	} else if _, exists = h.sessions[Token(valid.Value)]; !exists {
+		t.Errorf("Valid session removed from sessions.")
+	} else if _, exists = h.userTokens[valid.username]; !exists {
+		t.Errorf("Valid session removed from userTokens.")
+	}
+
+	if n := atomic.LoadInt32(&closed); n != 1 {
+		t.Errorf("Unexpected number of stores closed."+
+			"\nexpected: %d\nreceived: %d", 1, n)
+	}
+}
+
+// Tests that the reaper started by handler.startSessionReaper removes expired
+// sessions in the background and that handler.stopSessionReaper stops it.
+func Test_handler_startSessionReaper_stopSessionReaper(t *testing.T) {
+	clock := newTestClock(time.Now())
+	var closed int32
+	h := newReaperTestHandler(time.Hour, clock, &closed)
+
+	if _, err := h.addSession("waldo"); err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+
+	h.startSessionReaper(time.Millisecond)
+	h.startSessionReaper(time.Millisecond)
+	clock.add(2 * time.Hour)
+
+	for i := 0; atomic.LoadInt32(&closed) == 0; i++ {
+		if i > 1000 {
+			t.Fatalf("Timed out waiting for session to be removed.")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	h.stopSessionReaper()
+	if h.reaper != nil {
+		t.Errorf("Reaper not cleared after stopping.")
+	}
+
+	// Stopping a stopped reaper does nothing
+	h.stopSessionReaper()
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if len(h.sessions) != 0 || len(h.userTokens) != 0 {
+		t.Errorf("Expired session not removed.\nsessions:   %v\nuserTokens: %v",
+			h.sessions, h.userTokens)
+	}
+}
+
+// newReaperTestHandler creates a handler for the user using the clock whose
+// stores increment closed when they are closed.
+func newReaperTestHandler(
+	tokenTTL time.Duration, clock *testClock, closed *int32) *handler {
+	return &handler{
+		tokenTTL:      tokenTTL,
+		sessions:      make(map[Token]*userSession),
+		userTokens:    make(map[string][]Token),
+		stores:        make(map[string]*userStore),
+		closingStores: make(map[string]*userStore),
+		limiters:      make(map[string]*userLimiter),
+		restored:      make(map[string]PersistedSession),
+		newStore: func(storageDir, baseDir string) (store.Store, error) {
+			s, err := store.NewMemStore(storageDir, baseDir)
+			return &closerStore{s, closed}, err
+		},
+		now: clock.now,
+	}
+}
+
+// closerStore is a store.Store that records when it is closed.
+type closerStore struct {
+	store.Store
+	closed *int32
+}
+
+func (cs *closerStore) Close() error {
+	atomic.AddInt32(cs.closed, 1)
+	return nil
+}
+
+// testClock is a manually advanced clock used as handler.now.
+type testClock struct {
+	t   time.Time
+	mux sync.Mutex
+}
+
+func newTestClock(t time.Time) *testClock {
+	return &testClock{t: t}
+}
+
+func (c *testClock) now() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.t
+}
+
+func (c *testClock) add(d time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.t = c.t.Add(d)
+}
@@ -0,0 +1,266 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+
+	"gitlab.com/xx_network/crypto/nonce"
+	"gitlab.com/xx_network/primitives/utils"
+)
+
+// SessionStore persists the active sessions of the server so that their tokens
+// remain valid after a restart.
+type SessionStore interface {
+	// Load returns the sessions saved by the most recent call to Save. It
+	// returns no sessions if none have been saved.
+	Load() ([]PersistedSession, error)
+
+	// Save replaces all saved sessions with the given sessions.
+	Save(sessions []PersistedSession) error
+}
+
+// PersistedSession is a session saved in a SessionStore. The token itself is
+// never saved, only its hash, so a stolen session file cannot be used to access
+// a user's storage.
+type PersistedSession struct {
+	// TokenHash is the hash of the session's token.
+	TokenHash []byte `json:"tokenHash"`
+
+	// Username is the user the session belongs to.
+	Username string `json:"username"`
+
+	// LoggedIn is when the user authenticated to create the session.
+	LoggedIn time.Time `json:"loggedIn"`
+
+	// Created is when the session's token was issued.
+	Created time.Time `json:"created"`
+
+	// Expires is when the session expires.
+	Expires time.Time `json:"expires"`
+}
+
+// FileSessionStore is a SessionStore that saves sessions as JSON to a file on
+// the local file system.
+type FileSessionStore struct {
+	path string
+}
+
+// NewFileSessionStore returns a FileSessionStore that saves sessions to the
+// file at the path. The file is created on the first save.
+func NewFileSessionStore(path string) (*FileSessionStore, error) {
+	expanded, err := utils.ExpandPath(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to expand path %s", path)
+	}
+	return &FileSessionStore{path: expanded}, nil
+}
+
+// Load reads the sessions from the file. Returns no sessions if the file does
+// not exist.
+func (fss *FileSessionStore) Load() ([]PersistedSession, error) {
+	data, err := os.ReadFile(fss.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to read sessions file %s",
+			fss.path)
+	}
+
+	var sessions []PersistedSession
+	if err = json.Unmarshal(data, &sessions); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse sessions file %s",
+			fss.path)
+	}
+	return sessions, nil
+}
+
+// Save writes the sessions to the file. They are written to a temporary file
+// that is renamed over the file so that it is never left partially written.
+// The file is only readable by the owner.
+func (fss *FileSessionStore) Save(sessions []PersistedSession) error {
+	data, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(fss.path), filepath.Base(fss.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	} else if err = f.Chmod(0600); err != nil {
+		_ = f.Close()
+		return err
+	} else if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	} else if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), fss.path)
+}
+
+// loadSessions loads the unexpired sessions of existing users from the session
+// store. Since only the hash of each token is saved, they are kept aside until
+// their token is first used and then restored by restoreSession. Sessions of
+// users removed from the authenticator while the server was stopped are
+// dropped; if a user cannot be looked up, their sessions are kept, as on
+// reload.
+func (h *handler) loadSessions() error {
+	persisted, err := h.sessionStore.Load()
+	if err != nil {
+		return errors.Wrap(err, "failed to load sessions")
+	}
+
+	now := h.now()
+	users := make(map[string]bool)
+	for _, p := range persisted {
+		if !now.Before(p.Expires) || len(p.TokenHash) < sessionIDLen {
+			continue
+		}
+
+		exists, checked := users[p.Username]
+		if !checked {
+			exists, err = h.authenticator.HasUser(p.Username)
+			if err != nil {
+				jww.WARN.Printf("Failed to look up user %s; keeping their "+
+					"saved sessions: %+v", p.Username, err)
+				exists = true
+			} else if !exists {
+				jww.INFO.Printf("Dropping saved sessions of removed user %s.",
+					p.Username)
+			}
+			users[p.Username] = exists
+		}
+		if exists {
+			h.restored[string(p.TokenHash)] = p
+		}
+	}
+	jww.INFO.Printf("Loaded %d unexpired sessions of %d saved sessions.",
+		len(h.restored), len(persisted))
+
+	return nil
+}
+
+// saveSessions saves all active and not yet restored sessions to the session
+// store. Errors are logged since a failed save only affects sessions after a
+// restart. Does nothing if sessions are not persisted. Must not be called with
+// the lock held since saving may block on I/O.
+//
+// Every save rewrites all sessions. It is called after each login, logout,
+// refresh, and revocation so that a restart never revives a revoked token or
+// invalidates a newly issued one, which costs one write of the session store
+// per call; these are rare compared to reads and writes of files. Expiries
+// extended by sliding expiry change on every request, so they are only saved
+// by the session reaper and on shutdown. After a crash, such a session is
+// restored with the expiry of the last save and may expire up to one reap
+// interval early.
+func (h *handler) saveSessions() {
+	if h.sessionStore == nil {
+		return
+	}
+
+	// Saves are serialized so that an older snapshot of the sessions never
+	// overwrites a newer one
+	h.saveMux.Lock()
+	defer h.saveMux.Unlock()
+
+	h.mux.Lock()
+	sessions := make([]PersistedSession, 0, len(h.sessions)+len(h.restored))
+	for token, s := range h.sessions {
+		sessions = append(sessions, PersistedSession{
+			TokenHash: hashToken(token),
+			Username:  s.username,
+			LoggedIn:  s.loggedIn,
+			Created:   s.GenTime,
+			Expires:   s.ExpiryTime,
+		})
+	}
+	for _, p := range h.restored {
+		sessions = append(sessions, p)
+	}
+	h.mux.Unlock()
+
+	if err := h.sessionStore.Save(sessions); err != nil {
+		jww.WARN.Printf("Failed to save %d sessions: %+v", len(sessions), err)
+	}
+}
+
+// restoreSession restores the loaded session with the token into the active
+// sessions. The loaded session is kept if it cannot be restored yet because the
+// user's previous store is still being closed.
+//
+// Returns [InvalidTokenErr] if no unexpired session with the token was loaded
+// and a [storeClosingErr] if the user's previous store is still being closed.
+// Must be called with the lock held.
+func (h *handler) restoreSession(token Token) (*userSession, error) {
+	if len(h.restored) == 0 {
+		return nil, InvalidTokenErr
+	}
+
+	key := string(hashToken(token))
+	p, exists := h.restored[key]
+	if !exists {
+		return nil, InvalidTokenErr
+	}
+	if !h.now().Before(p.Expires) {
+		delete(h.restored, key)
+		return nil, InvalidTokenErr
+	}
+
+	n := nonce.Nonce{
+		Value:      nonce.Value(token),
+		GenTime:    p.Created,
+		ExpiryTime: p.Expires,
+		TTL:        h.tokenTTL,
+	}
+	s, err := h.insertSession(p.Username, token, n, p.LoggedIn)
+	if err != nil {
+		var closing storeClosingErr
+		if !errors.As(err, &closing) {
+			delete(h.restored, key)
+		}
+		return nil, err
+	}
+	delete(h.restored, key)
+
+	jww.DEBUG.Printf("Restored session %s of user %s.",
+		sessionID(token), p.Username)
+	return s, nil
+}
+
+// removeRestored removes the loaded sessions of the user that have not been
+// restored. Returns the number removed. Must be called with the lock held.
+func (h *handler) removeRestored(username string) int {
+	var removed int
+	for key, p := range h.restored {
+		if p.Username == username {
+			delete(h.restored, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// restoredID returns the session ID of the loaded session.
+func restoredID(p PersistedSession) string {
+	return hex.EncodeToString(p.TokenHash[:sessionIDLen])
+}
@@ -0,0 +1,311 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"gitlab.com/elixxir/remoteSyncServer/store"
+	"gitlab.com/xx_network/primitives/netTime"
+)
+
+// Tests that the sessions saved by FileSessionStore.Save are returned by
+// FileSessionStore.Load and that the file is only readable by the owner.
+func TestFileSessionStore_SaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	fss, err := NewFileSessionStore(path)
+	if err != nil {
+		t.Fatalf("Failed to make session store: %+v", err)
+	}
+
+	now := netTime.Now().Round(0).UTC()
+	expected := []PersistedSession{{
+		TokenHash: hashToken(Token{1, 2, 3}),
+		Username:  "waldo",
+		LoggedIn:  now.Add(-time.Hour),
+		Created:   now,
+		Expires:   now.Add(time.Hour),
+	}, {
+		TokenHash: hashToken(Token{4, 5, 6}),
+		Username:  "carmen",
+		LoggedIn:  now,
+		Created:   now,
+		Expires:   now.Add(2 * time.Hour),
+	}}
+	if err = fss.Save(expected); err != nil {
+		t.Fatalf("Failed to save sessions: %+v", err)
+	}
+
+	sessions, err := fss.Load()
+	if err != nil {
+		t.Fatalf("Failed to load sessions: %+v", err)
+	}
+	if !reflect.DeepEqual(expected, sessions) {
+		t.Errorf("Unexpected sessions.\nexpected: %+v\nreceived: %+v",
+			expected, sessions)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat file: %+v", err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("Unexpected file permissions.\nexpected: %o\nreceived: %o",
+			0600, perm)
+	}
+}
+
+// Tests that FileSessionStore.Load returns no sessions when the file does not
+// exist.
+func TestFileSessionStore_Load_NoFile(t *testing.T) {
+	fss, err := NewFileSessionStore(filepath.Join(t.TempDir(), "sessions.json"))
+	if err != nil {
+		t.Fatalf("Failed to make session store: %+v", err)
+	}
+
+	sessions, err := fss.Load()
+	if err != nil {
+		t.Errorf("Failed to load sessions: %+v", err)
+	} else if len(sessions) != 0 {
+		t.Errorf("Loaded sessions when no file exists: %+v", sessions)
+	}
+}
+
+// Error path: Tests that FileSessionStore.Load returns an error for a file
+// that is not valid JSON.
+func TestFileSessionStore_Load_InvalidFileError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	if err := os.WriteFile(path, []byte("sessions"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %+v", err)
+	}
+	fss, err := NewFileSessionStore(path)
+	if err != nil {
+		t.Fatalf("Failed to make session store: %+v", err)
+	}
+
+	if _, err = fss.Load(); err == nil {
+		t.Errorf("Failed to error for invalid file.")
+	}
+}
+
+// Tests that a session saved by one handler is restored by a new handler
+// loading the same session store, so the token remains valid after a restart,
+// and that the raw token is never saved.
+func Test_handler_sessionStore_Restart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	fss, err := NewFileSessionStore(path)
+	if err != nil {
+		t.Fatalf("Failed to make session store: %+v", err)
+	}
+	records := [][]string{{"waldo", "hunter2"}}
+
+	h1, err := newHandler(
+		"tmp", time.Hour, records, nil, store.NewMemStore, fss)
+	if err != nil {
+		t.Fatalf("Failed to make first handler: %+v", err)
+	}
+	s1, err := h1.addSession("waldo")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+	h1.saveSessions()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read sessions file: %+v", err)
+	}
+	if bytes.Contains(data, s1.Value[:]) {
+		t.Errorf("Raw token saved in sessions file.")
+	}
+
+	h2, err := newHandler(
+		"tmp", time.Hour, records, nil, store.NewMemStore, fss)
+	if err != nil {
+		t.Fatalf("Failed to make second handler: %+v", err)
+	}
+	if len(h2.restored) != 1 {
+		t.Errorf("Unexpected number of loaded sessions."+
+			"\nexpected: %d\nreceived: %d", 1, len(h2.restored))
+	}
+
+	s2, err := h2.addSession("waldo")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+	rs, err := h2.getSession(Token(s1.Value))
+	if err != nil {
+		t.Fatalf("Failed to get restored session: %+v", err)
+	}
+	if !rs.ExpiryTime.Equal(s1.ExpiryTime) || !rs.loggedIn.Equal(s1.loggedIn) {
+		t.Errorf("Unexpected restored session times."+
+			"\nexpected: %s, %s\nreceived: %s, %s",
+			s1.loggedIn, s1.ExpiryTime, rs.loggedIn, rs.ExpiryTime)
+	}
+	if rs.Store != s2.Store {
+		t.Errorf("Restored session does not share the user's store.")
+	}
+	if len(h2.restored) != 0 {
+		t.Errorf("Restored session not removed from loaded sessions.")
+	}
+
+	_, err = h2.getSession(Token{1, 2, 3})
+	if !errors.Is(err, InvalidTokenErr) {
+		t.Errorf("Unexpected error for unknown token."+
+			"\nexpected: %v\nreceived: %+v", InvalidTokenErr, err)
+	}
+}
+
+// Tests that expired saved sessions are not loaded and that an expired session
+// cannot be restored.
+func Test_handler_sessionStore_Expired(t *testing.T) {
+	fss, err := NewFileSessionStore(filepath.Join(t.TempDir(), "sessions.json"))
+	if err != nil {
+		t.Fatalf("Failed to make session store: %+v", err)
+	}
+	now := netTime.Now()
+	expired, valid := Token{1}, Token{2}
+	err = fss.Save([]PersistedSession{{
+		TokenHash: hashToken(expired),
+		Username:  "waldo",
+		Expires:   now.Add(-time.Minute),
+	}, {
+		TokenHash: hashToken(valid),
+		Username:  "waldo",
+		Expires:   now.Add(time.Hour),
+	}})
+	if err != nil {
+		t.Fatalf("Failed to save sessions: %+v", err)
+	}
+
+	h, err := newHandler("tmp", time.Hour, [][]string{{"waldo", "hunter2"}},
+		nil, store.NewMemStore, fss)
+	if err != nil {
+		t.Fatalf("Failed to make handler: %+v", err)
+	}
+	if len(h.restored) != 1 {
+		t.Errorf("Unexpected number of loaded sessions."+
+			"\nexpected: %d\nreceived: %d", 1, len(h.restored))
+	}
+
+	_, err = h.getSession(expired)
+	if !errors.Is(err, InvalidTokenErr) {
+		t.Errorf("Unexpected error for expired token."+
+			"\nexpected: %v\nreceived: %+v", InvalidTokenErr, err)
+	}
+
+	clock := newTestClock(now.Add(time.Hour))
+	h.now = clock.now
+	_, err = h.getSession(valid)
+	if !errors.Is(err, InvalidTokenErr) {
+		t.Errorf("Unexpected error for token expired after loading."+
+			"\nexpected: %v\nreceived: %+v", InvalidTokenErr, err)
+	}
+	if len(h.sessions) != 0 || len(h.restored) != 0 {
+		t.Errorf("Expired session not removed.\nsessions: %v\nrestored: %v",
+			h.sessions, h.restored)
+	}
+}
+
+// Tests that saved sessions of users that no longer exist are not loaded.
+func Test_handler_sessionStore_RemovedUser(t *testing.T) {
+	fss, err := NewFileSessionStore(filepath.Join(t.TempDir(), "sessions.json"))
+	if err != nil {
+		t.Fatalf("Failed to make session store: %+v", err)
+	}
+	expires := netTime.Now().Add(time.Hour)
+	err = fss.Save([]PersistedSession{
+		{TokenHash: hashToken(Token{1}), Username: "waldo", Expires: expires},
+		{TokenHash: hashToken(Token{2}), Username: "carmen", Expires: expires},
+		{TokenHash: hashToken(Token{3}), Username: "carmen", Expires: expires},
+	})
+	if err != nil {
+		t.Fatalf("Failed to save sessions: %+v", err)
+	}
+
+	h, err := newHandler("tmp", time.Hour, [][]string{{"waldo", "hunter2"}},
+		nil, store.NewMemStore, fss)
+	if err != nil {
+		t.Fatalf("Failed to make handler: %+v", err)
+	}
+	if len(h.restored) != 1 {
+		t.Errorf("Unexpected number of loaded sessions."+
+			"\nexpected: %d\nreceived: %d", 1, len(h.restored))
+	}
+
+	_, err = h.getSession(Token{2})
+	if !errors.Is(err, InvalidTokenErr) {
+		t.Errorf("Unexpected error for session of removed user."+
+			"\nexpected: %v\nreceived: %+v", InvalidTokenErr, err)
+	}
+	if _, err = h.getSession(Token{1}); err != nil {
+		t.Errorf("Failed to restore session of existing user: %+v", err)
+	}
+}
+
+// Tests that sessions loaded from the session store that have not yet been
+// used are listed and can be revoked by ID and by user.
+func Test_handler_sessionStore_ListRevoke(t *testing.T) {
+	var closed int32
+	h := newReaperTestHandler(
+		time.Hour, newTestClock(netTime.Now()), &closed)
+	now := h.now()
+	for i, p := range []PersistedSession{
+		{TokenHash: hashToken(Token{1}), Username: "waldo", Created: now},
+		{TokenHash: hashToken(Token{2}), Username: "waldo", Created: now},
+		{TokenHash: hashToken(Token{3}), Username: "waldo", Created: now},
+		{TokenHash: hashToken(Token{4}), Username: "carmen", Created: now},
+	} {
+		p.Expires = now.Add(time.Duration(i+1) * time.Minute)
+		h.restored[string(p.TokenHash)] = p
+	}
+
+	if list := h.listSessions("waldo"); len(list) != 3 {
+		t.Errorf("Unexpected number of sessions listed."+
+			"\nexpected: %d\nreceived: %+v", 3, list)
+	}
+
+	if err := h.revokeSession("waldo", sessionID(Token{1})); err != nil {
+		t.Errorf("Failed to revoke loaded session: %+v", err)
+	}
+	_, err := h.getSession(Token{1})
+	if !errors.Is(err, InvalidTokenErr) {
+		t.Errorf("Unexpected error for revoked session."+
+			"\nexpected: %v\nreceived: %+v", InvalidTokenErr, err)
+	}
+	err = h.revokeSession("waldo", sessionID(Token{4}))
+	if !errors.Is(err, SessionNotFoundErr) {
+		t.Errorf("Unexpected error for session of other user."+
+			"\nexpected: %v\nreceived: %+v", SessionNotFoundErr, err)
+	}
+
+	// Restore one session so that both active and loaded sessions are revoked
+	if _, err = h.getSession(Token{2}); err != nil {
+		t.Fatalf("Failed to restore session: %+v", err)
+	}
+	if n := h.revokeUser("waldo"); n != 2 {
+		t.Errorf("Unexpected number of sessions revoked."+
+			"\nexpected: %d\nreceived: %d", 2, n)
+	}
+	for _, token := range []Token{{2}, {3}} {
+		_, err = h.Logout(&pb.RsLastWriteRequest{Token: token[:]})
+		if !errors.Is(err, InvalidTokenErr) {
+			t.Errorf("Unexpected error for revoked session."+
+				"\nexpected: %v\nreceived: %+v", InvalidTokenErr, err)
+		}
+	}
+	if _, err = h.getSession(Token{4}); err != nil {
+		t.Errorf("Failed to restore session of other user: %+v", err)
+	}
+}
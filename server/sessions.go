@@ -0,0 +1,135 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package server
+
+import (
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+// SessionNotFoundErr is returned when revoking a session that does not exist
+// or belongs to another user.
+var SessionNotFoundErr = errors.New("session not found")
+
+// SessionInfo describes an active session of a user.
+type SessionInfo struct {
+	// ID identifies the session. It is derived from the session's token but
+	// cannot be used in its place.
+	ID string
+
+	// Created is when the user logged in.
+	Created time.Time
+
+	// Expires is when the session expires.
+	Expires time.Time
+}
+
+// listSessions returns the active sessions of the user, oldest first. Expired
+// sessions that have not yet been removed are excluded.
+func (h *handler) listSessions(username string) []SessionInfo {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	now := h.now()
+	tokens := h.userTokens[username]
+	list := make([]SessionInfo, 0, len(tokens))
+	for _, token := range tokens {
+		s := h.sessions[token]
+		if s.isExpired(now) {
+			continue
+		}
+		list = append(list, SessionInfo{
+			ID:      sessionID(token),
+			Created: s.GenTime,
+			Expires: s.ExpiryTime,
+		})
+	}
+
+	// Include sessions loaded from the session store that have not been used
+	// since the restart
+	for _, p := range h.restored {
+		if p.Username != username || !now.Before(p.Expires) {
+			continue
+		}
+		list = append(list, SessionInfo{
+			ID:      restoredID(p),
+			Created: p.Created,
+			Expires: p.Expires,
+		})
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+
+	return list
+}
+
+// revokeSession removes the session of the user with the ID so that its token
+// can no longer be used. The user's store is closed if it was their last
+// session. Returns [SessionNotFoundErr] if the user has no session with the ID.
+func (h *handler) revokeSession(username, id string) error {
+	h.mux.Lock()
+	var s *userSession
+	var us *userStore
+	for _, token := range h.userTokens[username] {
+		if sessionID(token) == id {
+			s, us = h.removeSession(token)
+			break
+		}
+	}
+	var restored bool
+	for key, p := range h.restored {
+		if p.Username == username && restoredID(p) == id {
+			delete(h.restored, key)
+			restored = true
+			break
+		}
+	}
+	h.mux.Unlock()
+
+	if s == nil && !restored {
+		return errors.Wrapf(SessionNotFoundErr, "user %s has no session %s",
+			username, id)
+	}
+
+	jww.INFO.Printf("Revoked session %s of user %s.", id, username)
+	if us != nil {
+		h.closeStore(us)
+	}
+	h.saveSessions()
+	return nil
+}
+
+// revokeUser removes all sessions of the user so that none of their tokens can
+// be used and closes their store. Returns the number of sessions revoked.
+func (h *handler) revokeUser(username string) int {
+	h.mux.Lock()
+	tokens := h.userTokens[username]
+	var us *userStore
+	for _, token := range tokens {
+		if _, closing := h.removeSession(token); closing != nil {
+			us = closing
+		}
+	}
+	revoked := len(tokens) + h.removeRestored(username)
+	h.mux.Unlock()
+
+	if revoked == 0 {
+		return 0
+	}
+
+	jww.INFO.Printf("Revoked %d sessions of user %s.", revoked, username)
+	if us != nil {
+		h.closeStore(us)
+	}
+	h.saveSessions()
+	return revoked
+}
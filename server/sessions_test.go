@@ -0,0 +1,177 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package server
+
+import (
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gitlab.com/xx_network/primitives/netTime"
+)
+
+// Tests that handler.listSessions returns the unexpired sessions of only the
+// user, oldest first.
+func Test_handler_listSessions(t *testing.T) {
+	clock := newTestClock(netTime.Now())
+	var closed int32
+	h := newReaperTestHandler(time.Hour, clock, &closed)
+
+	expired, err := h.addSession("waldo")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+	clock.add(30 * time.Minute)
+	var expected []SessionInfo
+	for i := 0; i < 2; i++ {
+		s, err := h.addSession("waldo")
+		if err != nil {
+			t.Fatalf("Failed to add session %d: %+v", i, err)
+		}
+		expected = append(expected, SessionInfo{
+			ID:      sessionID(Token(s.Value)),
+			Created: s.GenTime,
+			Expires: s.ExpiryTime,
+		})
+		clock.add(time.Minute)
+	}
+	if _, err = h.addSession("carmen"); err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+	clock.add(30 * time.Minute)
+
+	list := h.listSessions("waldo")
+	if !reflect.DeepEqual(expected, list) {
+		t.Errorf("Unexpected sessions.\nexpected: %+v\nreceived: %+v",
+			expected, list)
+	}
+	for _, info := range list {
+		if info.ID == sessionID(Token(expired.Value)) {
+			t.Errorf("Expired session listed.")
+		}
+	}
+
+	if list = h.listSessions("sandiego"); len(list) != 0 {
+		t.Errorf("Sessions listed for user without sessions: %+v", list)
+	}
+}
+
+// Tests that handler.revokeSession invalidates only the revoked session and
+// closes the user's store once their last session is revoked.
+func Test_handler_revokeSession(t *testing.T) {
+	var closed int32
+	h := newReaperTestHandler(time.Hour, newTestClock(netTime.Now()), &closed)
+
+	s1, err := h.addSession("waldo")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+	s2, err := h.addSession("waldo")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+
+	if err = h.revokeSession("waldo", sessionID(Token(s1.Value))); err != nil {
+		t.Fatalf("Failed to revoke session: %+v", err)
+	}
+	_, err = h.getSession(Token(s1.Value))
+	if !errors.Is(err, InvalidTokenErr) {
+		t.Errorf("Unexpected error for revoked session."+
+			"\nexpected: %v\nreceived: %+v", InvalidTokenErr, err)
+	}
+	if _, err = h.getSession(Token(s2.Value)); err != nil {
+		t.Errorf("Failed to get remaining session: %+v", err)
+	}
+	if n := atomic.LoadInt32(&closed); n != 0 {
+		t.Errorf("Store closed while a session remains.")
+	}
+
+	if err = h.revokeSession("waldo", sessionID(Token(s2.Value))); err != nil {
+		t.Fatalf("Failed to revoke session: %+v", err)
+	}
+	if n := atomic.LoadInt32(&closed); n != 1 {
+		t.Errorf("Unexpected number of stores closed."+
+			"\nexpected: %d\nreceived: %d", 1, n)
+	}
+	if _, exists := h.userTokens["waldo"]; exists {
+		t.Errorf("User not removed from userTokens.")
+	}
+}
+
+// Error path: Tests that handler.revokeSession returns SessionNotFoundErr for
+// an unknown ID and for the ID of another user's session.
+func Test_handler_revokeSession_SessionNotFoundError(t *testing.T) {
+	var closed int32
+	h := newReaperTestHandler(time.Hour, newTestClock(netTime.Now()), &closed)
+	s, err := h.addSession("waldo")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+
+	for username, id := range map[string]string{
+		"waldo":  "0123456789abcdef",
+		"carmen": sessionID(Token(s.Value)),
+	} {
+		err = h.revokeSession(username, id)
+		if !errors.Is(err, SessionNotFoundErr) {
+			t.Errorf("Unexpected error for session %s of user %s."+
+				"\nexpected: %v\nreceived: %+v",
+				id, username, SessionNotFoundErr, err)
+		}
+	}
+	if _, err = h.getSession(Token(s.Value)); err != nil {
+		t.Errorf("Failed to get session: %+v", err)
+	}
+}
+
+// Tests that handler.revokeUser invalidates all sessions of only the user and
+// closes their store.
+func Test_handler_revokeUser(t *testing.T) {
+	var closed int32
+	h := newReaperTestHandler(time.Hour, newTestClock(netTime.Now()), &closed)
+
+	revoked := make([]*userSession, 3)
+	for i := range revoked {
+		var err error
+		if revoked[i], err = h.addSession("waldo"); err != nil {
+			t.Fatalf("Failed to add session %d: %+v", i, err)
+		}
+	}
+	kept, err := h.addSession("carmen")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+
+	if n := h.revokeUser("waldo"); n != len(revoked) {
+		t.Errorf("Unexpected number of sessions revoked."+
+			"\nexpected: %d\nreceived: %d", len(revoked), n)
+	}
+	for i, s := range revoked {
+		_, err = h.getSession(Token(s.Value))
+		if !errors.Is(err, InvalidTokenErr) {
+			t.Errorf("Unexpected error for revoked session %d."+
+				"\nexpected: %v\nreceived: %+v", i, InvalidTokenErr, err)
+		}
+	}
+	if _, exists := h.userTokens["waldo"]; exists {
+		t.Errorf("User not removed from userTokens.")
+	}
+	if _, err = h.getSession(Token(kept.Value)); err != nil {
+		t.Errorf("Failed to get session of other user: %+v", err)
+	}
+	if n := atomic.LoadInt32(&closed); n != 1 {
+		t.Errorf("Unexpected number of stores closed."+
+			"\nexpected: %d\nreceived: %d", 1, n)
+	}
+
+	if n := h.revokeUser("waldo"); n != 0 {
+		t.Errorf("Revoked %d sessions of user without sessions.", n)
+	}
+}
@@ -0,0 +1,107 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package server
+
+import (
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultSQLAuthQuery is the query used by SQLAuthenticator if none is set.
+const DefaultSQLAuthQuery = "SELECT password FROM users WHERE username = ?"
+
+// SQLParams contains the parameters used to connect to a database of users.
+type SQLParams struct {
+	// Driver is the name of the database/sql driver. The driver must be
+	// compiled into the server; the sqlite driver is always available.
+	Driver string
+
+	// DataSource is the driver-specific data source name.
+	DataSource string
+
+	// Query selects the password of a user. It must take the username as its
+	// only argument and return a single column. Defaults to
+	// DefaultSQLAuthQuery, which uses the ? placeholder; drivers that use
+	// another placeholder style require a custom query.
+	Query string
+}
+
+// SQLAuthenticator authenticates users against a table of users in an SQL
+// database. The password selected by the query is the cleartext password, like
+// in the credentials CSV. The database is queried on each login, so changes to
+// the table take effect immediately.
+type SQLAuthenticator struct {
+	db    *sql.DB
+	query string
+}
+
+// NewSQLAuthenticator connects to the database in the params and returns an
+// SQLAuthenticator that queries it. Returns an error if the connection fails.
+func NewSQLAuthenticator(params SQLParams) (*SQLAuthenticator, error) {
+	if params.Driver == "" {
+		return nil, errors.New("no SQL driver set")
+	}
+	if params.Query == "" {
+		params.Query = DefaultSQLAuthQuery
+	}
+
+	db, err := sql.Open(params.Driver, params.DataSource)
+	if err != nil {
+		return nil, errors.Wrapf(
+			err, "failed to open %s database", params.Driver)
+	}
+	if err = db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, errors.Wrapf(
+			err, "failed to connect to %s database", params.Driver)
+	}
+
+	return &SQLAuthenticator{db: db, query: params.Query}, nil
+}
+
+// Authenticate returns InvalidCredentialsErr if the user is not in the table or
+// the password hash does not match their password.
+func (a *SQLAuthenticator) Authenticate(
+	username string, passwordHash, salt []byte) error {
+	password, exists, err := a.password(username)
+	if err != nil {
+		return err
+	} else if !exists {
+		return InvalidCredentialsErr
+	}
+
+	if !verifyPassword(password, passwordHash, salt) {
+		return InvalidCredentialsErr
+	}
+	return nil
+}
+
+// HasUser returns true if the user is in the table.
+func (a *SQLAuthenticator) HasUser(username string) (bool, error) {
+	_, exists, err := a.password(username)
+	return exists, err
+}
+
+// Close closes the connection to the database.
+func (a *SQLAuthenticator) Close() error {
+	return a.db.Close()
+}
+
+// password returns the password of the user selected by the query. Returns
+// false if the user is not in the table.
+func (a *SQLAuthenticator) password(username string) (string, bool, error) {
+	var password string
+	err := a.db.QueryRow(a.query, username).Scan(&password)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, errors.Wrapf(err, "failed to query user %q", username)
+	}
+	return password, true, nil
+}
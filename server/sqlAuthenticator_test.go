@@ -0,0 +1,128 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+// Tests that SQLAuthenticator.Authenticate accepts the password hashes of the
+// users in the table and rejects an invalid password hash and an unknown user.
+func TestSQLAuthenticator_Authenticate(t *testing.T) {
+	prng := rand.New(rand.NewSource(9147))
+	salt := make([]byte, 32)
+	prng.Read(salt)
+
+	dataSource := newTestUsersDB(`CREATE TABLE users (
+		username TEXT PRIMARY KEY, password TEXT NOT NULL)`, t,
+		"waldo", "hunter2", "carmen", "hunter3")
+
+	a, err := NewSQLAuthenticator(
+		SQLParams{Driver: "sqlite", DataSource: dataSource})
+	if err != nil {
+		t.Fatalf("Failed to make authenticator: %+v", err)
+	}
+	defer func() { _ = a.Close() }()
+
+	checkAuthenticator(a, salt, t)
+}
+
+// Tests that SQLAuthenticator uses a custom query to select the password.
+func TestSQLAuthenticator_Query(t *testing.T) {
+	prng := rand.New(rand.NewSource(3710))
+	salt := make([]byte, 32)
+	prng.Read(salt)
+
+	dataSource := newTestUsersDB(`CREATE TABLE accounts (
+		name TEXT PRIMARY KEY, secret TEXT NOT NULL)`, t)
+	db, err := sql.Open("sqlite", dataSource)
+	if err != nil {
+		t.Fatalf("Failed to open database: %+v", err)
+	}
+	_, err = db.Exec("INSERT INTO accounts VALUES ('waldo', 'hunter2')")
+	_ = db.Close()
+	if err != nil {
+		t.Fatalf("Failed to insert user: %+v", err)
+	}
+
+	a, err := NewSQLAuthenticator(SQLParams{
+		Driver:     "sqlite",
+		DataSource: dataSource,
+		Query:      "SELECT secret FROM accounts WHERE name = $1",
+	})
+	if err != nil {
+		t.Fatalf("Failed to make authenticator: %+v", err)
+	}
+	defer func() { _ = a.Close() }()
+
+	err = a.Authenticate("waldo", hashPassword("hunter2", salt), salt)
+	if err != nil {
+		t.Errorf("Failed to authenticate: %+v", err)
+	}
+}
+
+// Error path: Tests that SQLAuthenticator.Authenticate returns an error other
+// than InvalidCredentialsErr when the query fails.
+func TestSQLAuthenticator_Authenticate_QueryError(t *testing.T) {
+	dataSource := newTestUsersDB(`CREATE TABLE other (id INTEGER)`, t)
+	a, err := NewSQLAuthenticator(
+		SQLParams{Driver: "sqlite", DataSource: dataSource})
+	if err != nil {
+		t.Fatalf("Failed to make authenticator: %+v", err)
+	}
+	defer func() { _ = a.Close() }()
+
+	err = a.Authenticate("waldo", []byte("hash"), []byte("salt"))
+	if err == nil || errors.Is(err, InvalidCredentialsErr) {
+		t.Errorf("Failed to get query error: %+v", err)
+	}
+	if _, err = a.HasUser("waldo"); err == nil {
+		t.Errorf("Failed to get query error from HasUser.")
+	}
+}
+
+// Error path: Tests that NewSQLAuthenticator returns an error when no driver
+// or an unknown driver is set.
+func TestNewSQLAuthenticator_DriverError(t *testing.T) {
+	for _, driver := range []string{"", "unknown"} {
+		_, err := NewSQLAuthenticator(SQLParams{Driver: driver})
+		if err == nil {
+			t.Errorf("Failed to error for driver %q.", driver)
+		}
+	}
+}
+
+// newTestUsersDB creates an SQLite database in a temporary directory with the
+// table and inserts the username/password pairs into the users table. Returns
+// the data source name of the database.
+func newTestUsersDB(table string, t testing.TB, users ...string) string {
+	dataSource := "file:" + filepath.Join(t.TempDir(), "users.db")
+	db, err := sql.Open("sqlite", dataSource)
+	if err != nil {
+		t.Fatalf("Failed to open database: %+v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	if _, err = db.Exec(table); err != nil {
+		t.Fatalf("Failed to create table: %+v", err)
+	}
+	for i := 0; i+1 < len(users); i += 2 {
+		_, err = db.Exec("INSERT INTO users (username, password) VALUES (?, ?)",
+			users[i], users[i+1])
+		if err != nil {
+			t.Fatalf("Failed to insert user %s: %+v", users[i], err)
+		}
+	}
+	return dataSource
+}
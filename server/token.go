@@ -8,9 +8,16 @@
 package server
 
 import (
+	"encoding/hex"
+
+	"gitlab.com/elixxir/crypto/hash"
 	"gitlab.com/xx_network/crypto/nonce"
 )
 
+// sessionIDLen is the length, in bytes, of the hash of a token used as its
+// session ID.
+const sessionIDLen = 8
+
 // Token that identifies a user. It is unique and generated from a user's
 // username and password.
 type Token nonce.Value
@@ -26,3 +33,18 @@ func UnmarshalToken(b []byte) Token {
 	copy(t[:], b)
 	return t
 }
+
+// sessionID returns the ID of the session with the token. The ID identifies
+// the session to administrators without revealing the token, which grants
+// access to the user's storage.
+func sessionID(t Token) string {
+	return hex.EncodeToString(hashToken(t)[:sessionIDLen])
+}
+
+// hashToken returns the hash of the token. It is saved in place of the token
+// when sessions are persisted.
+func hashToken(t Token) []byte {
+	h := hash.CMixHash.New()
+	h.Write(t[:])
+	return h.Sum(nil)
+}
@@ -8,35 +8,27 @@
 package server
 
 import (
-	"github.com/pkg/errors"
+	"time"
 
 	"gitlab.com/elixxir/remoteSyncServer/store"
 	"gitlab.com/xx_network/crypto/nonce"
 )
 
-// userSession stores a nonce with a unique token and an instance of a
-// store.Store for a user that only exists for the given TTL.
+// userSession stores a nonce with a unique token and the store.Store of a user
+// that only exists for the given TTL. The store is shared by all sessions of
+// the user and each session holds a reference to it (see userStore).
 type userSession struct {
 	username string
 	nonce.Nonce
 	store.Store
-}
 
-// newUserSession creates a new session for the user that will expire after the
-// given TTL.
-//
-// Returns [store.NonLocalFileErr] if the file is outside the storage directory.
-func newUserSession(storageDir, username string, n nonce.Nonce,
-	newStore store.NewStore) (userSession, error) {
-	s, err := newStore(storageDir, username)
-	if err != nil {
-		return userSession{}, errors.Wrapf(
-			err, "Failed to create new store for user %q", username)
-	}
+	// loggedIn is when the user authenticated to create the session. It is
+	// kept when the session's token is refreshed and bounds how long the
+	// session may be extended.
+	loggedIn time.Time
+}
 
-	return userSession{
-		username: username,
-		Nonce:    n,
-		Store:    s,
-	}, nil
+// isExpired returns true if the session has expired at the given time.
+func (us *userSession) isExpired(now time.Time) bool {
+	return !now.Before(us.ExpiryTime)
 }
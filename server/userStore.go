@@ -0,0 +1,147 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package server
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+
+	"gitlab.com/elixxir/remoteSyncServer/store"
+)
+
+// userStore is the store of a user, shared by all of their sessions. It is
+// reference counted: each session holds a reference for as long as it exists
+// and each request holds one while it uses the store. The store is closed once
+// the last reference is released.
+type userStore struct {
+	store.Store
+	username string
+	refs     int
+
+	// closed is closed once the store has been closed after its last
+	// reference was released.
+	closed chan struct{}
+}
+
+// storeClosingErr is returned when a store cannot be opened for the user
+// because their previous store is still being closed. The caller must wait for
+// it with waitForStore and try again so that two stores are never open on the
+// same storage at once.
+type storeClosingErr struct {
+	username string
+	closed   <-chan struct{}
+}
+
+// Error returns the error message.
+func (err storeClosingErr) Error() string {
+	return fmt.Sprintf("store of user %s is being closed", err.username)
+}
+
+// acquireStore returns the store of the user with a reference taken. If the
+// user has no open store, a new one is opened in their storage directory. Must
+// be called with the lock held.
+//
+// Returns a [storeClosingErr] if the user's previous store is still being
+// closed and [store.NonLocalFileErr] if the user's directory is outside the
+// storage directory.
+func (h *handler) acquireStore(username string) (store.Store, error) {
+	if us, exists := h.stores[username]; exists {
+		us.refs++
+		return us.Store, nil
+	}
+	if us, exists := h.closingStores[username]; exists {
+		return nil, storeClosingErr{username, us.closed}
+	}
+
+	jww.DEBUG.Printf("Creating new store for user %s.", username)
+	s, err := h.newStore(h.storageDir, username)
+	if err != nil {
+		return nil, errors.Wrapf(
+			err, "Failed to create new store for user %q", username)
+	}
+	s.SetQuota(h.userQuota(username))
+	s.SetRetention(h.retention)
+	h.stores[username] = &userStore{
+		Store:    s,
+		username: username,
+		refs:     1,
+		closed:   make(chan struct{}),
+	}
+
+	return s, nil
+}
+
+// waitForStore waits for the store to finish closing if the error is a
+// [storeClosingErr]. The lock is released while waiting, so the caller must
+// recheck any state it read before. Returns true if it waited. Must be called
+// with the lock held.
+func (h *handler) waitForStore(err error) bool {
+	var closing storeClosingErr
+	if !errors.As(err, &closing) {
+		return false
+	}
+
+	h.mux.Unlock()
+	<-closing.closed
+	h.mux.Lock()
+	return true
+}
+
+// releaseStore releases a reference to the store of the user. If it was the
+// last reference, the store is returned and the caller must close it with
+// closeStore once the lock is released; until then, the user's store cannot be
+// reopened. Must be called with the lock held.
+func (h *handler) releaseStore(username string) *userStore {
+	us, exists := h.stores[username]
+	if !exists {
+		// The stores are closed on shutdown regardless of their references
+		return nil
+	}
+
+	us.refs--
+	if us.refs > 0 {
+		return nil
+	}
+	delete(h.stores, username)
+	h.closingStores[username] = us
+	return us
+}
+
+// closeStore closes the store, logging any error, and then allows the user's
+// store to be reopened. It must not be called with the lock held since closing
+// may block on I/O.
+func (h *handler) closeStore(us *userStore) {
+	if c, ok := us.Store.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			jww.WARN.Printf("Failed to close store for user %s: %+v",
+				us.username, err)
+		}
+	}
+
+	h.mux.Lock()
+	if h.closingStores[us.username] == us {
+		delete(h.closingStores, us.username)
+	}
+	h.mux.Unlock()
+	close(us.closed)
+}
+
+// endRequest releases the reference to the user's store held by a request
+// since it was returned by getLimitedSession. The store is closed if the
+// user's sessions were all removed during the request.
+func (h *handler) endRequest(s *userSession) {
+	h.mux.Lock()
+	us := h.releaseStore(s.username)
+	h.mux.Unlock()
+	if us != nil {
+		h.closeStore(us)
+	}
+}
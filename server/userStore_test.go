@@ -0,0 +1,178 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package server
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gitlab.com/elixxir/remoteSyncServer/store"
+	"gitlab.com/xx_network/primitives/netTime"
+)
+
+// Tests that handler.acquireStore opens a store for a user on the first call
+// and returns the same store with another reference taken on the next.
+func Test_handler_acquireStore(t *testing.T) {
+	h := &handler{
+		stores:        make(map[string]*userStore),
+		closingStores: make(map[string]*userStore),
+		newStore:      store.NewMemStore,
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	s1, err := h.acquireStore("waldo")
+	if err != nil {
+		t.Fatalf("Failed to acquire store: %+v", err)
+	}
+	s2, err := h.acquireStore("waldo")
+	if err != nil {
+		t.Fatalf("Failed to acquire store again: %+v", err)
+	}
+
+	if s1 != s2 {
+		t.Errorf("New store opened for user with an open store.")
+	}
+	if refs := h.stores["waldo"].refs; refs != 2 {
+		t.Errorf("Unexpected number of references."+
+			"\nexpected: %d\nreceived: %d", 2, refs)
+	}
+}
+
+// Error path: Tests that handler.acquireStore returns store.NonLocalFileErr
+// for a username outside the storage directory.
+func Test_handler_acquireStore_NonLocalFileError(t *testing.T) {
+	testDir := "tmp"
+	defer func() {
+		if err := os.RemoveAll(testDir); err != nil {
+			t.Fatalf("Failed to remove %s: %+v", testDir, err)
+		}
+	}()
+	h := &handler{
+		storageDir:    testDir,
+		stores:        make(map[string]*userStore),
+		closingStores: make(map[string]*userStore),
+		newStore:      store.NewFileStore,
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	_, err := h.acquireStore("user/../..")
+	if !errors.Is(err, store.NonLocalFileErr) {
+		t.Errorf("Unexpected error.\nexpected: %v\nreceived: %+v",
+			store.NonLocalFileErr, err)
+	}
+	if len(h.stores) != 0 {
+		t.Errorf("Store added on error: %v", h.stores)
+	}
+}
+
+// Tests that the store of a user is not closed while a request is using it
+// after the user's last session is revoked and that it is closed once the
+// request ends.
+func Test_handler_endRequest(t *testing.T) {
+	var closed int32
+	h := newReaperTestHandler(time.Hour, newTestClock(netTime.Now()), &closed)
+	added, err := h.addSession("waldo")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+
+	s, err := h.getLimitedSession(Token(added.Value), readOp, 0)
+	if err != nil {
+		t.Fatalf("Failed to get session: %+v", err)
+	}
+	if n := h.revokeUser("waldo"); n != 1 {
+		t.Errorf("Unexpected number of sessions revoked."+
+			"\nexpected: %d\nreceived: %d", 1, n)
+	}
+
+	if n := atomic.LoadInt32(&closed); n != 0 {
+		t.Errorf("Store closed during request.")
+	}
+	if err = s.Write("file.txt", []byte("data")); err != nil {
+		t.Errorf("Failed to write during request: %+v", err)
+	}
+
+	h.endRequest(s)
+	if n := atomic.LoadInt32(&closed); n != 1 {
+		t.Errorf("Unexpected number of stores closed after request."+
+			"\nexpected: %d\nreceived: %d", 1, n)
+	}
+	if len(h.stores) != 0 || len(h.closingStores) != 0 {
+		t.Errorf("Closed store not removed.\nstores:        %v"+
+			"\nclosingStores: %v", h.stores, h.closingStores)
+	}
+}
+
+// Tests that handler.addSession waits for the previous store of the user to
+// finish closing before opening a new one, so that two stores are never open
+// on the same storage at once.
+func Test_handler_addSession_WaitsForClose(t *testing.T) {
+	var opened int32
+	h := &handler{
+		tokenTTL:      time.Hour,
+		sessions:      make(map[Token]*userSession),
+		userTokens:    make(map[string][]Token),
+		stores:        make(map[string]*userStore),
+		closingStores: make(map[string]*userStore),
+		newStore: func(storageDir, baseDir string) (store.Store, error) {
+			atomic.AddInt32(&opened, 1)
+			s, err := store.NewMemStore(storageDir, baseDir)
+			return &blockingCloserStore{s, make(chan struct{})}, err
+		},
+		now: netTime.Now,
+	}
+	first, err := h.addSession("waldo")
+	if err != nil {
+		t.Fatalf("Failed to add session: %+v", err)
+	}
+
+	go h.revokeUser("waldo")
+	for closing := false; !closing; {
+		time.Sleep(time.Millisecond)
+		h.mux.Lock()
+		_, closing = h.closingStores["waldo"]
+		h.mux.Unlock()
+	}
+
+	added := make(chan *userSession)
+	go func() {
+		s, err2 := h.addSession("waldo")
+		if err2 != nil {
+			t.Errorf("Failed to add session after close: %+v", err2)
+		}
+		added <- s
+	}()
+
+	select {
+	case <-added:
+		t.Fatalf("Session added while previous store was closing.")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if n := atomic.LoadInt32(&opened); n != 1 {
+		t.Errorf("Store opened while previous store was closing.")
+	}
+
+	close(first.Store.(*blockingCloserStore).unblock)
+	select {
+	case s := <-added:
+		if s.Store == first.Store {
+			t.Errorf("Closed store reused.")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for session to be added.")
+	}
+	if n := atomic.LoadInt32(&opened); n != 2 {
+		t.Errorf("Unexpected number of stores opened."+
+			"\nexpected: %d\nreceived: %d", 2, n)
+	}
+}
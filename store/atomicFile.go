@@ -0,0 +1,161 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package store
+
+import (
+	ioFS "io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+
+	"gitlab.com/xx_network/primitives/utils"
+)
+
+// internalFilePrefix is the prefix of all files the FileStore creates for its
+// own use. Paths with a component starting with this prefix are reserved and
+// cannot be accessed by users.
+const internalFilePrefix = ".remoteSync."
+
+// tempFilePrefix is the prefix of temporary files created while writing. Any
+// that exist when a FileStore is opened were left by an interrupted write.
+const tempFilePrefix = internalFilePrefix + "tmp."
+
+// renameFile renames the temporary file into place. It can be replaced in
+// tests to simulate an interrupted write.
+var renameFile = os.Rename
+
+// writeFileAtomic writes the data to the file at the path so that the file
+// either contains its old contents or the new data, even if the process or
+// machine crashes during the write. The data is written to a temporary file in
+// the same directory, which is synced to disk and then renamed over the file.
+// The parent directory is then synced so the rename is durable. Any missing
+// parent directories are created.
+func writeFileAtomic(path string, data []byte, perm ioFS.FileMode) error {
+	path, err := utils.ExpandPath(path)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	if err = os.MkdirAll(dir, perm); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, tempFilePrefix+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tempPath := f.Name()
+
+	// Remove the temporary file if anything fails before it is renamed
+	renamed := false
+	defer func() {
+		if !renamed {
+			if err := os.Remove(tempPath); err != nil &&
+				!errors.Is(err, os.ErrNotExist) {
+				jww.WARN.Printf(
+					"Failed to remove temporary file %s: %+v", tempPath, err)
+			}
+		}
+	}()
+
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	} else if err = f.Chmod(perm); err != nil {
+		_ = f.Close()
+		return err
+	} else if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	} else if err = f.Close(); err != nil {
+		return err
+	}
+
+	if err = renameFile(tempPath, path); err != nil {
+		return err
+	}
+	renamed = true
+
+	return syncDir(dir)
+}
+
+// linkFile makes the new path refer to the same contents as the old path and
+// preserves its modification time. A hard link is used when the file system
+// supports it; otherwise, the file is copied.
+func linkFile(oldPath, newPath string) error {
+	if err := os.Link(oldPath, newPath); err == nil {
+		return nil
+	}
+
+	fi, err := os.Stat(oldPath)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(oldPath)
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(newPath, data, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(newPath, fi.ModTime(), fi.ModTime())
+}
+
+// syncDir commits the directory's entries to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err = d.Sync(); err != nil {
+		_ = d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// removeTempFiles deletes all temporary files left in the directory and its
+// subdirectories by interrupted writes. Returns the number of files removed.
+func removeTempFiles(dir string) (int, error) {
+	var removed int
+	err := filepath.WalkDir(dir, func(path string, d ioFS.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !isTempFile(d.Name()) {
+			return err
+		}
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+		jww.INFO.Printf("Removed temporary file %s left by an interrupted "+
+			"write.", path)
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+// isTempFile returns true if the file name is of a temporary file created by
+// writeFileAtomic.
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, tempFilePrefix)
+}
+
+// isReservedPath returns true if any component of the relative path is
+// reserved for files internal to the store.
+func isReservedPath(path string) bool {
+	for _, name := range strings.Split(
+		filepath.ToSlash(filepath.Clean(path)), "/") {
+		if strings.HasPrefix(name, internalFilePrefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package store
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Tests that writeFileAtomic writes the data, creates missing directories, and
+// leaves no temporary files behind.
+func Test_writeFileAtomic(t *testing.T) {
+	testDir := "tmp"
+	defer removeTestFile(t, testDir)
+
+	path := filepath.Join(testDir, "dir1", "dir2", "file.txt")
+	for _, data := range [][]byte{[]byte("hello"), []byte("goodbye")} {
+		if err := writeFileAtomic(path, data, FilePerm); err != nil {
+			t.Fatalf("Failed to write %s: %+v", path, err)
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Errorf("Failed to read %s: %+v", path, err)
+		} else if !bytes.Equal(data, content) {
+			t.Errorf("Unexpected content.\nexpected: %q\nreceived: %q",
+				data, content)
+		}
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat %s: %+v", path, err)
+	} else if fi.Mode().Perm() != FilePerm {
+		t.Errorf("Unexpected permissions.\nexpected: %s\nreceived: %s",
+			FilePerm, fi.Mode().Perm())
+	}
+
+	assertNoTempFiles(testDir, t)
+}
+
+// Tests that when a write is interrupted before the temporary file is renamed
+// into place, the file keeps its previous contents and the temporary file is
+// removed.
+func Test_writeFileAtomic_Interrupted(t *testing.T) {
+	testDir := "tmp"
+	defer removeTestFile(t, testDir)
+
+	path := filepath.Join(testDir, "file.txt")
+	original := []byte("original contents")
+	if err := writeFileAtomic(path, original, FilePerm); err != nil {
+		t.Fatalf("Failed to write %s: %+v", path, err)
+	}
+
+	interruptErr := errors.New("interrupted")
+	renameFile = func(string, string) error { return interruptErr }
+	defer func() { renameFile = os.Rename }()
+
+	err := writeFileAtomic(path, []byte("new"), FilePerm)
+	if !errors.Is(err, interruptErr) {
+		t.Errorf("Unexpected error.\nexpected: %v\nreceived: %+v",
+			interruptErr, err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Errorf("Failed to read %s: %+v", path, err)
+	} else if !bytes.Equal(original, content) {
+		t.Errorf("File modified by interrupted write."+
+			"\nexpected: %q\nreceived: %q", original, content)
+	}
+
+	assertNoTempFiles(testDir, t)
+}
+
+// Tests that NewFileStore removes temporary files left by writes interrupted
+// by a crash, leaves all other files untouched, and excludes the temporary
+// files from the usage.
+func TestNewFileStore_RemovesTempFiles(t *testing.T) {
+	testDir := "tmp"
+	defer removeTestFile(t, testDir)
+
+	fs := newTestFileStore("baseDir", testDir, t)
+	if err := fs.Write("dir/file.txt", []byte("data")); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+
+	// Simulate a crash after the temporary file was written
+	orphan := filepath.Join(fs.baseDir, "dir", tempFilePrefix+"file.txt.1234")
+	if err := os.WriteFile(orphan, []byte("partial"), FilePerm); err != nil {
+		t.Fatalf("Failed to write temporary file: %+v", err)
+	}
+
+	fs = newTestFileStore("baseDir", testDir, t)
+	if _, err := os.Stat(orphan); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Temporary file not removed: %+v", err)
+	}
+
+	if data, err := fs.Read("dir/file.txt"); err != nil {
+		t.Errorf("Failed to read: %+v", err)
+	} else if !bytes.Equal([]byte("data"), data) {
+		t.Errorf("Unexpected data.\nexpected: %q\nreceived: %q", "data", data)
+	}
+
+	if usage := fs.GetUsage(); usage != (Usage{4, 1, 0}) {
+		t.Errorf("Unexpected usage.\nexpected: %+v\nreceived: %+v",
+			Usage{4, 1, 0}, usage)
+	}
+}
+
+// Error path: Tests that FileStore returns ReservedPathErr for paths that use
+// a name reserved for internal files.
+func TestFileStore_ReservedPathError(t *testing.T) {
+	fs := &FileStore{baseDir: "baseDir"}
+	for _, path := range []string{tempFilePrefix + "file",
+		"dir/" + internalFilePrefix + "meta", internalFilePrefix + "dir/file"} {
+		if _, err := fs.Read(path); !errors.Is(err, ReservedPathErr) {
+			t.Errorf("Unexpected error reading reserved path %s."+
+				"\nexpected: %v\nreceived: %v", path, ReservedPathErr, err)
+		}
+		if err := fs.Write(path, nil); !errors.Is(err, ReservedPathErr) {
+			t.Errorf("Unexpected error writing reserved path %s."+
+				"\nexpected: %v\nreceived: %v", path, ReservedPathErr, err)
+		}
+	}
+}
+
+// Tests that isReservedPath only returns true for paths with a component that
+// starts with internalFilePrefix.
+func Test_isReservedPath(t *testing.T) {
+	tests := map[string]bool{
+		"file":                                false,
+		"dir/file":                            false,
+		".remoteSync":                         false,
+		"dir/.remoteSyncFile":                 false,
+		"dir/" + internalFilePrefix + "a/b":   true,
+		internalFilePrefix + "meta":           true,
+		"dir/../" + tempFilePrefix + "file.1": true,
+	}
+
+	for path, expected := range tests {
+		if reserved := isReservedPath(path); reserved != expected {
+			t.Errorf("Unexpected result for %s.\nexpected: %t\nreceived: %t",
+				path, expected, reserved)
+		}
+	}
+}
+
+// assertNoTempFiles fails the test if any temporary files exist in the
+// directory.
+func assertNoTempFiles(dir string, t testing.TB) {
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && isTempFile(d.Name()) {
+			t.Errorf("Temporary file %s not removed.", path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Errorf("Failed to walk %s: %+v", dir, err)
+	}
+}
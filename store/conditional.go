@@ -0,0 +1,117 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"time"
+)
+
+// Precondition is the state that a file must be in for WriteIf to write to it.
+// Only the fields that are set are checked. If no fields are set, then the
+// write is unconditional.
+type Precondition struct {
+	// Modified is the last modification time of the file, as returned by
+	// GetLastModified.
+	Modified time.Time
+
+	// Hash is the hash of the contents of the file, as returned by
+	// ContentHash.
+	Hash []byte
+
+	// NotExist requires that the file does not exist. It cannot be combined
+	// with the other fields.
+	NotExist bool
+}
+
+// ConflictError is returned by WriteIf when the file does not match the
+// precondition. It describes the current state of the file so that the client
+// can merge its changes.
+type ConflictError struct {
+	// Path is the path of the file.
+	Path string
+
+	// Exists is true if the file exists. If it is false, then the remaining
+	// fields are empty.
+	Exists bool
+
+	// Modified is the last modification time of the file.
+	Modified time.Time
+
+	// Hash is the hash of the contents of the file.
+	Hash []byte
+
+	// Size is the size of the file in bytes.
+	Size int64
+}
+
+// Error returns a description of the conflict.
+func (e *ConflictError) Error() string {
+	if e.Path == "" {
+		return "file does not match precondition"
+	} else if !e.Exists {
+		return fmt.Sprintf(
+			"file %s does not match precondition: file does not exist", e.Path)
+	}
+	return fmt.Sprintf("file %s does not match precondition: modified %s "+
+		"with hash %x", e.Path, e.Modified, e.Hash)
+}
+
+// Is returns true if the target is a *ConflictError so that any conflict
+// matches ConflictErr with errors.Is.
+func (e *ConflictError) Is(target error) bool {
+	_, ok := target.(*ConflictError)
+	return ok
+}
+
+// ContentHash returns the SHA-256 hash of the contents of a file used in a
+// Precondition.
+func ContentHash(data []byte) []byte {
+	h := sha256.Sum256(data)
+	return h[:]
+}
+
+// isEmpty returns true if no fields of the precondition are set.
+func (c Precondition) isEmpty() bool {
+	return c.Modified.IsZero() && c.Hash == nil && !c.NotExist
+}
+
+// check returns a *ConflictError if the current state of the file does not
+// match the precondition. The data is only used if the file exists.
+func (c Precondition) check(
+	path string, exists bool, modified time.Time, data []byte) error {
+	if c.matches(exists, modified, data) {
+		return nil
+	}
+
+	conflict := &ConflictError{Path: path, Exists: exists}
+	if exists {
+		conflict.Modified = modified
+		conflict.Hash = ContentHash(data)
+		conflict.Size = int64(len(data))
+	}
+	return conflict
+}
+
+// matches returns true if the current state of the file matches the
+// precondition.
+func (c Precondition) matches(
+	exists bool, modified time.Time, data []byte) bool {
+	if c.isEmpty() {
+		return true
+	} else if c.NotExist || !exists {
+		return c.NotExist && !exists
+	} else if !c.Modified.IsZero() && !c.Modified.Equal(modified) {
+		return false
+	} else if c.Hash != nil && !bytes.Equal(c.Hash, ContentHash(data)) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package store
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	pkgErrors "github.com/pkg/errors"
+)
+
+// Tests that Precondition.matches returns the expected result for each
+// combination of precondition and file state.
+func TestPrecondition_matches(t *testing.T) {
+	modified := time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)
+	data := []byte("contents")
+
+	tests := []struct {
+		cond     Precondition
+		exists   bool
+		expected bool
+	}{
+		{Precondition{}, true, true},
+		{Precondition{}, false, true},
+		{Precondition{NotExist: true}, false, true},
+		{Precondition{NotExist: true}, true, false},
+		{Precondition{Modified: modified}, true, true},
+		{Precondition{Modified: modified}, false, false},
+		{Precondition{Modified: modified.Add(time.Nanosecond)}, true, false},
+		{Precondition{Hash: ContentHash(data)}, true, true},
+		{Precondition{Hash: ContentHash([]byte("other"))}, true, false},
+		{Precondition{Hash: ContentHash(data)}, false, false},
+		{Precondition{Modified: modified, Hash: ContentHash(data)}, true, true},
+		{Precondition{Modified: modified.Add(time.Second),
+			Hash: ContentHash(data)}, true, false},
+	}
+
+	for i, tt := range tests {
+		if m := tt.cond.matches(tt.exists, modified, data); m != tt.expected {
+			t.Errorf("Unexpected result for %+v with exists=%t (%d)."+
+				"\nexpected: %t\nreceived: %t", tt.cond, tt.exists, i, tt.expected, m)
+		}
+	}
+}
+
+// Tests that Precondition.check returns a ConflictError describing the
+// current file when it does not match.
+func TestPrecondition_check(t *testing.T) {
+	modified := time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)
+	data := []byte("contents")
+
+	err := Precondition{NotExist: true}.check("file", true, modified, data)
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("Unexpected error.\nexpected: %T\nreceived: %+v",
+			conflict, err)
+	}
+
+	expected := &ConflictError{
+		Path:     "file",
+		Exists:   true,
+		Modified: modified,
+		Hash:     ContentHash(data),
+		Size:     int64(len(data)),
+	}
+	if conflict.Path != expected.Path || conflict.Exists != expected.Exists ||
+		!conflict.Modified.Equal(expected.Modified) ||
+		!bytes.Equal(conflict.Hash, expected.Hash) ||
+		conflict.Size != expected.Size {
+		t.Errorf("Unexpected conflict.\nexpected: %+v\nreceived: %+v",
+			expected, conflict)
+	}
+
+	err = Precondition{Hash: ContentHash(data)}.check("file", false, time.Time{}, nil)
+	if !errors.As(err, &conflict) {
+		t.Fatalf("Unexpected error.\nexpected: %T\nreceived: %+v",
+			conflict, err)
+	} else if conflict.Exists || conflict.Hash != nil {
+		t.Errorf("Unexpected conflict for missing file: %+v", conflict)
+	}
+
+	if err = (Precondition{}).check("file", true, modified, data); err != nil {
+		t.Errorf("Unexpected error for empty precondition: %+v", err)
+	}
+}
+
+// Tests that a wrapped ConflictError matches ConflictErr and no other error.
+func TestConflictError_Is(t *testing.T) {
+	err := pkgErrors.WithStack(&ConflictError{Path: "file", Exists: true})
+	if !errors.Is(err, ConflictErr) {
+		t.Errorf("Wrapped ConflictError does not match ConflictErr.")
+	}
+	if errors.Is(err, QuotaExceededErr) {
+		t.Errorf("ConflictError matches QuotaExceededErr.")
+	}
+	if errors.Is(QuotaExceededErr, ConflictErr) {
+		t.Errorf("QuotaExceededErr matches ConflictErr.")
+	}
+}
@@ -0,0 +1,998 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package store
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"gitlab.com/xx_network/primitives/netTime"
+)
+
+// conformanceClockTolerance is how far the times reported by a store may
+// precede the time a modification started. File systems set modification times
+// from a coarse clock that can lag behind the current time, and object stores
+// report modification times in whole seconds.
+const conformanceClockTolerance = time.Second
+
+// RunConformanceTests runs the tests that every Store implementation must pass
+// against the stores created by newStore. Each test creates a new store in a
+// new temporary storage directory. Stores that implement io.Closer are closed
+// when their test finishes.
+//
+// Call it from a test of the implementation:
+//
+//	func TestMyStore_Conformance(t *testing.T) {
+//		store.RunConformanceTests(t, NewMyStore)
+//	}
+func RunConformanceTests(t *testing.T, newStore NewStore) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s Store)
+	}{
+		{"WriteRead", conformanceWriteRead},
+		{"NonLocalPath", conformanceNonLocalPath},
+		{"ReservedPath", conformanceReservedPath},
+		{"MissingFile", conformanceMissingFile},
+		{"WriteIf", conformanceWriteIf},
+		{"ReadDirOrder", conformanceReadDirOrder},
+		{"ReadDirEntries", conformanceReadDirEntries},
+		{"Manifest", conformanceManifest},
+		{"GetLastWrite", conformanceGetLastWrite},
+		{"Delete", conformanceDelete},
+		{"DeleteDir", conformanceDeleteDir},
+		{"GetChanges", conformanceGetChanges},
+		{"Versions", conformanceVersions},
+		{"VersionQuota", conformanceVersionQuota},
+		{"ConcurrentAccess", conformanceConcurrentAccess},
+		{"Rewrite", conformanceRewrite},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newStore(t.TempDir(), "user")
+			if err != nil {
+				t.Fatalf("Failed to create new store: %+v", err)
+			}
+			if c, ok := s.(io.Closer); ok {
+				t.Cleanup(func() {
+					if err := c.Close(); err != nil {
+						t.Errorf("Failed to close store: %+v", err)
+					}
+				})
+			}
+			tt.test(t, s)
+		})
+	}
+}
+
+// conformanceWriteRead tests that written files can be read back, that
+// equivalent paths refer to the same file, and that files can be overwritten.
+func conformanceWriteRead(t *testing.T, s Store) {
+	files := map[string][]byte{
+		"file.txt":         []byte("file"),
+		"dir/file.txt":     []byte("nested file"),
+		"dir/sub/file.txt": []byte("deeply nested file"),
+		"empty":            {},
+	}
+	for path, data := range files {
+		if err := s.Write(path, data); err != nil {
+			t.Fatalf("Failed to write %s: %+v", path, err)
+		}
+	}
+	for path, expected := range files {
+		if data, err := s.Read(path); err != nil {
+			t.Errorf("Failed to read %s: %+v", path, err)
+		} else if !bytes.Equal(expected, data) {
+			t.Errorf("Unexpected data for %s.\nexpected: %q\nreceived: %q",
+				path, expected, data)
+		}
+	}
+
+	// Equivalent paths refer to the same file
+	for _, path := range []string{"/file.txt", "dir/../file.txt", "./file.txt"} {
+		if data, err := s.Read(path); err != nil {
+			t.Errorf("Failed to read %s: %+v", path, err)
+		} else if !bytes.Equal(files["file.txt"], data) {
+			t.Errorf("Unexpected data for %s.\nexpected: %q\nreceived: %q",
+				path, files["file.txt"], data)
+		}
+	}
+
+	overwrite := []byte("overwritten")
+	if err := s.Write("dir/./file.txt", overwrite); err != nil {
+		t.Fatalf("Failed to overwrite: %+v", err)
+	} else if data, err := s.Read("dir/file.txt"); err != nil {
+		t.Errorf("Failed to read overwritten file: %+v", err)
+	} else if !bytes.Equal(overwrite, data) {
+		t.Errorf("Unexpected data after overwrite."+
+			"\nexpected: %q\nreceived: %q", overwrite, data)
+	}
+
+	var size int64
+	for path, data := range files {
+		if path == "dir/file.txt" {
+			data = overwrite
+		}
+		size += int64(len(data))
+	}
+	checkConformanceUsage(t, s, int64(len(files)), size)
+}
+
+// conformanceNonLocalPath tests that every method rejects paths outside the
+// base directory with NonLocalFileErr without modifying the store.
+func conformanceNonLocalPath(t *testing.T, s Store) {
+	if err := s.Write("file", []byte("data")); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+	usage := s.GetUsage()
+
+	for _, path := range []string{"../file", "dir/../../file", "..", "../user"} {
+		ops := map[string]func() error{
+			"Read": func() error { _, err := s.Read(path); return err },
+			"Write": func() error {
+				return s.Write(path, []byte("data"))
+			},
+			"WriteIf": func() error {
+				return s.WriteIf(path, []byte("data"), Precondition{})
+			},
+			"GetLastModified": func() error {
+				_, err := s.GetLastModified(path)
+				return err
+			},
+			"ReadDir": func() error { _, err := s.ReadDir(path); return err },
+			"ReadDirEntries": func() error {
+				_, err := s.ReadDirEntries(path)
+				return err
+			},
+			"Manifest": func() error {
+				_, err := s.Manifest(path, time.Time{})
+				return err
+			},
+			"Delete":    func() error { return s.Delete(path) },
+			"DeleteDir": func() error { return s.DeleteDir(path) },
+			"ListVersions": func() error {
+				_, err := s.ListVersions(path)
+				return err
+			},
+			"ReadVersion": func() error {
+				_, err := s.ReadVersion(path, 1)
+				return err
+			},
+		}
+		for name, op := range ops {
+			if err := op(); !errors.Is(err, NonLocalFileErr) {
+				t.Errorf("Unexpected error from %s for %q."+
+					"\nexpected: %v\nreceived: %+v",
+					name, path, NonLocalFileErr, err)
+			}
+		}
+	}
+
+	if data, err := s.Read("file"); err != nil || !bytes.Equal(data, []byte("data")) {
+		t.Errorf("File modified by non-local operations: %q, %+v", data, err)
+	} else if newUsage := s.GetUsage(); newUsage != usage {
+		t.Errorf("Usage modified by non-local operations."+
+			"\nexpected: %+v\nreceived: %+v", usage, newUsage)
+	}
+}
+
+// conformanceReservedPath tests that names reserved for internal files cannot
+// be written.
+func conformanceReservedPath(t *testing.T, s Store) {
+	for _, path := range []string{
+		internalFilePrefix + "file", "dir/" + internalFilePrefix + "file"} {
+		if err := s.Write(path, []byte("data")); !errors.Is(err, ReservedPathErr) {
+			t.Errorf("Unexpected error writing %s."+
+				"\nexpected: %v\nreceived: %+v", path, ReservedPathErr, err)
+		}
+	}
+}
+
+// conformanceMissingFile tests that operations on files and directories that
+// do not exist return os.ErrNotExist and that reading a missing version returns
+// VersionNotFoundErr.
+func conformanceMissingFile(t *testing.T, s Store) {
+	if err := s.Write("dir/file", []byte("data")); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+
+	for _, path := range []string{"missing", "dir/missing", "missing/file"} {
+		if _, err := s.Read(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Unexpected error from Read for %s."+
+				"\nexpected: %v\nreceived: %+v", path, os.ErrNotExist, err)
+		}
+		if _, err := s.GetLastModified(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Unexpected error from GetLastModified for %s."+
+				"\nexpected: %v\nreceived: %+v", path, os.ErrNotExist, err)
+		}
+		if err := s.Delete(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Unexpected error from Delete for %s."+
+				"\nexpected: %v\nreceived: %+v", path, os.ErrNotExist, err)
+		}
+		if _, err := s.ReadDir(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Unexpected error from ReadDir for %s."+
+				"\nexpected: %v\nreceived: %+v", path, os.ErrNotExist, err)
+		}
+		if _, err := s.ReadDirEntries(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Unexpected error from ReadDirEntries for %s."+
+				"\nexpected: %v\nreceived: %+v", path, os.ErrNotExist, err)
+		}
+		if _, err := s.Manifest(path, time.Time{}); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Unexpected error from Manifest for %s."+
+				"\nexpected: %v\nreceived: %+v", path, os.ErrNotExist, err)
+		}
+		if err := s.DeleteDir(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Unexpected error from DeleteDir for %s."+
+				"\nexpected: %v\nreceived: %+v", path, os.ErrNotExist, err)
+		}
+	}
+
+	if _, err := s.ReadVersion("dir/file", 1); !errors.Is(err, VersionNotFoundErr) {
+		t.Errorf("Unexpected error from ReadVersion."+
+			"\nexpected: %v\nreceived: %+v", VersionNotFoundErr, err)
+	}
+}
+
+// conformanceReadDirOrder tests that ReadDir returns only the directories and
+// ReadDirEntries returns all entries, both sorted by name, and that
+// directories sharing a prefix are not confused.
+func conformanceReadDirOrder(t *testing.T, s Store) {
+	names := []string{"b", "a", "C", "aa", "a1", "_x", "0", "B"}
+	for i, name := range names {
+		for _, path := range []string{name + "/file", "dir/" + name,
+			"dir/" + name + "Dir/file", "dir2/" + name + "/file"} {
+			if err := s.Write(path, []byte(strconv.Itoa(i))); err != nil {
+				t.Fatalf("Failed to write %s: %+v", path, err)
+			}
+		}
+	}
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+
+	dirs, err := s.ReadDir("")
+	if err != nil {
+		t.Fatalf("Failed to read base directory: %+v", err)
+	}
+	expected := append(append([]string{}, sorted...), "dir", "dir2")
+	sort.Strings(expected)
+	if !reflect.DeepEqual(expected, dirs) {
+		t.Errorf("Unexpected base directories.\nexpected: %q\nreceived: %q",
+			expected, dirs)
+	}
+
+	dirs, err = s.ReadDir("dir2")
+	if err != nil {
+		t.Fatalf("Failed to read directory: %+v", err)
+	} else if !reflect.DeepEqual(sorted, dirs) {
+		t.Errorf("Unexpected directories.\nexpected: %q\nreceived: %q",
+			sorted, dirs)
+	}
+
+	entries, err := s.ReadDirEntries("dir")
+	if err != nil {
+		t.Fatalf("Failed to read directory entries: %+v", err)
+	}
+	expectedEntries := make([]DirEntry, 0, 2*len(names))
+	for _, name := range sorted {
+		expectedEntries = append(expectedEntries,
+			DirEntry{Name: name, Size: 1}, DirEntry{Name: name + "Dir", IsDir: true})
+	}
+	sortDirEntries(expectedEntries)
+	if len(expectedEntries) != len(entries) {
+		t.Fatalf("Unexpected entries.\nexpected: %+v\nreceived: %+v",
+			expectedEntries, entries)
+	}
+	for i, e := range entries {
+		ee := expectedEntries[i]
+		if e.Name != ee.Name || e.IsDir != ee.IsDir || e.Size != ee.Size ||
+			e.IsDir != e.Modified.IsZero() {
+			t.Errorf("Unexpected entry %d.\nexpected: %+v\nreceived: %+v",
+				i, ee, e)
+		}
+	}
+
+	dirs, err = s.ReadDir("a")
+	if err != nil {
+		t.Fatalf("Failed to read directory: %+v", err)
+	} else if len(dirs) != 0 {
+		t.Errorf("Directory with only files has subdirectories: %q", dirs)
+	}
+}
+
+// conformanceGetLastWrite tests that GetLastWrite returns os.ErrNotExist until
+// a file is written and afterwards returns the time of the most recent write
+// or delete.
+func conformanceGetLastWrite(t *testing.T, s Store) {
+	if _, err := s.GetLastWrite(); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error for new store."+
+			"\nexpected: %v\nreceived: %+v", os.ErrNotExist, err)
+	}
+
+	var last time.Time
+	check := func(op string, start time.Time) {
+		lastWrite, err := s.GetLastWrite()
+		if err != nil {
+			t.Fatalf("Failed to get last write after %s: %+v", op, err)
+		} else if lastWrite.Before(start.Add(-conformanceClockTolerance)) ||
+			lastWrite.After(netTime.Now()) {
+			t.Errorf("Last write after %s not between %s and now: %s",
+				op, start, lastWrite)
+		} else if lastWrite.Before(last) {
+			t.Errorf("Last write after %s is before the previous last write."+
+				"\nprevious: %s\nreceived: %s", op, last, lastWrite)
+		}
+		last = lastWrite
+	}
+
+	start := netTime.Now()
+	if err := s.Write("dir/a", []byte("a")); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+	check("write", start)
+	if modified, err := s.GetLastModified("dir/a"); err != nil {
+		t.Errorf("Failed to get last modified: %+v", err)
+	} else if !modified.Equal(last) {
+		t.Errorf("Last write does not match modification time of the written "+
+			"file.\nexpected: %s\nreceived: %s", modified, last)
+	}
+
+	start = netTime.Now()
+	if err := s.Write("dir/b", []byte("b")); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+	check("second write", start)
+
+	start = netTime.Now()
+	if err := s.Delete("dir/a"); err != nil {
+		t.Fatalf("Failed to delete: %+v", err)
+	}
+	check("delete", start)
+
+	start = netTime.Now()
+	if err := s.DeleteDir("dir"); err != nil {
+		t.Fatalf("Failed to delete directory: %+v", err)
+	}
+	check("delete directory", start)
+
+	// Failed modifications do not change the last write
+	_ = s.Delete("missing")
+	if lastWrite, err := s.GetLastWrite(); err != nil || !lastWrite.Equal(last) {
+		t.Errorf("Last write changed after failed delete."+
+			"\nexpected: %s\nreceived: %s (%+v)", last, lastWrite, err)
+	}
+}
+
+// conformanceDelete tests that Delete removes only the file and updates the
+// usage.
+func conformanceDelete(t *testing.T, s Store) {
+	for _, path := range []string{"a", "dir/a", "dir/b"} {
+		if err := s.Write(path, []byte(path)); err != nil {
+			t.Fatalf("Failed to write %s: %+v", path, err)
+		}
+	}
+
+	if err := s.Delete("dir/a"); err != nil {
+		t.Fatalf("Failed to delete: %+v", err)
+	}
+	if _, err := s.Read("dir/a"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error reading deleted file."+
+			"\nexpected: %v\nreceived: %+v", os.ErrNotExist, err)
+	}
+	for _, path := range []string{"a", "dir/b"} {
+		if data, err := s.Read(path); err != nil || !bytes.Equal([]byte(path), data) {
+			t.Errorf("File %s changed by delete: %q, %+v", path, data, err)
+		}
+	}
+
+	if err := s.Delete("dir"); err == nil {
+		t.Errorf("Did not fail to delete a directory as a file.")
+	}
+
+	checkConformanceUsage(t, s, 2, int64(len("a")+len("dir/b")))
+}
+
+// conformanceDeleteDir tests that DeleteDir removes everything in the directory
+// and nothing outside it and that deleting the base directory empties the
+// store.
+func conformanceDeleteDir(t *testing.T, s Store) {
+	for _, path := range []string{"file", "dir1/a", "dir1/dirA/a",
+		"dir1/dirB/dirB1/a", "dir10/a", "dir2/a"} {
+		if err := s.Write(path, []byte("data")); err != nil {
+			t.Fatalf("Failed to write %s: %+v", path, err)
+		}
+	}
+
+	if err := s.DeleteDir("dir1/"); err != nil {
+		t.Fatalf("Failed to delete directory: %+v", err)
+	}
+	dirs, err := s.ReadDir("")
+	if err != nil {
+		t.Fatalf("Failed to read base directory: %+v", err)
+	} else if expected := []string{"dir10", "dir2"}; !reflect.DeepEqual(expected, dirs) {
+		t.Errorf("Unexpected directories after delete."+
+			"\nexpected: %q\nreceived: %q", expected, dirs)
+	}
+	if _, err = s.Read(filepath.Join("dir1", "a")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error reading deleted file."+
+			"\nexpected: %v\nreceived: %+v", os.ErrNotExist, err)
+	}
+	checkConformanceUsage(t, s, 3, 12)
+
+	if err = s.DeleteDir(""); err != nil {
+		t.Fatalf("Failed to delete base directory: %+v", err)
+	}
+	entries, err := s.ReadDirEntries("")
+	if err != nil {
+		t.Errorf("Failed to read base directory after delete: %+v", err)
+	} else if len(entries) != 0 {
+		t.Errorf("Base directory not empty after delete: %+v", entries)
+	}
+	checkConformanceUsage(t, s, 0, 0)
+
+	// The base directory can be deleted when it is empty
+	if err = s.DeleteDir(""); err != nil {
+		t.Errorf("Failed to delete empty base directory: %+v", err)
+	}
+}
+
+// conformanceVersionQuota tests that previous versions count towards the byte
+// quota and that the oldest versions are removed to keep the store within it,
+// so that repeatedly writing and deleting a file cannot exceed the quota.
+func conformanceVersionQuota(t *testing.T, s Store) {
+	const maxBytes, writes = 1000, 50
+	s.SetQuota(Quota{MaxBytes: maxBytes})
+	s.SetRetention(RetentionPolicy{MaxVersions: writes})
+
+	var data []byte
+	for i := 0; i < writes; i++ {
+		data = bytes.Repeat([]byte{byte(i)}, 100)
+		if err := s.Write("file", data); err != nil {
+			t.Fatalf("Failed to write file (%d): %+v", i, err)
+		}
+		if u := s.GetUsage(); u.Bytes+u.VersionBytes > maxBytes {
+			t.Fatalf("Usage exceeds quota after write %d."+
+				"\nquota: %d bytes\nusage: %+v", i, maxBytes, u)
+		}
+		if err := s.Delete("file"); err != nil {
+			t.Fatalf("Failed to delete file (%d): %+v", i, err)
+		}
+		if u := s.GetUsage(); u.Bytes+u.VersionBytes > maxBytes {
+			t.Fatalf("Usage exceeds quota after delete %d."+
+				"\nquota: %d bytes\nusage: %+v", i, maxBytes, u)
+		}
+	}
+
+	versions, err := s.ListVersions("file")
+	if err != nil {
+		t.Fatalf("Failed to list versions: %+v", err)
+	} else if len(versions) == 0 || len(versions) >= writes {
+		t.Fatalf("Unexpected number of versions kept.\nexpected: between 1 "+
+			"and %d\nreceived: %d", writes-1, len(versions))
+	}
+	if v, err := s.ReadVersion("file", versions[0].ID); err != nil {
+		t.Errorf("Failed to read newest version: %+v", err)
+	} else if !bytes.Equal(data, v) {
+		t.Errorf("Newest version removed.\nexpected: %v\nreceived: %v",
+			data, v)
+	}
+
+	if err = s.DeleteDir(""); err != nil {
+		t.Fatalf("Failed to delete base directory: %+v", err)
+	}
+	if u := s.GetUsage(); u != (Usage{}) {
+		t.Errorf("Unexpected usage after deleting everything."+
+			"\nexpected: %+v\nreceived: %+v", Usage{}, u)
+	}
+}
+
+// conformanceConcurrentAccess tests that concurrent writes, reads, and deletes
+// from many goroutines leave the store consistent.
+func conformanceConcurrentAccess(t *testing.T, s Store) {
+	const writers, files = 8, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*files*3)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dir := "dir" + strconv.Itoa(i)
+			for j := 0; j < files; j++ {
+				path := dir + "/file" + strconv.Itoa(j)
+				data := []byte(path)
+				if err := s.Write(path, data); err != nil {
+					errs <- errors.Wrapf(err, "failed to write %s", path)
+				} else if read, err := s.Read(path); err != nil {
+					errs <- errors.Wrapf(err, "failed to read %s", path)
+				} else if !bytes.Equal(data, read) {
+					errs <- errors.Errorf("read %q from %s", read, path)
+				}
+
+				// Every writer also overwrites the same shared file
+				if err := s.Write("shared", data); err != nil {
+					errs <- errors.Wrap(err, "failed to write shared file")
+				}
+			}
+			if err := s.Delete(dir + "/file0"); err != nil {
+				errs <- errors.Wrapf(err, "failed to delete %s/file0", dir)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	dirs, err := s.ReadDir("")
+	if err != nil {
+		t.Fatalf("Failed to read base directory: %+v", err)
+	} else if len(dirs) != writers {
+		t.Errorf("Unexpected number of directories."+
+			"\nexpected: %d\nreceived: %d", writers, len(dirs))
+	}
+
+	shared, err := s.Read("shared")
+	if err != nil {
+		t.Fatalf("Failed to read shared file: %+v", err)
+	}
+	expectedFiles, size := int64(writers*(files-1)+1), int64(len(shared))
+	manifest, err := s.Manifest("", time.Time{})
+	if err != nil {
+		t.Fatalf("Failed to get manifest: %+v", err)
+	}
+	for _, e := range manifest {
+		if e.Path != "shared" {
+			size += e.Size
+		}
+	}
+	if int64(len(manifest)) != expectedFiles {
+		t.Errorf("Unexpected number of files."+
+			"\nexpected: %d\nreceived: %d", expectedFiles, len(manifest))
+	}
+	checkConformanceUsage(t, s, expectedFiles, size)
+}
+
+// conformanceRewrite tests that, for stores that implement Rewriter, Rewrite
+// replaces the contents of every file and previous version, including those of
+// deleted files, without saving versions, adding changes to the journal, or
+// changing the last write. Modification times are not checked since object
+// stores cannot keep them.
+func conformanceRewrite(t *testing.T, s Store) {
+	r, ok := s.(Rewriter)
+	if !ok {
+		t.Skipf("%T does not implement Rewriter", s)
+	}
+	s.SetRetention(RetentionPolicy{MaxVersions: 5})
+
+	for _, w := range []struct{ path, data string }{
+		{"a", "a1"}, {"a", "a2"}, {"dir/b", "b1"}, {"dir/c", "c1"}} {
+		if err := s.Write(w.path, []byte(w.data)); err != nil {
+			t.Fatalf("Failed to write %s: %+v", w.path, err)
+		}
+	}
+	if err := s.Delete("dir/c"); err != nil {
+		t.Fatalf("Failed to delete: %+v", err)
+	}
+	lastWrite, err := s.GetLastWrite()
+	if err != nil {
+		t.Fatalf("Failed to get last write: %+v", err)
+	}
+	journalID, changes, err := s.GetChanges("", 0)
+	if err != nil {
+		t.Fatalf("Failed to get changes: %+v", err)
+	}
+	usage := s.GetUsage()
+
+	var rewritten []string
+	err = r.Rewrite(func(path string, data []byte) ([]byte, error) {
+		rewritten = append(rewritten, filepath.ToSlash(path)+":"+string(data))
+		if string(data) == "b1" {
+			return nil, nil
+		}
+		return bytes.ToUpper(data), nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to rewrite: %+v", err)
+	}
+
+	sort.Strings(rewritten)
+	expected := []string{"a:a1", "a:a2", "dir/b:b1", "dir/c:c1"}
+	if !reflect.DeepEqual(expected, rewritten) {
+		t.Errorf("Unexpected files rewritten."+
+			"\nexpected: %q\nreceived: %q", expected, rewritten)
+	}
+	for path, expected := range map[string]string{"a": "A2", "dir/b": "b1"} {
+		if data, err := s.Read(path); err != nil || string(data) != expected {
+			t.Errorf("Unexpected contents of %s after rewrite."+
+				"\nexpected: %q\nreceived: %q (%+v)", path, expected, data, err)
+		}
+	}
+	for path, expected := range map[string]string{"a": "A1", "dir/c": "C1"} {
+		versions, err := s.ListVersions(path)
+		if err != nil || len(versions) != 1 {
+			t.Errorf("Unexpected versions of %s after rewrite: %+v (%+v)",
+				path, versions, err)
+			continue
+		}
+		data, err := s.ReadVersion(path, versions[0].ID)
+		if err != nil || string(data) != expected {
+			t.Errorf("Unexpected contents of version of %s after rewrite."+
+				"\nexpected: %q\nreceived: %q (%+v)", path, expected, data, err)
+		}
+	}
+
+	if lw, err := s.GetLastWrite(); err != nil || !lw.Equal(lastWrite) {
+		t.Errorf("Last write changed by rewrite."+
+			"\nexpected: %s\nreceived: %s (%+v)", lastWrite, lw, err)
+	}
+	id, c, err := s.GetChanges(journalID, 0)
+	if err != nil || id != journalID || !reflect.DeepEqual(changes, c) {
+		t.Errorf("Journal changed by rewrite."+
+			"\nexpected: %s %+v\nreceived: %s %+v (%+v)",
+			journalID, changes, id, c, err)
+	}
+	if u := s.GetUsage(); u != usage {
+		t.Errorf("Usage changed by rewrite of the same size."+
+			"\nexpected: %+v\nreceived: %+v", usage, u)
+	}
+}
+
+// conformanceWriteIf tests that WriteIf writes only when the file matches the
+// precondition and otherwise returns a ConflictError describing the current
+// file without modifying it.
+func conformanceWriteIf(t *testing.T, s Store) {
+	if err := s.WriteIf("file", []byte("v1"), Precondition{NotExist: true}); err != nil {
+		t.Fatalf("Failed to write missing file: %+v", err)
+	}
+	modified, err := s.GetLastModified("file")
+	if err != nil {
+		t.Fatalf("Failed to get last modified: %+v", err)
+	}
+
+	tests := []struct {
+		cond     Precondition
+		conflict bool
+	}{
+		{Precondition{NotExist: true}, true},
+		{Precondition{Hash: ContentHash([]byte("v0"))}, true},
+		{Precondition{Modified: modified.Add(-time.Hour)}, true},
+		{Precondition{Hash: ContentHash([]byte("v1"))}, false},
+	}
+	for i, tt := range tests {
+		data := []byte("v" + strconv.Itoa(i+2))
+		err = s.WriteIf("file", data, tt.cond)
+		if !tt.conflict {
+			if err != nil {
+				t.Errorf("Failed to write file matching precondition (%d): %+v",
+					i, err)
+			}
+			continue
+		}
+
+		var conflict *ConflictError
+		if !errors.As(err, &conflict) || !errors.Is(err, ConflictErr) {
+			t.Errorf("Unexpected error (%d).\nexpected: %v\nreceived: %+v",
+				i, ConflictErr, err)
+			continue
+		}
+		expected := &ConflictError{Path: "file", Exists: true,
+			Modified: modified, Hash: ContentHash([]byte("v1")), Size: 2}
+		if filepath.ToSlash(conflict.Path) != expected.Path ||
+			!conflict.Exists || !conflict.Modified.Equal(expected.Modified) ||
+			!bytes.Equal(conflict.Hash, expected.Hash) ||
+			conflict.Size != expected.Size {
+			t.Errorf("Unexpected conflict (%d).\nexpected: %+v\nreceived: %+v",
+				i, expected, conflict)
+		}
+		if data, err := s.Read("file"); err != nil || string(data) != "v1" {
+			t.Errorf("File modified by conflicting write (%d): %q, %+v",
+				i, data, err)
+		}
+	}
+
+	// A modification time precondition matches the time from GetLastModified
+	if modified, err = s.GetLastModified("file"); err != nil {
+		t.Fatalf("Failed to get last modified: %+v", err)
+	}
+	err = s.WriteIf("file", []byte("v6"), Precondition{Modified: modified})
+	if err != nil {
+		t.Errorf("Failed to write file matching modification time: %+v", err)
+	} else if data, err := s.Read("file"); err != nil || string(data) != "v6" {
+		t.Errorf("Unexpected data after conditional write: %q, %+v", data, err)
+	}
+
+	err = s.WriteIf("missing", []byte("data"),
+		Precondition{Hash: ContentHash([]byte("data"))})
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) {
+		t.Errorf("Unexpected error for missing file."+
+			"\nexpected: %v\nreceived: %+v", ConflictErr, err)
+	} else if conflict.Exists {
+		t.Errorf("Missing file reported as existing: %+v", conflict)
+	}
+	checkConformanceUsage(t, s, 1, 2)
+}
+
+// conformanceReadDirEntries tests that ReadDirEntries returns the files of a
+// directory with their size and modification time and its subdirectories
+// without them, and that it does not list the contents of subdirectories.
+func conformanceReadDirEntries(t *testing.T, s Store) {
+	for _, path := range []string{"dir/a", "dir/bb", "dir/sub/c", "dir/sub/d/e"} {
+		if err := s.Write(path, []byte(path)); err != nil {
+			t.Fatalf("Failed to write %s: %+v", path, err)
+		}
+	}
+
+	tests := []struct {
+		path    string
+		entries []DirEntry
+	}{
+		{"", []DirEntry{{Name: "dir", IsDir: true}}},
+		{"dir", []DirEntry{{Name: "a", Size: 5}, {Name: "bb", Size: 6},
+			{Name: "sub", IsDir: true}}},
+		{"dir/sub/", []DirEntry{{Name: "c", Size: 9}, {Name: "d", IsDir: true}}},
+		{"dir/sub/d", []DirEntry{{Name: "e", Size: 11}}},
+	}
+	for _, tt := range tests {
+		entries, err := s.ReadDirEntries(tt.path)
+		if err != nil {
+			t.Errorf("Failed to read entries of %q: %+v", tt.path, err)
+			continue
+		} else if len(entries) != len(tt.entries) {
+			t.Errorf("Unexpected entries of %q.\nexpected: %+v\nreceived: %+v",
+				tt.path, tt.entries, entries)
+			continue
+		}
+		for i, e := range entries {
+			expected := tt.entries[i]
+			if e.IsDir {
+				expected.Modified = time.Time{}
+			} else if modified, err := s.GetLastModified(
+				filepath.Join(tt.path, e.Name)); err != nil {
+				t.Errorf("Failed to get last modified of %s: %+v", e.Name, err)
+			} else {
+				expected.Modified = modified
+			}
+			if e.Name != expected.Name || e.IsDir != expected.IsDir ||
+				e.Size != expected.Size || !e.Modified.Equal(expected.Modified) {
+				t.Errorf("Unexpected entry %d of %q."+
+					"\nexpected: %+v\nreceived: %+v", i, tt.path, expected, e)
+			}
+		}
+	}
+
+	if _, err := s.ReadDirEntries("dir/a"); err == nil {
+		t.Errorf("Did not fail to read the entries of a file.")
+	}
+}
+
+// conformanceManifest tests that Manifest returns every file in a directory
+// and its subdirectories with its size, modification time, and hash, sorted by
+// path, and that only files modified at or after since are included.
+func conformanceManifest(t *testing.T, s Store) {
+	files := map[string]string{
+		"a": "a", "dir/b": "bb", "dir/sub/c": "ccc", "dir2/d": "dddd"}
+	for path, data := range files {
+		if err := s.Write(path, []byte(data)); err != nil {
+			t.Fatalf("Failed to write %s: %+v", path, err)
+		}
+	}
+
+	check := func(path string, since time.Time, expected []string) {
+		t.Helper()
+		entries, err := s.Manifest(path, since)
+		if err != nil {
+			t.Fatalf("Failed to get manifest of %q: %+v", path, err)
+		}
+		received := make([]string, len(entries))
+		for i, e := range entries {
+			received[i] = filepath.ToSlash(e.Path)
+			data := []byte(files[received[i]])
+			modified, err := s.GetLastModified(received[i])
+			if err != nil {
+				t.Errorf("Failed to get last modified of %s: %+v", e.Path, err)
+			}
+			if e.Size != int64(len(data)) || !e.Modified.Equal(modified) ||
+				!bytes.Equal(e.Hash, ContentHash(data)) {
+				t.Errorf("Unexpected manifest entry for %s."+
+					"\nexpected: size %d, modified %s, hash %x"+
+					"\nreceived: %+v", e.Path, len(data), modified,
+					ContentHash(data), e)
+			}
+		}
+		if !reflect.DeepEqual(expected, received) {
+			t.Errorf("Unexpected manifest of %q since %s."+
+				"\nexpected: %q\nreceived: %q", path, since, expected, received)
+		}
+	}
+	check("", time.Time{}, []string{"a", "dir/b", "dir/sub/c", "dir2/d"})
+	check("dir", time.Time{}, []string{"dir/b", "dir/sub/c"})
+
+	// Files modified at since are included
+	modified, err := s.GetLastModified("dir/sub/c")
+	if err != nil {
+		t.Fatalf("Failed to get last modified: %+v", err)
+	}
+	entries, err := s.Manifest("dir", modified)
+	if err != nil {
+		t.Fatalf("Failed to get manifest since %s: %+v", modified, err)
+	}
+	var found bool
+	for _, e := range entries {
+		found = found || filepath.ToSlash(e.Path) == "dir/sub/c"
+		if e.Modified.Before(modified) {
+			t.Errorf("Manifest since %s includes file modified before: %+v",
+				modified, e)
+		}
+	}
+	if !found {
+		t.Errorf("Manifest since %s does not include file modified at that "+
+			"time: %+v", modified, entries)
+	}
+	check("", netTime.Now().Add(time.Hour), []string{})
+}
+
+// conformanceGetChanges tests that GetChanges returns every modification in
+// order with increasing sequence numbers, that failed modifications are not
+// recorded, and that it returns JournalCompactedErr for a sequence number that
+// the journal cannot serve.
+func conformanceGetChanges(t *testing.T, s Store) {
+	journalID, changes, err := s.GetChanges("", 0)
+	if err != nil {
+		t.Fatalf("Failed to get changes of new store: %+v", err)
+	} else if journalID == "" || len(changes) != 0 {
+		t.Errorf("Unexpected changes of new store: %q %+v", journalID, changes)
+	}
+
+	ops := []struct {
+		op   func() error
+		ct   ChangeType
+		path string
+	}{
+		{func() error { return s.Write("dir/a", []byte("a")) }, ChangeWrite, "dir/a"},
+		{func() error { return s.Write("b", []byte("b")) }, ChangeWrite, "b"},
+		{func() error { return s.WriteIf("b", []byte("c"), Precondition{}) },
+			ChangeWrite, "b"},
+		{func() error { return s.Delete("b") }, ChangeDelete, "b"},
+		{func() error { return s.DeleteDir("dir") }, ChangeDeleteDir, "dir"},
+	}
+	start := netTime.Now()
+	for i, op := range ops {
+		if err = op.op(); err != nil {
+			t.Fatalf("Operation %d failed: %+v", i, err)
+		}
+	}
+	_ = s.Delete("missing")
+	_ = s.WriteIf("dir/a", []byte("a"), Precondition{Hash: []byte("hash")})
+
+	id, changes, err := s.GetChanges(journalID, 0)
+	if err != nil {
+		t.Fatalf("Failed to get changes: %+v", err)
+	} else if id != journalID {
+		t.Errorf("Unexpected journal ID.\nexpected: %s\nreceived: %s",
+			journalID, id)
+	} else if len(changes) != len(ops) {
+		t.Fatalf("Unexpected number of changes.\nexpected: %d\nreceived: %d"+
+			"\nchanges: %+v", len(ops), len(changes), changes)
+	}
+	for i, c := range changes {
+		if c.Seq != uint64(i+1) || c.Type != ops[i].ct ||
+			filepath.ToSlash(c.Path) != ops[i].path ||
+			c.Time.Before(start.Add(-conformanceClockTolerance)) {
+			t.Errorf("Unexpected change %d.\nexpected: %d %s %s after %s"+
+				"\nreceived: %+v", i, i+1, ops[i].ct, ops[i].path, start, c)
+		}
+	}
+
+	if _, after, err := s.GetChanges(journalID, 3); err != nil {
+		t.Errorf("Failed to get changes after 3: %+v", err)
+	} else if !reflect.DeepEqual(changes[3:], after) {
+		t.Errorf("Unexpected changes after 3.\nexpected: %+v\nreceived: %+v",
+			changes[3:], after)
+	}
+	if _, after, err := s.GetChanges(journalID, uint64(len(ops))); err != nil {
+		t.Errorf("Failed to get changes after last: %+v", err)
+	} else if len(after) != 0 {
+		t.Errorf("Unexpected changes after last: %+v", after)
+	}
+
+	for _, tt := range []struct {
+		journalID string
+		after     uint64
+	}{{journalID, uint64(len(ops) + 1)}, {journalID + "0", 1}, {"", 1}} {
+		_, _, err = s.GetChanges(tt.journalID, tt.after)
+		if !errors.Is(err, JournalCompactedErr) {
+			t.Errorf("Unexpected error for changes after %q/%d."+
+				"\nexpected: %v\nreceived: %+v",
+				tt.journalID, tt.after, JournalCompactedErr, err)
+		}
+	}
+}
+
+// conformanceVersions tests that overwriting or deleting a file keeps its
+// previous contents as versions that are listed from newest to oldest and can
+// be read back, and that the retention policy limits how many are kept.
+func conformanceVersions(t *testing.T, s Store) {
+	if versions, err := s.ListVersions("file"); err != nil || len(versions) != 0 {
+		t.Errorf("Unexpected versions without retention: %+v (%+v)",
+			versions, err)
+	}
+
+	s.SetRetention(RetentionPolicy{MaxVersions: 3})
+	contents := []string{"v1", "v22", "v333", "v4444", "v55555"}
+	for _, data := range contents {
+		if err := s.Write("file", []byte(data)); err != nil {
+			t.Fatalf("Failed to write %s: %+v", data, err)
+		}
+	}
+	if err := s.Write("other", []byte("other")); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+	if err := s.Delete("file"); err != nil {
+		t.Fatalf("Failed to delete: %+v", err)
+	}
+
+	versions, err := s.ListVersions("file")
+	if err != nil {
+		t.Fatalf("Failed to list versions: %+v", err)
+	}
+	expected := []string{"v55555", "v4444", "v333"}
+	if len(versions) != len(expected) {
+		t.Fatalf("Unexpected number of versions."+
+			"\nexpected: %d\nreceived: %d\nversions: %+v",
+			len(expected), len(versions), versions)
+	}
+	for i, v := range versions {
+		if i > 0 && v.ID >= versions[i-1].ID {
+			t.Errorf("Versions not sorted from newest to oldest: %+v", versions)
+		}
+		if v.Size != int64(len(expected[i])) || v.Modified.IsZero() ||
+			v.Replaced.Before(v.Modified) {
+			t.Errorf("Unexpected version %d of size %d: %+v",
+				i, len(expected[i]), v)
+		}
+		if data, err := s.ReadVersion("file", v.ID); err != nil {
+			t.Errorf("Failed to read version %d: %+v", i, err)
+		} else if string(data) != expected[i] {
+			t.Errorf("Unexpected contents of version %d."+
+				"\nexpected: %q\nreceived: %q", i, expected[i], data)
+		}
+	}
+
+	if _, err = s.ReadVersion("other", versions[0].ID); !errors.Is(err, VersionNotFoundErr) {
+		t.Errorf("Unexpected error reading version of another file."+
+			"\nexpected: %v\nreceived: %+v", VersionNotFoundErr, err)
+	}
+	if versions, err = s.ListVersions("other"); err != nil || len(versions) != 0 {
+		t.Errorf("Unexpected versions of file never overwritten: %+v (%+v)",
+			versions, err)
+	}
+}
+
+// checkConformanceUsage checks that the usage of the store counts the expected
+// number of files and at least the size of their contents. Stores may use more
+// bytes than the contents of the files, for example to encrypt them.
+func checkConformanceUsage(t *testing.T, s Store, files, size int64) {
+	t.Helper()
+	usage := s.GetUsage()
+	if usage.Files != files || usage.Bytes < size || (files == 0 && usage.Bytes != 0) {
+		t.Errorf("Unexpected usage.\nexpected: %d files of at least %d "+
+			"bytes\nreceived: %+v", files, size, usage)
+	}
+}
@@ -0,0 +1,37 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package store
+
+import (
+	"sort"
+	"time"
+)
+
+// DirEntry describes a file or directory in a directory listing returned by
+// ReadDirEntries.
+type DirEntry struct {
+	// Name is the name of the file or directory within its parent directory.
+	Name string
+
+	// IsDir is true if the entry is a directory.
+	IsDir bool
+
+	// Size is the size of the file in bytes. It is zero for directories.
+	Size int64
+
+	// Modified is the last modification time of the file. It is zero for
+	// directories.
+	Modified time.Time
+}
+
+// sortDirEntries sorts the entries by name.
+func sortDirEntries(entries []DirEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+}
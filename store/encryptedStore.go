@@ -0,0 +1,663 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package store
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// encryptedFormatVersion is the first byte of every encrypted file.
+	encryptedFormatVersion = 1
+
+	// encryptedHeaderLen is the length of the header of an encrypted file,
+	// which contains the format version, the master key ID, and the nonce.
+	encryptedHeaderLen = 1 + 4 + chacha20poly1305.NonceSizeX
+
+	// encryptionOverhead is the number of bytes an encrypted file is larger
+	// than its contents.
+	encryptionOverhead = encryptedHeaderLen + chacha20poly1305.Overhead
+
+	// MasterKeyLen is the required length of a MasterKey in bytes.
+	MasterKeyLen = chacha20poly1305.KeySize
+
+	// Info strings used to derive each user's keys from a master key.
+	contentKeyInfo = "remoteSyncContentKey"
+	pathKeyInfo    = "remoteSyncPathKey"
+)
+
+// DecryptionErr is returned when an encrypted file cannot be decrypted because
+// it is corrupt, was encrypted for another path, or was encrypted with a
+// master key that is not configured.
+var DecryptionErr = errors.New("failed to decrypt file")
+
+// MasterKey is a server key from which each user's encryption keys are
+// derived.
+type MasterKey struct {
+	// ID identifies the key. It is stored with each encrypted file so that the
+	// file can be decrypted after the key is rotated.
+	ID uint32
+
+	// Key is the secret key. It must be MasterKeyLen bytes.
+	Key []byte
+}
+
+// EncryptionParams configures an EncryptedStore.
+type EncryptionParams struct {
+	// Keys are the master keys. Files are encrypted with the key with the
+	// highest ID; the other keys are only used to decrypt files written before
+	// the key was rotated. To rotate keys, add a key with a higher ID and run
+	// EncryptedStore.Rotate on each store before removing the old key.
+	Keys []MasterKey
+
+	// ObfuscatePaths enables the encryption of file and directory names. Names
+	// are encrypted with a key derived from the key with the lowest ID, which
+	// therefore cannot be rotated and must be kept for as long as the stores
+	// exist. Each encrypted name is about 1.4 times as long as the original
+	// name plus 54 characters, which limits the length of names to about 140
+	// bytes on most file systems.
+	ObfuscatePaths bool
+}
+
+// EncryptedStore wraps a Store, encrypting the contents of all files and,
+// optionally, the names of all files and directories. Each user's keys are
+// derived from the server's master keys. Adheres to the Store interface.
+//
+// File contents are encrypted with XChaCha20-Poly1305 using the file path as
+// additional data so that files cannot be swapped between paths. Quotas and
+// usage apply to the encrypted files.
+type EncryptedStore struct {
+	// backend is the underlying store that holds the encrypted files.
+	backend Store
+
+	// contentKeys are the user's content keys keyed on master key ID.
+	// currentKey is the ID of the key used for encryption.
+	contentKeys map[uint32]cipher.AEAD
+	currentKey  uint32
+
+	// pathCipher and pathMAC are used to encrypt names. pathCipher is nil if
+	// paths are not obfuscated.
+	pathCipher cipher.AEAD
+	pathMAC    []byte
+
+	// hashes is a map of encrypted file paths to the content hash of their
+	// decrypted contents that avoids decrypting unchanged files when
+	// generating a manifest. The size and modification time are of the
+	// encrypted file.
+	hashes map[string]cachedHash
+	mux    sync.Mutex
+}
+
+// NewEncryptedStore returns a NewStore that wraps the stores created by
+// newStore in an EncryptedStore. Keys for each store are derived from the
+// master keys and the store's base directory, which is the username. Returns
+// an error if no keys are provided or any key is invalid.
+func NewEncryptedStore(newStore NewStore, params EncryptionParams) (NewStore, error) {
+	if len(params.Keys) == 0 {
+		return nil, errors.New("no master keys provided")
+	}
+	ids := make(map[uint32]bool, len(params.Keys))
+	for _, k := range params.Keys {
+		if len(k.Key) != MasterKeyLen {
+			return nil, errors.Errorf("master key %d is %d bytes; expected %d",
+				k.ID, len(k.Key), MasterKeyLen)
+		} else if ids[k.ID] {
+			return nil, errors.Errorf("duplicate master key ID %d", k.ID)
+		}
+		ids[k.ID] = true
+	}
+
+	return func(storageDir, baseDir string) (Store, error) {
+		s, err := newStore(storageDir, baseDir)
+		if err != nil {
+			return nil, err
+		}
+		return newEncryptedStore(s, baseDir, params)
+	}, nil
+}
+
+// newEncryptedStore wraps the store in an EncryptedStore with keys derived for
+// the user.
+func newEncryptedStore(
+	s Store, username string, params EncryptionParams) (*EncryptedStore, error) {
+	es := &EncryptedStore{
+		backend:     s,
+		contentKeys: make(map[uint32]cipher.AEAD, len(params.Keys)),
+		hashes:      make(map[string]cachedHash),
+	}
+
+	pathKey := params.Keys[0]
+	for i, k := range params.Keys {
+		aead, err := chacha20poly1305.NewX(
+			deriveKey(k.Key, contentKeyInfo, username, MasterKeyLen))
+		if err != nil {
+			return nil, err
+		}
+		es.contentKeys[k.ID] = aead
+		if i == 0 || k.ID > es.currentKey {
+			es.currentKey = k.ID
+		}
+		if k.ID < pathKey.ID {
+			pathKey = k
+		}
+	}
+
+	if params.ObfuscatePaths {
+		key := deriveKey(pathKey.Key, pathKeyInfo, username, 2*MasterKeyLen)
+		var err error
+		es.pathCipher, err = chacha20poly1305.NewX(key[:MasterKeyLen])
+		if err != nil {
+			return nil, err
+		}
+		es.pathMAC = key[MasterKeyLen:]
+	}
+
+	return es, nil
+}
+
+// deriveKey derives a key of the given length for the user from the master key
+// using HKDF-SHA256.
+func deriveKey(masterKey []byte, info, username string, length int) []byte {
+	key := make([]byte, length)
+	r := hkdf.New(sha256.New, masterKey, nil, []byte(info+username))
+	if _, err := io.ReadFull(r, key); err != nil {
+		// This error cannot happen for lengths this short
+		jww.FATAL.Panicf("Failed to derive key: %+v", err)
+	}
+	return key
+}
+
+// Read reads from the provided file path and returns the decrypted data in the
+// file at that path.
+//
+// Returns [DecryptionErr] if the file cannot be decrypted and the errors of the
+// underlying store.
+func (es *EncryptedStore) Read(path string) ([]byte, error) {
+	path, encPath, err := es.encryptPath(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := es.backend.Read(encPath)
+	if err != nil {
+		return nil, err
+	}
+	return es.decrypt(path, data)
+}
+
+// Write encrypts the provided data and writes it to the file path.
+func (es *EncryptedStore) Write(path string, data []byte) error {
+	path, encPath, err := es.encryptPath(path)
+	if err != nil {
+		return err
+	}
+	return es.backend.Write(encPath, es.encrypt(path, data))
+}
+
+// WriteIf encrypts the provided data and writes it to the file path only if
+// the file matches the precondition. The precondition hash and the returned
+// *[ConflictError] refer to the decrypted contents.
+func (es *EncryptedStore) WriteIf(
+	path string, data []byte, cond Precondition) error {
+	path, encPath, err := es.encryptPath(path)
+	if err != nil {
+		return err
+	}
+
+	// Check the precondition against the decrypted file and then make the
+	// write conditional on the encrypted file being unchanged
+	encCond := cond
+	if cond.Hash != nil {
+		current, err := es.backend.Read(encPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		} else if err != nil {
+			return es.conflict(path, encPath)
+		}
+		plaintext, err := es.decrypt(path, current)
+		if err != nil {
+			return err
+		} else if !bytes.Equal(cond.Hash, ContentHash(plaintext)) {
+			return es.conflict(path, encPath)
+		}
+		encCond.Hash = ContentHash(current)
+	}
+
+	err = es.backend.WriteIf(encPath, es.encrypt(path, data), encCond)
+	if errors.Is(err, ConflictErr) {
+		return es.conflict(path, encPath)
+	}
+	return err
+}
+
+// conflict returns a *ConflictError describing the current decrypted state of
+// the file.
+func (es *EncryptedStore) conflict(path, encPath string) error {
+	conflict := &ConflictError{Path: path}
+	data, err := es.backend.Read(encPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.WithStack(conflict)
+	} else if err != nil {
+		return err
+	}
+	plaintext, err := es.decrypt(path, data)
+	if err != nil {
+		return err
+	}
+	conflict.Exists = true
+	conflict.Hash = ContentHash(plaintext)
+	conflict.Size = int64(len(plaintext))
+	conflict.Modified, err = es.backend.GetLastModified(encPath)
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(conflict)
+}
+
+// GetLastModified returns the last modification time for the file at the given
+// file.
+func (es *EncryptedStore) GetLastModified(path string) (time.Time, error) {
+	_, encPath, err := es.encryptPath(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return es.backend.GetLastModified(encPath)
+}
+
+// GetLastWrite returns the time of the most recent successful Write or Delete
+// operation that was performed.
+func (es *EncryptedStore) GetLastWrite() (time.Time, error) {
+	return es.backend.GetLastWrite()
+}
+
+// ReadDir reads the named directory, returning all its directory entries
+// sorted by filename.
+func (es *EncryptedStore) ReadDir(path string) ([]string, error) {
+	_, encPath, err := es.encryptPath(path)
+	if err != nil {
+		return nil, err
+	}
+	encDirs, err := es.backend.ReadDir(encPath)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := make([]string, len(encDirs))
+	for i, encDir := range encDirs {
+		if dirs[i], err = es.decryptName(encDir); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// ReadDirEntries reads the named directory, returning all the files and
+// directories it contains sorted by name. Sizes are of the decrypted files.
+func (es *EncryptedStore) ReadDirEntries(path string) ([]DirEntry, error) {
+	_, encPath, err := es.encryptPath(path)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := es.backend.ReadDirEntries(encPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range entries {
+		if entries[i].Name, err = es.decryptName(entries[i].Name); err != nil {
+			return nil, err
+		}
+		if !entries[i].IsDir {
+			entries[i].Size = plaintextSize(entries[i].Size)
+		}
+	}
+	sortDirEntries(entries)
+	return entries, nil
+}
+
+// Manifest returns every file in the named directory and its subdirectories
+// with its size, modification time, and content hash, sorted by path. The
+// hashes of the decrypted contents are cached so that only files modified
+// since the last manifest are read and decrypted.
+func (es *EncryptedStore) Manifest(
+	path string, since time.Time) ([]ManifestEntry, error) {
+	_, encPath, err := es.encryptPath(path)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := es.backend.Manifest(encPath, since)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, e := range entries {
+		if entries[i].Path, err = es.decryptPath(e.Path); err != nil {
+			return nil, err
+		}
+		entries[i].Size = plaintextSize(e.Size)
+		entries[i].Hash, err = es.contentHash(entries[i].Path, e)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sortManifest(entries)
+	return entries, nil
+}
+
+// contentHash returns the content hash of the decrypted contents of the
+// encrypted file described by the manifest entry, reading and decrypting the
+// file only if it has changed since it was last hashed.
+func (es *EncryptedStore) contentHash(
+	path string, e ManifestEntry) ([]byte, error) {
+	key := filepath.ToSlash(e.Path)
+	es.mux.Lock()
+	c, exists := es.hashes[key]
+	es.mux.Unlock()
+	if exists && c.size == e.Size && c.modified.Equal(e.Modified) {
+		return c.hash, nil
+	}
+
+	data, err := es.backend.Read(e.Path)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := es.decrypt(path, data)
+	if err != nil {
+		return nil, err
+	}
+	hash := ContentHash(plaintext)
+
+	es.mux.Lock()
+	es.hashes[key] = cachedHash{e.Size, e.Modified, hash}
+	es.mux.Unlock()
+	return hash, nil
+}
+
+// forgetHashes removes the cached hashes of the encrypted file or directory at
+// the path and everything it contains.
+func (es *EncryptedStore) forgetHashes(encPath string) {
+	es.mux.Lock()
+	defer es.mux.Unlock()
+	for p := range es.hashes {
+		if encPath == "" || p == encPath || strings.HasPrefix(p, encPath+"/") {
+			delete(es.hashes, p)
+		}
+	}
+}
+
+// Delete deletes the file at the given path.
+func (es *EncryptedStore) Delete(path string) error {
+	_, encPath, err := es.encryptPath(path)
+	if err != nil {
+		return err
+	}
+	if err = es.backend.Delete(encPath); err != nil {
+		return err
+	}
+	es.forgetHashes(encPath)
+	return nil
+}
+
+// DeleteDir deletes the named directory and everything it contains.
+func (es *EncryptedStore) DeleteDir(path string) error {
+	_, encPath, err := es.encryptPath(path)
+	if err != nil {
+		return err
+	}
+	if err = es.backend.DeleteDir(encPath); err != nil {
+		return err
+	}
+	es.forgetHashes(encPath)
+	return nil
+}
+
+// ListVersions returns the previous versions of the file at the given path
+// that are retained, sorted from newest to oldest. Sizes are of the decrypted
+// versions.
+func (es *EncryptedStore) ListVersions(path string) ([]Version, error) {
+	_, encPath, err := es.encryptPath(path)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := es.backend.ListVersions(encPath)
+	if err != nil {
+		return nil, err
+	}
+	for i := range versions {
+		versions[i].Size = plaintextSize(versions[i].Size)
+	}
+	return versions, nil
+}
+
+// ReadVersion returns the decrypted contents of the previous version of the
+// file at the given path with the given ID.
+func (es *EncryptedStore) ReadVersion(path string, id int64) ([]byte, error) {
+	path, encPath, err := es.encryptPath(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := es.backend.ReadVersion(encPath, id)
+	if err != nil {
+		return nil, err
+	}
+	return es.decrypt(path, data)
+}
+
+// GetChanges returns the ID of the journal and all changes in it with a
+// sequence number greater than after, in order, with their paths decrypted.
+func (es *EncryptedStore) GetChanges(
+	journalID string, after uint64) (string, []Change, error) {
+	id, changes, err := es.backend.GetChanges(journalID, after)
+	if err != nil {
+		return "", nil, err
+	}
+	for i := range changes {
+		if changes[i].Path, err = es.decryptPath(changes[i].Path); err != nil {
+			return "", nil, err
+		}
+	}
+	return id, changes, nil
+}
+
+// SetQuota sets the limits on the storage used by the underlying store. Quotas
+// apply to the encrypted files.
+func (es *EncryptedStore) SetQuota(quota Quota) {
+	es.backend.SetQuota(quota)
+}
+
+// GetUsage returns the storage currently used by the encrypted files in the
+// underlying store.
+func (es *EncryptedStore) GetUsage() Usage {
+	return es.backend.GetUsage()
+}
+
+// SetRetention sets the policy that determines which previous versions of
+// each file are kept when it is overwritten or deleted.
+func (es *EncryptedStore) SetRetention(policy RetentionPolicy) {
+	es.backend.SetRetention(policy)
+}
+
+// Close closes the underlying store if it can be closed.
+func (es *EncryptedStore) Close() error {
+	if c, ok := es.backend.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Rotate re-encrypts every file and every retained previous version that was
+// not encrypted with the current master key. The underlying store must be a
+// [Rewriter] so that they are replaced in place: rotating does not save the
+// old ciphertext as a previous version, add changes to the journal, or change
+// the last write. Once every store has been rotated, the old master keys can
+// be removed, except for the key used to obfuscate paths. Returns the number
+// of files and versions re-encrypted.
+func (es *EncryptedStore) Rotate() (int, error) {
+	r, ok := es.backend.(Rewriter)
+	if !ok {
+		return 0, errors.Errorf(
+			"underlying store %T cannot rewrite files in place", es.backend)
+	}
+
+	var rotated int
+	err := r.Rewrite(func(encPath string, data []byte) ([]byte, error) {
+		if keyID, ok := encryptedKeyID(data); ok && keyID == es.currentKey {
+			return nil, nil
+		}
+
+		path, err := es.decryptPath(encPath)
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := es.decrypt(path, data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decrypt %s", path)
+		}
+		rotated++
+		return es.encrypt(path, plaintext), nil
+	})
+	return rotated, err
+}
+
+// encrypt encrypts the data for the file at the path with the current key.
+func (es *EncryptedStore) encrypt(path string, data []byte) []byte {
+	aead := es.contentKeys[es.currentKey]
+
+	header := make([]byte, encryptedHeaderLen, encryptionOverhead+len(data))
+	header[0] = encryptedFormatVersion
+	binary.BigEndian.PutUint32(header[1:5], es.currentKey)
+	nonce := header[5:]
+	if _, err := rand.Read(nonce); err != nil {
+		jww.FATAL.Panicf("Failed to generate nonce: %+v", err)
+	}
+
+	return aead.Seal(header, nonce, data, []byte(path))
+}
+
+// decrypt decrypts the data of the file at the path. Returns DecryptionErr if
+// the data is invalid or the key it was encrypted with is not configured.
+func (es *EncryptedStore) decrypt(path string, data []byte) ([]byte, error) {
+	keyID, ok := encryptedKeyID(data)
+	if !ok {
+		return nil, errors.Wrapf(DecryptionErr, "invalid header for %s", path)
+	}
+	aead, exists := es.contentKeys[keyID]
+	if !exists {
+		return nil, errors.Wrapf(DecryptionErr,
+			"master key %d for %s not configured", keyID, path)
+	}
+
+	plaintext, err := aead.Open(nil, data[5:encryptedHeaderLen],
+		data[encryptedHeaderLen:], []byte(path))
+	if err != nil {
+		return nil, errors.Wrapf(DecryptionErr, "%s: %v", path, err)
+	}
+	return plaintext, nil
+}
+
+// encryptedKeyID returns the ID of the master key that the data was encrypted
+// with. Returns false if the data does not have a valid header.
+func encryptedKeyID(data []byte) (uint32, bool) {
+	if len(data) < encryptionOverhead || data[0] != encryptedFormatVersion {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(data[1:5]), true
+}
+
+// plaintextSize returns the size of the contents of an encrypted file of the
+// given size.
+func plaintextSize(size int64) int64 {
+	if size < encryptionOverhead {
+		return 0
+	}
+	return size - encryptionOverhead
+}
+
+// encryptPath cleans the path and returns it along with the path to use in
+// the underlying store, which has each name encrypted if paths are obfuscated.
+// Returns NonLocalFileErr if the path is outside the base directory and
+// ReservedPathErr if it contains a reserved name.
+func (es *EncryptedStore) encryptPath(path string) (string, string, error) {
+	path = filepath.ToSlash(filepath.Clean(path))
+	if path == "." || path == "/" {
+		return "", "", nil
+	} else if path == ".." || strings.HasPrefix(path, "../") {
+		return "", "", NonLocalFileErr
+	}
+	path = strings.TrimPrefix(path, "/")
+
+	if es.pathCipher == nil {
+		return path, path, nil
+	} else if isReservedPath(path) {
+		// Encrypted names would hide reserved names from the underlying store
+		return "", "", ReservedPathErr
+	}
+
+	names := strings.Split(path, "/")
+	for i, name := range names {
+		mac := hmac.New(sha256.New, es.pathMAC)
+		mac.Write([]byte(name))
+		nonce := mac.Sum(nil)[:chacha20poly1305.NonceSizeX]
+		names[i] = base64.RawURLEncoding.EncodeToString(
+			es.pathCipher.Seal(nonce, nonce, []byte(name), nil))
+	}
+	return path, strings.Join(names, "/"), nil
+}
+
+// decryptPath returns the original path of a path in the underlying store.
+func (es *EncryptedStore) decryptPath(encPath string) (string, error) {
+	if es.pathCipher == nil || encPath == "" {
+		return encPath, nil
+	}
+
+	names := strings.Split(filepath.ToSlash(encPath), "/")
+	for i, name := range names {
+		var err error
+		if names[i], err = es.decryptName(name); err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(names, "/"), nil
+}
+
+// decryptName returns the original name of a file or directory name in the
+// underlying store.
+func (es *EncryptedStore) decryptName(encName string) (string, error) {
+	if es.pathCipher == nil {
+		return encName, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(encName)
+	if err != nil || len(data) < chacha20poly1305.NonceSizeX {
+		return "", errors.Wrapf(DecryptionErr, "invalid name %q", encName)
+	}
+	name, err := es.pathCipher.Open(nil,
+		data[:chacha20poly1305.NonceSizeX], data[chacha20poly1305.NonceSizeX:], nil)
+	if err != nil {
+		return "", errors.Wrapf(DecryptionErr, "name %q: %v", encName, err)
+	}
+	return string(name), nil
+}
@@ -0,0 +1,497 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package store
+
+import (
+	"bytes"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Tests that EncryptedStore adheres to the Store interface.
+var _ Store = (*EncryptedStore)(nil)
+
+// Tests that EncryptedStore passes the store conformance tests with and
+// without path obfuscation.
+func TestEncryptedStore_Conformance(t *testing.T) {
+	prng := rand.New(rand.NewSource(42))
+	for _, obfuscate := range []bool{false, true} {
+		params := EncryptionParams{
+			Keys: newTestMasterKeys(2, prng), ObfuscatePaths: obfuscate}
+		newStore, err := NewEncryptedStore(NewFileStore, params)
+		if err != nil {
+			t.Fatalf("Failed to create NewStore: %+v", err)
+		}
+		t.Run("ObfuscatePaths="+strconv.FormatBool(obfuscate), func(t *testing.T) {
+			RunConformanceTests(t, newStore)
+		})
+	}
+}
+
+// Tests that the files written to an EncryptedStore backed by a FileStore are
+// encrypted on disk, that their names are obfuscated, and that they can be
+// read back.
+func TestEncryptedStore_Write_Read_Ciphertext(t *testing.T) {
+	prng := rand.New(rand.NewSource(6584))
+	testDir := "tmp"
+	defer removeTestFile(t, testDir)
+	es := newTestEncryptedStore(NewFileStore, testDir,
+		EncryptionParams{Keys: newTestMasterKeys(1, prng), ObfuscatePaths: true}, t)
+
+	testFiles := map[string][]byte{
+		"secretFile.txt":           []byte("plaintext contents of secret file"),
+		"secretDir/secretFile.txt": []byte("plaintext contents of nested file"),
+	}
+	for path, data := range testFiles {
+		if err := es.Write(path, data); err != nil {
+			t.Fatalf("Failed to write %s: %+v", path, err)
+		}
+	}
+
+	for path, expected := range testFiles {
+		data, err := es.Read(path)
+		if err != nil {
+			t.Errorf("Failed to read %s: %+v", path, err)
+		} else if !bytes.Equal(expected, data) {
+			t.Errorf("Unexpected data for %s.\nexpected: %q\nreceived: %q",
+				path, expected, data)
+		}
+	}
+
+	var files int
+	err := filepath.WalkDir(filepath.Join(testDir, "user"),
+		func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			} else if strings.HasPrefix(d.Name(), internalFilePrefix) {
+				return skipInternalEntry(d)
+			} else if strings.Contains(d.Name(), "secret") {
+				t.Errorf("Name %q not obfuscated.", path)
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			files++
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			for _, plaintext := range testFiles {
+				if bytes.Contains(data, plaintext) ||
+					bytes.Contains(data, []byte("plaintext")) {
+					t.Errorf("File %s contains plaintext: %q", path, data)
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		t.Fatalf("Failed to walk store: %+v", err)
+	} else if files != len(testFiles) {
+		t.Errorf("Unexpected number of files on disk."+
+			"\nexpected: %d\nreceived: %d", len(testFiles), files)
+	}
+}
+
+// Tests that the metadata returned by an EncryptedStore with obfuscated paths
+// describes the decrypted files.
+func TestEncryptedStore_Metadata(t *testing.T) {
+	prng := rand.New(rand.NewSource(3524))
+	es := newTestEncryptedStore(NewMemStore, "",
+		EncryptionParams{Keys: newTestMasterKeys(1, prng), ObfuscatePaths: true}, t)
+
+	testFiles := map[string][]byte{
+		"b.txt":         []byte(randString(12, prng)),
+		"a.txt":         []byte(randString(5, prng)),
+		"dir/c.txt":     []byte(randString(30, prng)),
+		"dir/sub/d.txt": []byte(randString(1, prng)),
+	}
+	for path, data := range testFiles {
+		if err := es.Write(path, data); err != nil {
+			t.Fatalf("Failed to write %s: %+v", path, err)
+		}
+	}
+
+	dirs, err := es.ReadDir("dir")
+	if err != nil {
+		t.Fatalf("Failed to read dir: %+v", err)
+	}
+	if expected := []string{"sub"}; !reflect.DeepEqual(expected, dirs) {
+		t.Errorf("Unexpected dirs.\nexpected: %q\nreceived: %q", expected, dirs)
+	}
+
+	entries, err := es.ReadDirEntries("")
+	if err != nil {
+		t.Fatalf("Failed to read dir entries: %+v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+		if !e.IsDir && e.Size != int64(len(testFiles[e.Name])) {
+			t.Errorf("Unexpected size for %s.\nexpected: %d\nreceived: %d",
+				e.Name, len(testFiles[e.Name]), e.Size)
+		}
+	}
+	if expected := []string{"a.txt", "b.txt", "dir"}; !reflect.DeepEqual(expected, names) {
+		t.Errorf("Unexpected entries.\nexpected: %q\nreceived: %q",
+			expected, names)
+	}
+
+	manifest, err := es.Manifest("", time.Time{})
+	if err != nil {
+		t.Fatalf("Failed to get manifest: %+v", err)
+	}
+	if len(manifest) != len(testFiles) {
+		t.Errorf("Unexpected number of manifest entries."+
+			"\nexpected: %d\nreceived: %d", len(testFiles), len(manifest))
+	}
+	for _, e := range manifest {
+		data := testFiles[filepath.ToSlash(e.Path)]
+		if e.Size != int64(len(data)) {
+			t.Errorf("Unexpected size for %s.\nexpected: %d\nreceived: %d",
+				e.Path, len(data), e.Size)
+		}
+		if !bytes.Equal(ContentHash(data), e.Hash) {
+			t.Errorf("Unexpected hash for %s.\nexpected: %x\nreceived: %x",
+				e.Path, ContentHash(data), e.Hash)
+		}
+	}
+
+	_, changes, err := es.GetChanges("", 0)
+	if err != nil {
+		t.Fatalf("Failed to get changes: %+v", err)
+	}
+	for _, c := range changes {
+		if _, exists := testFiles[filepath.ToSlash(c.Path)]; !exists {
+			t.Errorf("Unexpected change path %q.", c.Path)
+		}
+	}
+}
+
+// Tests that EncryptedStore.Manifest only decrypts files that have changed
+// since the last manifest and that deleted files are removed from the cache.
+func TestEncryptedStore_Manifest_CachedHashes(t *testing.T) {
+	prng := rand.New(rand.NewSource(6541))
+	es := newTestEncryptedStore(NewMemStore, "",
+		EncryptionParams{Keys: newTestMasterKeys(1, prng)}, t)
+
+	for _, path := range []string{"a.txt", "dir/b.txt"} {
+		if err := es.Write(path, []byte(path)); err != nil {
+			t.Fatalf("Failed to write %s: %+v", path, err)
+		}
+	}
+	if _, err := es.Manifest("", time.Time{}); err != nil {
+		t.Fatalf("Failed to get manifest: %+v", err)
+	} else if len(es.hashes) != 2 {
+		t.Fatalf("Unexpected number of cached hashes."+
+			"\nexpected: %d\nreceived: %d", 2, len(es.hashes))
+	}
+
+	// Replace a cached hash so that a manifest that decrypts the file differs
+	c := es.hashes["a.txt"]
+	c.hash = []byte("cached")
+	es.hashes["a.txt"] = c
+	manifest, err := es.Manifest("", time.Time{})
+	if err != nil {
+		t.Fatalf("Failed to get manifest: %+v", err)
+	} else if !bytes.Equal(c.hash, manifest[0].Hash) {
+		t.Errorf("Unchanged file decrypted.\nexpected: %q\nreceived: %x",
+			c.hash, manifest[0].Hash)
+	}
+
+	data := []byte("new contents")
+	if err = es.Write("a.txt", data); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+	if manifest, err = es.Manifest("", time.Time{}); err != nil {
+		t.Fatalf("Failed to get manifest: %+v", err)
+	} else if !bytes.Equal(ContentHash(data), manifest[0].Hash) {
+		t.Errorf("Changed file not decrypted.\nexpected: %x\nreceived: %x",
+			ContentHash(data), manifest[0].Hash)
+	}
+
+	if err = es.DeleteDir("dir"); err != nil {
+		t.Fatalf("Failed to delete dir: %+v", err)
+	} else if _, exists := es.hashes["dir/b.txt"]; exists {
+		t.Errorf("Hash of deleted file not removed from cache.")
+	}
+}
+
+// Tests that EncryptedStore.WriteIf checks the precondition against the
+// decrypted contents and returns a ConflictError describing them.
+func TestEncryptedStore_WriteIf(t *testing.T) {
+	prng := rand.New(rand.NewSource(8742))
+	es := newTestEncryptedStore(NewMemStore, "",
+		EncryptionParams{Keys: newTestMasterKeys(1, prng)}, t)
+
+	path, data := "file.txt", []byte("contents")
+	if err := es.WriteIf(path, data, Precondition{NotExist: true}); err != nil {
+		t.Fatalf("Failed to write new file: %+v", err)
+	}
+
+	newData := []byte("new contents")
+	err := es.WriteIf(path, newData, Precondition{Hash: ContentHash(data)})
+	if err != nil {
+		t.Fatalf("Failed to write with matching hash: %+v", err)
+	}
+
+	err = es.WriteIf(path, []byte("lost"), Precondition{Hash: ContentHash(data)})
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("Unexpected error for stale hash."+
+			"\nexpected: %v\nreceived: %+v", ConflictErr, err)
+	}
+	if !conflict.Exists || conflict.Size != int64(len(newData)) ||
+		!bytes.Equal(ContentHash(newData), conflict.Hash) {
+		t.Errorf("Conflict does not describe decrypted file: %+v", conflict)
+	}
+
+	if read, _ := es.Read(path); !bytes.Equal(newData, read) {
+		t.Errorf("File changed after conflict.\nexpected: %q\nreceived: %q",
+			newData, read)
+	}
+}
+
+// Tests that after a new master key is added, files written with the old key
+// can still be read, and that EncryptedStore.Rotate re-encrypts them and their
+// previous versions in place so that they can be read once the old key is
+// removed.
+func TestEncryptedStore_Rotate(t *testing.T) {
+	prng := rand.New(rand.NewSource(1245))
+	keys := newTestMasterKeys(2, prng)
+	ms, _ := NewMemStore("", "user")
+	ms.SetRetention(RetentionPolicy{MaxVersions: 2})
+	newStore := func(string, string) (Store, error) { return ms, nil }
+
+	oldStore := newTestEncryptedStore(
+		newStore, "", EncryptionParams{Keys: keys[:1]}, t)
+	oldVersion := []byte(randString(12, prng))
+	if err := oldStore.Write("a.txt", oldVersion); err != nil {
+		t.Fatalf("Failed to write a.txt: %+v", err)
+	}
+	testFiles := map[string][]byte{
+		"a.txt":     []byte(randString(12, prng)),
+		"dir/b.txt": []byte(randString(12, prng)),
+	}
+	for path, data := range testFiles {
+		if err := oldStore.Write(path, data); err != nil {
+			t.Fatalf("Failed to write %s: %+v", path, err)
+		}
+	}
+	lastWrite, _ := oldStore.GetLastWrite()
+	_, changes, _ := oldStore.GetChanges("", 0)
+	modified, _ := oldStore.GetLastModified("a.txt")
+
+	// Add a new key and check the old files can still be read
+	es := newTestEncryptedStore(newStore, "", EncryptionParams{Keys: keys}, t)
+	for path, expected := range testFiles {
+		if data, err := es.Read(path); err != nil {
+			t.Errorf("Failed to read %s with old key: %+v", path, err)
+		} else if !bytes.Equal(expected, data) {
+			t.Errorf("Unexpected data for %s.\nexpected: %q\nreceived: %q",
+				path, expected, data)
+		}
+	}
+
+	rotated, err := es.Rotate()
+	if err != nil {
+		t.Fatalf("Failed to rotate keys: %+v", err)
+	} else if rotated != len(testFiles)+1 {
+		t.Errorf("Unexpected number of rotated files and versions."+
+			"\nexpected: %d\nreceived: %d", len(testFiles)+1, rotated)
+	}
+	if rotated, err = es.Rotate(); err != nil || rotated != 0 {
+		t.Errorf("Files rotated twice: %d, %+v", rotated, err)
+	}
+
+	// Rotating is not a modification
+	if lw, _ := es.GetLastWrite(); !lw.Equal(lastWrite) {
+		t.Errorf("Last write changed by rotation."+
+			"\nexpected: %s\nreceived: %s", lastWrite, lw)
+	}
+	if _, c, _ := es.GetChanges("", 0); !reflect.DeepEqual(changes, c) {
+		t.Errorf("Journal changed by rotation."+
+			"\nexpected: %+v\nreceived: %+v", changes, c)
+	}
+	if m, _ := es.GetLastModified("a.txt"); !m.Equal(modified) {
+		t.Errorf("Modification time changed by rotation."+
+			"\nexpected: %s\nreceived: %s", modified, m)
+	}
+
+	// Remove the old key and check the files can be read
+	es = newTestEncryptedStore(
+		newStore, "", EncryptionParams{Keys: keys[1:]}, t)
+	for path, expected := range testFiles {
+		if data, err := es.Read(path); err != nil {
+			t.Errorf("Failed to read %s with new key: %+v", path, err)
+		} else if !bytes.Equal(expected, data) {
+			t.Errorf("Unexpected data for %s.\nexpected: %q\nreceived: %q",
+				path, expected, data)
+		}
+	}
+	versions, err := es.ListVersions("a.txt")
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("Unexpected versions after rotation: %+v (%+v)",
+			versions, err)
+	}
+	if data, err := es.ReadVersion("a.txt", versions[0].ID); err != nil {
+		t.Errorf("Failed to read version with new key: %+v", err)
+	} else if !bytes.Equal(oldVersion, data) {
+		t.Errorf("Unexpected data for version.\nexpected: %q\nreceived: %q",
+			oldVersion, data)
+	}
+}
+
+// Error path: Tests that EncryptedStore.Rotate returns an error when the
+// underlying store cannot rewrite files in place.
+func TestEncryptedStore_Rotate_NotRewriterError(t *testing.T) {
+	prng := rand.New(rand.NewSource(5230))
+	ms, _ := NewMemStore("", "user")
+	newStore := func(string, string) (Store, error) {
+		// Embedding only the Store interface hides Rewrite
+		return struct{ Store }{ms}, nil
+	}
+	es := newTestEncryptedStore(newStore, "",
+		EncryptionParams{Keys: newTestMasterKeys(1, prng)}, t)
+
+	if _, err := es.Rotate(); err == nil {
+		t.Errorf("Failed to get error for store that is not a Rewriter.")
+	}
+}
+
+// Error path: Tests that EncryptedStore.Read returns DecryptionErr when the
+// file was encrypted with a key that is not configured.
+func TestEncryptedStore_Read_UnknownKey(t *testing.T) {
+	prng := rand.New(rand.NewSource(9845))
+	keys := newTestMasterKeys(2, prng)
+	ms, _ := NewMemStore("", "user")
+	newStore := func(string, string) (Store, error) { return ms, nil }
+
+	es := newTestEncryptedStore(newStore, "", EncryptionParams{Keys: keys}, t)
+	if err := es.Write("file.txt", []byte("contents")); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+
+	es = newTestEncryptedStore(
+		newStore, "", EncryptionParams{Keys: keys[:1]}, t)
+	_, err := es.Read("file.txt")
+	if !errors.Is(err, DecryptionErr) {
+		t.Errorf("Unexpected error.\nexpected: %v\nreceived: %+v",
+			DecryptionErr, err)
+	}
+}
+
+// Error path: Tests that EncryptedStore.Read returns DecryptionErr when an
+// encrypted file is moved to another path.
+func TestEncryptedStore_Read_SwappedFile(t *testing.T) {
+	prng := rand.New(rand.NewSource(2215))
+	ms, _ := NewMemStore("", "user")
+	newStore := func(string, string) (Store, error) { return ms, nil }
+	es := newTestEncryptedStore(
+		newStore, "", EncryptionParams{Keys: newTestMasterKeys(1, prng)}, t)
+
+	if err := es.Write("a.txt", []byte("contents")); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+	data, _ := ms.Read("a.txt")
+	_ = ms.Write("b.txt", data)
+
+	_, err := es.Read("b.txt")
+	if !errors.Is(err, DecryptionErr) {
+		t.Errorf("Unexpected error.\nexpected: %v\nreceived: %+v",
+			DecryptionErr, err)
+	}
+}
+
+// Error path: Tests that EncryptedStore.Write returns ReservedPathErr for
+// reserved names when paths are obfuscated.
+func TestEncryptedStore_Write_ReservedPath(t *testing.T) {
+	prng := rand.New(rand.NewSource(4471))
+	es := newTestEncryptedStore(NewMemStore, "",
+		EncryptionParams{Keys: newTestMasterKeys(1, prng), ObfuscatePaths: true}, t)
+
+	err := es.Write("dir/"+lastWriteFile, []byte("contents"))
+	if !errors.Is(err, ReservedPathErr) {
+		t.Errorf("Unexpected error.\nexpected: %v\nreceived: %+v",
+			ReservedPathErr, err)
+	}
+}
+
+// Tests that different users have different keys derived from the same master
+// key.
+func TestEncryptedStore_PerUserKeys(t *testing.T) {
+	prng := rand.New(rand.NewSource(6342))
+	keys := newTestMasterKeys(1, prng)
+	ms, _ := NewMemStore("", "")
+	newStore := func(string, string) (Store, error) { return ms, nil }
+	newEncrypted, err := NewEncryptedStore(
+		newStore, EncryptionParams{Keys: keys, ObfuscatePaths: true})
+	if err != nil {
+		t.Fatalf("Failed to create NewStore: %+v", err)
+	}
+
+	alice, _ := newEncrypted("", "alice")
+	bob, _ := newEncrypted("", "bob")
+	if err = alice.Write("file.txt", []byte("contents")); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+
+	if _, err = bob.ReadDirEntries(""); !errors.Is(err, DecryptionErr) {
+		t.Errorf("Unexpected error reading another user's names."+
+			"\nexpected: %v\nreceived: %+v", DecryptionErr, err)
+	}
+}
+
+// Error path: Tests that NewEncryptedStore returns an error for invalid keys.
+func TestNewEncryptedStore_InvalidKeys(t *testing.T) {
+	key := make([]byte, MasterKeyLen)
+	tests := [][]MasterKey{
+		nil,
+		{{ID: 1, Key: key[:16]}},
+		{{ID: 1, Key: key}, {ID: 1, Key: key}},
+	}
+
+	for i, keys := range tests {
+		_, err := NewEncryptedStore(NewMemStore, EncryptionParams{Keys: keys})
+		if err == nil {
+			t.Errorf("No error for invalid keys (%d).", i)
+		}
+	}
+}
+
+// newTestEncryptedStore creates a new EncryptedStore for the user "user".
+func newTestEncryptedStore(newStore NewStore, storageDir string,
+	params EncryptionParams, t testing.TB) *EncryptedStore {
+	newEncrypted, err := NewEncryptedStore(newStore, params)
+	if err != nil {
+		t.Fatalf("Failed to create NewStore: %+v", err)
+	}
+	s, err := newEncrypted(storageDir, "user")
+	if err != nil {
+		t.Fatalf("Failed to create new EncryptedStore: %+v", err)
+	}
+	return s.(*EncryptedStore)
+}
+
+// newTestMasterKeys generates n random master keys with IDs 1 to n.
+func newTestMasterKeys(n int, prng *rand.Rand) []MasterKey {
+	keys := make([]MasterKey, n)
+	for i := range keys {
+		keys[i] = MasterKey{ID: uint32(i + 1), Key: make([]byte, MasterKeyLen)}
+		prng.Read(keys[i].Key)
+	}
+	return keys
+}
@@ -11,6 +11,7 @@ import (
 	ioFS "io/fs"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,14 +19,46 @@ import (
 	"github.com/pkg/errors"
 	jww "github.com/spf13/jwalterweatherman"
 
+	"gitlab.com/xx_network/primitives/netTime"
 	"gitlab.com/xx_network/primitives/utils"
 )
 
 // FileStore manages the file storage in a base directory. Adheres to the Store
 // interface.
 type FileStore struct {
-	baseDir       string
+	baseDir string
+
+	// lastWritePath is the path of the most recently written file and
+	// lastWrite is the time of the most recent Write, Delete, or DeleteDir.
+	// lastWritePath is empty if the most recent modification was a delete.
+	// Both are persisted to the lastWriteFile in the base directory.
 	lastWritePath string
+	lastWrite     time.Time
+
+	// quota is the limit on the storage used. usage is the current storage
+	// used by the files and versionBytes is the size of their previous
+	// versions; both are calculated when the store is opened and kept up to
+	// date on every modification.
+	quota        Quota
+	usage        Usage
+	versionBytes int64
+
+	// retention determines which previous versions of files are kept in the
+	// versionsDir.
+	retention RetentionPolicy
+
+	// hashes is a map of file paths to their content hash that avoids
+	// rehashing unchanged files when generating a manifest.
+	hashes map[string]cachedHash
+
+	// journal is the list of recent modifications. It is persisted to the
+	// journalFile in the base directory.
+	journal *journal
+
+	// closed is true once Close has been called. inProgress tracks the
+	// modifications that Close must wait on.
+	closed     bool
+	inProgress sync.WaitGroup
 
 	mux sync.Mutex
 }
@@ -34,6 +67,16 @@ type FileStore struct {
 // 700 means only the owner can see and modify files.
 const FilePerm = ioFS.FileMode(0700)
 
+// versionsDir is the name of the directory in the base directory that holds
+// previous versions of files. The versions of each file are kept in a directory
+// with the same path relative to versionsDir as the file has to the base
+// directory.
+const versionsDir = internalFilePrefix + "versions"
+
+// versionFilePrefix is the prefix of the name of each previous version of a
+// file. It is followed by the version ID.
+const versionFilePrefix = internalFilePrefix + "v."
+
 // NewFileStore creates a new FileStore at the specified base directory. This
 // function creates a new directory in the filesystem.
 //
@@ -51,6 +94,54 @@ func NewFileStore(storageDir, baseDir string) (Store, error) {
 			err, "failed to make base directory %s", fs.baseDir)
 	}
 
+	removed, err := removeTempFiles(fs.baseDir)
+	if err != nil {
+		return nil, errors.Wrapf(err,
+			"failed to remove temporary files from base directory %s", fs.baseDir)
+	} else if removed > 0 {
+		jww.WARN.Printf("Removed %d temporary files left by interrupted "+
+			"writes in %s.", removed, fs.baseDir)
+	}
+
+	fs.usage, err = dirUsage(fs.baseDir)
+	if err != nil {
+		return nil, errors.Wrapf(
+			err, "failed to calculate usage of base directory %s", fs.baseDir)
+	}
+	versions, err := fs.dirVersions(fs.baseDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to calculate size of previous "+
+			"versions in base directory %s", fs.baseDir)
+	}
+	for _, v := range versions {
+		fs.versionBytes += v.Size
+	}
+
+	lw, err := loadLastWrite(fs.baseDir)
+	if err != nil {
+		return nil, errors.Wrapf(
+			err, "failed to recover last write of base directory %s", fs.baseDir)
+	}
+	if lw.Path != "" {
+		fs.lastWritePath = filepath.Join(fs.baseDir, lw.Path)
+	}
+	fs.lastWrite = lw.Time
+
+	var intact bool
+	fs.journal, intact, err = loadJournal(
+		filepath.Join(fs.baseDir, journalFile), journalMaxEntries)
+	if err != nil {
+		return nil, errors.Wrapf(
+			err, "failed to load journal of base directory %s", fs.baseDir)
+	} else if !intact {
+		// Rewrite the journal so that new changes are not appended after a
+		// partial line and so that a new journal ID is persisted
+		if err = fs.saveJournal(); err != nil {
+			return nil, errors.Wrapf(
+				err, "failed to repair journal of base directory %s", fs.baseDir)
+		}
+	}
+
 	return fs, nil
 }
 
@@ -67,24 +158,87 @@ func (fs *FileStore) Read(path string) ([]byte, error) {
 	return utils.ReadFile(path)
 }
 
-// Write writes the provided data to the file path.
+// Write writes the provided data to the file path. The write is atomic; if it
+// is interrupted, the file retains its previous contents.
 //
 // An error is returned if the write fails. Returns [NonLocalFileErr] if the
-// file is outside the base path.
+// file is outside the base path, [QuotaExceededErr] if the write would exceed
+// the quota, and [ClosedErr] if the store is closed.
 func (fs *FileStore) Write(path string, data []byte) error {
-	path, err := fs.readyPath(path)
+	return fs.write(path, data, Precondition{})
+}
+
+// WriteIf writes the provided data to the file path only if the file matches
+// the precondition. The check and write are atomic.
+//
+// Returns a *[ConflictError], which matches [ConflictErr], if the file does not
+// match the precondition. Otherwise, returns the same errors as Write.
+func (fs *FileStore) WriteIf(path string, data []byte, cond Precondition) error {
+	return fs.write(path, data, cond)
+}
+
+// write writes the data to the file path if it matches the precondition.
+func (fs *FileStore) write(relPath string, data []byte, cond Precondition) error {
+	path, err := fs.readyPath(relPath)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
-	err = utils.WriteFile(path, data, FilePerm, FilePerm)
+	if err = fs.startModification(); err != nil {
+		return err
+	}
+	defer fs.inProgress.Done()
+
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	newUsage := fs.usage
+	newUsage.Bytes += int64(len(data))
+	fi, err := os.Stat(path)
+	if err == nil {
+		newUsage.Bytes -= fi.Size()
+	} else if errors.Is(err, os.ErrNotExist) {
+		newUsage.Files++
+	} else {
+		return errors.WithStack(err)
+	}
+
+	if !cond.isEmpty() {
+		var current []byte
+		var modified time.Time
+		if fi != nil {
+			if current, err = os.ReadFile(path); err != nil {
+				return errors.WithStack(err)
+			}
+			modified = fi.ModTime()
+		}
+		err = cond.check(relPath, fi != nil, modified, current)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if !fs.quota.allows(fs.usage, newUsage) {
+		return errors.WithStack(QuotaExceededErr)
+	}
+
+	if fi != nil && fi.Mode().IsRegular() {
+		if err = fs.saveVersion(path); err != nil {
+			return errors.Wrap(err, "failed to save previous version")
+		}
+	}
+
+	err = writeFileAtomic(path, data, FilePerm)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 
-	fs.mux.Lock()
-	fs.lastWritePath = path
-	fs.mux.Unlock()
+	fs.usage = newUsage
+	if err = fs.evictVersions(); err != nil {
+		jww.WARN.Printf("Failed to remove previous versions to keep %s "+
+			"within its quota: %+v", fs.baseDir, err)
+	}
+	fs.recordChange(ChangeWrite, path)
 	return nil
 }
 
@@ -109,12 +263,17 @@ func (fs *FileStore) getLastModified(path string) (time.Time, error) {
 	return fi.ModTime(), nil
 }
 
-// GetLastWrite returns the time of the most recent successful Write operation
-// that was performed.
+// GetLastWrite returns the time of the most recent successful Write or Delete
+// operation that was performed. The time persists when the store is reopened.
+//
+// Returns [os.ErrNotExist] if no files have ever been written.
 func (fs *FileStore) GetLastWrite() (time.Time, error) {
 	fs.mux.Lock()
 	defer fs.mux.Unlock()
-	return fs.getLastModified(fs.lastWritePath)
+	if fs.lastWrite.IsZero() {
+		return time.Time{}, errors.Wrap(os.ErrNotExist, "no files written")
+	}
+	return fs.lastWrite, nil
 }
 
 // ReadDir reads the named directory, returning all its directory entries
@@ -134,7 +293,7 @@ func (fs *FileStore) ReadDir(path string) ([]string, error) {
 
 	files := make([]string, 0)
 	for _, entry := range entries {
-		if entry.IsDir() {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), internalFilePrefix) {
 			files = append(files, entry.Name())
 		}
 	}
@@ -142,9 +301,641 @@ func (fs *FileStore) ReadDir(path string) ([]string, error) {
 	return files, nil
 }
 
+// ReadDirEntries reads the named directory, returning all the files and
+// directories it contains sorted by name.
+//
+// Returns [NonLocalFileErr] if the directory is outside the base path and
+// [os.ErrNotExist] if it does not exist.
+func (fs *FileStore) ReadDirEntries(path string) ([]DirEntry, error) {
+	path, err := fs.readyPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	list := make([]DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), internalFilePrefix) {
+			continue
+		} else if entry.IsDir() {
+			list = append(list, DirEntry{Name: entry.Name(), IsDir: true})
+		} else if entry.Type().IsRegular() {
+			fi, err := entry.Info()
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			list = append(list, DirEntry{
+				Name:     entry.Name(),
+				Size:     fi.Size(),
+				Modified: fi.ModTime(),
+			})
+		}
+	}
+
+	return list, nil
+}
+
+// Manifest returns every file in the named directory and its subdirectories
+// with its size, modification time, and content hash, sorted by path. If since
+// is not zero, only files modified at or after since are returned. Content
+// hashes are cached so that only files modified since the last manifest are
+// read.
+//
+// Returns [NonLocalFileErr] if the directory is outside the base path and
+// [os.ErrNotExist] if it does not exist.
+func (fs *FileStore) Manifest(
+	path string, since time.Time) ([]ManifestEntry, error) {
+	path, err := fs.readyPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	if fs.hashes == nil {
+		fs.hashes = make(map[string]cachedHash)
+	}
+
+	entries := make([]ManifestEntry, 0)
+	err = filepath.WalkDir(path, func(p string, d ioFS.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if isInternalEntry(path, p, d) {
+			return skipInternalEntry(d)
+		} else if !d.Type().IsRegular() {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		} else if !includeInManifest(fi.ModTime(), since) {
+			return nil
+		}
+
+		hash, err := fs.contentHash(p, fi)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(fs.baseDir, p)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, ManifestEntry{
+			Path:     rel,
+			Size:     fi.Size(),
+			Modified: fi.ModTime(),
+			Hash:     hash,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	sortManifest(entries)
+	return entries, nil
+}
+
+// contentHash returns the content hash of the file at the path, reading the
+// file only if it has changed since it was last hashed. Must be called with
+// fs.mux held.
+func (fs *FileStore) contentHash(path string, fi os.FileInfo) ([]byte, error) {
+	if c, exists := fs.hashes[path]; exists &&
+		c.size == fi.Size() && c.modified.Equal(fi.ModTime()) {
+		return c.hash, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	hash := ContentHash(data)
+	fs.hashes[path] = cachedHash{fi.Size(), fi.ModTime(), hash}
+	return hash, nil
+}
+
+// Delete deletes the file at the given path.
+//
+// An error is returned if the file does not exist or is a directory. Returns
+// [NonLocalFileErr] if the file is outside the base path and [ClosedErr] if the
+// store is closed.
+func (fs *FileStore) Delete(path string) error {
+	path, err := fs.readyPath(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = fs.startModification(); err != nil {
+		return err
+	}
+	defer fs.inProgress.Done()
+
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return errors.WithStack(err)
+	} else if fi.IsDir() {
+		return errors.Errorf("cannot delete directory %s as a file", path)
+	}
+
+	if err = fs.saveVersion(path); err != nil {
+		return errors.Wrap(err, "failed to save previous version")
+	}
+
+	if err = os.Remove(path); err != nil {
+		return errors.WithStack(err)
+	}
+	delete(fs.hashes, path)
+
+	fs.usage.Bytes -= fi.Size()
+	fs.usage.Files--
+
+	fs.recordChange(ChangeDelete, path)
+	return nil
+}
+
+// DeleteDir deletes the named directory and everything it contains, including
+// the previous versions of the files in it. If the path is the base directory,
+// then all of its contents are deleted but the base directory itself is kept.
+//
+// An error is returned if the directory does not exist. Returns
+// [NonLocalFileErr] if the directory is outside the base path and [ClosedErr]
+// if the store is closed.
+func (fs *FileStore) DeleteDir(path string) error {
+	path, err := fs.readyPath(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = fs.startModification(); err != nil {
+		return err
+	}
+	defer fs.inProgress.Done()
+
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return errors.WithStack(err)
+	} else if !fi.IsDir() {
+		return errors.Errorf("cannot delete file %s as a directory", path)
+	}
+
+	deleted, err := dirUsage(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var deletedVersions int64
+	versions, err := fs.dirVersions(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, v := range versions {
+		deletedVersions += v.Size
+	}
+
+	if path == filepath.Clean(fs.baseDir) {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), internalFilePrefix) {
+				continue
+			}
+			err = os.RemoveAll(filepath.Join(path, entry.Name()))
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	} else if err = os.RemoveAll(path); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = os.RemoveAll(fs.versionDir(path)); err != nil {
+		return errors.WithStack(err)
+	}
+	for p := range fs.hashes {
+		if isLocalFile(path, p) {
+			delete(fs.hashes, p)
+		}
+	}
+
+	fs.usage.Bytes -= deleted.Bytes
+	fs.usage.Files -= deleted.Files
+	fs.versionBytes -= deletedVersions
+
+	fs.recordChange(ChangeDeleteDir, path)
+	return nil
+}
+
+// recordChange records a modification of the file or directory at the path
+// as the last write and adds it to the journal, persisting both. The time of a
+// write is the file's modification time and the time of a delete is the
+// current time. The modification has already succeeded, so a failure to
+// persist is only logged. Must be called with fs.mux held.
+func (fs *FileStore) recordChange(changeType ChangeType, path string) {
+	lw := lastWriteMetadata{Time: netTime.Now()}
+	rel, _ := filepath.Rel(fs.baseDir, path)
+	if rel == "." {
+		rel = ""
+	}
+	if changeType == ChangeWrite {
+		if modTime, err := fs.getLastModified(path); err == nil {
+			lw.Time = modTime
+		}
+		lw.Path = rel
+		fs.lastWritePath = path
+	} else {
+		fs.lastWritePath = ""
+	}
+	fs.lastWrite = lw.Time
+
+	if err := saveLastWrite(fs.baseDir, lw); err != nil {
+		jww.WARN.Printf("Failed to persist last write of %s: %+v",
+			fs.baseDir, err)
+	}
+
+	journalPath := filepath.Join(fs.baseDir, journalFile)
+	c := fs.journal.add(changeType, rel, lw.Time)
+	var err error
+	if fs.journal.compact() {
+		err = fs.saveJournal()
+	} else {
+		err = appendJournal(journalPath, c)
+	}
+	if err != nil {
+		jww.WARN.Printf("Failed to persist change %d to journal %s: %+v",
+			c.Seq, journalPath, err)
+	}
+}
+
+// saveJournal replaces the journal file with the contents of the journal.
+func (fs *FileStore) saveJournal() error {
+	data, err := fs.journal.marshal()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(fs.baseDir, journalFile), data, FilePerm)
+}
+
+// GetChanges returns the ID of the journal and all changes in it with a
+// sequence number greater than after, in order. Passing zero returns all
+// changes. The journal and its ID persist when the store is reopened.
+//
+// Returns [JournalCompactedErr] if any of the requested changes have been
+// removed from the journal, if after is past the last change, or if after is
+// not zero and journalID is not the ID of the journal.
+func (fs *FileStore) GetChanges(
+	journalID string, after uint64) (string, []Change, error) {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	changes, err := fs.journal.since(journalID, after)
+	return fs.journal.id, changes, err
+}
+
+// SetQuota sets the limits on the storage used by the store. Existing files are
+// kept even if they exceed the new quota.
+func (fs *FileStore) SetQuota(quota Quota) {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	fs.quota = quota
+}
+
+// GetUsage returns the storage currently used by the store.
+func (fs *FileStore) GetUsage() Usage {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	return fs.getUsage()
+}
+
+// getUsage returns the storage used by the files and their previous versions.
+// Must be called with fs.mux held.
+func (fs *FileStore) getUsage() Usage {
+	u := fs.usage
+	u.VersionBytes = fs.versionBytes
+	return u
+}
+
+// SetRetention sets the policy that determines which previous versions of each
+// file are kept when it is overwritten or deleted. Versions no longer retained
+// under a new policy are removed the next time their file is modified.
+func (fs *FileStore) SetRetention(policy RetentionPolicy) {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	fs.retention = policy
+}
+
+// ListVersions returns the previous versions of the file at the given path that
+// are retained, sorted from newest to oldest. The current contents of the file
+// are not included.
+//
+// Returns [NonLocalFileErr] if the file is outside the base path.
+func (fs *FileStore) ListVersions(path string) ([]Version, error) {
+	path, err := fs.readyPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	versions, err := fs.listVersions(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	versions, _ = fs.retention.apply(versions, netTime.Now())
+	return versions, nil
+}
+
+// ReadVersion returns the contents of the previous version of the file at the
+// given path with the given ID.
+//
+// Returns [NonLocalFileErr] if the file is outside the base path and
+// [VersionNotFoundErr] if the version does not exist.
+func (fs *FileStore) ReadVersion(path string, id int64) ([]byte, error) {
+	path, err := fs.readyPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(fs.versionPath(path, id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errors.WithStack(VersionNotFoundErr)
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return data, nil
+}
+
+// Rewrite replaces the contents of every file and every retained previous
+// version with the data returned by rewrite. Each file is replaced atomically
+// and keeps its modification time. Implements [Rewriter].
+//
+// Returns [ClosedErr] if the store is closed.
+func (fs *FileStore) Rewrite(rewrite RewriteFunc) error {
+	if err := fs.startModification(); err != nil {
+		return err
+	}
+	defer fs.inProgress.Done()
+
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	err := filepath.WalkDir(fs.baseDir,
+		func(path string, d ioFS.DirEntry, err error) error {
+			if err != nil {
+				return err
+			} else if isInternalEntry(fs.baseDir, path, d) {
+				return skipInternalEntry(d)
+			} else if !d.Type().IsRegular() {
+				return nil
+			}
+			delete(fs.hashes, path)
+			return fs.rewriteFile(path, path, &fs.usage.Bytes, rewrite)
+		})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	versions, err := fs.dirVersions(fs.baseDir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, v := range versions {
+		err = fs.rewriteFile(
+			fs.versionPath(v.path, v.ID), v.path, &fs.versionBytes, rewrite)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// rewriteFile replaces the contents of the file at the path, which holds the
+// contents of the file at filePath, with the data returned by rewrite. The
+// modification time is kept and size is adjusted by the change in size. Must
+// be called with fs.mux held.
+func (fs *FileStore) rewriteFile(
+	path, filePath string, size *int64, rewrite RewriteFunc) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	rel, _ := filepath.Rel(fs.baseDir, filePath)
+	newData, err := rewrite(rel, data)
+	if err != nil || newData == nil {
+		return err
+	}
+
+	if err = writeFileAtomic(path, newData, FilePerm); err != nil {
+		return err
+	}
+	if err = os.Chtimes(path, fi.ModTime(), fi.ModTime()); err != nil {
+		return err
+	}
+	*size += int64(len(newData)) - fi.Size()
+	return nil
+}
+
+// saveVersion keeps the current contents of the file at the path as a previous
+// version and removes the versions of the file that are no longer retained.
+// Does nothing if the retention policy keeps no versions. Must be called with
+// fs.mux held.
+func (fs *FileStore) saveVersion(path string) error {
+	if !fs.retention.enabled() {
+		return nil
+	}
+
+	if err := os.MkdirAll(fs.versionDir(path), FilePerm); err != nil {
+		return err
+	}
+
+	now := netTime.Now()
+	id := newVersionID(now, func(id int64) bool {
+		_, err := os.Lstat(fs.versionPath(path, id))
+		return err == nil
+	})
+	if err := linkFile(path, fs.versionPath(path, id)); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(path); err == nil {
+		fs.versionBytes += fi.Size()
+	}
+
+	versions, err := fs.listVersions(path)
+	if err != nil {
+		return err
+	}
+	_, remove := fs.retention.apply(versions, now)
+	for _, v := range remove {
+		if err = fs.removeVersion(path, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evictVersions removes the oldest previous versions of any file until the
+// files and their versions fit within the byte quota. Must be called with
+// fs.mux held.
+func (fs *FileStore) evictVersions() error {
+	excess := fs.quota.excessVersionBytes(fs.getUsage())
+	if excess == 0 {
+		return nil
+	}
+
+	versions, err := fs.dirVersions(fs.baseDir)
+	if err != nil {
+		return err
+	}
+	for _, v := range oldestVersions(versions, excess) {
+		if err = fs.removeVersion(v.path, v.Version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeVersion removes the previous version of the file at the path. Must be
+// called with fs.mux held.
+func (fs *FileStore) removeVersion(path string, v Version) error {
+	err := os.Remove(fs.versionPath(path, v.ID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	fs.versionBytes -= v.Size
+	return nil
+}
+
+// dirVersions returns all previous versions of every file in the directory,
+// which must be in the base directory, and its subdirectories in no particular
+// order.
+func (fs *FileStore) dirVersions(path string) ([]storedVersion, error) {
+	root := fs.versionDir(path)
+	var versions []storedVersion
+	walk := func(dir string, d ioFS.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) && dir == root {
+			return nil
+		} else if err != nil || !d.IsDir() {
+			return err
+		}
+
+		// Each directory holds the versions of the file at the same path
+		// relative to the versions directory
+		rel, _ := filepath.Rel(filepath.Join(fs.baseDir, versionsDir), dir)
+		path := filepath.Join(fs.baseDir, rel)
+		fileVersions, err := fs.listVersions(path)
+		if err != nil {
+			return err
+		}
+		for _, v := range fileVersions {
+			versions = append(versions, storedVersion{path, v})
+		}
+		return nil
+	}
+	err := filepath.WalkDir(root, walk)
+	return versions, err
+}
+
+// listVersions returns all previous versions of the file at the path in no
+// particular order.
+func (fs *FileStore) listVersions(path string) ([]Version, error) {
+	entries, err := os.ReadDir(fs.versionDir(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return []Version{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	versions := make([]Version, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() ||
+			!strings.HasPrefix(entry.Name(), versionFilePrefix) {
+			continue
+		}
+		id, err := strconv.ParseInt(
+			strings.TrimPrefix(entry.Name(), versionFilePrefix), 10, 64)
+		if err != nil {
+			jww.WARN.Printf("Skipping version file %s with invalid ID: %+v",
+				entry.Name(), err)
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, Version{
+			ID:       id,
+			Modified: fi.ModTime(),
+			Replaced: time.Unix(0, id),
+			Size:     fi.Size(),
+		})
+	}
+	return versions, nil
+}
+
+// versionDir returns the directory that holds the previous versions of the file
+// at the path, which must be in the base directory.
+func (fs *FileStore) versionDir(path string) string {
+	rel, _ := filepath.Rel(fs.baseDir, path)
+	return filepath.Join(fs.baseDir, versionsDir, rel)
+}
+
+// versionPath returns the path of the previous version of the file at the path
+// with the given ID.
+func (fs *FileStore) versionPath(path string, id int64) string {
+	return filepath.Join(
+		fs.versionDir(path), versionFilePrefix+strconv.FormatInt(id, 10))
+}
+
+// Close prevents any further modifications to the store and waits for all
+// in-progress modifications to complete. Reads are still permitted. Calling
+// Close more than once has no effect.
+func (fs *FileStore) Close() error {
+	fs.mux.Lock()
+	fs.closed = true
+	fs.mux.Unlock()
+
+	fs.inProgress.Wait()
+	return nil
+}
+
+// startModification registers the start of a modification that Close must wait
+// on. The caller must call fs.inProgress.Done once the modification completes.
+// Returns [ClosedErr] if the store is closed.
+func (fs *FileStore) startModification() error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	if fs.closed {
+		return ClosedErr
+	}
+	fs.inProgress.Add(1)
+	return nil
+}
+
 // readyPath makes the path relative to the base directory and ensures it is
-// local. Returns NonLocalFileErr if the file is outside the base path.
+// local. Returns NonLocalFileErr if the file is outside the base path and
+// ReservedPathErr if the path is reserved for internal files.
 func (fs *FileStore) readyPath(path string) (string, error) {
+	if isReservedPath(path) {
+		return "", ReservedPathErr
+	}
 	return readyPath(fs.baseDir, path)
 }
 
@@ -154,12 +945,75 @@ func (fs *FileStore) isLocalFile(path string) bool {
 	return isLocalFile(fs.baseDir, path)
 }
 
+// dirUsage returns the total size and number of all regular files in the
+// directory and its subdirectories, excluding internal files and directories.
+// Previous versions of files are therefore not included; their size is kept
+// separately.
+func dirUsage(dir string) (Usage, error) {
+	var u Usage
+	err := filepath.WalkDir(dir, func(path string, d ioFS.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if isInternalEntry(dir, path, d) {
+			return skipInternalEntry(d)
+		} else if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		u.Bytes += fi.Size()
+		u.Files++
+		return nil
+	})
+	return u, err
+}
+
+// isInternalEntry returns true if the directory entry found at the path while
+// walking the root directory is an internal file or directory.
+func isInternalEntry(root, path string, d ioFS.DirEntry) bool {
+	return path != root && strings.HasPrefix(d.Name(), internalFilePrefix)
+}
+
+// skipInternalEntry returns the error that makes filepath.WalkDir skip the
+// internal directory entry and its contents.
+func skipInternalEntry(d ioFS.DirEntry) error {
+	if d.IsDir() {
+		return filepath.SkipDir
+	}
+	return nil
+}
+
+// ListBaseDirs returns the names of the base directories that have been created
+// in the storage directory by NewFileStore or NewSQLiteStore, sorted by name.
+// Returns no names if the storage directory does not exist.
+func ListBaseDirs(storageDir string) ([]string, error) {
+	entries, err := os.ReadDir(storageDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(
+			err, "failed to read storage directory %s", storageDir)
+	}
+
+	baseDirs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			baseDirs = append(baseDirs, entry.Name())
+		}
+	}
+	return baseDirs, nil
+}
+
+// readyPath joins the path to the base directory. Returns NonLocalFileErr if
+// the path leaves the base directory at any point, even if it returns to it
+// (e.g., "../user" for the base directory "user").
 func readyPath(baseDir, path string) (string, error) {
-	path = filepath.Join(baseDir, path)
-	if !isLocalFile(baseDir, path) {
+	if !isLocalFile(".", filepath.Join(".", path)) {
 		return "", NonLocalFileErr
 	}
-	return path, nil
+	return filepath.Join(baseDir, path), nil
 }
 
 func isLocalFile(baseDir, path string) bool {
@@ -168,7 +1022,8 @@ func isLocalFile(baseDir, path string) bool {
 		jww.WARN.Printf("Failed to get relative path of %s to base %s: %+v",
 			path, baseDir, err)
 		return false
-	} else if strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+	} else if rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
 		return false
 	}
 
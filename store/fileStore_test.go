@@ -15,6 +15,9 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -24,10 +27,18 @@ import (
 // Tests that FileStore adheres to the Store interface.
 var _ Store = (*FileStore)(nil)
 
+// Tests that FileStore passes the store conformance tests.
+func TestFileStore_Conformance(t *testing.T) {
+	RunConformanceTests(t, NewFileStore)
+}
+
 // Unit test of NewFileStore.
 func TestNewFileStore(t *testing.T) {
 	testDir := "tmp"
-	expected := &FileStore{baseDir: filepath.Join(testDir, "baseDir")}
+	expected := &FileStore{
+		baseDir: filepath.Join(testDir, "baseDir"),
+		journal: newJournal(journalMaxEntries),
+	}
 	defer removeTestFile(t, testDir)
 
 	fs, err := NewFileStore(testDir, "baseDir")
@@ -35,6 +46,8 @@ func TestNewFileStore(t *testing.T) {
 		t.Errorf("Error creating new store: %+v", err)
 	}
 
+	// The journal ID is random
+	expected.journal.id = fs.(*FileStore).journal.id
 	if !reflect.DeepEqual(expected, fs) {
 		t.Errorf("Unexpected new FileStore.\nexpected: %+v\nrecieved: %+v",
 			expected, fs)
@@ -85,6 +98,43 @@ func TestNewFileStore_NonLocalPathError(t *testing.T) {
 	}
 }
 
+// Tests that ListBaseDirs returns the base directory of every FileStore created
+// in the storage directory and ignores other files.
+func TestListBaseDirs(t *testing.T) {
+	testDir := "tmp"
+	defer removeTestFile(t, testDir)
+	for _, baseDir := range []string{"waldo", "carmen"} {
+		newTestFileStore(baseDir, testDir, t)
+	}
+	err := os.WriteFile(filepath.Join(testDir, "file.txt"), nil, FilePerm)
+	if err != nil {
+		t.Fatalf("Failed to write file: %+v", err)
+	}
+
+	baseDirs, err := ListBaseDirs(testDir)
+	if err != nil {
+		t.Fatalf("Failed to list base directories: %+v", err)
+	}
+
+	expected := []string{"carmen", "waldo"}
+	if !reflect.DeepEqual(expected, baseDirs) {
+		t.Errorf("Unexpected base directories."+
+			"\nexpected: %q\nreceived: %q", expected, baseDirs)
+	}
+}
+
+// Tests that ListBaseDirs returns no base directories if the storage directory
+// does not exist.
+func TestListBaseDirs_NoStorageDir(t *testing.T) {
+	baseDirs, err := ListBaseDirs("tmp/missing")
+	if err != nil {
+		t.Fatalf("Failed to list base directories: %+v", err)
+	}
+	if len(baseDirs) != 0 {
+		t.Errorf("Unexpected base directories: %q", baseDirs)
+	}
+}
+
 // Tests that FileStore.Read can only read files written to the base directory.
 func TestFileStore_Read(t *testing.T) {
 	testDir := "tmp"
@@ -331,6 +381,805 @@ func TestFileStore_ReadDir_InvalidPathError(t *testing.T) {
 	}
 }
 
+// Tests that FileStore.ReadDirEntries returns all files and directories with
+// their metadata and that it matches the listing of a MemStore with the same
+// files.
+func TestFileStore_ReadDirEntries(t *testing.T) {
+	testDir := "tmp"
+	fs := newTestFileStore("baseDir", testDir, t)
+	defer removeTestFile(t, testDir)
+	fs.SetRetention(RetentionPolicy{MaxVersions: 1})
+	ms, _ := NewMemStore("", "")
+
+	files := map[string]string{
+		"file":         "a",
+		"dir1/a":       "ab",
+		"dir1/file":    "abc",
+		"dir1/dirA/a":  "abcd",
+		"dir2/dirB/bb": "abcde",
+	}
+	for path, data := range files {
+		for _, s := range []Store{fs, ms} {
+			if err := s.Write(path, []byte(data)); err != nil {
+				t.Fatalf("Failed to write %s to %T: %+v", path, s, err)
+			}
+		}
+	}
+
+	// Overwrite a file in the base directory so a version is saved
+	if err := fs.Write("file", []byte("a")); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+
+	tests := []struct {
+		path     string
+		expected []DirEntry
+	}{
+		{"", []DirEntry{
+			{Name: "dir1", IsDir: true},
+			{Name: "dir2", IsDir: true},
+			{Name: "file", Size: 1},
+		}},
+		{"dir1", []DirEntry{
+			{Name: "a", Size: 2},
+			{Name: "dirA", IsDir: true},
+			{Name: "file", Size: 3},
+		}},
+		{"dir2", []DirEntry{{Name: "dirB", IsDir: true}}},
+		{"dir2/dirB/", []DirEntry{{Name: "bb", Size: 5}}},
+	}
+
+	for i, tt := range tests {
+		for _, s := range []Store{fs, ms} {
+			entries, err := s.ReadDirEntries(tt.path)
+			if err != nil {
+				t.Errorf("Failed to read %s from %T (%d): %+v", tt.path, s, i, err)
+				continue
+			}
+
+			for j := range entries {
+				if !entries[j].IsDir && entries[j].Modified.IsZero() {
+					t.Errorf("No modification time for %s in %s from %T (%d).",
+						entries[j].Name, tt.path, s, i)
+				}
+				entries[j].Modified = time.Time{}
+			}
+			if !reflect.DeepEqual(tt.expected, entries) {
+				t.Errorf("Unexpected entries for %s from %T (%d)."+
+					"\nexpected: %+v\nreceived: %+v", tt.path, s, i,
+					tt.expected, entries)
+			}
+		}
+	}
+}
+
+// Error path: Tests that FileStore.ReadDirEntries returns os.ErrNotExist when
+// the directory does not exist.
+func TestFileStore_ReadDirEntries_InvalidPathError(t *testing.T) {
+	testDir := "tmp"
+	fs := newTestFileStore("baseDir", testDir, t)
+	defer removeTestFile(t, testDir)
+
+	_, err := fs.ReadDirEntries("dir")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error for missing directory."+
+			"\nexpected: %v\nreceived: %+v", os.ErrNotExist, err)
+	}
+}
+
+// Tests that FileStore.Manifest returns every file under the directory with
+// the correct metadata and hash, filters by modification time, and reflects
+// changes made after a previous manifest.
+func TestFileStore_Manifest(t *testing.T) {
+	testDir := "tmp"
+	fs := newTestFileStore("baseDir", testDir, t)
+	defer removeTestFile(t, testDir)
+	fs.SetRetention(RetentionPolicy{MaxVersions: 1})
+
+	old := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	files := map[string]string{
+		"file":        "a",
+		"dir1/a":      "ab",
+		"dir1/dirA/b": "abc",
+		"dir2/c":      "abcd",
+	}
+	for path, data := range files {
+		if err := fs.Write(path, []byte(data)); err != nil {
+			t.Fatalf("Failed to write %s: %+v", path, err)
+		}
+		if path == "dir1/a" {
+			err := os.Chtimes(filepath.Join(fs.baseDir, path), old, old)
+			if err != nil {
+				t.Fatalf("Failed to set modification time: %+v", err)
+			}
+		}
+	}
+	// Overwrite a file so a version is saved
+	if err := fs.Write("file", []byte("a")); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+
+	check := func(path string, since time.Time, expected []string) {
+		entries, err := fs.Manifest(path, since)
+		if err != nil {
+			t.Fatalf("Failed to get manifest of %s: %+v", path, err)
+		}
+		var paths []string
+		for _, e := range entries {
+			paths = append(paths, e.Path)
+			data := files[e.Path]
+			if e.Size != int64(len(data)) ||
+				!bytes.Equal(e.Hash, ContentHash([]byte(data))) {
+				t.Errorf("Unexpected entry for %s: %+v", e.Path, e)
+			}
+			modified, _ := fs.GetLastModified(e.Path)
+			if !e.Modified.Equal(modified) {
+				t.Errorf("Unexpected modification time for %s."+
+					"\nexpected: %s\nreceived: %s", e.Path, modified, e.Modified)
+			}
+		}
+		if !reflect.DeepEqual(expected, paths) {
+			t.Errorf("Unexpected manifest of %s since %s."+
+				"\nexpected: %v\nreceived: %v", path, since, expected, paths)
+		}
+	}
+
+	check("", time.Time{}, []string{"dir1/a", "dir1/dirA/b", "dir2/c", "file"})
+	check("dir1", time.Time{}, []string{"dir1/a", "dir1/dirA/b"})
+	check("", old.Add(time.Hour), []string{"dir1/dirA/b", "dir2/c", "file"})
+
+	files["dir1/a"] = "changed"
+	if err := fs.Write("dir1/a", []byte(files["dir1/a"])); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+	check("dir1", time.Time{}, []string{"dir1/a", "dir1/dirA/b"})
+}
+
+// Error path: Tests that FileStore.Manifest returns os.ErrNotExist when the
+// directory does not exist.
+func TestFileStore_Manifest_InvalidPathError(t *testing.T) {
+	testDir := "tmp"
+	fs := newTestFileStore("baseDir", testDir, t)
+	defer removeTestFile(t, testDir)
+
+	_, err := fs.Manifest("dir", time.Time{})
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error for missing directory."+
+			"\nexpected: %v\nreceived: %+v", os.ErrNotExist, err)
+	}
+}
+
+// Tests that FileStore.Delete removes a written file and that
+// FileStore.GetLastWrite returns the time of the deletion afterwards.
+func TestFileStore_Delete(t *testing.T) {
+	testDir := "tmp"
+	fs := newTestFileStore("baseDir", testDir, t)
+	defer removeTestFile(t, testDir)
+
+	path := "dir/file.txt"
+	if err := fs.Write(path, []byte("data")); err != nil {
+		t.Fatalf("Failed to write data for path %s: %+v", path, err)
+	}
+
+	now := netTime.Now()
+	if err := fs.Delete(path); err != nil {
+		t.Fatalf("Failed to delete %s: %+v", path, err)
+	}
+
+	if _, err := fs.Read(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error reading deleted file."+
+			"\nexpected: %v\nreceived: %+v", os.ErrNotExist, err)
+	}
+
+	lastWrite, err := fs.GetLastWrite()
+	if err != nil {
+		t.Errorf("Failed to get last write: %+v", err)
+	} else if delta := lastWrite.Sub(now); delta > 10*time.Millisecond ||
+		lastWrite.Before(now) {
+		t.Errorf("Last write is not close to delete time (Δ%s)."+
+			"\nexpected: %s\nreceived: %s", delta, now, lastWrite)
+	}
+}
+
+// Error path: Tests that FileStore.Delete returns os.ErrNotExist when the file
+// does not exist.
+func TestFileStore_Delete_InvalidPathError(t *testing.T) {
+	testDir := "tmp"
+	fs := newTestFileStore("baseDir", testDir, t)
+	defer removeTestFile(t, testDir)
+
+	err := fs.Delete("file")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error for invalid path."+
+			"\nexpected: %v\nreceived: %+v", os.ErrNotExist, err)
+	}
+}
+
+// Error path: Tests that FileStore.Delete returns an error when the path is a
+// directory.
+func TestFileStore_Delete_DirectoryError(t *testing.T) {
+	testDir := "tmp"
+	fs := newTestFileStore("baseDir", testDir, t)
+	defer removeTestFile(t, testDir)
+
+	if err := fs.Write("dir/file.txt", []byte("data")); err != nil {
+		t.Fatalf("Failed to write data: %+v", err)
+	}
+
+	if err := fs.Delete("dir"); err == nil {
+		t.Errorf("Failed to receive error when deleting a directory.")
+	}
+}
+
+// Error path: Tests that FileStore.Delete returns NonLocalFileErr when the path
+// is not local to the base directory.
+func TestFileStore_Delete_NonLocalPathError(t *testing.T) {
+	fs := &FileStore{baseDir: "baseDir"}
+	for _, path := range []string{"../file", ".."} {
+		err := fs.Delete(path)
+		if !errors.Is(err, NonLocalFileErr) {
+			t.Errorf("Unexpected error for non-local file %s."+
+				"\nexpected: %v\nreceived: %v", path, NonLocalFileErr, err)
+		}
+	}
+}
+
+// Tests that FileStore.DeleteDir removes the directory and all its contents
+// while leaving other files untouched.
+func TestFileStore_DeleteDir(t *testing.T) {
+	testDir := "tmp"
+	fs := newTestFileStore("baseDir", testDir, t)
+	defer removeTestFile(t, testDir)
+
+	for i, path := range []string{"file", "dir1/a", "dir1/dirA/a",
+		"dir1/dirB/dirB1/a", "dir2/a"} {
+		if err := fs.Write(path, []byte("data")); err != nil {
+			t.Errorf("Failed to write data for path %s (%d): %+v", path, i, err)
+		}
+	}
+
+	if err := fs.DeleteDir("dir1"); err != nil {
+		t.Fatalf("Failed to delete directory: %+v", err)
+	}
+
+	dirs, err := fs.ReadDir("")
+	if err != nil {
+		t.Errorf("Failed to read directory: %+v", err)
+	} else if expected := []string{"dir2"}; !reflect.DeepEqual(expected, dirs) {
+		t.Errorf("Unexpected directories after delete."+
+			"\nexpected: %s\nreceived: %s", expected, dirs)
+	}
+
+	if _, err = fs.Read("dir2/a"); err != nil {
+		t.Errorf("Failed to read file outside deleted directory: %+v", err)
+	}
+}
+
+// Tests that FileStore.DeleteDir removes all contents of the base directory
+// without removing the base directory itself or the internal files in it.
+func TestFileStore_DeleteDir_BaseDir(t *testing.T) {
+	testDir := "tmp"
+	fs := newTestFileStore("baseDir", testDir, t)
+	defer removeTestFile(t, testDir)
+
+	for i, path := range []string{"file", "dir1/a", "dir2/a"} {
+		if err := fs.Write(path, []byte("data")); err != nil {
+			t.Errorf("Failed to write data for path %s (%d): %+v", path, i, err)
+		}
+	}
+
+	if err := fs.DeleteDir(""); err != nil {
+		t.Fatalf("Failed to delete base directory: %+v", err)
+	}
+
+	entries, err := os.ReadDir(fs.baseDir)
+	if err != nil {
+		t.Errorf("Failed to read base directory: %+v", err)
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), internalFilePrefix) {
+			t.Errorf("Base directory not empty: %v", entries)
+			break
+		}
+	}
+}
+
+// Error path: Tests that FileStore.DeleteDir returns NonLocalFileErr when the
+// path is not local to the base directory.
+func TestFileStore_DeleteDir_NonLocalPathError(t *testing.T) {
+	fs := &FileStore{baseDir: "baseDir"}
+	for _, path := range []string{"../dir", "..", "dir/../.."} {
+		err := fs.DeleteDir(path)
+		if !errors.Is(err, NonLocalFileErr) {
+			t.Errorf("Unexpected error for non-local directory %s."+
+				"\nexpected: %v\nreceived: %v", path, NonLocalFileErr, err)
+		}
+	}
+}
+
+// Error path: Tests that FileStore.DeleteDir returns os.ErrNotExist when the
+// directory does not exist.
+func TestFileStore_DeleteDir_InvalidPathError(t *testing.T) {
+	testDir := "tmp"
+	fs := newTestFileStore("baseDir", testDir, t)
+	defer removeTestFile(t, testDir)
+
+	err := fs.DeleteDir("dir")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error for invalid path."+
+			"\nexpected: %v\nreceived: %+v", os.ErrNotExist, err)
+	}
+}
+
+// Tests that FileStore tracks usage across writes, overwrites, and deletes,
+// rejects writes that exceed the quota with QuotaExceededErr, and recalculates
+// the usage when the store is reopened.
+func TestFileStore_SetQuota_GetUsage(t *testing.T) {
+	testDir := "tmp"
+	fs := newTestFileStore("baseDir", testDir, t)
+	defer removeTestFile(t, testDir)
+
+	fs.SetQuota(Quota{MaxBytes: 10, MaxFiles: 3})
+
+	steps := []struct {
+		op       func() error
+		err      error
+		expected Usage
+	}{
+		{func() error { return fs.Write("a", []byte("1234")) }, nil, Usage{4, 1, 0}},
+		{func() error { return fs.Write("dir/b", []byte("12")) }, nil, Usage{6, 2, 0}},
+		{func() error { return fs.Write("a", []byte("123456789")) }, QuotaExceededErr, Usage{6, 2, 0}},
+		{func() error { return fs.Write("a", []byte("1")) }, nil, Usage{3, 2, 0}},
+		{func() error { return fs.Write("dir/c", []byte("1")) }, nil, Usage{4, 3, 0}},
+		{func() error { return fs.Write("d", []byte("1")) }, QuotaExceededErr, Usage{4, 3, 0}},
+		{func() error { return fs.Delete("a") }, nil, Usage{3, 2, 0}},
+		{func() error { return fs.Write("d", []byte("1")) }, nil, Usage{4, 3, 0}},
+		{func() error { return fs.DeleteDir("dir") }, nil, Usage{1, 1, 0}},
+	}
+
+	for i, step := range steps {
+		err := step.op()
+		if step.err == nil && err != nil {
+			t.Errorf("Operation %d failed: %+v", i, err)
+		} else if !errors.Is(err, step.err) {
+			t.Errorf("Unexpected error for operation %d."+
+				"\nexpected: %v\nreceived: %+v", i, step.err, err)
+		}
+
+		if usage := fs.GetUsage(); usage != step.expected {
+			t.Errorf("Unexpected usage after operation %d."+
+				"\nexpected: %+v\nreceived: %+v", i, step.expected, usage)
+		}
+	}
+
+	reopened := newTestFileStore("baseDir", testDir, t)
+	if usage := reopened.GetUsage(); usage != (Usage{1, 1, 0}) {
+		t.Errorf("Unexpected usage after reopening."+
+			"\nexpected: %+v\nreceived: %+v", Usage{1, 1, 0}, usage)
+	}
+}
+
+// Tests that FileStore.WriteIf only writes when the file matches the
+// precondition and otherwise returns a ConflictError describing the file.
+func TestFileStore_WriteIf(t *testing.T) {
+	testDir := "tmp"
+	fs := newTestFileStore("baseDir", testDir, t)
+	defer removeTestFile(t, testDir)
+
+	path := "dir/file.txt"
+	err := fs.WriteIf(path, []byte("one"), Precondition{NotExist: true})
+	if err != nil {
+		t.Fatalf("Failed to create file: %+v", err)
+	}
+	modified, err := fs.GetLastModified(path)
+	if err != nil {
+		t.Fatalf("Failed to get last modified: %+v", err)
+	}
+
+	// Stale precondition from another device
+	err = fs.WriteIf(path, []byte("two"), Precondition{NotExist: true})
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) || !errors.Is(err, ConflictErr) {
+		t.Fatalf("Unexpected error.\nexpected: %v\nreceived: %+v",
+			ConflictErr, err)
+	} else if !conflict.Exists || conflict.Path != path ||
+		!conflict.Modified.Equal(modified) ||
+		!bytes.Equal(conflict.Hash, ContentHash([]byte("one"))) ||
+		conflict.Size != 3 {
+		t.Errorf("Unexpected conflict: %+v", conflict)
+	}
+
+	err = fs.WriteIf(path, []byte("two"), Precondition{
+		Modified: modified, Hash: ContentHash([]byte("one"))})
+	if err != nil {
+		t.Fatalf("Failed to write with matching precondition: %+v", err)
+	}
+
+	err = fs.WriteIf(path, []byte("three"),
+		Precondition{Hash: ContentHash([]byte("one"))})
+	if !errors.Is(err, ConflictErr) {
+		t.Errorf("Unexpected error.\nexpected: %v\nreceived: %+v",
+			ConflictErr, err)
+	}
+
+	if data, err := fs.Read(path); err != nil {
+		t.Errorf("Failed to read: %+v", err)
+	} else if string(data) != "two" {
+		t.Errorf("Unexpected data.\nexpected: %q\nreceived: %q", "two", data)
+	}
+}
+
+// Tests that when many concurrent FileStore.WriteIf calls use the same
+// precondition, exactly one of them succeeds.
+func TestFileStore_WriteIf_Concurrent(t *testing.T) {
+	testDir := "tmp"
+	fs := newTestFileStore("baseDir", testDir, t)
+	defer removeTestFile(t, testDir)
+
+	if err := fs.Write("file", []byte("base")); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+	cond := Precondition{Hash: ContentHash([]byte("base"))}
+
+	const n = 20
+	var wg sync.WaitGroup
+	results := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results <- fs.WriteIf("file", []byte(strconv.Itoa(i)), cond)
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+
+	var succeeded int
+	for err := range results {
+		if err == nil {
+			succeeded++
+		} else if !errors.Is(err, ConflictErr) {
+			t.Errorf("Unexpected error: %+v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("Unexpected number of successful writes."+
+			"\nexpected: %d\nreceived: %d", 1, succeeded)
+	}
+}
+
+// Tests that FileStore.Rewrite keeps the modification times of the files and
+// previous versions it replaces and that their new contents are read after
+// reopening the store.
+func TestFileStore_Rewrite(t *testing.T) {
+	testDir := "tmp"
+	fs := newTestFileStore("baseDir", testDir, t)
+	defer removeTestFile(t, testDir)
+	fs.SetRetention(RetentionPolicy{MaxVersions: 1})
+
+	for _, data := range []string{"one", "two"} {
+		if err := fs.Write("file.txt", []byte(data)); err != nil {
+			t.Fatalf("Failed to write %q: %+v", data, err)
+		}
+	}
+	modified, err := fs.GetLastModified("file.txt")
+	if err != nil {
+		t.Fatalf("Failed to get last modified: %+v", err)
+	}
+	versions, err := fs.ListVersions("file.txt")
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("Unexpected versions: %+v (%+v)", versions, err)
+	}
+
+	// Wait so that a changed modification time would be detected
+	time.Sleep(10 * time.Millisecond)
+	err = fs.Rewrite(func(path string, data []byte) ([]byte, error) {
+		return bytes.ToUpper(data), nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to rewrite: %+v", err)
+	}
+
+	fs = newTestFileStore("baseDir", testDir, t)
+	if data, err := fs.Read("file.txt"); err != nil || string(data) != "TWO" {
+		t.Errorf("Unexpected contents after rewrite."+
+			"\nexpected: %q\nreceived: %q (%+v)", "TWO", data, err)
+	}
+	if m, err := fs.GetLastModified("file.txt"); err != nil || !m.Equal(modified) {
+		t.Errorf("Modification time changed by rewrite."+
+			"\nexpected: %s\nreceived: %s (%+v)", modified, m, err)
+	}
+	rewritten, err := fs.ListVersions("file.txt")
+	if err != nil {
+		t.Fatalf("Failed to list versions: %+v", err)
+	} else if !reflect.DeepEqual(versions, rewritten) {
+		t.Errorf("Versions changed by rewrite."+
+			"\nexpected: %+v\nreceived: %+v", versions, rewritten)
+	}
+	data, err := fs.ReadVersion("file.txt", versions[0].ID)
+	if err != nil || string(data) != "ONE" {
+		t.Errorf("Unexpected contents of version after rewrite."+
+			"\nexpected: %q\nreceived: %q (%+v)", "ONE", data, err)
+	}
+}
+
+// Tests that FileStore keeps the retained previous versions of a file when it is
+// overwritten and deleted, that FileStore.ReadVersion returns their contents,
+// that they survive reopening the store, and that their size is counted in the
+// usage.
+func TestFileStore_ListVersions_ReadVersion(t *testing.T) {
+	testDir := "tmp"
+	fs := newTestFileStore("baseDir", testDir, t)
+	defer removeTestFile(t, testDir)
+	fs.SetRetention(RetentionPolicy{MaxVersions: 3})
+
+	path := "dir/file.txt"
+	contents := []string{"one", "two", "three", "four", "five"}
+	for _, data := range contents {
+		if err := fs.Write(path, []byte(data)); err != nil {
+			t.Fatalf("Failed to write %q: %+v", data, err)
+		}
+	}
+	if err := fs.Delete(path); err != nil {
+		t.Fatalf("Failed to delete %s: %+v", path, err)
+	}
+
+	// The three retained versions are "three", "four", and "five"
+	expectedUsage := Usage{VersionBytes: 13}
+	if usage := fs.GetUsage(); usage != expectedUsage {
+		t.Errorf("Unexpected usage.\nexpected: %+v\nreceived: %+v",
+			expectedUsage, usage)
+	}
+
+	fs = newTestFileStore("baseDir", testDir, t)
+	if usage := fs.GetUsage(); usage != expectedUsage {
+		t.Errorf("Unexpected usage after reopening."+
+			"\nexpected: %+v\nreceived: %+v", expectedUsage, usage)
+	}
+	versions, err := fs.ListVersions(path)
+	if err != nil {
+		t.Fatalf("Failed to list versions: %+v", err)
+	} else if len(versions) != 3 {
+		t.Fatalf("Unexpected number of versions.\nexpected: %d\nreceived: %d",
+			3, len(versions))
+	}
+
+	for i, expected := range []string{"five", "four", "three"} {
+		v := versions[i]
+		if v.Size != int64(len(expected)) {
+			t.Errorf("Unexpected size of version %d."+
+				"\nexpected: %d\nreceived: %d", i, len(expected), v.Size)
+		}
+		if v.Modified.After(v.Replaced) {
+			t.Errorf("Version %d modified at %s after it was replaced at %s.",
+				i, v.Modified, v.Replaced)
+		}
+
+		data, err := fs.ReadVersion(path, v.ID)
+		if err != nil {
+			t.Errorf("Failed to read version %d: %+v", i, err)
+		} else if string(data) != expected {
+			t.Errorf("Unexpected data for version %d."+
+				"\nexpected: %q\nreceived: %q", i, expected, data)
+		}
+	}
+}
+
+// Tests that FileStore does not keep previous versions when the retention
+// policy is not set.
+func TestFileStore_ListVersions_NoRetention(t *testing.T) {
+	testDir := "tmp"
+	fs := newTestFileStore("baseDir", testDir, t)
+	defer removeTestFile(t, testDir)
+
+	for _, data := range []string{"one", "two"} {
+		if err := fs.Write("file.txt", []byte(data)); err != nil {
+			t.Fatalf("Failed to write %q: %+v", data, err)
+		}
+	}
+
+	versions, err := fs.ListVersions("file.txt")
+	if err != nil {
+		t.Errorf("Failed to list versions: %+v", err)
+	} else if len(versions) != 0 {
+		t.Errorf("Unexpected versions: %+v", versions)
+	}
+
+	_, err = os.Stat(filepath.Join(fs.baseDir, versionsDir))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Versions directory created: %+v", err)
+	}
+}
+
+// Tests that FileStore.DeleteDir deletes the previous versions of the files in
+// the directory.
+func TestFileStore_DeleteDir_Versions(t *testing.T) {
+	testDir := "tmp"
+	fs := newTestFileStore("baseDir", testDir, t)
+	defer removeTestFile(t, testDir)
+	fs.SetRetention(RetentionPolicy{MaxVersions: 3})
+
+	for _, path := range []string{"dir/a", "dir/a", "b", "b"} {
+		if err := fs.Write(path, []byte("data")); err != nil {
+			t.Fatalf("Failed to write %s: %+v", path, err)
+		}
+	}
+
+	if err := fs.DeleteDir("dir"); err != nil {
+		t.Fatalf("Failed to delete directory: %+v", err)
+	}
+	if versions, _ := fs.ListVersions("dir/a"); len(versions) != 0 {
+		t.Errorf("Versions of deleted file kept: %+v", versions)
+	}
+	if versions, _ := fs.ListVersions("b"); len(versions) != 1 {
+		t.Errorf("Unexpected versions of file outside deleted directory: %+v",
+			versions)
+	}
+
+	if err := fs.DeleteDir(""); err != nil {
+		t.Fatalf("Failed to delete base directory: %+v", err)
+	}
+	if versions, _ := fs.ListVersions("b"); len(versions) != 0 {
+		t.Errorf("Versions kept after deleting base directory: %+v", versions)
+	}
+}
+
+// Error path: Tests that FileStore.ReadVersion returns VersionNotFoundErr for
+// a version that does not exist.
+func TestFileStore_ReadVersion_VersionNotFoundError(t *testing.T) {
+	testDir := "tmp"
+	fs := newTestFileStore("baseDir", testDir, t)
+	defer removeTestFile(t, testDir)
+
+	_, err := fs.ReadVersion("file.txt", 42)
+	if !errors.Is(err, VersionNotFoundErr) {
+		t.Errorf("Unexpected error for missing version."+
+			"\nexpected: %v\nreceived: %+v", VersionNotFoundErr, err)
+	}
+}
+
+// Error path: Tests that FileStore.ListVersions returns NonLocalFileErr when
+// the path is not local to the base directory.
+func TestFileStore_ListVersions_NonLocalPathError(t *testing.T) {
+	fs := &FileStore{baseDir: "baseDir"}
+	_, err := fs.ListVersions("../file")
+	if !errors.Is(err, NonLocalFileErr) {
+		t.Errorf("Unexpected error for non-local file."+
+			"\nexpected: %v\nreceived: %v", NonLocalFileErr, err)
+	}
+}
+
+// Tests that FileStore.GetChanges returns all modifications in order and that
+// the journal and its ID are recovered when the store is reopened, even after a
+// crash left a partial entry.
+func TestFileStore_GetChanges(t *testing.T) {
+	testDir := "tmp"
+	fs := newTestFileStore("baseDir", testDir, t)
+	defer removeTestFile(t, testDir)
+
+	ops := []struct {
+		op   func() error
+		ct   ChangeType
+		path string
+	}{
+		{func() error { return fs.Write("dir/a", []byte("a")) }, ChangeWrite, "dir/a"},
+		{func() error { return fs.Write("b", []byte("b")) }, ChangeWrite, "b"},
+		{func() error { return fs.Delete("b") }, ChangeDelete, "b"},
+		{func() error { return fs.DeleteDir("dir") }, ChangeDeleteDir, "dir"},
+		{func() error { return fs.DeleteDir("") }, ChangeDeleteDir, ""},
+	}
+	for i, op := range ops {
+		if err := op.op(); err != nil {
+			t.Fatalf("Operation %d failed: %+v", i, err)
+		}
+	}
+
+	journalID, _, err := fs.GetChanges("", 0)
+	if err != nil {
+		t.Fatalf("Failed to get journal ID: %+v", err)
+	}
+	check := func(fs *FileStore) {
+		id, changes, err := fs.GetChanges(journalID, 0)
+		if err != nil {
+			t.Fatalf("Failed to get changes: %+v", err)
+		} else if id != journalID {
+			t.Errorf("Unexpected journal ID.\nexpected: %s\nreceived: %s",
+				journalID, id)
+		} else if len(changes) != len(ops) {
+			t.Fatalf("Unexpected number of changes."+
+				"\nexpected: %d\nreceived: %d", len(ops), len(changes))
+		}
+		for i, c := range changes {
+			if c.Seq != uint64(i+1) || c.Type != ops[i].ct ||
+				c.Path != ops[i].path || c.Time.IsZero() {
+				t.Errorf("Unexpected change %d: %+v", i, c)
+			}
+		}
+	}
+	check(fs)
+
+	// Simulate a crash partway through appending a change
+	f, err := os.OpenFile(filepath.Join(fs.baseDir, journalFile),
+		os.O_APPEND|os.O_WRONLY, FilePerm)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %+v", err)
+	}
+	_, _ = f.WriteString(`{"seq":6,`)
+	_ = f.Close()
+
+	fs = newTestFileStore("baseDir", testDir, t)
+	check(fs)
+
+	if err = fs.Write("c", []byte("c")); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+	fs = newTestFileStore("baseDir", testDir, t)
+	_, changes, err := fs.GetChanges(journalID, uint64(len(ops)))
+	if err != nil {
+		t.Fatalf("Failed to get changes: %+v", err)
+	} else if len(changes) != 1 || changes[0].Seq != uint64(len(ops)+1) ||
+		changes[0].Path != "c" {
+		t.Errorf("Unexpected changes after repairing journal: %+v", changes)
+	}
+}
+
+// Tests that FileStore.Close waits for in-progress modifications to complete
+// and that modifications made after closing return ClosedErr.
+func TestFileStore_Close(t *testing.T) {
+	testDir := "tmp"
+	fs := newTestFileStore("baseDir", testDir, t)
+	defer removeTestFile(t, testDir)
+
+	if err := fs.Write("file", []byte("data")); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+
+	// Simulate an in-progress write
+	if err := fs.startModification(); err != nil {
+		t.Fatalf("Failed to start modification: %+v", err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		if err := fs.Close(); err != nil {
+			t.Errorf("Failed to close: %+v", err)
+		}
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		t.Fatalf("Close returned before in-progress modification finished.")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	fs.inProgress.Done()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for Close to return.")
+	}
+
+	if err := fs.Write("file", []byte("data")); !errors.Is(err, ClosedErr) {
+		t.Errorf("Unexpected error for write after close."+
+			"\nexpected: %v\nreceived: %+v", ClosedErr, err)
+	}
+	if err := fs.Delete("file"); !errors.Is(err, ClosedErr) {
+		t.Errorf("Unexpected error for delete after close."+
+			"\nexpected: %v\nreceived: %+v", ClosedErr, err)
+	}
+	if err := fs.DeleteDir(""); !errors.Is(err, ClosedErr) {
+		t.Errorf("Unexpected error for delete directory after close."+
+			"\nexpected: %v\nreceived: %+v", ClosedErr, err)
+	}
+	if _, err := fs.Read("file"); err != nil {
+		t.Errorf("Failed to read after close: %+v", err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Errorf("Failed to close a second time: %+v", err)
+	}
+}
+
 func TestFileStore_readyPath(t *testing.T) {
 	fs := &FileStore{baseDir: "baseDir"}
 	tests := []struct {
@@ -17,6 +17,31 @@ var (
 	// NonLocalFileErr is returned when attempting to read or write to file or
 	// directory outside the base directory.
 	NonLocalFileErr = errors.New("file path not in local base directory")
+
+	// ReservedPathErr is returned when attempting to access a file or
+	// directory with a name reserved for files internal to the store.
+	ReservedPathErr = errors.New("file path is reserved for internal use")
+
+	// ClosedErr is returned when attempting to modify a store that has been
+	// closed.
+	ClosedErr = errors.New("store is closed")
+
+	// QuotaExceededErr is returned when a write would cause the store to
+	// exceed its quota.
+	QuotaExceededErr = errors.New("storage quota exceeded")
+
+	// VersionNotFoundErr is returned when attempting to read a version of a
+	// file that does not exist.
+	VersionNotFoundErr = errors.New("file version not found")
+
+	// ConflictErr is returned by WriteIf when the file does not match the
+	// precondition. Any *ConflictError matches it with errors.Is; use
+	// errors.As to retrieve the current state of the file.
+	ConflictErr error = &ConflictError{}
+
+	// JournalCompactedErr is returned when requesting changes that have been
+	// removed from the journal. The client must rescan the store instead.
+	JournalCompactedErr = errors.New("changes have been compacted")
 )
 
 // NewStore generates a new Store for the given base directory that will be
@@ -37,17 +62,26 @@ type Store interface {
 	// Write writes the provided data to the file path.
 	//
 	// An error is returned if the write fails. Returns [NonLocalFileErr] if the
-	// file is outside the base path.
+	// file is outside the base path and [QuotaExceededErr] if the write would
+	// exceed the store's quota.
 	Write(path string, data []byte) error
 
+	// WriteIf writes the provided data to the file path only if the file
+	// matches the precondition. The check and write are atomic.
+	//
+	// Returns a *[ConflictError], which matches [ConflictErr], if the file
+	// does not match the precondition. Otherwise, returns the same errors as
+	// Write.
+	WriteIf(path string, data []byte, cond Precondition) error
+
 	// GetLastModified returns the last modification time for the file at the
 	// given file.
 	//
 	// Returns [NonLocalFileErr] if the file is outside the base path.
 	GetLastModified(path string) (time.Time, error)
 
-	// GetLastWrite returns the time of the most recent successful Write
-	// operation that was performed.
+	// GetLastWrite returns the time of the most recent successful Write or
+	// Delete operation that was performed.
 	GetLastWrite() (time.Time, error)
 
 	// ReadDir reads the named directory, returning all its directory entries
@@ -55,4 +89,93 @@ type Store interface {
 	//
 	// Returns [NonLocalFileErr] if the file is outside the base path.
 	ReadDir(path string) ([]string, error)
+
+	// ReadDirEntries reads the named directory, returning all the files and
+	// directories it contains sorted by name.
+	//
+	// Returns [NonLocalFileErr] if the directory is outside the base path and
+	// [os.ErrNotExist] if it does not exist.
+	ReadDirEntries(path string) ([]DirEntry, error)
+
+	// Manifest returns every file in the named directory and its
+	// subdirectories with its size, modification time, and content hash,
+	// sorted by path. If since is not zero, only files modified at or after
+	// since are returned.
+	//
+	// Returns [NonLocalFileErr] if the directory is outside the base path and
+	// [os.ErrNotExist] if it does not exist.
+	Manifest(path string, since time.Time) ([]ManifestEntry, error)
+
+	// Delete deletes the file at the given path.
+	//
+	// An error is returned if the file does not exist or is a directory.
+	// Returns [NonLocalFileErr] if the file is outside the base path.
+	Delete(path string) error
+
+	// DeleteDir deletes the named directory and everything it contains. If the
+	// path is the base directory, then all of its contents are deleted but the
+	// base directory itself is kept.
+	//
+	// An error is returned if the directory does not exist. Returns
+	// [NonLocalFileErr] if the directory is outside the base path.
+	DeleteDir(path string) error
+
+	// GetChanges returns the ID of the journal and all changes in it with a
+	// sequence number greater than after, in order. Passing zero returns all
+	// changes. The journal ID is generated randomly when the journal is
+	// created, so a journal that is lost and restarted has a new ID even
+	// though its sequence numbers start again at one. Clients must pass the
+	// journal ID returned with the sequence number they pass as after.
+	//
+	// Returns [JournalCompactedErr] if any of the requested changes have been
+	// removed from the journal, if after is greater than the sequence number
+	// of the last change, or if after is not zero and journalID is not the ID
+	// of the journal. The client must then resynchronise with a full listing.
+	GetChanges(journalID string, after uint64) (string, []Change, error)
+
+	// SetQuota sets the limits on the storage used by the store. Existing
+	// files are kept even if they exceed the new quota.
+	SetQuota(quota Quota)
+
+	// GetUsage returns the storage currently used by the store.
+	GetUsage() Usage
+
+	// SetRetention sets the policy that determines which previous versions of
+	// each file are kept when it is overwritten or deleted.
+	SetRetention(policy RetentionPolicy)
+
+	// ListVersions returns the previous versions of the file at the given path
+	// that are retained, sorted from newest to oldest. The current contents of
+	// the file are not included.
+	//
+	// Returns [NonLocalFileErr] if the file is outside the base path.
+	ListVersions(path string) ([]Version, error)
+
+	// ReadVersion returns the contents of the previous version of the file at
+	// the given path with the given ID.
+	//
+	// Returns [NonLocalFileErr] if the file is outside the base path and
+	// [VersionNotFoundErr] if the version does not exist.
+	ReadVersion(path string, id int64) ([]byte, error)
+}
+
+// RewriteFunc returns the new contents of the file at the path, which is
+// relative to the base directory, given its current contents. It returns nil
+// to leave the contents unchanged.
+type RewriteFunc func(path string, data []byte) ([]byte, error)
+
+// Rewriter is implemented by stores that can replace the contents of their
+// files in place. It is used by [EncryptedStore.Rotate] to re-encrypt files
+// without the side effects of a write.
+type Rewriter interface {
+	// Rewrite replaces the contents of every file and every retained previous
+	// version in the store with the data returned by rewrite, which is called
+	// with the path of the file that they belong to. Unlike Write, rewriting
+	// does not save a previous version, add a change to the journal, change
+	// the last write, or check the quota. rewrite is called with the store
+	// locked, so it must not call the store. Stops at and returns the first
+	// error.
+	//
+	// Returns [ClosedErr] if the store is closed.
+	Rewrite(rewrite RewriteFunc) error
 }
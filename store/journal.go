@@ -0,0 +1,255 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+// journalMaxEntries is the number of changes kept in a journal after it is
+// compacted. A journal is compacted once it holds twice this many changes.
+const journalMaxEntries = 10_000
+
+// journalFile is the name of the file in the base directory of a FileStore
+// that stores its journal. The first line is a JSON encoded journalHeader and
+// each following line is a JSON encoded Change.
+const journalFile = internalFilePrefix + "journal"
+
+// journalIDLen is the number of random bytes in a journal ID.
+const journalIDLen = 16
+
+// ChangeType is the type of modification recorded in a Change.
+type ChangeType uint8
+
+const (
+	// ChangeWrite is recorded when a file is written.
+	ChangeWrite ChangeType = iota + 1
+
+	// ChangeDelete is recorded when a file is deleted.
+	ChangeDelete
+
+	// ChangeDeleteDir is recorded when a directory and everything it contains
+	// is deleted.
+	ChangeDeleteDir
+)
+
+// String returns a human-readable name of the ChangeType.
+func (ct ChangeType) String() string {
+	switch ct {
+	case ChangeWrite:
+		return "Write"
+	case ChangeDelete:
+		return "Delete"
+	case ChangeDeleteDir:
+		return "DeleteDir"
+	default:
+		return "INVALID CHANGE TYPE: " + strconv.Itoa(int(ct))
+	}
+}
+
+// Change is an entry in a store's journal describing a single modification.
+type Change struct {
+	// Seq is the sequence number of the change. Sequence numbers start at one
+	// and increase by one with each change.
+	Seq uint64 `json:"seq"`
+
+	// Type is the type of modification.
+	Type ChangeType `json:"type"`
+
+	// Path is the path of the file or directory relative to the base
+	// directory.
+	Path string `json:"path"`
+
+	// Time is the time of the modification.
+	Time time.Time `json:"time"`
+}
+
+// journal is an append-only list of changes that is compacted by removing the
+// oldest changes once it grows too large.
+type journal struct {
+	// id is generated randomly when the journal is created and is stored with
+	// it. A journal that is lost restarts its sequence numbers at one with a
+	// new ID, so clients can tell its changes apart from those of the old
+	// journal.
+	id string
+
+	changes    []Change
+	maxEntries int
+}
+
+// journalHeader is the first line of an encoded journal.
+type journalHeader struct {
+	ID string `json:"journalID"`
+}
+
+// newJournal returns an empty journal with a new ID that keeps at least
+// maxEntries changes.
+func newJournal(maxEntries int) *journal {
+	return &journal{id: newJournalID(), maxEntries: maxEntries}
+}
+
+// newJournalID returns a new random hex encoded journal ID.
+func newJournalID() string {
+	b := make([]byte, journalIDLen)
+	if _, err := rand.Read(b); err != nil {
+		jww.FATAL.Panicf("Failed to generate journal ID: %+v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// add appends a new change with the next sequence number and returns it.
+func (j *journal) add(changeType ChangeType, path string, t time.Time) Change {
+	c := Change{Seq: j.lastSeq() + 1, Type: changeType, Path: path, Time: t}
+	j.changes = append(j.changes, c)
+	return c
+}
+
+// compact removes the oldest changes if the journal holds more than twice
+// maxEntries. Returns true if changes were removed.
+func (j *journal) compact() bool {
+	if len(j.changes) <= 2*j.maxEntries {
+		return false
+	}
+	j.changes = append(
+		[]Change(nil), j.changes[len(j.changes)-j.maxEntries:]...)
+	return true
+}
+
+// since returns all changes with a sequence number greater than after. The
+// journalID is the ID of the journal that after belongs to and is ignored if
+// after is zero. Returns JournalCompactedErr if any of those changes have been
+// removed by compaction or if the journal was lost and restarted since, which
+// is detected by a different journal ID or an after past the last change.
+func (j *journal) since(journalID string, after uint64) ([]Change, error) {
+	if after > j.lastSeq() || (after != 0 && journalID != j.id) {
+		return nil, JournalCompactedErr
+	} else if len(j.changes) == 0 {
+		return []Change{}, nil
+	} else if after+1 < j.changes[0].Seq {
+		return nil, JournalCompactedErr
+	}
+
+	i := sort.Search(len(j.changes), func(i int) bool {
+		return j.changes[i].Seq > after
+	})
+	return append([]Change{}, j.changes[i:]...), nil
+}
+
+// lastSeq returns the sequence number of the most recent change or zero if
+// there are none.
+func (j *journal) lastSeq() uint64 {
+	if len(j.changes) == 0 {
+		return 0
+	}
+	return j.changes[len(j.changes)-1].Seq
+}
+
+// marshal encodes the journal header and changes as JSON with one per line.
+func (j *journal) marshal() ([]byte, error) {
+	header, err := json.Marshal(journalHeader{j.id})
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(append(header, '\n'))
+	for _, c := range j.changes {
+		line, err := json.Marshal(c)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// loadJournal reads the journal from the file at the path. Returns an empty
+// journal with a new ID if the file does not exist. Lines that cannot be
+// decoded, such as a partial line left by a crash, are skipped. intact is false
+// if any were found or if the ID is new, in which case the journal must be
+// rewritten before changes are appended to it.
+func loadJournal(path string, maxEntries int) (j *journal, intact bool, err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return newJournal(maxEntries), false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return parseJournal(data, path, maxEntries)
+}
+
+// parseJournal decodes a journal encoded by journal.marshal. Lines that cannot
+// be decoded are skipped. A journal without a header, such as one written
+// before journals had IDs, is given a new ID. intact is false if any lines were
+// skipped or the ID is new. The source is the location of the journal used in
+// log messages.
+func parseJournal(
+	data []byte, source string, maxEntries int) (j *journal, intact bool, err error) {
+	j = newJournal(maxEntries)
+	intact = true
+	hasID := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for first := true; scanner.Scan(); first = false {
+		var header journalHeader
+		if first && json.Unmarshal(scanner.Bytes(), &header) == nil &&
+			header.ID != "" {
+			j.id, hasID = header.ID, true
+			continue
+		}
+
+		var c Change
+		if err = json.Unmarshal(scanner.Bytes(), &c); err != nil ||
+			c.Seq <= j.lastSeq() {
+			jww.WARN.Printf("Skipping invalid journal entry %q in %s: %v",
+				scanner.Text(), source, err)
+			intact = false
+			continue
+		}
+		j.changes = append(j.changes, c)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, false, err
+	}
+
+	if !hasID {
+		jww.WARN.Printf("Journal %s has no ID; assigning new ID %s", source, j.id)
+	}
+	return j, intact && hasID, nil
+}
+
+// appendJournal appends the change as a line to the journal file at the path
+// and syncs it to disk.
+func appendJournal(path string, c Change) error {
+	line, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, FilePerm)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	} else if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
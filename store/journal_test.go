@@ -0,0 +1,249 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Tests that journal.add assigns increasing sequence numbers and that
+// journal.since returns the changes after the given sequence number.
+func Test_journal_add_since(t *testing.T) {
+	j := newJournal(10)
+	now := time.Date(2022, 8, 1, 0, 0, 0, 0, time.UTC)
+	var expected []Change
+	for i, ct := range []ChangeType{ChangeWrite, ChangeDelete, ChangeDeleteDir} {
+		c := j.add(ct, "path"+strconv.Itoa(i), now)
+		expected = append(expected,
+			Change{uint64(i + 1), ct, "path" + strconv.Itoa(i), now})
+		if !reflect.DeepEqual(expected[i], c) {
+			t.Errorf("Unexpected change (%d).\nexpected: %+v\nreceived: %+v",
+				i, expected[i], c)
+		}
+	}
+
+	for after := uint64(0); after <= 3; after++ {
+		changes, err := j.since(j.id, after)
+		if err != nil {
+			t.Errorf("Failed to get changes after %d: %+v", after, err)
+		}
+		want := []Change{}
+		if after < 3 {
+			want = expected[after:]
+		}
+		if !reflect.DeepEqual(want, changes) {
+			t.Errorf("Unexpected changes after %d."+
+				"\nexpected: %+v\nreceived: %+v", after, want, changes)
+		}
+	}
+}
+
+// Error path: Tests that journal.since returns JournalCompactedErr for a
+// sequence number past the last change, as seen by a client whose cursor
+// predates the loss of the journal.
+func Test_journal_since_PastLastSeqError(t *testing.T) {
+	j := newJournal(10)
+	if _, err := j.since(j.id, 1); !errors.Is(err, JournalCompactedErr) {
+		t.Errorf("Unexpected error for empty journal."+
+			"\nexpected: %v\nreceived: %+v", JournalCompactedErr, err)
+	}
+
+	j.add(ChangeWrite, "file", time.Time{})
+	if _, err := j.since(j.id, 2); !errors.Is(err, JournalCompactedErr) {
+		t.Errorf("Unexpected error for cursor past last change."+
+			"\nexpected: %v\nreceived: %+v", JournalCompactedErr, err)
+	}
+}
+
+// Error path: Tests that journal.since returns JournalCompactedErr for a
+// sequence number of a different journal, as seen by a client whose cursor
+// predates the loss of the journal once the new journal has caught up to it,
+// and that the journal ID is ignored when requesting all changes.
+func Test_journal_since_JournalIDMismatchError(t *testing.T) {
+	old, j := newJournal(10), newJournal(10)
+	if old.id == j.id {
+		t.Fatalf("New journals have the same ID %s.", j.id)
+	}
+	old.add(ChangeWrite, "file", time.Time{})
+	j.add(ChangeWrite, "file", time.Time{})
+	j.add(ChangeWrite, "file", time.Time{})
+
+	if _, err := j.since(old.id, 1); !errors.Is(err, JournalCompactedErr) {
+		t.Errorf("Unexpected error for cursor of another journal."+
+			"\nexpected: %v\nreceived: %+v", JournalCompactedErr, err)
+	}
+	if _, err := j.since("", 1); !errors.Is(err, JournalCompactedErr) {
+		t.Errorf("Unexpected error for cursor without a journal ID."+
+			"\nexpected: %v\nreceived: %+v", JournalCompactedErr, err)
+	}
+	if changes, err := j.since(old.id, 0); err != nil || len(changes) != 2 {
+		t.Errorf("Failed to get all changes with another journal ID: %v %+v",
+			changes, err)
+	}
+}
+
+// Tests that journal.compact removes the oldest changes only once the journal
+// holds more than twice the maximum and that journal.since then returns
+// JournalCompactedErr for sequence numbers before the oldest remaining change.
+func Test_journal_compact(t *testing.T) {
+	j := newJournal(3)
+	for i := 0; i < 6; i++ {
+		j.add(ChangeWrite, "file", time.Time{})
+		if j.compact() {
+			t.Errorf("Compacted journal with %d changes.", len(j.changes))
+		}
+	}
+
+	j.add(ChangeWrite, "file", time.Time{})
+	if !j.compact() {
+		t.Fatalf("Failed to compact journal with %d changes.", len(j.changes))
+	} else if len(j.changes) != 3 || j.changes[0].Seq != 5 || j.lastSeq() != 7 {
+		t.Errorf("Unexpected changes after compaction: %+v", j.changes)
+	}
+
+	if _, err := j.since(j.id, 3); !errors.Is(err, JournalCompactedErr) {
+		t.Errorf("Unexpected error for compacted changes."+
+			"\nexpected: %v\nreceived: %+v", JournalCompactedErr, err)
+	}
+	if changes, err := j.since(j.id, 4); err != nil || len(changes) != 3 {
+		t.Errorf("Failed to get changes after last compacted change: %v %+v",
+			changes, err)
+	}
+
+	j.add(ChangeWrite, "file", time.Time{})
+	if j.lastSeq() != 8 {
+		t.Errorf("Unexpected sequence number after compaction."+
+			"\nexpected: %d\nreceived: %d", 8, j.lastSeq())
+	}
+}
+
+// Tests that a journal written with journal.marshal and appendJournal is
+// recovered by loadJournal with its ID and that a partial line left by a crash
+// is skipped.
+func Test_loadJournal(t *testing.T) {
+	testDir := "tmp"
+	defer removeTestFile(t, testDir)
+	if err := os.MkdirAll(testDir, FilePerm); err != nil {
+		t.Fatalf("Failed to make directory: %+v", err)
+	}
+	path := filepath.Join(testDir, journalFile)
+
+	j := newJournal(10)
+	data, err := j.marshal()
+	if err != nil {
+		t.Fatalf("Failed to marshal journal: %+v", err)
+	}
+	if err = os.WriteFile(path, data, FilePerm); err != nil {
+		t.Fatalf("Failed to write journal: %+v", err)
+	}
+	now := time.Date(2022, 8, 1, 0, 0, 0, 0, time.UTC)
+	for _, p := range []string{"a", "b", "c"} {
+		if err := appendJournal(path, j.add(ChangeWrite, p, now)); err != nil {
+			t.Fatalf("Failed to append to journal: %+v", err)
+		}
+	}
+
+	loaded, intact, err := loadJournal(path, 10)
+	if err != nil {
+		t.Fatalf("Failed to load journal: %+v", err)
+	} else if !intact {
+		t.Errorf("Journal not intact.")
+	} else if loaded.id != j.id {
+		t.Errorf("Unexpected journal ID.\nexpected: %s\nreceived: %s",
+			j.id, loaded.id)
+	} else if !reflect.DeepEqual(j.changes, loaded.changes) {
+		t.Errorf("Unexpected loaded changes.\nexpected: %+v\nreceived: %+v",
+			j.changes, loaded.changes)
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, FilePerm)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %+v", err)
+	}
+	_, _ = f.WriteString(`{"seq":4,"type":1,"pa`)
+	_ = f.Close()
+
+	loaded, intact, err = loadJournal(path, 10)
+	if err != nil {
+		t.Fatalf("Failed to load journal: %+v", err)
+	} else if intact {
+		t.Errorf("Journal with partial line reported as intact.")
+	} else if !reflect.DeepEqual(j.changes, loaded.changes) {
+		t.Errorf("Unexpected loaded changes.\nexpected: %+v\nreceived: %+v",
+			j.changes, loaded.changes)
+	}
+
+	data, err = loaded.marshal()
+	if err != nil {
+		t.Fatalf("Failed to marshal journal: %+v", err)
+	}
+	if err = os.WriteFile(path, data, FilePerm); err != nil {
+		t.Fatalf("Failed to write journal: %+v", err)
+	}
+	if _, intact, _ = loadJournal(path, 10); !intact {
+		t.Errorf("Rewritten journal not intact.")
+	}
+}
+
+// Tests that loadJournal gives a journal without an ID, such as a missing
+// journal or one written before journals had IDs, a new ID and reports that it
+// must be rewritten, while keeping its changes.
+func Test_loadJournal_NoID(t *testing.T) {
+	testDir := "tmp"
+	defer removeTestFile(t, testDir)
+	if err := os.MkdirAll(testDir, FilePerm); err != nil {
+		t.Fatalf("Failed to make directory: %+v", err)
+	}
+	path := filepath.Join(testDir, journalFile)
+
+	j, intact, err := loadJournal(path, 10)
+	if err != nil {
+		t.Fatalf("Failed to load missing journal: %+v", err)
+	} else if intact || j.id == "" {
+		t.Errorf("Missing journal not given new ID: %q, intact %t", j.id, intact)
+	}
+
+	for _, p := range []string{"a", "b"} {
+		if err = appendJournal(path, j.add(ChangeWrite, p, time.Time{})); err != nil {
+			t.Fatalf("Failed to append to journal: %+v", err)
+		}
+	}
+	loaded, intact, err := loadJournal(path, 10)
+	if err != nil {
+		t.Fatalf("Failed to load journal: %+v", err)
+	} else if intact || loaded.id == "" || loaded.id == j.id {
+		t.Errorf("Journal without ID not given new ID: %q, intact %t",
+			loaded.id, intact)
+	} else if !reflect.DeepEqual(j.changes, loaded.changes) {
+		t.Errorf("Unexpected loaded changes.\nexpected: %+v\nreceived: %+v",
+			j.changes, loaded.changes)
+	}
+}
+
+// Tests that ChangeType.String returns the expected name for each type.
+func TestChangeType_String(t *testing.T) {
+	tests := map[ChangeType]string{
+		ChangeWrite:     "Write",
+		ChangeDelete:    "Delete",
+		ChangeDeleteDir: "DeleteDir",
+		99:              "INVALID CHANGE TYPE: 99",
+	}
+
+	for ct, expected := range tests {
+		if s := ct.String(); s != expected {
+			t.Errorf("Unexpected string.\nexpected: %s\nreceived: %s",
+				expected, s)
+		}
+	}
+}
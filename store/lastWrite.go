@@ -0,0 +1,96 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package store
+
+import (
+	"encoding/json"
+	ioFS "io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+// lastWriteFile is the name of the file in the base directory that stores the
+// lastWriteMetadata so that it persists across restarts.
+const lastWriteFile = internalFilePrefix + "lastWrite"
+
+// lastWriteMetadata describes the most recent successful modification of a
+// store.
+type lastWriteMetadata struct {
+	// Path is the path, relative to the base directory, of the most recently
+	// written file. It is empty if the most recent modification was a delete.
+	Path string `json:"path"`
+
+	// Time is the time of the modification.
+	Time time.Time `json:"time"`
+}
+
+// loadLastWrite recovers the lastWriteMetadata for the base directory. It is
+// read from the lastWriteFile if it exists. Otherwise, or if the file is
+// corrupt, it is recovered by finding the most recently modified file in the
+// directory. If the directory contains no files, then an empty
+// lastWriteMetadata is returned.
+func loadLastWrite(baseDir string) (lastWriteMetadata, error) {
+	path := filepath.Join(baseDir, lastWriteFile)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		var lw lastWriteMetadata
+		if err = json.Unmarshal(data, &lw); err == nil {
+			return lw, nil
+		}
+		jww.WARN.Printf("Failed to parse last write metadata %s; recovering "+
+			"from the files in %s: %+v", path, baseDir, err)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return lastWriteMetadata{}, errors.Wrapf(
+			err, "failed to read last write metadata %s", path)
+	}
+
+	return scanLastWrite(baseDir)
+}
+
+// saveLastWrite writes the lastWriteMetadata to the lastWriteFile in the base
+// directory.
+func saveLastWrite(baseDir string, lw lastWriteMetadata) error {
+	data, err := json.Marshal(lw)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(baseDir, lastWriteFile), data, FilePerm)
+}
+
+// scanLastWrite returns the lastWriteMetadata of the most recently modified
+// file in the directory and its subdirectories, excluding internal files and
+// directories.
+func scanLastWrite(dir string) (lastWriteMetadata, error) {
+	var lw lastWriteMetadata
+	err := filepath.WalkDir(dir, func(path string, d ioFS.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if isInternalEntry(dir, path, d) {
+			return skipInternalEntry(d)
+		} else if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if fi.ModTime().After(lw.Time) {
+			lw.Path, err = filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			lw.Time = fi.ModTime()
+		}
+		return nil
+	})
+	return lw, err
+}
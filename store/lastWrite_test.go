@@ -0,0 +1,172 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Tests that the last write of a FileStore is recovered when it is reopened,
+// both after a write and after a delete.
+func TestNewFileStore_RecoversLastWrite(t *testing.T) {
+	testDir := "tmp"
+	defer removeTestFile(t, testDir)
+
+	fs := newTestFileStore("baseDir", testDir, t)
+	for _, path := range []string{"dir/fileA.txt", "fileB.txt"} {
+		if err := fs.Write(path, []byte("data")); err != nil {
+			t.Fatalf("Failed to write %s: %+v", path, err)
+		}
+	}
+	expected, err := fs.GetLastWrite()
+	if err != nil {
+		t.Fatalf("Failed to get last write: %+v", err)
+	}
+
+	reopened := newTestFileStore("baseDir", testDir, t)
+	if lastWrite, err := reopened.GetLastWrite(); err != nil {
+		t.Errorf("Failed to get last write after reopening: %+v", err)
+	} else if !lastWrite.Equal(expected) {
+		t.Errorf("Unexpected last write after reopening."+
+			"\nexpected: %s\nreceived: %s", expected, lastWrite)
+	}
+	if reopened.lastWritePath != fs.lastWritePath {
+		t.Errorf("Unexpected last write path after reopening."+
+			"\nexpected: %s\nreceived: %s", fs.lastWritePath, reopened.lastWritePath)
+	}
+
+	if err = reopened.DeleteDir(""); err != nil {
+		t.Fatalf("Failed to delete base directory: %+v", err)
+	}
+	expected, err = reopened.GetLastWrite()
+	if err != nil {
+		t.Fatalf("Failed to get last write: %+v", err)
+	}
+
+	reopened = newTestFileStore("baseDir", testDir, t)
+	if lastWrite, err := reopened.GetLastWrite(); err != nil {
+		t.Errorf("Failed to get last write after reopening: %+v", err)
+	} else if !lastWrite.Equal(expected) {
+		t.Errorf("Unexpected last write after reopening."+
+			"\nexpected: %s\nreceived: %s", expected, lastWrite)
+	}
+}
+
+// Tests that when the last write metadata is missing or corrupt, NewFileStore
+// recovers the last write from the most recently modified file.
+func TestNewFileStore_RecoversLastWriteFromFiles(t *testing.T) {
+	testDir := "tmp"
+	defer removeTestFile(t, testDir)
+
+	fs := newTestFileStore("baseDir", testDir, t)
+	modTimes := map[string]time.Time{
+		"fileA.txt":           time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		"dir1/fileB.txt":      time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC),
+		"dir1/dir2/fileC.txt": time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for path, modTime := range modTimes {
+		if err := fs.Write(path, []byte("data")); err != nil {
+			t.Fatalf("Failed to write %s: %+v", path, err)
+		}
+		err := os.Chtimes(filepath.Join(fs.baseDir, path), modTime, modTime)
+		if err != nil {
+			t.Fatalf("Failed to set modification time of %s: %+v", path, err)
+		}
+	}
+	expectedPath := filepath.Join(fs.baseDir, "dir1/fileB.txt")
+	expectedTime := modTimes["dir1/fileB.txt"]
+
+	metadataPath := filepath.Join(fs.baseDir, lastWriteFile)
+	for name, setup := range map[string]func() error{
+		"missing": func() error { return os.Remove(metadataPath) },
+		"corrupt": func() error {
+			return os.WriteFile(metadataPath, []byte("{invalid"), FilePerm)
+		},
+	} {
+		if err := setup(); err != nil {
+			t.Fatalf("Failed to make metadata %s: %+v", name, err)
+		}
+
+		reopened := newTestFileStore("baseDir", testDir, t)
+		if lastWrite, err := reopened.GetLastWrite(); err != nil {
+			t.Errorf("Failed to get last write with %s metadata: %+v", name, err)
+		} else if !lastWrite.Equal(expectedTime) {
+			t.Errorf("Unexpected last write with %s metadata."+
+				"\nexpected: %s\nreceived: %s", name, expectedTime, lastWrite)
+		}
+		if reopened.lastWritePath != expectedPath {
+			t.Errorf("Unexpected last write path with %s metadata."+
+				"\nexpected: %s\nreceived: %s",
+				name, expectedPath, reopened.lastWritePath)
+		}
+	}
+}
+
+// Error path: Tests that FileStore.GetLastWrite returns os.ErrNotExist for a
+// new store with no files.
+func TestFileStore_GetLastWrite_NoWriteError(t *testing.T) {
+	testDir := "tmp"
+	defer removeTestFile(t, testDir)
+
+	fs := newTestFileStore("baseDir", testDir, t)
+	_, err := fs.GetLastWrite()
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error for store with no writes."+
+			"\nexpected: %v\nreceived: %+v", os.ErrNotExist, err)
+	}
+}
+
+// Tests that saveLastWrite and loadLastWrite round trip the metadata.
+func Test_saveLastWrite_loadLastWrite(t *testing.T) {
+	testDir := "tmp"
+	defer removeTestFile(t, testDir)
+
+	expected := lastWriteMetadata{
+		Path: "dir/file.txt",
+		Time: time.Date(2022, 6, 1, 12, 30, 0, 500, time.UTC),
+	}
+	if err := saveLastWrite(testDir, expected); err != nil {
+		t.Fatalf("Failed to save last write: %+v", err)
+	}
+
+	lw, err := loadLastWrite(testDir)
+	if err != nil {
+		t.Fatalf("Failed to load last write: %+v", err)
+	} else if lw.Path != expected.Path || !lw.Time.Equal(expected.Time) {
+		t.Errorf("Unexpected last write.\nexpected: %+v\nreceived: %+v",
+			expected, lw)
+	}
+}
+
+// Tests that scanLastWrite returns empty metadata for a directory with no
+// files other than internal files.
+func Test_scanLastWrite_Empty(t *testing.T) {
+	testDir := "tmp"
+	defer removeTestFile(t, testDir)
+
+	err := os.MkdirAll(filepath.Join(testDir, "dir"), FilePerm)
+	if err != nil {
+		t.Fatalf("Failed to make directory: %+v", err)
+	}
+	err = os.WriteFile(filepath.Join(testDir, lastWriteFile), []byte{}, FilePerm)
+	if err != nil {
+		t.Fatalf("Failed to write internal file: %+v", err)
+	}
+
+	lw, err := scanLastWrite(testDir)
+	if err != nil {
+		t.Errorf("Failed to scan last write: %+v", err)
+	} else if lw != (lastWriteMetadata{}) {
+		t.Errorf("Unexpected last write.\nexpected: %+v\nreceived: %+v",
+			lastWriteMetadata{}, lw)
+	}
+}
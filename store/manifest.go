@@ -0,0 +1,52 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package store
+
+import (
+	"sort"
+	"time"
+)
+
+// ManifestEntry describes a file in a manifest returned by Manifest.
+type ManifestEntry struct {
+	// Path is the path of the file relative to the base directory.
+	Path string
+
+	// Size is the size of the file in bytes.
+	Size int64
+
+	// Modified is the last modification time of the file.
+	Modified time.Time
+
+	// Hash is the hash of the contents of the file, as returned by
+	// ContentHash.
+	Hash []byte
+}
+
+// cachedHash is the content hash of a file along with the size and
+// modification time of the file when it was hashed. The hash is only valid
+// while the size and modification time are unchanged.
+type cachedHash struct {
+	size     int64
+	modified time.Time
+	hash     []byte
+}
+
+// includeInManifest returns true if a file modified at the given time is
+// included in a manifest of files modified since the given time. All files are
+// included if since is zero.
+func includeInManifest(modified, since time.Time) bool {
+	return since.IsZero() || !modified.Before(since)
+}
+
+// sortManifest sorts the entries by path.
+func sortManifest(entries []ManifestEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+}
@@ -0,0 +1,37 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+// Tests that includeInManifest includes all files when since is zero and
+// otherwise only files modified at or after since.
+func Test_includeInManifest(t *testing.T) {
+	since := time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		modified, since time.Time
+		expected        bool
+	}{
+		{since.Add(-time.Hour), time.Time{}, true},
+		{since.Add(-time.Nanosecond), since, false},
+		{since, since, true},
+		{since.Add(time.Hour), since, true},
+	}
+
+	for i, tt := range tests {
+		included := includeInManifest(tt.modified, tt.since)
+		if included != tt.expected {
+			t.Errorf("Unexpected result for %s since %s (%d)."+
+				"\nexpected: %t\nreceived: %t",
+				tt.modified, tt.since, i, tt.expected, included)
+		}
+	}
+}
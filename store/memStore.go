@@ -8,13 +8,14 @@
 package store
 
 import (
-	"gitlab.com/xx_network/primitives/netTime"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
 	"time"
+
+	"gitlab.com/xx_network/primitives/netTime"
 )
 
 // MemStore manages the storage in a base directory. It saves everything in
@@ -23,6 +24,25 @@ type MemStore struct {
 	lastWritePath string
 	store         map[string]memFile
 
+	// lastDelete is the time of the most recent Delete or DeleteDir. It is
+	// only used by GetLastWrite when no file has been written since.
+	lastDelete time.Time
+
+	// quota is the limit on the storage used. usage is the current storage
+	// used by the files.
+	quota Quota
+	usage Usage
+
+	// retention determines which previous versions of files are kept.
+	// versions is a map of each file path to its previous versions and
+	// versionBytes is their total size.
+	retention    RetentionPolicy
+	versions     map[string]map[int64]memFile
+	versionBytes int64
+
+	// journal is the list of recent modifications.
+	journal *journal
+
 	mux sync.Mutex
 }
 
@@ -34,7 +54,9 @@ type memFile struct {
 // NewMemStore creates a new MemStore at the specified base directory.
 func NewMemStore(_ string, _ string) (Store, error) {
 	ms := &MemStore{
-		store: make(map[string]memFile),
+		store:    make(map[string]memFile),
+		versions: make(map[string]map[int64]memFile),
+		journal:  newJournal(journalMaxEntries),
 	}
 
 	return ms, nil
@@ -43,9 +65,15 @@ func NewMemStore(_ string, _ string) (Store, error) {
 // Read reads from the provided file path and returns the data in the file at
 // that path.
 //
-// An error is returned if it fails to read the file. Returns [os.ErrNotExist]
-// if the file cannot be found.
+// An error is returned if it fails to read the file. Returns [NonLocalFileErr]
+// if the file is outside the base path and [os.ErrNotExist] if the file cannot
+// be found.
 func (ms *MemStore) Read(path string) ([]byte, error) {
+	path, err := ms.readyPath(path)
+	if err != nil {
+		return nil, err
+	}
+
 	ms.mux.Lock()
 	defer ms.mux.Unlock()
 	f, exists := ms.store[path]
@@ -55,12 +83,58 @@ func (ms *MemStore) Read(path string) ([]byte, error) {
 	return f.data, nil
 }
 
-// Write writes the provided data to the file path. Does not return any errors.
+// Write writes the provided data to the file path.
+//
+// Returns [NonLocalFileErr] if the file is outside the base path and
+// [QuotaExceededErr] if the write would exceed the quota.
 func (ms *MemStore) Write(path string, data []byte) error {
+	return ms.write(path, data, Precondition{})
+}
+
+// WriteIf writes the provided data to the file path only if the file matches
+// the precondition. The check and write are atomic.
+//
+// Returns a *[ConflictError], which matches [ConflictErr], if the file does not
+// match the precondition and [QuotaExceededErr] if the write would exceed the
+// quota.
+func (ms *MemStore) WriteIf(path string, data []byte, cond Precondition) error {
+	return ms.write(path, data, cond)
+}
+
+// write writes the data to the file path if it matches the precondition.
+func (ms *MemStore) write(relPath string, data []byte, cond Precondition) error {
+	path, err := ms.readyPath(relPath)
+	if err != nil {
+		return err
+	}
+
 	ms.mux.Lock()
 	defer ms.mux.Unlock()
+
+	newUsage := ms.usage
+	newUsage.Bytes += int64(len(data))
+	f, exists := ms.store[path]
+	if exists {
+		newUsage.Bytes -= int64(len(f.data))
+	} else {
+		newUsage.Files++
+	}
+	if err = cond.check(relPath, exists, f.modified, f.data); err != nil {
+		return err
+	}
+	if !ms.quota.allows(ms.usage, newUsage) {
+		return QuotaExceededErr
+	}
+
+	if exists {
+		ms.saveVersion(path, f)
+	}
+
 	ms.store[path] = memFile{data, netTime.Now()}
+	ms.usage = newUsage
+	ms.evictVersions()
 	ms.lastWritePath = path
+	ms.recordChange(ChangeWrite, path)
 	return nil
 }
 
@@ -69,6 +143,11 @@ func (ms *MemStore) Write(path string, data []byte) error {
 //
 // Returns [NonLocalFileErr] if the file is outside the base path.
 func (ms *MemStore) GetLastModified(path string) (time.Time, error) {
+	path, err := ms.readyPath(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
 	ms.mux.Lock()
 	defer ms.mux.Unlock()
 	return ms.getLastModified(path)
@@ -82,45 +161,419 @@ func (ms *MemStore) getLastModified(path string) (time.Time, error) {
 	return f.modified, nil
 }
 
-// GetLastWrite returns the time of the most recent successful Write operation
-// that was performed.
+// GetLastWrite returns the time of the most recent successful Write or Delete
+// operation that was performed.
 func (ms *MemStore) GetLastWrite() (time.Time, error) {
 	ms.mux.Lock()
 	defer ms.mux.Unlock()
+	if ms.lastWritePath == "" && !ms.lastDelete.IsZero() {
+		return ms.lastDelete, nil
+	}
 	return ms.getLastModified(ms.lastWritePath)
 }
 
 // ReadDir reads the named directory, returning all its directory entries
 // sorted by filename.
 //
-// Returns [NonLocalFileErr] if the file is outside the base path.
+// Returns [NonLocalFileErr] if the file is outside the base path and
+// [os.ErrNotExist] if no files exist in the directory, unless it is the base
+// directory.
 func (ms *MemStore) ReadDir(path string) ([]string, error) {
+	entries, err := ms.ReadDirEntries(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := make([]string, 0)
+	for _, entry := range entries {
+		if entry.IsDir {
+			dirs = append(dirs, entry.Name)
+		}
+	}
+	return dirs, nil
+}
+
+// ReadDirEntries reads the named directory, returning all the files and
+// directories it contains sorted by name.
+//
+// Returns [NonLocalFileErr] if the directory is outside the base path and
+// [os.ErrNotExist] if no files exist in the directory, unless it is the base
+// directory.
+func (ms *MemStore) ReadDirEntries(path string) ([]DirEntry, error) {
+	path, err := ms.readyPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+
+	prefix := ""
+	if path != "" {
+		prefix = path + string(filepath.Separator)
+	}
+
+	dirs := make(map[string]struct{})
+	list := make([]DirEntry, 0)
+	var exists bool
+	for fPath, f := range ms.store {
+		if !strings.HasPrefix(fPath, prefix) {
+			continue
+		}
+		exists = true
+
+		name := strings.TrimPrefix(fPath, prefix)
+		if i := strings.IndexRune(name, os.PathSeparator); i >= 0 {
+			dirs[name[:i]] = struct{}{}
+		} else {
+			list = append(list, DirEntry{
+				Name:     name,
+				Size:     int64(len(f.data)),
+				Modified: f.modified,
+			})
+		}
+	}
+	if !exists && prefix != "" {
+		return nil, os.ErrNotExist
+	}
+
+	for dir := range dirs {
+		list = append(list, DirEntry{Name: dir, IsDir: true})
+	}
+	sortDirEntries(list)
+
+	return list, nil
+}
+
+// Manifest returns every file in the named directory and its subdirectories
+// with its size, modification time, and content hash, sorted by path. If since
+// is not zero, only files modified at or after since are returned.
+//
+// Returns [NonLocalFileErr] if the directory is outside the base path and
+// [os.ErrNotExist] if no files exist in the directory, unless it is the base
+// directory.
+func (ms *MemStore) Manifest(
+	path string, since time.Time) ([]ManifestEntry, error) {
+	path, err := ms.readyPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+
+	prefix := ""
+	if path != "" {
+		prefix = path + string(filepath.Separator)
+	}
+
+	entries := make([]ManifestEntry, 0)
+	var exists bool
+	for fPath, f := range ms.store {
+		if !strings.HasPrefix(fPath, prefix) {
+			continue
+		}
+		exists = true
+
+		if includeInManifest(f.modified, since) {
+			entries = append(entries, ManifestEntry{
+				Path:     fPath,
+				Size:     int64(len(f.data)),
+				Modified: f.modified,
+				Hash:     ContentHash(f.data),
+			})
+		}
+	}
+	if !exists && prefix != "" {
+		return nil, os.ErrNotExist
+	}
+
+	sortManifest(entries)
+	return entries, nil
+}
+
+// Delete deletes the file at the given path.
+//
+// Returns [NonLocalFileErr] if the file is outside the base path and
+// [os.ErrNotExist] if the file cannot be found.
+func (ms *MemStore) Delete(path string) error {
+	path, err := ms.readyPath(path)
+	if err != nil {
+		return err
+	}
+
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	f, exists := ms.store[path]
+	if !exists {
+		return os.ErrNotExist
+	}
+	ms.saveVersion(path, f)
+	delete(ms.store, path)
+	ms.usage.Bytes -= int64(len(f.data))
+	ms.usage.Files--
+	ms.lastWritePath = ""
+	ms.lastDelete = netTime.Now()
+	ms.recordChange(ChangeDelete, path)
+	return nil
+}
+
+// DeleteDir deletes all files in the named directory and its subdirectories,
+// including their previous versions. An empty path deletes every file in the
+// store.
+//
+// Returns [NonLocalFileErr] if the directory is outside the base path and
+// [os.ErrNotExist] if no files exist in the directory, unless it is the base
+// directory.
+func (ms *MemStore) DeleteDir(path string) error {
+	path, err := ms.readyPath(path)
+	if err != nil {
+		return err
+	}
+
 	ms.mux.Lock()
 	defer ms.mux.Unlock()
 
-	dirMap := make(map[string]struct{})
+	prefix := ""
 	if path != "" {
-		path = filepath.Clean(path)
-	}
-
-	for fPath := range ms.store {
-		fPath = filepath.Dir(fPath) + string(os.PathSeparator)
-		if fPath != string(os.PathSeparator) &&
-			fPath != "."+string(os.PathSeparator) &&
-			strings.HasPrefix(fPath, path) {
-			dir := strings.TrimPrefix(fPath, path+string(os.PathSeparator))
-			dir = strings.Split(dir, string(os.PathSeparator))[0]
-			if dir != "" && dir != path {
-				dirMap[dir] = struct{}{}
+		prefix = path + string(filepath.Separator)
+	}
+
+	var deleted bool
+	for fPath, f := range ms.store {
+		if strings.HasPrefix(fPath, prefix) {
+			delete(ms.store, fPath)
+			ms.usage.Bytes -= int64(len(f.data))
+			ms.usage.Files--
+			deleted = true
+		}
+	}
+	for fPath, versions := range ms.versions {
+		if strings.HasPrefix(fPath, prefix) {
+			for _, f := range versions {
+				ms.versionBytes -= int64(len(f.data))
 			}
+			delete(ms.versions, fPath)
 		}
 	}
+	if !deleted && prefix != "" {
+		return os.ErrNotExist
+	}
+
+	ms.lastWritePath = ""
+	ms.lastDelete = netTime.Now()
+	ms.recordChange(ChangeDeleteDir, path)
+	return nil
+}
+
+// SetQuota sets the limits on the storage used by the store. Existing files are
+// kept even if they exceed the new quota.
+func (ms *MemStore) SetQuota(quota Quota) {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	ms.quota = quota
+}
+
+// GetUsage returns the storage currently used by the store.
+func (ms *MemStore) GetUsage() Usage {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	return ms.getUsage()
+}
+
+// getUsage returns the storage used by the files and their previous versions.
+// Must be called with ms.mux held.
+func (ms *MemStore) getUsage() Usage {
+	u := ms.usage
+	u.VersionBytes = ms.versionBytes
+	return u
+}
+
+// SetRetention sets the policy that determines which previous versions of each
+// file are kept when it is overwritten or deleted. Versions no longer retained
+// under a new policy are removed the next time their file is modified.
+func (ms *MemStore) SetRetention(policy RetentionPolicy) {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	ms.retention = policy
+}
+
+// ListVersions returns the previous versions of the file at the given path that
+// are retained, sorted from newest to oldest. The current contents of the file
+// are not included.
+//
+// Returns [NonLocalFileErr] if the file is outside the base path.
+func (ms *MemStore) ListVersions(path string) ([]Version, error) {
+	path, err := ms.readyPath(path)
+	if err != nil {
+		return nil, err
+	}
 
-	dirList := make([]string, 0, len(dirMap))
-	for dir := range dirMap {
-		dirList = append(dirList, dir)
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	versions, _ := ms.retention.apply(ms.listVersions(path), netTime.Now())
+	return versions, nil
+}
+
+// ReadVersion returns the contents of the previous version of the file at the
+// given path with the given ID.
+//
+// Returns [NonLocalFileErr] if the file is outside the base path and
+// [VersionNotFoundErr] if the version does not exist.
+func (ms *MemStore) ReadVersion(path string, id int64) ([]byte, error) {
+	path, err := ms.readyPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	f, exists := ms.versions[path][id]
+	if !exists {
+		return nil, VersionNotFoundErr
 	}
-	sort.Strings(dirList)
+	return f.data, nil
+}
 
-	return dirList, nil
+// Rewrite replaces the contents of every file and every retained previous
+// version with the data returned by rewrite. Each file keeps its modification
+// time. Implements [Rewriter].
+func (ms *MemStore) Rewrite(rewrite RewriteFunc) error {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+
+	paths := make([]string, 0, len(ms.store))
+	for path := range ms.store {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		f := ms.store[path]
+		data, err := rewrite(path, f.data)
+		if err != nil {
+			return err
+		} else if data != nil {
+			ms.usage.Bytes += int64(len(data) - len(f.data))
+			ms.store[path] = memFile{data, f.modified}
+		}
+	}
+
+	paths = paths[:0]
+	for path := range ms.versions {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		for id, f := range ms.versions[path] {
+			data, err := rewrite(path, f.data)
+			if err != nil {
+				return err
+			} else if data != nil {
+				ms.versionBytes += int64(len(data) - len(f.data))
+				ms.versions[path][id] = memFile{data, f.modified}
+			}
+		}
+	}
+	return nil
+}
+
+// saveVersion keeps the file as a previous version of the file at the path and
+// removes the versions of the file that are no longer retained. Does nothing if
+// the retention policy keeps no versions. Must be called with ms.mux held.
+func (ms *MemStore) saveVersion(path string, f memFile) {
+	if !ms.retention.enabled() {
+		return
+	}
+
+	if _, exists := ms.versions[path]; !exists {
+		ms.versions[path] = make(map[int64]memFile)
+	}
+
+	now := netTime.Now()
+	id := newVersionID(now, func(id int64) bool {
+		_, exists := ms.versions[path][id]
+		return exists
+	})
+	ms.versions[path][id] = f
+	ms.versionBytes += int64(len(f.data))
+
+	_, remove := ms.retention.apply(ms.listVersions(path), now)
+	for _, v := range remove {
+		delete(ms.versions[path], v.ID)
+		ms.versionBytes -= v.Size
+	}
+}
+
+// evictVersions removes the oldest previous versions of any file until the
+// files and their versions fit within the byte quota. Must be called with
+// ms.mux held.
+func (ms *MemStore) evictVersions() {
+	excess := ms.quota.excessVersionBytes(ms.getUsage())
+	if excess == 0 {
+		return
+	}
+
+	var versions []storedVersion
+	for path := range ms.versions {
+		for _, v := range ms.listVersions(path) {
+			versions = append(versions, storedVersion{path, v})
+		}
+	}
+	for _, v := range oldestVersions(versions, excess) {
+		delete(ms.versions[v.path], v.ID)
+		ms.versionBytes -= v.Size
+	}
+}
+
+// listVersions returns all previous versions of the file at the path in no
+// particular order.
+func (ms *MemStore) listVersions(path string) []Version {
+	versions := make([]Version, 0, len(ms.versions[path]))
+	for id, f := range ms.versions[path] {
+		versions = append(versions, Version{
+			ID:       id,
+			Modified: f.modified,
+			Replaced: time.Unix(0, id),
+			Size:     int64(len(f.data)),
+		})
+	}
+	return versions
+}
+
+// GetChanges returns the ID of the journal and all changes in it with a
+// sequence number greater than after, in order. Passing zero returns all
+// changes. Each MemStore has a new journal ID.
+//
+// Returns [JournalCompactedErr] if any of the requested changes have been
+// removed from the journal, if after is past the last change, or if after is
+// not zero and journalID is not the ID of the journal.
+func (ms *MemStore) GetChanges(
+	journalID string, after uint64) (string, []Change, error) {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	changes, err := ms.journal.since(journalID, after)
+	return ms.journal.id, changes, err
+}
+
+// recordChange adds a modification of the file or directory at the path to the
+// journal. Must be called with ms.mux held.
+func (ms *MemStore) recordChange(changeType ChangeType, path string) {
+	ms.journal.add(changeType, path, netTime.Now())
+	ms.journal.compact()
+}
+
+// readyPath cleans the path and ensures it is local. The base directory is the
+// empty string. Returns NonLocalFileErr if the file is outside the base path
+// and ReservedPathErr if the path is reserved for internal files.
+func (ms *MemStore) readyPath(path string) (string, error) {
+	if isReservedPath(path) {
+		return "", ReservedPathErr
+	}
+	path, err := readyPath(".", path)
+	if err != nil {
+		return "", err
+	} else if path == "." {
+		return "", nil
+	}
+	return path, nil
 }
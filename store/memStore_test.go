@@ -24,11 +24,22 @@ import (
 // Tests that MemStore adheres to the Store interface.
 var _ Store = (*MemStore)(nil)
 
+// Tests that MemStore passes the store conformance tests.
+func TestMemStore_Conformance(t *testing.T) {
+	RunConformanceTests(t, NewMemStore)
+}
+
 // Unit test of NewMemStore.
 func TestNewMemStore(t *testing.T) {
-	expected := &MemStore{store: make(map[string]memFile)}
+	expected := &MemStore{
+		store:    make(map[string]memFile),
+		versions: make(map[string]map[int64]memFile),
+		journal:  newJournal(journalMaxEntries),
+	}
 	ms, _ := NewMemStore("", "")
 
+	// The journal ID is random
+	expected.journal.id = ms.(*MemStore).journal.id
 	if !reflect.DeepEqual(expected, ms) {
 		t.Errorf("Unexpected new MemStore.\nexpected: %+v\nrecieved: %+v",
 			expected, ms)
@@ -147,11 +158,13 @@ func TestMemStore_GetLastWrite(t *testing.T) {
 func TestMemStore_ReadDir(t *testing.T) {
 	ms, _ := NewMemStore("", "")
 
+	// Paths are cleaned as in the other stores, so "dirD/" is written as the
+	// file "dirD" rather than as a directory
 	tests := []struct {
 		path string
 		dirs []string
 	}{
-		{"", []string{"dir1", "dir2", "dirD"}},
+		{"", []string{"dir1", "dir2"}},
 		{"dir1", []string{"dirA", "dirB", "dirC"}},
 		{"dir1/dirB", []string{"dirB1", "dirB2"}},
 		{"dir1/dirB/dirB2", []string{}},
@@ -177,3 +190,315 @@ func TestMemStore_ReadDir(t *testing.T) {
 		}
 	}
 }
+
+// Tests that MemStore.Delete removes a written file and that
+// MemStore.GetLastWrite returns the time of the deletion afterwards.
+func TestMemStore_Delete(t *testing.T) {
+	ms, _ := NewMemStore("", "")
+
+	path := "dir/file.txt"
+	if err := ms.Write(path, []byte("data")); err != nil {
+		t.Fatalf("Failed to write data for path %s: %+v", path, err)
+	}
+
+	now := netTime.Now()
+	if err := ms.Delete(path); err != nil {
+		t.Fatalf("Failed to delete %s: %+v", path, err)
+	}
+
+	if _, err := ms.Read(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error reading deleted file."+
+			"\nexpected: %v\nreceived: %+v", os.ErrNotExist, err)
+	}
+
+	lastWrite, err := ms.GetLastWrite()
+	if err != nil {
+		t.Errorf("Failed to get last write: %+v", err)
+	} else if delta := lastWrite.Sub(now); delta > 10*time.Millisecond ||
+		lastWrite.Before(now) {
+		t.Errorf("Last write is not close to delete time (Δ%s)."+
+			"\nexpected: %s\nreceived: %s", delta, now, lastWrite)
+	}
+}
+
+// Error path: Tests that MemStore.Delete returns os.ErrNotExist if the file
+// does not exist.
+func TestMemStore_Delete_ErrNotExist(t *testing.T) {
+	ms, _ := NewMemStore("", "")
+	err := ms.Delete("no file")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error for missing file."+
+			"\nexpected: %v\nreceived: %v", os.ErrNotExist, err)
+	}
+}
+
+// Tests that MemStore.DeleteDir removes all files in the directory while
+// leaving other files untouched.
+func TestMemStore_DeleteDir(t *testing.T) {
+	ms, _ := NewMemStore("", "")
+
+	for i, path := range []string{"file", "dir1/a", "dir1/dirA/a",
+		"dir1/dirB/dirB1/a", "dir10/a", "dir2/a"} {
+		if err := ms.Write(path, []byte("data")); err != nil {
+			t.Errorf("Failed to write data for path %s (%d): %+v", path, i, err)
+		}
+	}
+
+	if err := ms.DeleteDir("dir1/"); err != nil {
+		t.Fatalf("Failed to delete directory: %+v", err)
+	}
+
+	dirs, err := ms.ReadDir("")
+	if err != nil {
+		t.Errorf("Failed to read directory: %+v", err)
+	} else if expected := []string{"dir10", "dir2"}; !reflect.DeepEqual(expected, dirs) {
+		t.Errorf("Unexpected directories after delete."+
+			"\nexpected: %s\nreceived: %s", expected, dirs)
+	}
+
+	if err = ms.DeleteDir(""); err != nil {
+		t.Fatalf("Failed to delete base directory: %+v", err)
+	} else if n := len(ms.(*MemStore).store); n != 0 {
+		t.Errorf("%d files remain after deleting base directory.", n)
+	}
+}
+
+// Error path: Tests that MemStore.DeleteDir returns os.ErrNotExist if the
+// directory does not exist.
+func TestMemStore_DeleteDir_ErrNotExist(t *testing.T) {
+	ms, _ := NewMemStore("", "")
+	err := ms.DeleteDir("no dir")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error for missing directory."+
+			"\nexpected: %v\nreceived: %v", os.ErrNotExist, err)
+	}
+}
+
+// Tests that MemStore tracks usage across writes, overwrites, and deletes and
+// rejects writes that exceed the quota with QuotaExceededErr.
+func TestMemStore_SetQuota_GetUsage(t *testing.T) {
+	ms, _ := NewMemStore("", "")
+	ms.SetQuota(Quota{MaxBytes: 10, MaxFiles: 3})
+
+	steps := []struct {
+		op       func() error
+		err      error
+		expected Usage
+	}{
+		{func() error { return ms.Write("a", []byte("1234")) }, nil, Usage{4, 1, 0}},
+		{func() error { return ms.Write("dir/b", []byte("12")) }, nil, Usage{6, 2, 0}},
+		{func() error { return ms.Write("a", []byte("123456789")) }, QuotaExceededErr, Usage{6, 2, 0}},
+		{func() error { return ms.Write("a", []byte("1")) }, nil, Usage{3, 2, 0}},
+		{func() error { return ms.Write("dir/c", []byte("1")) }, nil, Usage{4, 3, 0}},
+		{func() error { return ms.Write("d", []byte("1")) }, QuotaExceededErr, Usage{4, 3, 0}},
+		{func() error { return ms.Delete("a") }, nil, Usage{3, 2, 0}},
+		{func() error { return ms.Write("d", []byte("1")) }, nil, Usage{4, 3, 0}},
+		{func() error { return ms.DeleteDir("dir") }, nil, Usage{1, 1, 0}},
+	}
+
+	for i, step := range steps {
+		err := step.op()
+		if step.err == nil && err != nil {
+			t.Errorf("Operation %d failed: %+v", i, err)
+		} else if !errors.Is(err, step.err) {
+			t.Errorf("Unexpected error for operation %d."+
+				"\nexpected: %v\nreceived: %+v", i, step.err, err)
+		}
+
+		if usage := ms.GetUsage(); usage != step.expected {
+			t.Errorf("Unexpected usage after operation %d."+
+				"\nexpected: %+v\nreceived: %+v", i, step.expected, usage)
+		}
+	}
+}
+
+// Tests that MemStore keeps the retained previous versions of a file when it is
+// overwritten and deleted and that MemStore.ReadVersion returns their contents.
+func TestMemStore_ListVersions_ReadVersion(t *testing.T) {
+	ms, _ := NewMemStore("", "")
+	ms.SetRetention(RetentionPolicy{MaxVersions: 2})
+
+	path := "dir/file.txt"
+	for _, data := range []string{"one", "two", "three"} {
+		if err := ms.Write(path, []byte(data)); err != nil {
+			t.Fatalf("Failed to write %q: %+v", data, err)
+		}
+	}
+	if err := ms.Delete(path); err != nil {
+		t.Fatalf("Failed to delete %s: %+v", path, err)
+	}
+
+	versions, err := ms.ListVersions(path)
+	if err != nil {
+		t.Fatalf("Failed to list versions: %+v", err)
+	} else if len(versions) != 2 {
+		t.Fatalf("Unexpected number of versions.\nexpected: %d\nreceived: %d",
+			2, len(versions))
+	}
+
+	for i, expected := range []string{"three", "two"} {
+		data, err := ms.ReadVersion(path, versions[i].ID)
+		if err != nil {
+			t.Errorf("Failed to read version %d: %+v", i, err)
+		} else if string(data) != expected {
+			t.Errorf("Unexpected data for version %d."+
+				"\nexpected: %q\nreceived: %q", i, expected, data)
+		}
+	}
+
+	if err = ms.DeleteDir("dir"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Failed to delete directory: %+v", err)
+	}
+	if versions, _ = ms.ListVersions(path); len(versions) != 0 {
+		t.Errorf("Versions kept after deleting directory: %+v", versions)
+	}
+}
+
+// Error path: Tests that MemStore.ReadVersion returns VersionNotFoundErr for a
+// version that does not exist.
+func TestMemStore_ReadVersion_VersionNotFoundError(t *testing.T) {
+	ms, _ := NewMemStore("", "")
+	_, err := ms.ReadVersion("file.txt", 42)
+	if !errors.Is(err, VersionNotFoundErr) {
+		t.Errorf("Unexpected error for missing version."+
+			"\nexpected: %v\nreceived: %+v", VersionNotFoundErr, err)
+	}
+}
+
+// Tests that MemStore.WriteIf only writes when the file matches the
+// precondition and otherwise returns a ConflictError describing the file.
+func TestMemStore_WriteIf(t *testing.T) {
+	ms, _ := NewMemStore("", "")
+
+	path := "dir/file.txt"
+	err := ms.WriteIf(path, []byte("one"), Precondition{Hash: ContentHash(nil)})
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("Unexpected error for missing file."+
+			"\nexpected: %v\nreceived: %+v", ConflictErr, err)
+	} else if conflict.Exists {
+		t.Errorf("Conflict reports missing file exists: %+v", conflict)
+	}
+
+	if err = ms.WriteIf(path, []byte("one"), Precondition{NotExist: true}); err != nil {
+		t.Fatalf("Failed to create file: %+v", err)
+	}
+	modified, _ := ms.GetLastModified(path)
+
+	err = ms.WriteIf(path, []byte("two"), Precondition{Modified: modified})
+	if err != nil {
+		t.Fatalf("Failed to write with matching precondition: %+v", err)
+	}
+
+	err = ms.WriteIf(path, []byte("three"), Precondition{Modified: modified})
+	if !errors.As(err, &conflict) {
+		t.Fatalf("Unexpected error.\nexpected: %v\nreceived: %+v",
+			ConflictErr, err)
+	} else if !bytes.Equal(conflict.Hash, ContentHash([]byte("two"))) {
+		t.Errorf("Unexpected hash in conflict.\nexpected: %x\nreceived: %x",
+			ContentHash([]byte("two")), conflict.Hash)
+	}
+
+	if data, _ := ms.Read(path); string(data) != "two" {
+		t.Errorf("Unexpected data.\nexpected: %q\nreceived: %q", "two", data)
+	}
+}
+
+// Tests that MemStore.ReadDirEntries returns an empty list for the empty base
+// directory and os.ErrNotExist for a directory with no files.
+func TestMemStore_ReadDirEntries_Empty(t *testing.T) {
+	ms, _ := NewMemStore("", "")
+
+	entries, err := ms.ReadDirEntries("")
+	if err != nil {
+		t.Errorf("Failed to read base directory: %+v", err)
+	} else if len(entries) != 0 {
+		t.Errorf("Unexpected entries in empty store: %+v", entries)
+	}
+
+	_, err = ms.ReadDirEntries("dir")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error for missing directory."+
+			"\nexpected: %v\nreceived: %+v", os.ErrNotExist, err)
+	}
+}
+
+// Tests that MemStore.Manifest returns every file under the directory with the
+// correct metadata and hash and filters by modification time.
+func TestMemStore_Manifest(t *testing.T) {
+	ms, _ := NewMemStore("", "")
+	files := map[string]string{"file": "a", "dir1/a": "ab", "dir1/dirA/b": "abc"}
+	for path, data := range files {
+		if err := ms.Write(path, []byte(data)); err != nil {
+			t.Fatalf("Failed to write %s: %+v", path, err)
+		}
+	}
+
+	entries, err := ms.Manifest("dir1", time.Time{})
+	if err != nil {
+		t.Fatalf("Failed to get manifest: %+v", err)
+	} else if len(entries) != 2 || entries[0].Path != "dir1/a" ||
+		entries[1].Path != "dir1/dirA/b" {
+		t.Fatalf("Unexpected manifest: %+v", entries)
+	}
+	for _, e := range entries {
+		f := ms.(*MemStore).store[e.Path]
+		if e.Size != int64(len(f.data)) || !e.Modified.Equal(f.modified) ||
+			!bytes.Equal(e.Hash, ContentHash(f.data)) {
+			t.Errorf("Unexpected entry for %s: %+v", e.Path, e)
+		}
+	}
+
+	since := netTime.Now()
+	if err = ms.Write("dir1/a", []byte("changed")); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+	entries, err = ms.Manifest("", since)
+	if err != nil {
+		t.Fatalf("Failed to get manifest: %+v", err)
+	} else if len(entries) != 1 || entries[0].Path != "dir1/a" {
+		t.Errorf("Unexpected manifest since %s: %+v", since, entries)
+	}
+
+	if _, err = ms.Manifest("dir2", time.Time{}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error for missing directory."+
+			"\nexpected: %v\nreceived: %+v", os.ErrNotExist, err)
+	}
+}
+
+// Tests that MemStore.GetChanges returns all modifications in order.
+func TestMemStore_GetChanges(t *testing.T) {
+	ms, _ := NewMemStore("", "")
+	_ = ms.Write("dir/a", []byte("a"))
+	_ = ms.Delete("dir/a")
+	_ = ms.Write("dir/b", []byte("b"))
+	_ = ms.DeleteDir("dir")
+
+	expected := []struct {
+		ct   ChangeType
+		path string
+	}{
+		{ChangeWrite, "dir/a"},
+		{ChangeDelete, "dir/a"},
+		{ChangeWrite, "dir/b"},
+		{ChangeDeleteDir, "dir"},
+	}
+
+	journalID, _, err := ms.GetChanges("", 0)
+	if err != nil {
+		t.Fatalf("Failed to get journal ID: %+v", err)
+	}
+	_, changes, err := ms.GetChanges(journalID, 1)
+	if err != nil {
+		t.Fatalf("Failed to get changes: %+v", err)
+	} else if len(changes) != len(expected)-1 {
+		t.Fatalf("Unexpected number of changes.\nexpected: %d\nreceived: %d",
+			len(expected)-1, len(changes))
+	}
+	for i, c := range changes {
+		e := expected[i+1]
+		if c.Seq != uint64(i+2) || c.Type != e.ct || c.Path != e.path {
+			t.Errorf("Unexpected change %d: %+v", i, c)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package store
+
+// Quota limits the storage a store may use. A limit of zero means there is no
+// limit.
+type Quota struct {
+	// MaxBytes is the maximum total size, in bytes, of all files and their
+	// retained previous versions. The oldest previous versions are removed to
+	// keep within the limit, so previous versions never cause a write to be
+	// rejected.
+	MaxBytes int64
+
+	// MaxFiles is the maximum number of files.
+	MaxFiles int64
+}
+
+// Usage is the storage currently used by a store.
+type Usage struct {
+	// Bytes is the total size, in bytes, of all files.
+	Bytes int64
+
+	// Files is the number of files.
+	Files int64
+
+	// VersionBytes is the total size, in bytes, of the retained previous
+	// versions of all files. It counts towards the byte quota.
+	VersionBytes int64
+}
+
+// allows returns true if changing the usage from old to new does not exceed
+// the quota. Changes that do not increase the usage are always allowed so that
+// a store over its quota can still be reduced. Previous versions are not
+// considered since they are removed to make room for the files.
+func (q Quota) allows(old, new Usage) bool {
+	if q.MaxBytes > 0 && new.Bytes > old.Bytes && new.Bytes > q.MaxBytes {
+		return false
+	}
+	if q.MaxFiles > 0 && new.Files > old.Files && new.Files > q.MaxFiles {
+		return false
+	}
+	return true
+}
+
+// excessVersionBytes returns the number of bytes of previous versions that must
+// be removed for the files and versions of the usage to fit within the byte
+// quota. It is at most the size of all previous versions.
+func (q Quota) excessVersionBytes(u Usage) int64 {
+	if q.MaxBytes <= 0 {
+		return 0
+	}
+	excess := u.Bytes + u.VersionBytes - q.MaxBytes
+	if excess <= 0 {
+		return 0
+	} else if excess > u.VersionBytes {
+		return u.VersionBytes
+	}
+	return excess
+}
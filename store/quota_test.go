@@ -0,0 +1,66 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package store
+
+import (
+	"testing"
+)
+
+// Tests that Quota.allows only rejects changes that increase usage past a
+// non-zero limit.
+func TestQuota_allows(t *testing.T) {
+	tests := []struct {
+		quota    Quota
+		old, new Usage
+		expected bool
+	}{
+		{Quota{}, Usage{0, 0, 0}, Usage{1 << 40, 1 << 20, 0}, true},
+		{Quota{100, 0}, Usage{0, 0, 0}, Usage{100, 1, 0}, true},
+		{Quota{100, 0}, Usage{0, 0, 0}, Usage{101, 1, 0}, false},
+		{Quota{100, 0}, Usage{150, 1, 0}, Usage{120, 1, 0}, true},
+		{Quota{100, 0}, Usage{150, 1, 0}, Usage{151, 1, 0}, false},
+		{Quota{0, 2}, Usage{0, 1, 0}, Usage{10, 2, 0}, true},
+		{Quota{0, 2}, Usage{0, 2, 0}, Usage{10, 3, 0}, false},
+		{Quota{0, 2}, Usage{0, 3, 0}, Usage{10, 3, 0}, true},
+		{Quota{100, 2}, Usage{50, 1, 0}, Usage{60, 2, 0}, true},
+	}
+
+	for i, tt := range tests {
+		allowed := tt.quota.allows(tt.old, tt.new)
+		if allowed != tt.expected {
+			t.Errorf("Unexpected result for quota %+v from %+v to %+v (%d)."+
+				"\nexpected: %t\nreceived: %t",
+				tt.quota, tt.old, tt.new, i, tt.expected, allowed)
+		}
+	}
+}
+
+// Tests that Quota.excessVersionBytes returns the number of bytes over the byte
+// quota, limited to the size of the previous versions.
+func TestQuota_excessVersionBytes(t *testing.T) {
+	tests := []struct {
+		quota    Quota
+		usage    Usage
+		expected int64
+	}{
+		{Quota{}, Usage{1 << 40, 1, 1 << 40}, 0},
+		{Quota{100, 0}, Usage{60, 1, 40}, 0},
+		{Quota{100, 0}, Usage{60, 1, 50}, 10},
+		{Quota{100, 0}, Usage{120, 1, 50}, 50},
+		{Quota{100, 0}, Usage{120, 1, 0}, 0},
+	}
+
+	for i, tt := range tests {
+		excess := tt.quota.excessVersionBytes(tt.usage)
+		if excess != tt.expected {
+			t.Errorf("Unexpected excess for quota %+v and usage %+v (%d)."+
+				"\nexpected: %d\nreceived: %d",
+				tt.quota, tt.usage, i, tt.expected, excess)
+		}
+	}
+}
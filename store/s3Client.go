@@ -0,0 +1,179 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/pkg/errors"
+)
+
+// s3MaxDeleteKeys is the maximum number of keys that can be deleted in a single
+// DeleteObjects request.
+const s3MaxDeleteKeys = 1000
+
+// s3Client is an objectClient for a bucket in an S3-compatible object store.
+type s3Client struct {
+	client *s3.Client
+	bucket string
+}
+
+// newS3Client returns an s3Client for the bucket in the params.
+func newS3Client(params S3Params) *s3Client {
+	opts := s3.Options{
+		Region:       params.Region,
+		Credentials:  aws.AnonymousCredentials{},
+		UsePathStyle: params.UsePathStyle,
+	}
+	if opts.Region == "" {
+		opts.Region = s3DefaultRegion
+	}
+	if params.AccessKeyID != "" || params.SecretAccessKey != "" {
+		creds := aws.Credentials{
+			AccessKeyID:     params.AccessKeyID,
+			SecretAccessKey: params.SecretAccessKey,
+			Source:          "remoteSyncServer",
+		}
+		opts.Credentials = aws.CredentialsProviderFunc(
+			func(context.Context) (aws.Credentials, error) { return creds, nil })
+	}
+	if params.Endpoint != "" {
+		opts.EndpointResolver = s3.EndpointResolverFromURL(params.Endpoint)
+	}
+
+	return &s3Client{client: s3.New(opts), bucket: params.Bucket}
+}
+
+// get returns the contents and information of the object with the key.
+func (c *s3Client) get(key string) ([]byte, objectInfo, error) {
+	out, err := c.client.GetObject(context.Background(),
+		&s3.GetObjectInput{Bucket: &c.bucket, Key: &key})
+	if err != nil {
+		return nil, objectInfo{}, s3Error(err, key)
+	}
+	defer func() { _ = out.Body.Close() }()
+
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, objectInfo{}, errors.Wrapf(err, "failed to read object %s", key)
+	}
+	return data, objectInfo{
+		Key:      key,
+		Size:     out.ContentLength,
+		Modified: aws.ToTime(out.LastModified),
+		Metadata: out.Metadata,
+	}, nil
+}
+
+// head returns the information of the object with the key.
+func (c *s3Client) head(key string) (objectInfo, error) {
+	out, err := c.client.HeadObject(context.Background(),
+		&s3.HeadObjectInput{Bucket: &c.bucket, Key: &key})
+	if err != nil {
+		return objectInfo{}, s3Error(err, key)
+	}
+	return objectInfo{
+		Key:      key,
+		Size:     out.ContentLength,
+		Modified: aws.ToTime(out.LastModified),
+		Metadata: out.Metadata,
+	}, nil
+}
+
+// put creates or replaces the object with the key.
+func (c *s3Client) put(key string, data []byte, metadata map[string]string) error {
+	_, err := c.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:   &c.bucket,
+		Key:      &key,
+		Body:     bytes.NewReader(data),
+		Metadata: metadata,
+	})
+	if err != nil {
+		return s3Error(err, key)
+	}
+	return nil
+}
+
+// delete deletes the objects with the keys in batches of s3MaxDeleteKeys.
+func (c *s3Client) delete(keys ...string) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > s3MaxDeleteKeys {
+			n = s3MaxDeleteKeys
+		}
+		objects := make([]types.ObjectIdentifier, n)
+		for i := range objects {
+			objects[i].Key = aws.String(keys[i])
+		}
+
+		out, err := c.client.DeleteObjects(context.Background(),
+			&s3.DeleteObjectsInput{
+				Bucket: &c.bucket,
+				Delete: &types.Delete{Objects: objects, Quiet: true},
+			})
+		if err != nil {
+			return errors.Wrapf(err, "failed to delete %d objects", n)
+		} else if len(out.Errors) > 0 {
+			e := out.Errors[0]
+			return errors.Errorf("failed to delete %d of %d objects: %s: %s",
+				len(out.Errors), n, aws.ToString(e.Key), aws.ToString(e.Message))
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// list returns the objects with keys that start with the prefix, following
+// every page of the listing.
+func (c *s3Client) list(prefix string, delimited bool) (
+	objects []objectInfo, commonPrefixes []string, err error) {
+	input := &s3.ListObjectsV2Input{Bucket: &c.bucket, Prefix: &prefix}
+	if delimited {
+		input.Delimiter = aws.String("/")
+	}
+
+	objects, commonPrefixes = make([]objectInfo, 0), make([]string, 0)
+	pages := s3.NewListObjectsV2Paginator(c.client, input)
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(context.Background())
+		if err != nil {
+			return nil, nil, errors.Wrapf(
+				err, "failed to list objects with prefix %s", prefix)
+		}
+		for _, o := range page.Contents {
+			objects = append(objects, objectInfo{
+				Key:      aws.ToString(o.Key),
+				Size:     o.Size,
+				Modified: aws.ToTime(o.LastModified),
+			})
+		}
+		for _, p := range page.CommonPrefixes {
+			commonPrefixes = append(commonPrefixes, aws.ToString(p.Prefix))
+		}
+	}
+	return objects, commonPrefixes, nil
+}
+
+// s3Error returns an error that matches os.ErrNotExist if the error is returned
+// for an object that does not exist. Otherwise, the error is wrapped.
+func s3Error(err error, key string) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NoSuchKey", "NotFound":
+			return notExistErr(key)
+		}
+	}
+	return errors.Wrapf(err, "request for object %s failed", key)
+}
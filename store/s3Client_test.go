@@ -0,0 +1,250 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package store
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Tests that s3Client adheres to the objectClient interface.
+var _ objectClient = (*s3Client)(nil)
+
+// Tests that an S3Store connected to an S3 API server passes the store
+// conformance tests.
+func Test_s3Client_Conformance(t *testing.T) {
+	params := newTestS3Server("bucket", t)
+	RunConformanceTests(t, func(storageDir, baseDir string) (Store, error) {
+		// Each store uses a new prefix so that the tests do not share files
+		p := params
+		p.Prefix = storageDir
+		newStore, err := NewS3Store(p)
+		if err != nil {
+			return nil, err
+		}
+		return newStore(storageDir, baseDir)
+	})
+}
+
+// Tests that s3Client.put stores the data and metadata of an object that are
+// returned by s3Client.get and s3Client.head.
+func Test_s3Client_put_get(t *testing.T) {
+	c := newS3Client(newTestS3Server("bucket", t))
+	data, metadata := []byte("data"), map[string]string{"key": "value"}
+	if err := c.put("dir/file name", data, metadata); err != nil {
+		t.Fatalf("Failed to put: %+v", err)
+	}
+
+	received, info, err := c.get("dir/file name")
+	if err != nil {
+		t.Fatalf("Failed to get: %+v", err)
+	} else if string(data) != string(received) {
+		t.Errorf("Unexpected data.\nexpected: %q\nreceived: %q", data, received)
+	} else if !reflect.DeepEqual(metadata, info.Metadata) {
+		t.Errorf("Unexpected metadata.\nexpected: %v\nreceived: %v",
+			metadata, info.Metadata)
+	}
+
+	headInfo, err := c.head("dir/file name")
+	if err != nil {
+		t.Fatalf("Failed to head: %+v", err)
+	} else if !reflect.DeepEqual(info, headInfo) {
+		t.Errorf("Unexpected info.\nexpected: %+v\nreceived: %+v", info, headInfo)
+	}
+}
+
+// Error path: Tests that s3Client.get and s3Client.head return an error
+// matching os.ErrNotExist for an object that does not exist.
+func Test_s3Client_NotExistError(t *testing.T) {
+	c := newS3Client(newTestS3Server("bucket", t))
+	if _, _, err := c.get("missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error from get.\nexpected: %v\nreceived: %+v",
+			os.ErrNotExist, err)
+	}
+	if _, err := c.head("missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error from head.\nexpected: %v\nreceived: %+v",
+			os.ErrNotExist, err)
+	}
+}
+
+// Tests that s3Client.list returns all objects and common prefixes and that
+// s3Client.delete deletes objects.
+func Test_s3Client_list_delete(t *testing.T) {
+	c := newS3Client(newTestS3Server("bucket", t))
+	for _, key := range []string{"p/a", "p/b/c", "p/b/d", "q/e"} {
+		if err := c.put(key, []byte(key), nil); err != nil {
+			t.Fatalf("Failed to put %s: %+v", key, err)
+		}
+	}
+
+	objects, prefixes, err := c.list("p/", true)
+	if err != nil {
+		t.Fatalf("Failed to list: %+v", err)
+	} else if len(objects) != 1 || objects[0].Key != "p/a" || objects[0].Size != 3 {
+		t.Errorf("Unexpected objects: %+v", objects)
+	} else if !reflect.DeepEqual([]string{"p/b/"}, prefixes) {
+		t.Errorf("Unexpected prefixes: %q", prefixes)
+	}
+
+	if err = c.delete("p/a", "p/b/c", "missing"); err != nil {
+		t.Fatalf("Failed to delete: %+v", err)
+	}
+	objects, _, err = c.list("", false)
+	if err != nil {
+		t.Fatalf("Failed to list: %+v", err)
+	}
+	keys := make([]string, len(objects))
+	for i, o := range objects {
+		keys[i] = o.Key
+	}
+	if expected := []string{"p/b/d", "q/e"}; !reflect.DeepEqual(expected, keys) {
+		t.Errorf("Unexpected keys after delete."+
+			"\nexpected: %q\nreceived: %q", expected, keys)
+	}
+}
+
+// newTestS3Server starts an HTTP server that implements the subset of the S3
+// API used by s3Client for a single bucket and returns the params to connect to
+// it. Like S3, it keeps modification times in whole seconds.
+func newTestS3Server(bucket string, t testing.TB) S3Params {
+	objects := newMemObjectClient()
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			path := strings.TrimPrefix(r.URL.Path, "/")
+			if path != bucket && !strings.HasPrefix(path, bucket+"/") {
+				http.Error(w, "no such bucket", http.StatusNotFound)
+				return
+			}
+			key := strings.TrimPrefix(strings.TrimPrefix(path, bucket), "/")
+
+			switch {
+			case key == "" && r.Method == http.MethodGet:
+				serveTestS3List(w, r, objects)
+			case key == "" && r.Method == http.MethodPost:
+				serveTestS3Delete(w, r, objects)
+			case r.Method == http.MethodPut:
+				data, err := io.ReadAll(r.Body)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				metadata := make(map[string]string)
+				for name := range r.Header {
+					if strings.HasPrefix(name, "X-Amz-Meta-") {
+						metadata[strings.ToLower(strings.TrimPrefix(
+							name, "X-Amz-Meta-"))] = r.Header.Get(name)
+					}
+				}
+				_ = objects.put(key, data, metadata)
+				objects.mux.Lock()
+				o := objects.objects[key]
+				o.modified = o.modified.Truncate(time.Second)
+				objects.objects[key] = o
+				objects.mux.Unlock()
+			case r.Method == http.MethodGet || r.Method == http.MethodHead:
+				data, info, err := objects.get(key)
+				if err != nil {
+					w.WriteHeader(http.StatusNotFound)
+					if r.Method == http.MethodGet {
+						_, _ = w.Write([]byte("<Error><Code>NoSuchKey</Code>" +
+							"<Message>The specified key does not exist." +
+							"</Message></Error>"))
+					}
+					return
+				}
+				for k, v := range info.Metadata {
+					w.Header().Set("X-Amz-Meta-"+k, v)
+				}
+				w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+				w.Header().Set("Last-Modified",
+					info.Modified.UTC().Format(http.TimeFormat))
+				if r.Method == http.MethodGet {
+					_, _ = w.Write(data)
+				}
+			default:
+				http.Error(w, "unsupported request", http.StatusNotImplemented)
+			}
+		}))
+	t.Cleanup(srv.Close)
+
+	return S3Params{
+		Bucket:          bucket,
+		Endpoint:        srv.URL,
+		AccessKeyID:     "accessKeyID",
+		SecretAccessKey: "secretAccessKey",
+		UsePathStyle:    true,
+	}
+}
+
+// testS3ListResult is the response to a ListObjectsV2 request.
+type testS3ListResult struct {
+	XMLName        xml.Name `xml:"ListBucketResult"`
+	Prefix         string
+	KeyCount       int
+	IsTruncated    bool
+	Contents       []testS3Object
+	CommonPrefixes []testS3Prefix
+}
+
+type testS3Object struct {
+	Key          string
+	LastModified string
+	Size         int64
+}
+
+type testS3Prefix struct {
+	Prefix string
+}
+
+// serveTestS3List responds to a ListObjectsV2 request with all matching
+// objects in a single page.
+func serveTestS3List(
+	w http.ResponseWriter, r *http.Request, objects *memObjectClient) {
+	prefix := r.URL.Query().Get("prefix")
+	list, prefixes, _ := objects.list(
+		prefix, r.URL.Query().Get("delimiter") == "/")
+
+	result := testS3ListResult{Prefix: prefix, KeyCount: len(list)}
+	for _, o := range list {
+		result.Contents = append(result.Contents, testS3Object{
+			Key:          o.Key,
+			LastModified: o.Modified.UTC().Format("2006-01-02T15:04:05.000Z"),
+			Size:         o.Size,
+		})
+	}
+	for _, p := range prefixes {
+		result.CommonPrefixes = append(result.CommonPrefixes, testS3Prefix{p})
+	}
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+// serveTestS3Delete responds to a DeleteObjects request.
+func serveTestS3Delete(
+	w http.ResponseWriter, r *http.Request, objects *memObjectClient) {
+	var request struct {
+		Objects []struct{ Key string } `xml:"Object"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, o := range request.Objects {
+		_ = objects.delete(o.Key)
+	}
+	_, _ = w.Write([]byte("<DeleteResult></DeleteResult>"))
+}
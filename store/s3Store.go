@@ -0,0 +1,1199 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package store
+
+import (
+	"encoding/hex"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+
+	"gitlab.com/xx_network/primitives/netTime"
+)
+
+// s3JournalMaxEntries is the number of changes kept in the journal of an
+// S3Store after it is compacted. It is smaller than journalMaxEntries because
+// objects cannot be appended to, so the entire journal is rewritten on every
+// modification.
+const s3JournalMaxEntries = 1_000
+
+// s3HashMetadata is the user metadata key of each object that holds the
+// content hash of the file, as returned by ContentHash, encoded in hexadecimal.
+const s3HashMetadata = "sha256"
+
+// s3DefaultRegion is the region used when none is configured. Most
+// S3-compatible object stores accept it.
+const s3DefaultRegion = "us-east-1"
+
+// S3Params configures the connection of an S3Store to an S3-compatible object
+// store.
+type S3Params struct {
+	// Bucket is the name of the bucket that holds the files. It must already
+	// exist.
+	Bucket string
+
+	// Prefix is prepended to the keys of all objects. The files of each user
+	// are stored under the key Prefix/<base directory>/.
+	Prefix string
+
+	// Endpoint is the URL of the object store. If it is empty, then the AWS
+	// endpoint for the region is used.
+	Endpoint string
+
+	// Region is the region of the bucket. Defaults to us-east-1.
+	Region string
+
+	// AccessKeyID and SecretAccessKey are the credentials used to sign
+	// requests. If they are empty, then requests are sent anonymously.
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// UsePathStyle puts the bucket name in the path of the URL instead of the
+	// host name. Most self-hosted object stores, such as MinIO, require it.
+	UsePathStyle bool
+}
+
+// S3Store manages the storage of a base directory in an S3-compatible object
+// store. Adheres to the Store interface.
+//
+// Each file is an object whose key is the path of the file prefixed by the key
+// prefix of the base directory. Directories are not stored; like the keys they
+// are emulated from, a directory exists while it contains at least one file,
+// with the exception of the base directory, which always exists. Internal
+// files, such as the journal and previous versions, are stored under reserved
+// names in the base directory.
+//
+// The store assumes that it is the only writer of its base directory. WriteIf
+// is only atomic with respect to other modifications made through the same
+// S3Store.
+type S3Store struct {
+	client objectClient
+
+	// prefix is the key prefix of all objects in the base directory. It is
+	// empty or ends in a slash.
+	prefix string
+
+	// lastWrite is the time of the most recent Write, Delete, or DeleteDir. It
+	// is recovered from the journal when the store is opened.
+	lastWrite time.Time
+
+	// quota is the limit on the storage used. usage is the current storage
+	// used by the files and versionBytes is the size of their previous
+	// versions; both are calculated when the store is opened and kept up to
+	// date on every modification.
+	quota        Quota
+	usage        Usage
+	versionBytes int64
+
+	// retention determines which previous versions of files are kept.
+	retention RetentionPolicy
+
+	// hashes is a map of file paths to their content hash that avoids
+	// requesting the hash of unchanged files when generating a manifest.
+	hashes map[string]cachedHash
+
+	// journal is the list of recent modifications. It is persisted to the
+	// journalFile object in the base directory. unsavedJournal is true if the
+	// last attempt to save it failed.
+	journal        *journal
+	unsavedJournal bool
+
+	// closed is true once Close has been called. inProgress tracks the
+	// modifications that Close must wait on.
+	closed     bool
+	inProgress sync.WaitGroup
+
+	mux sync.Mutex
+}
+
+// objectClient is the subset of operations of an S3-compatible object store
+// used by an S3Store. Operations on objects that do not exist return an error
+// that matches os.ErrNotExist.
+type objectClient interface {
+	// get returns the contents and information of the object with the key.
+	get(key string) ([]byte, objectInfo, error)
+
+	// head returns the information of the object with the key.
+	head(key string) (objectInfo, error)
+
+	// put creates or replaces the object with the key.
+	put(key string, data []byte, metadata map[string]string) error
+
+	// delete deletes the objects with the keys. Keys that do not exist are
+	// ignored.
+	delete(keys ...string) error
+
+	// list returns the objects with keys that start with the prefix, sorted by
+	// key. If delimited is true, then keys that contain a slash after the
+	// prefix are grouped into a common prefix ending at that slash instead of
+	// being returned.
+	list(prefix string, delimited bool) (
+		objects []objectInfo, commonPrefixes []string, err error)
+}
+
+// objectInfo describes an object in an object store.
+type objectInfo struct {
+	Key      string
+	Size     int64
+	Modified time.Time
+
+	// Metadata is the user metadata of the object. It is not set on objects
+	// returned by objectClient.list.
+	Metadata map[string]string
+}
+
+// NewS3Store returns a NewStore that creates an S3Store in the configured
+// bucket for each base directory. The storage directory passed to the
+// NewStore is not used; the base directory is stored under the key prefix
+// in the params instead.
+func NewS3Store(params S3Params) (NewStore, error) {
+	if params.Bucket == "" {
+		return nil, errors.New("no S3 bucket specified")
+	}
+	return newS3StoreConstructor(newS3Client(params), params.Prefix), nil
+}
+
+// ListS3BaseDirs returns the names of the base directories that have been
+// created under the key prefix in the configured bucket, sorted by name.
+func ListS3BaseDirs(params S3Params) ([]string, error) {
+	if params.Bucket == "" {
+		return nil, errors.New("no S3 bucket specified")
+	}
+	return listS3BaseDirs(newS3Client(params), params.Prefix)
+}
+
+// listS3BaseDirs returns the names of the base directories under the key prefix
+// using the client.
+func listS3BaseDirs(client objectClient, keyPrefix string) ([]string, error) {
+	prefix := strings.Trim(keyPrefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	_, commonPrefixes, err := client.list(prefix, true)
+	if err != nil {
+		return nil, err
+	}
+
+	baseDirs := make([]string, len(commonPrefixes))
+	for i, p := range commonPrefixes {
+		baseDirs[i] = strings.TrimSuffix(strings.TrimPrefix(p, prefix), "/")
+	}
+	sort.Strings(baseDirs)
+	return baseDirs, nil
+}
+
+// newS3StoreConstructor returns a NewStore that creates an S3Store for each
+// base directory under the key prefix using the client.
+func newS3StoreConstructor(client objectClient, keyPrefix string) NewStore {
+	return func(_, baseDir string) (Store, error) {
+		baseDir, err := readyPath(".", baseDir)
+		if err != nil {
+			return nil, err
+		}
+
+		prefix := path.Join(strings.Trim(keyPrefix, "/"), filepath.ToSlash(baseDir))
+		if prefix == "." {
+			prefix = ""
+		} else {
+			prefix += "/"
+		}
+
+		s := &S3Store{
+			client:  client,
+			prefix:  prefix,
+			hashes:  make(map[string]cachedHash),
+			journal: newJournal(s3JournalMaxEntries),
+		}
+		if err = s.init(); err != nil {
+			return nil, errors.Wrapf(
+				err, "failed to open base directory with key prefix %q", prefix)
+		}
+		return s, nil
+	}
+}
+
+// init calculates the usage and loads the journal and last write. If the
+// journal does not exist, then the last write is the modification time of the
+// most recently modified file and the new journal is saved with its first
+// change.
+func (s *S3Store) init() error {
+	objects, _, err := s.client.list(s.prefix, false)
+	if err != nil {
+		return errors.Wrap(err, "failed to list objects")
+	}
+	var newest time.Time
+	versionsPrefix := s.key(versionsDir + "/")
+	for _, o := range objects {
+		if strings.HasPrefix(o.Key, versionsPrefix) {
+			s.versionBytes += o.Size
+			continue
+		} else if _, isFile := s.relPath(o.Key); !isFile {
+			continue
+		}
+		s.usage.Files++
+		s.usage.Bytes += o.Size
+		if o.Modified.After(newest) {
+			newest = o.Modified
+		}
+	}
+
+	data, _, err := s.client.get(s.key(journalFile))
+	if errors.Is(err, os.ErrNotExist) {
+		s.lastWrite = newest
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "failed to read journal")
+	}
+
+	var intact bool
+	s.journal, intact, err = parseJournal(
+		data, s.key(journalFile), s3JournalMaxEntries)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse journal")
+	} else if n := len(s.journal.changes); n > 0 {
+		s.lastWrite = s.journal.changes[n-1].Time
+	}
+
+	// Rewrite the journal if lines were skipped or it was given a new ID so
+	// that the ID persists
+	if !intact {
+		if err = s.saveJournal(); err != nil {
+			jww.WARN.Printf("Failed to save repaired journal of %s; it will be "+
+				"saved with the next change: %+v", s.prefix, err)
+		}
+	}
+	return nil
+}
+
+// Read reads from the provided file path and returns the data in the file at
+// that path.
+//
+// An error is returned if it fails to read the file. Returns [NonLocalFileErr]
+// if the file is outside the base path and [os.ErrNotExist] if the file does
+// not exist.
+func (s *S3Store) Read(path string) ([]byte, error) {
+	path, err := s.readyPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, _, err := s.client.get(s.key(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, s.fileNotFound(path)
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return data, nil
+}
+
+// Write writes the provided data to the file path. The write is atomic; if it
+// is interrupted, the file retains its previous contents.
+//
+// An error is returned if the write fails. Returns [NonLocalFileErr] if the
+// file is outside the base path, [QuotaExceededErr] if the write would exceed
+// the quota, and [ClosedErr] if the store is closed.
+func (s *S3Store) Write(path string, data []byte) error {
+	return s.write(path, data, Precondition{})
+}
+
+// WriteIf writes the provided data to the file path only if the file matches
+// the precondition. The check and write are atomic with respect to other
+// modifications made through this store.
+//
+// Returns a *[ConflictError], which matches [ConflictErr], if the file does not
+// match the precondition. Otherwise, returns the same errors as Write.
+func (s *S3Store) WriteIf(path string, data []byte, cond Precondition) error {
+	return s.write(path, data, cond)
+}
+
+// write writes the data to the file path if it matches the precondition.
+func (s *S3Store) write(relPath string, data []byte, cond Precondition) error {
+	path, err := s.readyPath(relPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = s.startModification(); err != nil {
+		return err
+	}
+	defer s.inProgress.Done()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	// The contents are only needed to check the precondition and keep the
+	// previous version
+	needData := !cond.isEmpty() || s.retention.enabled()
+	current, info, exists, err := s.stat(path, needData)
+	if err != nil {
+		return err
+	} else if !exists {
+		if isDir, err := s.isDir(path); err != nil {
+			return err
+		} else if isDir {
+			return errors.Errorf("cannot write to directory %s", path)
+		} else if err = s.checkParents(path); err != nil {
+			return err
+		}
+	}
+
+	newUsage := s.usage
+	newUsage.Bytes += int64(len(data)) - info.Size
+	if !exists {
+		newUsage.Files++
+	}
+
+	if !cond.isEmpty() {
+		if err = cond.check(relPath, exists, info.Modified, current); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if !s.quota.allows(s.usage, newUsage) {
+		return errors.WithStack(QuotaExceededErr)
+	}
+
+	if exists {
+		if err = s.saveVersion(path, current, info.Modified); err != nil {
+			return errors.Wrap(err, "failed to save previous version")
+		}
+	}
+
+	hash := ContentHash(data)
+	err = s.client.put(s.key(path), data,
+		map[string]string{s3HashMetadata: hex.EncodeToString(hash)})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	s.usage = newUsage
+	if err = s.evictVersions(); err != nil {
+		jww.WARN.Printf("Failed to remove previous versions to keep %s "+
+			"within its quota: %+v", s.prefix, err)
+	}
+
+	// The modification time is set by the object store. The write has already
+	// succeeded, so if it cannot be read, the current time is recorded instead.
+	modified := netTime.Now()
+	info, err = s.client.head(s.key(path))
+	if err != nil {
+		jww.WARN.Printf("Failed to get modification time of written file "+
+			"%s: %+v", path, err)
+		delete(s.hashes, path)
+	} else {
+		modified = info.Modified
+		s.hashes[path] = cachedHash{info.Size, info.Modified, hash}
+	}
+
+	s.recordChange(ChangeWrite, path, modified)
+	return nil
+}
+
+// GetLastModified returns the last modification time for the file at the given
+// file. The modification time of a directory is that of the most recently
+// modified file it contains.
+//
+// Returns [NonLocalFileErr] if the file is outside the base path and
+// [os.ErrNotExist] if the file does not exist.
+func (s *S3Store) GetLastModified(path string) (time.Time, error) {
+	path, err := s.readyPath(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	info, err := s.client.head(s.key(path))
+	if err == nil && path != "" {
+		return info.Modified, nil
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return time.Time{}, errors.WithStack(err)
+	}
+
+	objects, _, err := s.client.list(s.key(dirPrefix(path)), false)
+	if err != nil {
+		return time.Time{}, errors.WithStack(err)
+	}
+	var modified time.Time
+	var found bool
+	for _, o := range objects {
+		if _, isFile := s.relPath(o.Key); isFile {
+			found = true
+			if o.Modified.After(modified) {
+				modified = o.Modified
+			}
+		}
+	}
+	if !found && path != "" {
+		return time.Time{}, notExistErr(path)
+	}
+	return modified, nil
+}
+
+// GetLastWrite returns the time of the most recent successful Write or Delete
+// operation that was performed. The time persists when the store is reopened.
+//
+// Returns [os.ErrNotExist] if no files have ever been written.
+func (s *S3Store) GetLastWrite() (time.Time, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.lastWrite.IsZero() {
+		return time.Time{}, errors.Wrap(os.ErrNotExist, "no files written")
+	}
+	return s.lastWrite, nil
+}
+
+// ReadDir reads the named directory, returning all its directory entries
+// sorted by filename.
+//
+// Returns [NonLocalFileErr] if the file is outside the base path and
+// [os.ErrNotExist] if the directory does not exist.
+func (s *S3Store) ReadDir(path string) ([]string, error) {
+	entries, err := s.ReadDirEntries(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := make([]string, 0)
+	for _, entry := range entries {
+		if entry.IsDir {
+			dirs = append(dirs, entry.Name)
+		}
+	}
+	return dirs, nil
+}
+
+// ReadDirEntries reads the named directory, returning all the files and
+// directories it contains sorted by name. Directories are the common prefixes
+// of the keys in the directory delimited by a slash.
+//
+// Returns [NonLocalFileErr] if the directory is outside the base path and
+// [os.ErrNotExist] if it does not exist.
+func (s *S3Store) ReadDirEntries(path string) ([]DirEntry, error) {
+	path, err := s.readyPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := s.readDir(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	} else if len(list) == 0 && path != "" {
+		return nil, s.dirNotFound(path)
+	}
+
+	sortDirEntries(list)
+	return list, nil
+}
+
+// readDir returns the files and directories in the directory in no particular
+// order, excluding internal files and directories.
+func (s *S3Store) readDir(path string) ([]DirEntry, error) {
+	prefix := s.key(dirPrefix(path))
+	objects, prefixes, err := s.client.list(prefix, true)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]DirEntry, 0, len(objects)+len(prefixes))
+	for _, o := range objects {
+		// Skip internal files and the empty objects that some tools create to
+		// mark directories
+		name := strings.TrimPrefix(o.Key, prefix)
+		if name != "" && !strings.HasPrefix(name, internalFilePrefix) {
+			list = append(list,
+				DirEntry{Name: name, Size: o.Size, Modified: o.Modified})
+		}
+	}
+	for _, p := range prefixes {
+		name := strings.TrimSuffix(strings.TrimPrefix(p, prefix), "/")
+		if name != "" && !strings.HasPrefix(name, internalFilePrefix) {
+			list = append(list, DirEntry{Name: name, IsDir: true})
+		}
+	}
+	return list, nil
+}
+
+// Manifest returns every file in the named directory and its subdirectories
+// with its size, modification time, and content hash, sorted by path. If since
+// is not zero, only files modified at or after since are returned. If the path
+// is a file, then only that file is returned.
+//
+// Returns [NonLocalFileErr] if the directory is outside the base path and
+// [os.ErrNotExist] if it does not exist.
+func (s *S3Store) Manifest(
+	path string, since time.Time) ([]ManifestEntry, error) {
+	path, err := s.readyPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	objects, _, err := s.client.list(s.key(dirPrefix(path)), false)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if path != "" {
+		info, err := s.client.head(s.key(path))
+		if err == nil {
+			objects = append(objects, info)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	entries := make([]ManifestEntry, 0, len(objects))
+	var found bool
+	for _, o := range objects {
+		rel, isFile := s.relPath(o.Key)
+		if !isFile {
+			continue
+		}
+		found = true
+		if !includeInManifest(o.Modified, since) {
+			continue
+		}
+
+		hash, err := s.hash(rel, o)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to hash %s", rel)
+		}
+		entries = append(entries, ManifestEntry{
+			Path:     filepath.FromSlash(rel),
+			Size:     o.Size,
+			Modified: o.Modified,
+			Hash:     hash,
+		})
+	}
+	if !found && path != "" {
+		return nil, notExistErr(path)
+	}
+
+	sortManifest(entries)
+	return entries, nil
+}
+
+// hash returns the content hash of the file at the path described by the
+// object info. The hash is read from the object's metadata, or calculated from
+// its contents if the metadata does not have it, and cached until the file
+// changes.
+func (s *S3Store) hash(path string, info objectInfo) ([]byte, error) {
+	s.mux.Lock()
+	cached, ok := s.hashes[path]
+	s.mux.Unlock()
+	if ok && cached.size == info.Size && cached.modified.Equal(info.Modified) {
+		return cached.hash, nil
+	}
+
+	if info.Metadata == nil {
+		var err error
+		if info, err = s.client.head(info.Key); err != nil {
+			return nil, err
+		}
+	}
+	hash, err := hex.DecodeString(info.Metadata[s3HashMetadata])
+	if err != nil || len(hash) == 0 {
+		// Objects not written by an S3Store have no hash
+		data, _, err := s.client.get(info.Key)
+		if err != nil {
+			return nil, err
+		}
+		hash = ContentHash(data)
+	}
+
+	s.mux.Lock()
+	s.hashes[path] = cachedHash{info.Size, info.Modified, hash}
+	s.mux.Unlock()
+	return hash, nil
+}
+
+// Delete deletes the file at the given path.
+//
+// An error is returned if the file does not exist or is a directory. Returns
+// [NonLocalFileErr] if the file is outside the base path and [ClosedErr] if the
+// store is closed.
+func (s *S3Store) Delete(path string) error {
+	path, err := s.readyPath(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = s.startModification(); err != nil {
+		return err
+	}
+	defer s.inProgress.Done()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	data, info, exists, err := s.stat(path, s.retention.enabled())
+	if err != nil {
+		return err
+	} else if !exists {
+		if isDir, err := s.isDir(path); err != nil {
+			return err
+		} else if isDir {
+			return errors.Errorf("cannot delete directory %s as a file", path)
+		}
+		return notExistErr(path)
+	}
+
+	if err = s.saveVersion(path, data, info.Modified); err != nil {
+		return errors.Wrap(err, "failed to save previous version")
+	}
+
+	if err = s.client.delete(s.key(path)); err != nil {
+		return errors.WithStack(err)
+	}
+	delete(s.hashes, path)
+	s.usage.Bytes -= info.Size
+	s.usage.Files--
+
+	s.recordChange(ChangeDelete, path, netTime.Now())
+	return nil
+}
+
+// DeleteDir deletes the named directory and everything it contains, including
+// the previous versions of the files in it. If the path is the base directory,
+// then all of its contents are deleted.
+//
+// An error is returned if the directory does not exist. Returns
+// [NonLocalFileErr] if the directory is outside the base path and [ClosedErr]
+// if the store is closed.
+func (s *S3Store) DeleteDir(path string) error {
+	path, err := s.readyPath(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = s.startModification(); err != nil {
+		return err
+	}
+	defer s.inProgress.Done()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if isDir, err := s.isDir(path); err != nil {
+		return err
+	} else if !isDir {
+		return s.dirNotFound(path)
+	}
+
+	objects, _, err := s.client.list(s.key(dirPrefix(path)), false)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	versions, _, err := s.client.list(
+		s.key(versionsDir+"/"+dirPrefix(path)), false)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var deleted Usage
+	keys := make([]string, 0, len(objects)+len(versions))
+	for _, o := range objects {
+		rel, isFile := s.relPath(o.Key)
+		if isFile {
+			deleted.Files++
+			deleted.Bytes += o.Size
+			delete(s.hashes, rel)
+		}
+		if !strings.HasPrefix(rel, internalFilePrefix) {
+			keys = append(keys, o.Key)
+		}
+	}
+	for _, v := range versions {
+		keys = append(keys, v.Key)
+		deleted.VersionBytes += v.Size
+	}
+
+	if err = s.client.delete(keys...); err != nil {
+		// Some objects may have been deleted, so the usage is recalculated
+		// when the store is next opened
+		return errors.WithStack(err)
+	}
+	s.usage.Bytes -= deleted.Bytes
+	s.usage.Files -= deleted.Files
+	s.versionBytes -= deleted.VersionBytes
+
+	s.recordChange(ChangeDeleteDir, path, netTime.Now())
+	return nil
+}
+
+// recordChange records the change as the last write and in the journal and
+// saves the journal. It is called once the modification has succeeded, since
+// the time of a write is only known afterwards, so a failure to save the
+// journal is only logged. The change is kept in the in-memory journal, and
+// since the whole journal is saved each time, it is saved with the next change
+// or when the store is closed. Must be called with s.mux held.
+func (s *S3Store) recordChange(changeType ChangeType, path string, t time.Time) {
+	s.lastWrite = t
+	c := s.journal.add(changeType, filepath.FromSlash(path), t)
+	s.journal.compact()
+
+	if err := s.saveJournal(); err != nil {
+		jww.WARN.Printf("Failed to save change %d to journal of %s; it will "+
+			"be saved with the next change: %+v", c.Seq, s.prefix, err)
+	}
+}
+
+// saveJournal replaces the journal object with the contents of the journal.
+// unsavedJournal is set until it succeeds. Must be called with s.mux held.
+func (s *S3Store) saveJournal() error {
+	data, err := s.journal.marshal()
+	if err == nil {
+		err = s.client.put(s.key(journalFile), data, nil)
+	}
+	s.unsavedJournal = err != nil
+	return err
+}
+
+// GetChanges returns the ID of the journal and all changes in it with a
+// sequence number greater than after, in order. Passing zero returns all
+// changes. The journal and its ID persist when the store is reopened.
+//
+// Returns [JournalCompactedErr] if any of the requested changes have been
+// removed from the journal, if after is past the last change, or if after is
+// not zero and journalID is not the ID of the journal.
+func (s *S3Store) GetChanges(
+	journalID string, after uint64) (string, []Change, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	changes, err := s.journal.since(journalID, after)
+	return s.journal.id, changes, err
+}
+
+// SetQuota sets the limits on the storage used by the store. Existing files are
+// kept even if they exceed the new quota.
+func (s *S3Store) SetQuota(quota Quota) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.quota = quota
+}
+
+// GetUsage returns the storage currently used by the store.
+func (s *S3Store) GetUsage() Usage {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.getUsage()
+}
+
+// getUsage returns the storage used by the files and their previous versions.
+// Must be called with s.mux held.
+func (s *S3Store) getUsage() Usage {
+	u := s.usage
+	u.VersionBytes = s.versionBytes
+	return u
+}
+
+// SetRetention sets the policy that determines which previous versions of each
+// file are kept when it is overwritten or deleted. Versions no longer retained
+// under a new policy are removed the next time their file is modified.
+func (s *S3Store) SetRetention(policy RetentionPolicy) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.retention = policy
+}
+
+// ListVersions returns the previous versions of the file at the given path that
+// are retained, sorted from newest to oldest. The current contents of the file
+// are not included.
+//
+// Returns [NonLocalFileErr] if the file is outside the base path.
+func (s *S3Store) ListVersions(path string) ([]Version, error) {
+	path, err := s.readyPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := s.listVersions(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	versions, _ = s.retention.apply(versions, netTime.Now())
+	return versions, nil
+}
+
+// ReadVersion returns the contents of the previous version of the file at the
+// given path with the given ID.
+//
+// Returns [NonLocalFileErr] if the file is outside the base path and
+// [VersionNotFoundErr] if the version does not exist.
+func (s *S3Store) ReadVersion(path string, id int64) ([]byte, error) {
+	path, err := s.readyPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := s.listVersions(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, v := range versions {
+		if v.ID == id {
+			data, _, err := s.client.get(s.versionKey(path, v))
+			if errors.Is(err, os.ErrNotExist) {
+				break
+			} else if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			return data, nil
+		}
+	}
+	return nil, errors.WithStack(VersionNotFoundErr)
+}
+
+// Rewrite replaces the contents of every file and every retained previous
+// version with the data returned by rewrite. Implements [Rewriter].
+//
+// Previous versions keep their modification time, which is part of their key.
+// The modification time of a file is set by the object store, however, so each
+// rewritten file has the time it was rewritten as its modification time.
+//
+// Returns [ClosedErr] if the store is closed.
+func (s *S3Store) Rewrite(rewrite RewriteFunc) error {
+	if err := s.startModification(); err != nil {
+		return err
+	}
+	defer s.inProgress.Done()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	objects, _, err := s.client.list(s.prefix, false)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	versionsPrefix := s.key(versionsDir + "/")
+	for _, o := range objects {
+		var path string
+		var isVersion bool
+		if rel := strings.TrimPrefix(o.Key, versionsPrefix); rel != o.Key {
+			i := strings.LastIndex(rel, "/")
+			if i < 0 {
+				continue
+			}
+			path, isVersion = rel[:i], true
+		} else if rel, isFile := s.relPath(o.Key); isFile {
+			path = rel
+		} else {
+			continue
+		}
+
+		data, _, err := s.client.get(o.Key)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		newData, err := rewrite(filepath.FromSlash(path), data)
+		if err != nil {
+			return err
+		} else if newData == nil {
+			continue
+		}
+
+		// Versions have no metadata
+		var metadata map[string]string
+		if !isVersion {
+			metadata = map[string]string{
+				s3HashMetadata: hex.EncodeToString(ContentHash(newData))}
+			delete(s.hashes, path)
+		}
+		if err = s.client.put(o.Key, newData, metadata); err != nil {
+			return errors.WithStack(err)
+		}
+		if isVersion {
+			s.versionBytes += int64(len(newData)) - o.Size
+		} else {
+			s.usage.Bytes += int64(len(newData)) - o.Size
+		}
+	}
+	return nil
+}
+
+// saveVersion keeps the contents of the file at the path as a previous version
+// and removes the versions of the file that are no longer retained. Does
+// nothing if the retention policy keeps no versions. Must be called with s.mux
+// held.
+func (s *S3Store) saveVersion(path string, data []byte, modified time.Time) error {
+	if !s.retention.enabled() {
+		return nil
+	}
+
+	versions, err := s.listVersions(path)
+	if err != nil {
+		return err
+	}
+
+	now := netTime.Now()
+	v := Version{Modified: modified, Size: int64(len(data))}
+	v.ID = newVersionID(now, func(id int64) bool {
+		for _, v := range versions {
+			if v.ID == id {
+				return true
+			}
+		}
+		return false
+	})
+	v.Replaced = time.Unix(0, v.ID)
+	if err = s.client.put(s.versionKey(path, v), data, nil); err != nil {
+		return err
+	}
+	s.versionBytes += v.Size
+
+	_, remove := s.retention.apply(append(versions, v), now)
+	stored := make([]storedVersion, len(remove))
+	for i, v := range remove {
+		stored[i] = storedVersion{path, v}
+	}
+	return s.removeVersions(stored)
+}
+
+// evictVersions removes the oldest previous versions of any file until the
+// files and their versions fit within the byte quota. Must be called with
+// s.mux held.
+func (s *S3Store) evictVersions() error {
+	excess := s.quota.excessVersionBytes(s.getUsage())
+	if excess == 0 {
+		return nil
+	}
+
+	prefix := s.key(versionsDir + "/")
+	objects, _, err := s.client.list(prefix, false)
+	if err != nil {
+		return err
+	}
+	versions := make([]storedVersion, 0, len(objects))
+	for _, o := range objects {
+		rel := strings.TrimPrefix(o.Key, prefix)
+		i := strings.LastIndex(rel, "/")
+		if i < 0 {
+			continue
+		}
+		v, err := parseVersionName(rel[i+1:], o.Size)
+		if err != nil {
+			jww.WARN.Printf("Skipping version object %s with invalid "+
+				"name: %+v", o.Key, err)
+			continue
+		}
+		versions = append(versions, storedVersion{rel[:i], v})
+	}
+
+	return s.removeVersions(oldestVersions(versions, excess))
+}
+
+// removeVersions removes the previous versions. Must be called with s.mux held.
+func (s *S3Store) removeVersions(versions []storedVersion) error {
+	keys := make([]string, len(versions))
+	var size int64
+	for i, v := range versions {
+		keys[i] = s.versionKey(v.path, v.Version)
+		size += v.Size
+	}
+	if err := s.client.delete(keys...); err != nil {
+		return err
+	}
+	s.versionBytes -= size
+	return nil
+}
+
+// listVersions returns all previous versions of the file at the path in no
+// particular order.
+func (s *S3Store) listVersions(path string) ([]Version, error) {
+	prefix := s.key(versionsDir + "/" + path + "/")
+	objects, _, err := s.client.list(prefix, true)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]Version, 0, len(objects))
+	for _, o := range objects {
+		v, err := parseVersionName(strings.TrimPrefix(o.Key, prefix), o.Size)
+		if err != nil {
+			jww.WARN.Printf("Skipping version object %s with invalid "+
+				"name: %+v", o.Key, err)
+			continue
+		}
+		versions = append(versions, v)
+	}
+	return versions, nil
+}
+
+// parseVersionName parses the version ID and modification time from the name
+// of a version object, which is the last element of its key.
+func parseVersionName(name string, size int64) (Version, error) {
+	idStr, modifiedStr, _ := strings.Cut(
+		strings.TrimPrefix(name, versionFilePrefix), ".")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return Version{}, err
+	}
+	modified, err := strconv.ParseInt(modifiedStr, 10, 64)
+	if err != nil {
+		return Version{}, err
+	}
+	return Version{
+		ID:       id,
+		Modified: time.Unix(0, modified),
+		Replaced: time.Unix(0, id),
+		Size:     size,
+	}, nil
+}
+
+// versionKey returns the key of the object that holds the previous version of
+// the file at the path. The modification time of the version is kept in the key
+// so that versions can be listed without reading the metadata of each object.
+func (s *S3Store) versionKey(path string, v Version) string {
+	return s.key(versionsDir + "/" + path + "/" + versionFilePrefix +
+		strconv.FormatInt(v.ID, 10) + "." +
+		strconv.FormatInt(v.Modified.UnixNano(), 10))
+}
+
+// Close prevents any further modifications to the store and waits for all
+// in-progress modifications to complete. If saving the journal failed after the
+// last change, it is saved again. Calling Close more than once has no effect.
+func (s *S3Store) Close() error {
+	s.mux.Lock()
+	if s.closed {
+		s.mux.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mux.Unlock()
+
+	s.inProgress.Wait()
+
+	// Retry saving changes that failed to be saved to the journal
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.unsavedJournal {
+		if err := s.saveJournal(); err != nil {
+			return errors.Wrap(err, "failed to save journal")
+		}
+	}
+	return nil
+}
+
+// startModification registers the start of a modification that Close must wait
+// on. The caller must call s.inProgress.Done once the modification completes.
+// Returns [ClosedErr] if the store is closed.
+func (s *S3Store) startModification() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.closed {
+		return ClosedErr
+	}
+	s.inProgress.Add(1)
+	return nil
+}
+
+// stat returns the information of the file at the path and whether it exists.
+// If withData is true, then the contents of the file are also returned.
+func (s *S3Store) stat(
+	path string, withData bool) (data []byte, info objectInfo, exists bool, err error) {
+	if path == "" {
+		return nil, objectInfo{}, false, nil
+	} else if withData {
+		data, info, err = s.client.get(s.key(path))
+	} else {
+		info, err = s.client.head(s.key(path))
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, objectInfo{}, false, nil
+	} else if err != nil {
+		return nil, objectInfo{}, false, errors.WithStack(err)
+	}
+	return data, info, true, nil
+}
+
+// isDir returns true if the path is the base directory or a directory that
+// contains at least one file.
+func (s *S3Store) isDir(path string) (bool, error) {
+	if path == "" {
+		return true, nil
+	}
+	list, err := s.readDir(path)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return len(list) > 0, nil
+}
+
+// checkParents returns an error if any parent directory of the path is a
+// file.
+func (s *S3Store) checkParents(p string) error {
+	for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+		_, _, exists, err := s.stat(dir, false)
+		if err != nil {
+			return err
+		} else if exists {
+			return errors.Errorf("cannot write %s: %s is not a directory", p, dir)
+		}
+	}
+	return nil
+}
+
+// fileNotFound returns the error for a file that does not exist at the path.
+func (s *S3Store) fileNotFound(path string) error {
+	if isDir, err := s.isDir(path); err != nil {
+		return err
+	} else if isDir {
+		return errors.Errorf("cannot read directory %s as a file", path)
+	}
+	return notExistErr(path)
+}
+
+// dirNotFound returns the error for a directory that does not exist at the
+// path.
+func (s *S3Store) dirNotFound(path string) error {
+	if _, _, exists, err := s.stat(path, false); err != nil {
+		return err
+	} else if exists {
+		return errors.Errorf("cannot read file %s as a directory", path)
+	}
+	return notExistErr(path)
+}
+
+// readyPath returns the path relative to the base directory with forward
+// slashes, as it is used in keys. The base directory is the empty string.
+// Returns NonLocalFileErr if the file is outside the base path and
+// ReservedPathErr if the path is reserved for internal files.
+func (s *S3Store) readyPath(path string) (string, error) {
+	if isReservedPath(path) {
+		return "", ReservedPathErr
+	}
+	path, err := readyPath(".", path)
+	if err != nil {
+		return "", err
+	} else if path == "." {
+		return "", nil
+	}
+	return filepath.ToSlash(path), nil
+}
+
+// key returns the key of the object at the path relative to the base
+// directory.
+func (s *S3Store) key(path string) string {
+	return s.prefix + path
+}
+
+// relPath returns the path of the object with the key relative to the base
+// directory and true if the object is a file. Internal files and the empty
+// objects that some tools create to mark directories are not files.
+func (s *S3Store) relPath(key string) (rel string, isFile bool) {
+	rel = strings.TrimPrefix(key, s.prefix)
+	return rel, rel != "" && !strings.HasPrefix(rel, internalFilePrefix) &&
+		!strings.HasSuffix(rel, "/")
+}
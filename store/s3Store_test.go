@@ -0,0 +1,516 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package store
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"gitlab.com/xx_network/primitives/netTime"
+)
+
+// Tests that S3Store adheres to the Store interface.
+var _ Store = (*S3Store)(nil)
+
+// Tests that memObjectClient adheres to the objectClient interface.
+var _ objectClient = (*memObjectClient)(nil)
+
+// Tests that S3Store passes the store conformance tests.
+func TestS3Store_Conformance(t *testing.T) {
+	RunConformanceTests(t, func(storageDir, baseDir string) (Store, error) {
+		return newS3StoreConstructor(newMemObjectClient(), "prefix")(
+			storageDir, baseDir)
+	})
+}
+
+// Error path: Tests that NewS3Store returns an error when no bucket is
+// specified.
+func TestNewS3Store_NoBucketError(t *testing.T) {
+	if _, err := NewS3Store(S3Params{Prefix: "prefix"}); err == nil {
+		t.Errorf("Did not fail to create NewStore without a bucket.")
+	}
+}
+
+// Error path: Tests that the NewStore returned by newS3StoreConstructor returns
+// NonLocalFileErr when the base directory is outside the key prefix.
+func Test_newS3StoreConstructor_NonLocalPathError(t *testing.T) {
+	newStore := newS3StoreConstructor(newMemObjectClient(), "prefix")
+	_, err := newStore("", "../baseDir")
+	if !errors.Is(err, NonLocalFileErr) {
+		t.Errorf("Unexpected error.\nexpected: %v\nreceived: %+v",
+			NonLocalFileErr, err)
+	}
+}
+
+// Tests that S3Store stores each file as an object under the key prefix of the
+// base directory with the content hash in its metadata and that the stores of
+// different base directories are isolated.
+func TestS3Store_Keys(t *testing.T) {
+	client := newMemObjectClient()
+	newStore := newS3StoreConstructor(client, "/remoteSync/")
+	s1 := newTestS3Store(newStore, "user1", t)
+	s2 := newTestS3Store(newStore, "user2", t)
+
+	data := []byte("data")
+	if err := s1.Write("dir/file", data); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+
+	o, exists := client.objects["remoteSync/user1/dir/file"]
+	if !exists {
+		t.Fatalf("No object for file. Objects: %v", client.keys())
+	} else if !bytes.Equal(data, o.data) {
+		t.Errorf("Unexpected object data.\nexpected: %q\nreceived: %q",
+			data, o.data)
+	} else if expected := hex.EncodeToString(ContentHash(data)); o.metadata[s3HashMetadata] != expected {
+		t.Errorf("Unexpected hash metadata.\nexpected: %s\nreceived: %s",
+			expected, o.metadata[s3HashMetadata])
+	}
+
+	if _, err := s2.Read("dir/file"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error reading file of another base directory."+
+			"\nexpected: %v\nreceived: %+v", os.ErrNotExist, err)
+	} else if usage := s2.GetUsage(); usage != (Usage{}) {
+		t.Errorf("Unexpected usage of other base directory: %+v", usage)
+	}
+}
+
+// Tests that S3Store.ReadDirEntries and S3Store.Manifest handle objects created
+// by other tools, ignoring the empty objects used to mark directories and
+// hashing objects that have no hash metadata.
+func TestS3Store_ExternalObjects(t *testing.T) {
+	client := newMemObjectClient()
+	external := []byte("external")
+	_ = client.put("user/marked/", nil, nil)
+	_ = client.put("user/marked/file", external, nil)
+	s := newTestS3Store(newS3StoreConstructor(client, ""), "user", t)
+
+	entries, err := s.ReadDirEntries("")
+	if err != nil {
+		t.Fatalf("Failed to read directory: %+v", err)
+	} else if len(entries) != 1 || entries[0].Name != "marked" || !entries[0].IsDir {
+		t.Errorf("Unexpected entries: %+v", entries)
+	}
+
+	entries, err = s.ReadDirEntries("marked")
+	if err != nil {
+		t.Fatalf("Failed to read directory: %+v", err)
+	} else if len(entries) != 1 || entries[0].Name != "file" {
+		t.Errorf("Unexpected entries: %+v", entries)
+	}
+
+	manifest, err := s.Manifest("", time.Time{})
+	if err != nil {
+		t.Fatalf("Failed to get manifest: %+v", err)
+	} else if len(manifest) != 1 {
+		t.Fatalf("Unexpected manifest: %+v", manifest)
+	} else if !bytes.Equal(ContentHash(external), manifest[0].Hash) {
+		t.Errorf("Unexpected hash.\nexpected: %x\nreceived: %x",
+			ContentHash(external), manifest[0].Hash)
+	}
+
+	if usage := s.GetUsage(); usage != (Usage{Bytes: int64(len(external)), Files: 1}) {
+		t.Errorf("Unexpected usage: %+v", usage)
+	}
+}
+
+// Tests that the usage, last write, and journal of an S3Store persist when it
+// is reopened.
+func TestS3Store_Reopen(t *testing.T) {
+	client := newMemObjectClient()
+	newStore := newS3StoreConstructor(client, "prefix")
+	s := newTestS3Store(newStore, "user", t)
+
+	for _, path := range []string{"a", "dir/b", "dir/c"} {
+		if err := s.Write(path, []byte(path)); err != nil {
+			t.Fatalf("Failed to write %s: %+v", path, err)
+		}
+	}
+	if err := s.Delete("dir/b"); err != nil {
+		t.Fatalf("Failed to delete: %+v", err)
+	}
+	usage := s.GetUsage()
+	lastWrite, err := s.GetLastWrite()
+	if err != nil {
+		t.Fatalf("Failed to get last write: %+v", err)
+	}
+	journalID, changes, err := s.GetChanges("", 0)
+	if err != nil {
+		t.Fatalf("Failed to get changes: %+v", err)
+	}
+	_ = s.Close()
+
+	s = newTestS3Store(newStore, "user", t)
+	if newUsage := s.GetUsage(); newUsage != usage {
+		t.Errorf("Unexpected usage.\nexpected: %+v\nreceived: %+v",
+			usage, newUsage)
+	}
+	if lw, err := s.GetLastWrite(); err != nil || !lw.Equal(lastWrite) {
+		t.Errorf("Unexpected last write.\nexpected: %s\nreceived: %s (%+v)",
+			lastWrite, lw, err)
+	}
+	id, loaded, err := s.GetChanges(journalID, 0)
+	if err != nil {
+		t.Fatalf("Failed to get changes: %+v", err)
+	} else if id != journalID {
+		t.Errorf("Unexpected journal ID.\nexpected: %s\nreceived: %s",
+			journalID, id)
+	} else if len(loaded) != len(changes) {
+		t.Fatalf("Unexpected number of changes.\nexpected: %d\nreceived: %d",
+			len(changes), len(loaded))
+	}
+	for i, c := range changes {
+		if c.Seq != loaded[i].Seq || c.Type != loaded[i].Type ||
+			c.Path != loaded[i].Path || !c.Time.Equal(loaded[i].Time) {
+			t.Errorf("Unexpected change %d.\nexpected: %+v\nreceived: %+v",
+				i, c, loaded[i])
+		}
+	}
+}
+
+// Tests that the last write of an S3Store with no journal is the modification
+// time of the most recently modified file.
+func TestS3Store_GetLastWrite_NoJournal(t *testing.T) {
+	client := newMemObjectClient()
+	_ = client.put("user/a", []byte("a"), nil)
+	_ = client.put("user/dir/b", []byte("b"), nil)
+	s := newTestS3Store(newS3StoreConstructor(client, ""), "user", t)
+
+	expected := client.objects["user/dir/b"].modified
+	if lastWrite, err := s.GetLastWrite(); err != nil {
+		t.Errorf("Failed to get last write: %+v", err)
+	} else if !expected.Equal(lastWrite) {
+		t.Errorf("Unexpected last write.\nexpected: %s\nreceived: %s",
+			expected, lastWrite)
+	}
+}
+
+// Tests that S3Store keeps the versions allowed by the retention policy when a
+// file is overwritten and that they can be read.
+func TestS3Store_Versions(t *testing.T) {
+	s := newTestS3Store(
+		newS3StoreConstructor(newMemObjectClient(), "prefix"), "user", t)
+	s.SetRetention(RetentionPolicy{MaxVersions: 2})
+
+	var modified []time.Time
+	for _, data := range []string{"v1", "v2", "v3", "v4"} {
+		if err := s.Write("dir/file", []byte(data)); err != nil {
+			t.Fatalf("Failed to write %s: %+v", data, err)
+		}
+		m, err := s.GetLastModified("dir/file")
+		if err != nil {
+			t.Fatalf("Failed to get last modified: %+v", err)
+		}
+		modified = append(modified, m)
+	}
+
+	versions, err := s.ListVersions("dir/file")
+	if err != nil {
+		t.Fatalf("Failed to list versions: %+v", err)
+	} else if len(versions) != 2 {
+		t.Fatalf("Unexpected number of versions.\nexpected: %d\nreceived: %d",
+			2, len(versions))
+	}
+	for i, expected := range []string{"v3", "v2"} {
+		v := versions[i]
+		if !v.Modified.Equal(modified[2-i]) || v.Size != int64(len(expected)) {
+			t.Errorf("Unexpected version %d: %+v", i, v)
+		}
+		data, err := s.ReadVersion("dir/file", v.ID)
+		if err != nil {
+			t.Errorf("Failed to read version %d: %+v", i, err)
+		} else if string(data) != expected {
+			t.Errorf("Unexpected version %d data.\nexpected: %q\nreceived: %q",
+				i, expected, data)
+		}
+	}
+
+	// Versions do not count towards the files in the directory
+	if entries, err := s.ReadDirEntries("dir"); err != nil || len(entries) != 1 {
+		t.Errorf("Unexpected entries: %+v (%+v)", entries, err)
+	}
+
+	if err = s.DeleteDir("dir"); err != nil {
+		t.Fatalf("Failed to delete directory: %+v", err)
+	}
+	if versions, err = s.ListVersions("dir/file"); err != nil || len(versions) != 0 {
+		t.Errorf("Versions not deleted with directory: %+v (%+v)",
+			versions, err)
+	}
+}
+
+// Error path: Tests that S3Store.WriteIf returns a ConflictError when the file
+// does not match the precondition and does not write the file.
+func TestS3Store_WriteIf_ConflictError(t *testing.T) {
+	s := newTestS3Store(
+		newS3StoreConstructor(newMemObjectClient(), "prefix"), "user", t)
+	if err := s.Write("file", []byte("old")); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+
+	err := s.WriteIf("file", []byte("new"), Precondition{Hash: ContentHash(nil)})
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("Unexpected error.\nexpected: %v\nreceived: %+v",
+			ConflictErr, err)
+	} else if !bytes.Equal(ContentHash([]byte("old")), conflict.Hash) {
+		t.Errorf("Unexpected conflict hash: %x", conflict.Hash)
+	}
+
+	err = s.WriteIf("file", []byte("new"),
+		Precondition{Hash: ContentHash([]byte("old"))})
+	if err != nil {
+		t.Errorf("Failed to write matching precondition: %+v", err)
+	} else if data, _ := s.Read("file"); string(data) != "new" {
+		t.Errorf("Unexpected data: %q", data)
+	}
+}
+
+// Error path: Tests that S3Store.Write returns QuotaExceededErr when the write
+// would exceed the quota.
+func TestS3Store_Write_QuotaExceededError(t *testing.T) {
+	s := newTestS3Store(
+		newS3StoreConstructor(newMemObjectClient(), "prefix"), "user", t)
+	s.SetQuota(Quota{MaxFiles: 1})
+	if err := s.Write("a", []byte("a")); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+	if err := s.Write("b", []byte("b")); !errors.Is(err, QuotaExceededErr) {
+		t.Errorf("Unexpected error.\nexpected: %v\nreceived: %+v",
+			QuotaExceededErr, err)
+	}
+}
+
+// Tests that a change that fails to be saved to the journal is still applied
+// and is saved when the store is closed.
+func TestS3Store_Close_UnsavedJournal(t *testing.T) {
+	client := newMemObjectClient()
+	newStore := newS3StoreConstructor(client, "prefix")
+	s := newTestS3Store(newStore, "user", t)
+
+	client.setPutErr(s.key(journalFile), errors.New("put failed"))
+	if err := s.Write("file", []byte("data")); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	} else if !s.unsavedJournal {
+		t.Errorf("Failed journal save not recorded.")
+	}
+
+	client.setPutErr(s.key(journalFile), nil)
+	if err := s.Close(); err != nil {
+		t.Fatalf("Failed to close: %+v", err)
+	}
+
+	s = newTestS3Store(newStore, "user", t)
+	_, changes, err := s.GetChanges("", 0)
+	if err != nil {
+		t.Fatalf("Failed to get changes: %+v", err)
+	} else if len(changes) != 1 || changes[0].Path != "file" {
+		t.Errorf("Unsaved change not saved on close: %+v", changes)
+	}
+}
+
+// Error path: Tests that S3Store returns ClosedErr for modifications once it is
+// closed.
+func TestS3Store_Close(t *testing.T) {
+	s := newTestS3Store(
+		newS3StoreConstructor(newMemObjectClient(), "prefix"), "user", t)
+	if err := s.Write("file", []byte("data")); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	} else if err = s.Close(); err != nil {
+		t.Fatalf("Failed to close: %+v", err)
+	}
+
+	if err := s.Write("file", nil); !errors.Is(err, ClosedErr) {
+		t.Errorf("Unexpected error.\nexpected: %v\nreceived: %+v",
+			ClosedErr, err)
+	}
+	if data, err := s.Read("file"); err != nil || string(data) != "data" {
+		t.Errorf("Failed to read after close: %q (%+v)", data, err)
+	}
+}
+
+// Tests that listS3BaseDirs returns the base directory of every store created
+// under the key prefix.
+func Test_listS3BaseDirs(t *testing.T) {
+	client := newMemObjectClient()
+	newStore := newS3StoreConstructor(client, "/prefix/")
+	for _, baseDir := range []string{"waldo", "carmen"} {
+		s := newTestS3Store(newStore, baseDir, t)
+		if err := s.Write("file.txt", []byte("data")); err != nil {
+			t.Fatalf("Failed to write to store %s: %+v", baseDir, err)
+		}
+	}
+	_ = client.put("other/file.txt", nil, nil)
+
+	baseDirs, err := listS3BaseDirs(client, "/prefix/")
+	if err != nil {
+		t.Fatalf("Failed to list base directories: %+v", err)
+	}
+
+	expected := []string{"carmen", "waldo"}
+	if !reflect.DeepEqual(expected, baseDirs) {
+		t.Errorf("Unexpected base directories."+
+			"\nexpected: %q\nreceived: %q", expected, baseDirs)
+	}
+}
+
+// Tests that memObjectClient.list groups keys into common prefixes by the
+// delimiter.
+func Test_memObjectClient_list(t *testing.T) {
+	client := newMemObjectClient()
+	for _, key := range []string{"p/a", "p/b/c", "p/b/d", "p/e/", "q/f"} {
+		_ = client.put(key, nil, nil)
+	}
+
+	objects, prefixes, _ := client.list("p/", true)
+	keys := make([]string, len(objects))
+	for i, o := range objects {
+		keys[i] = o.Key
+	}
+	if expected := []string{"p/a"}; !reflect.DeepEqual(expected, keys) {
+		t.Errorf("Unexpected keys.\nexpected: %q\nreceived: %q", expected, keys)
+	}
+	if expected := []string{"p/b/", "p/e/"}; !reflect.DeepEqual(expected, prefixes) {
+		t.Errorf("Unexpected prefixes.\nexpected: %q\nreceived: %q",
+			expected, prefixes)
+	}
+}
+
+// newTestS3Store creates a new S3Store for the base directory.
+func newTestS3Store(newStore NewStore, baseDir string, t testing.TB) *S3Store {
+	s, err := newStore("", baseDir)
+	if err != nil {
+		t.Fatalf("Failed to create new S3Store: %+v", err)
+	}
+	return s.(*S3Store)
+}
+
+// memObjectClient is an in-memory objectClient that stands in for an object
+// store in tests.
+type memObjectClient struct {
+	objects map[string]memObject
+	putErrs map[string]error // Errors returned by put for each key
+	mux     sync.Mutex
+}
+
+// memObject is an object in a memObjectClient.
+type memObject struct {
+	data     []byte
+	modified time.Time
+	metadata map[string]string
+}
+
+func newMemObjectClient() *memObjectClient {
+	return &memObjectClient{
+		objects: make(map[string]memObject),
+		putErrs: make(map[string]error),
+	}
+}
+
+// setPutErr sets the error returned by put for the key. A nil error clears it.
+func (c *memObjectClient) setPutErr(key string, err error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.putErrs[key] = err
+}
+
+func (c *memObjectClient) get(key string) ([]byte, objectInfo, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	o, exists := c.objects[key]
+	if !exists {
+		return nil, objectInfo{}, notExistErr(key)
+	}
+	return append([]byte{}, o.data...), o.info(key), nil
+}
+
+func (c *memObjectClient) head(key string) (objectInfo, error) {
+	_, info, err := c.get(key)
+	return info, err
+}
+
+func (c *memObjectClient) put(
+	key string, data []byte, metadata map[string]string) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if err := c.putErrs[key]; err != nil {
+		return err
+	}
+	c.objects[key] = memObject{
+		data:     append([]byte{}, data...),
+		modified: netTime.Now(),
+		metadata: metadata,
+	}
+	return nil
+}
+
+func (c *memObjectClient) delete(keys ...string) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for _, key := range keys {
+		delete(c.objects, key)
+	}
+	return nil
+}
+
+func (c *memObjectClient) list(prefix string, delimited bool) (
+	[]objectInfo, []string, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	objects, prefixes := make([]objectInfo, 0), make([]string, 0)
+	for _, key := range c.sortedKeys() {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if i := strings.Index(key[len(prefix):], "/"); delimited && i >= 0 {
+			p := key[:len(prefix)+i+1]
+			if len(prefixes) == 0 || prefixes[len(prefixes)-1] != p {
+				prefixes = append(prefixes, p)
+			}
+			continue
+		}
+		info := c.objects[key].info(key)
+		info.Metadata = nil
+		objects = append(objects, info)
+	}
+	return objects, prefixes, nil
+}
+
+// keys returns all keys in the client, sorted.
+func (c *memObjectClient) keys() []string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.sortedKeys()
+}
+
+func (c *memObjectClient) sortedKeys() []string {
+	keys := make([]string, 0, len(c.objects))
+	for key := range c.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (o memObject) info(key string) objectInfo {
+	return objectInfo{
+		Key:      key,
+		Size:     int64(len(o.data)),
+		Modified: o.modified,
+		Metadata: o.metadata,
+	}
+}
@@ -0,0 +1,1095 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package store
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	_ "modernc.org/sqlite"
+
+	"gitlab.com/xx_network/primitives/netTime"
+)
+
+// sqliteFile is the name of the database file in the base directory of a
+// SQLiteStore.
+const sqliteFile = internalFilePrefix + "store.db"
+
+// sqliteSchema creates the tables of a SQLiteStore database. Paths are stored
+// relative to the base directory with forward slashes, and times are stored as
+// Unix nanoseconds.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS files (
+	path     TEXT PRIMARY KEY,
+	data     BLOB NOT NULL,
+	hash     BLOB NOT NULL,
+	modified INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS versions (
+	path     TEXT NOT NULL,
+	id       INTEGER NOT NULL,
+	data     BLOB NOT NULL,
+	modified INTEGER NOT NULL,
+	PRIMARY KEY (path, id)
+);
+CREATE TABLE IF NOT EXISTS journal (
+	seq  INTEGER PRIMARY KEY,
+	type INTEGER NOT NULL,
+	path TEXT NOT NULL,
+	time INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS lastWrite (
+	id   INTEGER PRIMARY KEY CHECK (id = 0),
+	path TEXT NOT NULL,
+	time INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS journalID (
+	id        INTEGER PRIMARY KEY CHECK (id = 0),
+	journalID TEXT NOT NULL
+);`
+
+// SQLiteStore manages the storage in a SQLite database in the base directory.
+// Adheres to the Store interface.
+//
+// Each file is a row in the database, which avoids the per-file overhead of
+// the file system for stores with many small files. Directories are not stored;
+// a directory exists while it contains at least one file, with the exception of
+// the base directory, which always exists.
+type SQLiteStore struct {
+	baseDir string
+	db      *sql.DB
+
+	// lastWritePath is the path of the most recently written file and
+	// lastWrite is the time of the most recent Write, Delete, or DeleteDir.
+	// lastWritePath is empty if the most recent modification was a delete.
+	lastWritePath string
+	lastWrite     time.Time
+
+	// quota is the limit on the storage used. usage is the current storage
+	// used by the files and versionBytes is the size of their previous
+	// versions; both are calculated when the store is opened and kept up to
+	// date on every modification.
+	quota        Quota
+	usage        Usage
+	versionBytes int64
+
+	// retention determines which previous versions of files are kept.
+	retention RetentionPolicy
+
+	// journal is the list of recent modifications. It is mirrored in the
+	// journal table.
+	journal *journal
+
+	// closed is true once Close has been called. inProgress tracks the
+	// modifications that Close must wait on.
+	closed     bool
+	inProgress sync.WaitGroup
+
+	mux sync.Mutex
+}
+
+// sqlQuerier is the subset of methods shared by sql.DB and sql.Tx.
+type sqlQuerier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// NewSQLiteStore creates a new SQLiteStore with a database in the base
+// directory, which is created in the storage directory. If the database
+// already exists, it is opened.
+//
+// Returns [NonLocalFileErr] if the base directory is outside the storage
+// directory.
+func NewSQLiteStore(storageDir, baseDir string) (Store, error) {
+	baseDir, err := readyPath(storageDir, baseDir)
+	if err != nil {
+		return nil, err
+	}
+	ss := &SQLiteStore{baseDir: baseDir}
+
+	err = os.MkdirAll(ss.baseDir, FilePerm)
+	if err != nil {
+		return nil, errors.Wrapf(
+			err, "failed to make base directory %s", ss.baseDir)
+	}
+
+	dbPath := filepath.Join(ss.baseDir, sqliteFile)
+	ss.db, err = sql.Open("sqlite", "file:"+dbPath+
+		"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"+
+		"&_pragma=synchronous(FULL)&_txlock=immediate")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open database %s", dbPath)
+	}
+
+	if err = ss.init(); err != nil {
+		_ = ss.db.Close()
+		return nil, errors.Wrapf(err, "failed to initialize database %s", dbPath)
+	}
+
+	return ss, nil
+}
+
+// init creates the database tables if they do not exist and loads the usage,
+// last write, and journal.
+func (ss *SQLiteStore) init() error {
+	if _, err := ss.db.Exec(sqliteSchema); err != nil {
+		return err
+	}
+
+	err := ss.db.QueryRow(
+		"SELECT COUNT(*), COALESCE(SUM(LENGTH(data)), 0) FROM files").
+		Scan(&ss.usage.Files, &ss.usage.Bytes)
+	if err != nil {
+		return errors.Wrap(err, "failed to calculate usage")
+	}
+	err = ss.db.QueryRow(
+		"SELECT COALESCE(SUM(LENGTH(data)), 0) FROM versions").
+		Scan(&ss.versionBytes)
+	if err != nil {
+		return errors.Wrap(err, "failed to calculate size of previous versions")
+	}
+
+	var lwPath string
+	var lwTime int64
+	err = ss.db.QueryRow("SELECT path, time FROM lastWrite").Scan(&lwPath, &lwTime)
+	if err == nil {
+		ss.lastWritePath = lwPath
+		ss.lastWrite = time.Unix(0, lwTime)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return errors.Wrap(err, "failed to load last write")
+	}
+
+	ss.journal = newJournal(journalMaxEntries)
+	err = ss.db.QueryRow("SELECT journalID FROM journalID").Scan(&ss.journal.id)
+	if errors.Is(err, sql.ErrNoRows) {
+		_, err = ss.db.Exec(
+			"INSERT INTO journalID (id, journalID) VALUES (0, ?)", ss.journal.id)
+		if err != nil {
+			return errors.Wrap(err, "failed to save journal ID")
+		}
+	} else if err != nil {
+		return errors.Wrap(err, "failed to load journal ID")
+	}
+
+	rows, err := ss.db.Query(
+		"SELECT seq, type, path, time FROM journal ORDER BY seq")
+	if err != nil {
+		return errors.Wrap(err, "failed to load journal")
+	}
+	defer func() { _ = rows.Close() }()
+	for rows.Next() {
+		var c Change
+		var path string
+		var t int64
+		if err = rows.Scan(&c.Seq, &c.Type, &path, &t); err != nil {
+			return errors.Wrap(err, "failed to load journal")
+		}
+		c.Path, c.Time = filepath.FromSlash(path), time.Unix(0, t)
+		ss.journal.changes = append(ss.journal.changes, c)
+	}
+	return rows.Err()
+}
+
+// Read reads from the provided file path and returns the data in the file at
+// that path.
+//
+// An error is returned if it fails to read the file. Returns [NonLocalFileErr]
+// if the file is outside the base path and [os.ErrNotExist] if the file does
+// not exist.
+func (ss *SQLiteStore) Read(path string) ([]byte, error) {
+	path, err := ss.readyPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	err = ss.db.QueryRow("SELECT data FROM files WHERE path = ?", path).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ss.fileNotFound(ss.db, path)
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return data, nil
+}
+
+// Write writes the provided data to the file path. The write is atomic; if it
+// is interrupted, the file retains its previous contents.
+//
+// An error is returned if the write fails. Returns [NonLocalFileErr] if the
+// file is outside the base path, [QuotaExceededErr] if the write would exceed
+// the quota, and [ClosedErr] if the store is closed.
+func (ss *SQLiteStore) Write(path string, data []byte) error {
+	return ss.write(path, data, Precondition{})
+}
+
+// WriteIf writes the provided data to the file path only if the file matches
+// the precondition. The check and write are atomic.
+//
+// Returns a *[ConflictError], which matches [ConflictErr], if the file does not
+// match the precondition. Otherwise, returns the same errors as Write.
+func (ss *SQLiteStore) WriteIf(path string, data []byte, cond Precondition) error {
+	return ss.write(path, data, cond)
+}
+
+// write writes the data to the file path if it matches the precondition.
+func (ss *SQLiteStore) write(relPath string, data []byte, cond Precondition) error {
+	path, err := ss.readyPath(relPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = ss.startModification(); err != nil {
+		return err
+	}
+	defer ss.inProgress.Done()
+
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+
+	return ss.update(func(tx *sql.Tx) (Change, error) {
+		if isDir, err := ss.isDir(tx, path); err != nil {
+			return Change{}, err
+		} else if isDir {
+			return Change{}, errors.Errorf("cannot write to directory %s", path)
+		} else if err = ss.checkParents(tx, path); err != nil {
+			return Change{}, err
+		}
+
+		var current []byte
+		var modified int64
+		err := tx.QueryRow("SELECT data, modified FROM files WHERE path = ?",
+			path).Scan(&current, &modified)
+		exists := err == nil
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return Change{}, err
+		}
+
+		newUsage := ss.usage
+		newUsage.Bytes += int64(len(data)) - int64(len(current))
+		if !exists {
+			newUsage.Files++
+		}
+
+		if !cond.isEmpty() {
+			var modTime time.Time
+			if exists {
+				modTime = time.Unix(0, modified)
+			}
+			err = cond.check(relPath, exists, modTime, current)
+			if err != nil {
+				return Change{}, err
+			}
+		}
+
+		if !ss.quota.allows(ss.usage, newUsage) {
+			return Change{}, QuotaExceededErr
+		}
+
+		if exists {
+			err = ss.saveVersion(tx, path, current, modified)
+			if err != nil {
+				return Change{}, errors.Wrap(err, "failed to save previous version")
+			}
+		}
+
+		now := netTime.Now()
+		_, err = tx.Exec("INSERT INTO files (path, data, hash, modified) "+
+			"VALUES (?, ?, ?, ?) ON CONFLICT (path) DO UPDATE SET "+
+			"data = excluded.data, hash = excluded.hash, "+
+			"modified = excluded.modified",
+			path, data, ContentHash(data), now.UnixNano())
+		if err != nil {
+			return Change{}, err
+		}
+
+		ss.usage = newUsage
+		if err = ss.evictVersions(tx); err != nil {
+			return Change{}, errors.Wrap(
+				err, "failed to remove previous versions over the quota")
+		}
+		return Change{Type: ChangeWrite, Path: path, Time: now}, nil
+	})
+}
+
+// GetLastModified returns the last modification time for the file at the given
+// file. The modification time of a directory is that of the most recently
+// modified file it contains.
+//
+// Returns [NonLocalFileErr] if the file is outside the base path and
+// [os.ErrNotExist] if the file does not exist.
+func (ss *SQLiteStore) GetLastModified(path string) (time.Time, error) {
+	path, err := ss.readyPath(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var modified int64
+	err = ss.db.QueryRow(
+		"SELECT modified FROM files WHERE path = ?", path).Scan(&modified)
+	if err == nil {
+		return time.Unix(0, modified), nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, errors.WithStack(err)
+	}
+
+	var dirModified sql.NullInt64
+	err = ss.db.QueryRow("SELECT MAX(modified) FROM files WHERE "+
+		"substr(path, 1, length(?)) = ?", dirPrefix(path), dirPrefix(path)).
+		Scan(&dirModified)
+	if err != nil {
+		return time.Time{}, errors.WithStack(err)
+	} else if dirModified.Valid {
+		return time.Unix(0, dirModified.Int64), nil
+	} else if path == "" {
+		return time.Time{}, nil
+	}
+	return time.Time{}, notExistErr(path)
+}
+
+// GetLastWrite returns the time of the most recent successful Write or Delete
+// operation that was performed. The time persists when the store is reopened.
+//
+// Returns [os.ErrNotExist] if no files have ever been written.
+func (ss *SQLiteStore) GetLastWrite() (time.Time, error) {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	if ss.lastWrite.IsZero() {
+		return time.Time{}, errors.Wrap(os.ErrNotExist, "no files written")
+	}
+	return ss.lastWrite, nil
+}
+
+// ReadDir reads the named directory, returning all its directory entries
+// sorted by filename.
+//
+// Returns [NonLocalFileErr] if the file is outside the base path and
+// [os.ErrNotExist] if the directory does not exist.
+func (ss *SQLiteStore) ReadDir(path string) ([]string, error) {
+	entries, err := ss.ReadDirEntries(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := make([]string, 0)
+	for _, entry := range entries {
+		if entry.IsDir {
+			dirs = append(dirs, entry.Name)
+		}
+	}
+	return dirs, nil
+}
+
+// ReadDirEntries reads the named directory, returning all the files and
+// directories it contains sorted by name.
+//
+// Returns [NonLocalFileErr] if the directory is outside the base path and
+// [os.ErrNotExist] if it does not exist.
+func (ss *SQLiteStore) ReadDirEntries(path string) ([]DirEntry, error) {
+	path, err := ss.readyPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := dirPrefix(path)
+	rows, err := ss.db.Query("SELECT path, LENGTH(data), modified FROM files "+
+		"WHERE substr(path, 1, length(?)) = ?", prefix, prefix)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	list := make([]DirEntry, 0)
+	dirs := make(map[string]bool)
+	for rows.Next() {
+		var p string
+		var size, modified int64
+		if err = rows.Scan(&p, &size, &modified); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		name, _, isDir := strings.Cut(strings.TrimPrefix(p, prefix), "/")
+		if !isDir {
+			list = append(list, DirEntry{
+				Name:     name,
+				Size:     size,
+				Modified: time.Unix(0, modified),
+			})
+		} else if !dirs[name] {
+			dirs[name] = true
+			list = append(list, DirEntry{Name: name, IsDir: true})
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if len(list) == 0 && path != "" {
+		return nil, ss.dirNotFound(ss.db, path)
+	}
+
+	sortDirEntries(list)
+	return list, nil
+}
+
+// Manifest returns every file in the named directory and its subdirectories
+// with its size, modification time, and content hash, sorted by path. If since
+// is not zero, only files modified at or after since are returned. If the path
+// is a file, then only that file is returned.
+//
+// Returns [NonLocalFileErr] if the directory is outside the base path and
+// [os.ErrNotExist] if it does not exist.
+func (ss *SQLiteStore) Manifest(
+	path string, since time.Time) ([]ManifestEntry, error) {
+	path, err := ss.readyPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := dirPrefix(path)
+	rows, err := ss.db.Query("SELECT path, LENGTH(data), modified, hash "+
+		"FROM files WHERE path = ? OR substr(path, 1, length(?)) = ?",
+		path, prefix, prefix)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	entries := make([]ManifestEntry, 0)
+	var found bool
+	for rows.Next() {
+		var p string
+		var modified int64
+		var e ManifestEntry
+		if err = rows.Scan(&p, &e.Size, &modified, &e.Hash); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		found = true
+		e.Path, e.Modified = filepath.FromSlash(p), time.Unix(0, modified)
+		if includeInManifest(e.Modified, since) {
+			entries = append(entries, e)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	} else if !found && path != "" {
+		return nil, notExistErr(path)
+	}
+
+	sortManifest(entries)
+	return entries, nil
+}
+
+// Delete deletes the file at the given path.
+//
+// An error is returned if the file does not exist or is a directory. Returns
+// [NonLocalFileErr] if the file is outside the base path and [ClosedErr] if the
+// store is closed.
+func (ss *SQLiteStore) Delete(path string) error {
+	path, err := ss.readyPath(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = ss.startModification(); err != nil {
+		return err
+	}
+	defer ss.inProgress.Done()
+
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+
+	return ss.update(func(tx *sql.Tx) (Change, error) {
+		var data []byte
+		var modified int64
+		err := tx.QueryRow("SELECT data, modified FROM files WHERE path = ?",
+			path).Scan(&data, &modified)
+		if errors.Is(err, sql.ErrNoRows) {
+			if isDir, err := ss.isDir(tx, path); err != nil {
+				return Change{}, err
+			} else if isDir {
+				return Change{}, errors.Errorf(
+					"cannot delete directory %s as a file", path)
+			}
+			return Change{}, notExistErr(path)
+		} else if err != nil {
+			return Change{}, err
+		}
+
+		if err = ss.saveVersion(tx, path, data, modified); err != nil {
+			return Change{}, errors.Wrap(err, "failed to save previous version")
+		}
+
+		if _, err = tx.Exec("DELETE FROM files WHERE path = ?", path); err != nil {
+			return Change{}, err
+		}
+
+		ss.usage.Bytes -= int64(len(data))
+		ss.usage.Files--
+		return Change{Type: ChangeDelete, Path: path, Time: netTime.Now()}, nil
+	})
+}
+
+// DeleteDir deletes the named directory and everything it contains, including
+// the previous versions of the files in it. If the path is the base directory,
+// then all of its contents are deleted.
+//
+// An error is returned if the directory does not exist. Returns
+// [NonLocalFileErr] if the directory is outside the base path and [ClosedErr]
+// if the store is closed.
+func (ss *SQLiteStore) DeleteDir(path string) error {
+	path, err := ss.readyPath(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = ss.startModification(); err != nil {
+		return err
+	}
+	defer ss.inProgress.Done()
+
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+
+	return ss.update(func(tx *sql.Tx) (Change, error) {
+		if isDir, err := ss.isDir(tx, path); err != nil {
+			return Change{}, err
+		} else if !isDir {
+			return Change{}, ss.dirNotFound(tx, path)
+		}
+
+		prefix := dirPrefix(path)
+		var deleted Usage
+		err := tx.QueryRow("SELECT COUNT(*), COALESCE(SUM(LENGTH(data)), 0) "+
+			"FROM files WHERE substr(path, 1, length(?)) = ?", prefix, prefix).
+			Scan(&deleted.Files, &deleted.Bytes)
+		if err != nil {
+			return Change{}, err
+		}
+		err = tx.QueryRow("SELECT COALESCE(SUM(LENGTH(data)), 0) "+
+			"FROM versions WHERE substr(path, 1, length(?)) = ?", prefix,
+			prefix).Scan(&deleted.VersionBytes)
+		if err != nil {
+			return Change{}, err
+		}
+
+		for _, table := range []string{"files", "versions"} {
+			_, err = tx.Exec("DELETE FROM "+table+
+				" WHERE substr(path, 1, length(?)) = ?", prefix, prefix)
+			if err != nil {
+				return Change{}, err
+			}
+		}
+
+		ss.usage.Bytes -= deleted.Bytes
+		ss.usage.Files -= deleted.Files
+		ss.versionBytes -= deleted.VersionBytes
+		return Change{Type: ChangeDeleteDir, Path: path, Time: netTime.Now()}, nil
+	})
+}
+
+// update runs the modification in a transaction and records the change it
+// returns as the last write and in the journal in the same transaction. The
+// in-memory state is only updated once the transaction commits. Must be called
+// with ss.mux held.
+func (ss *SQLiteStore) update(modify func(tx *sql.Tx) (Change, error)) error {
+	tx, err := ss.db.Begin()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	usage, versionBytes := ss.usage, ss.versionBytes
+	c, err := modify(tx)
+	if err != nil {
+		ss.usage, ss.versionBytes = usage, versionBytes
+		return errors.WithStack(err)
+	}
+	c.Seq = ss.journal.lastSeq() + 1
+
+	err = ss.recordChange(tx, c)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		ss.usage, ss.versionBytes = usage, versionBytes
+		return errors.WithStack(err)
+	}
+
+	if c.Type == ChangeWrite {
+		ss.lastWritePath = c.Path
+	} else {
+		ss.lastWritePath = ""
+	}
+	ss.lastWrite = c.Time
+	ss.journal.add(c.Type, filepath.FromSlash(c.Path), c.Time)
+	ss.journal.compact()
+	return nil
+}
+
+// recordChange writes the change to the last write and journal tables,
+// removing the oldest changes from the journal once it is compacted.
+func (ss *SQLiteStore) recordChange(tx *sql.Tx, c Change) error {
+	lwPath := ""
+	if c.Type == ChangeWrite {
+		lwPath = c.Path
+	}
+	_, err := tx.Exec("INSERT INTO lastWrite (id, path, time) VALUES (0, ?, ?) "+
+		"ON CONFLICT (id) DO UPDATE SET path = excluded.path, "+
+		"time = excluded.time", lwPath, c.Time.UnixNano())
+	if err != nil {
+		return errors.Wrap(err, "failed to record last write")
+	}
+
+	_, err = tx.Exec("INSERT INTO journal (seq, type, path, time) "+
+		"VALUES (?, ?, ?, ?)", c.Seq, c.Type, c.Path, c.Time.UnixNano())
+	if err != nil {
+		return errors.Wrap(err, "failed to record change in journal")
+	}
+
+	// Mirror journal.compact, which keeps the last maxEntries changes once the
+	// journal holds more than twice that many
+	if len(ss.journal.changes)+1 > 2*ss.journal.maxEntries {
+		_, err = tx.Exec("DELETE FROM journal WHERE seq <= ?",
+			c.Seq-uint64(ss.journal.maxEntries))
+		if err != nil {
+			return errors.Wrap(err, "failed to compact journal")
+		}
+	}
+	return nil
+}
+
+// GetChanges returns the ID of the journal and all changes in it with a
+// sequence number greater than after, in order. Passing zero returns all
+// changes. The journal and its ID persist when the store is reopened.
+//
+// Returns [JournalCompactedErr] if any of the requested changes have been
+// removed from the journal, if after is past the last change, or if after is
+// not zero and journalID is not the ID of the journal.
+func (ss *SQLiteStore) GetChanges(
+	journalID string, after uint64) (string, []Change, error) {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	changes, err := ss.journal.since(journalID, after)
+	return ss.journal.id, changes, err
+}
+
+// SetQuota sets the limits on the storage used by the store. Existing files are
+// kept even if they exceed the new quota.
+func (ss *SQLiteStore) SetQuota(quota Quota) {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	ss.quota = quota
+}
+
+// GetUsage returns the storage currently used by the store.
+func (ss *SQLiteStore) GetUsage() Usage {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	return ss.getUsage()
+}
+
+// getUsage returns the storage used by the files and their previous versions.
+// Must be called with ss.mux held.
+func (ss *SQLiteStore) getUsage() Usage {
+	u := ss.usage
+	u.VersionBytes = ss.versionBytes
+	return u
+}
+
+// SetRetention sets the policy that determines which previous versions of each
+// file are kept when it is overwritten or deleted. Versions no longer retained
+// under a new policy are removed the next time their file is modified.
+func (ss *SQLiteStore) SetRetention(policy RetentionPolicy) {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	ss.retention = policy
+}
+
+// ListVersions returns the previous versions of the file at the given path that
+// are retained, sorted from newest to oldest. The current contents of the file
+// are not included.
+//
+// Returns [NonLocalFileErr] if the file is outside the base path.
+func (ss *SQLiteStore) ListVersions(path string) ([]Version, error) {
+	path, err := ss.readyPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	versions, err := listSQLiteVersions(ss.db, path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	versions, _ = ss.retention.apply(versions, netTime.Now())
+	return versions, nil
+}
+
+// ReadVersion returns the contents of the previous version of the file at the
+// given path with the given ID.
+//
+// Returns [NonLocalFileErr] if the file is outside the base path and
+// [VersionNotFoundErr] if the version does not exist.
+func (ss *SQLiteStore) ReadVersion(path string, id int64) ([]byte, error) {
+	path, err := ss.readyPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	err = ss.db.QueryRow("SELECT data FROM versions WHERE path = ? AND id = ?",
+		path, id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.WithStack(VersionNotFoundErr)
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return data, nil
+}
+
+// Rewrite replaces the contents of every file and every retained previous
+// version with the data returned by rewrite in a single transaction. Each file
+// keeps its modification time. Implements [Rewriter].
+//
+// Returns [ClosedErr] if the store is closed.
+func (ss *SQLiteStore) Rewrite(rewrite RewriteFunc) error {
+	if err := ss.startModification(); err != nil {
+		return err
+	}
+	defer ss.inProgress.Done()
+
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+
+	tx, err := ss.db.Begin()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	paths, err := querySQLitePaths(tx, "SELECT path FROM files ORDER BY path")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var usageDelta int64
+	for _, path := range paths {
+		var data []byte
+		err = tx.QueryRow(
+			"SELECT data FROM files WHERE path = ?", path).Scan(&data)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		newData, err := rewrite(filepath.FromSlash(path), data)
+		if err != nil {
+			return err
+		} else if newData == nil {
+			continue
+		}
+		_, err = tx.Exec("UPDATE files SET data = ?, hash = ? WHERE path = ?",
+			newData, ContentHash(newData), path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		usageDelta += int64(len(newData) - len(data))
+	}
+
+	paths, err = querySQLitePaths(
+		tx, "SELECT DISTINCT path FROM versions ORDER BY path")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var versionDelta int64
+	for _, path := range paths {
+		versions, err := listSQLiteVersions(tx, path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for _, v := range versions {
+			var data []byte
+			err = tx.QueryRow("SELECT data FROM versions "+
+				"WHERE path = ? AND id = ?", path, v.ID).Scan(&data)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			newData, err := rewrite(filepath.FromSlash(path), data)
+			if err != nil {
+				return err
+			} else if newData == nil {
+				continue
+			}
+			_, err = tx.Exec("UPDATE versions SET data = ? "+
+				"WHERE path = ? AND id = ?", newData, path, v.ID)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			versionDelta += int64(len(newData) - len(data))
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errors.WithStack(err)
+	}
+	ss.usage.Bytes += usageDelta
+	ss.versionBytes += versionDelta
+	return nil
+}
+
+// querySQLitePaths returns the paths in the first column of the rows returned
+// by the query.
+func querySQLitePaths(q sqlQuerier, query string) ([]string, error) {
+	rows, err := q.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err = rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
+// saveVersion keeps the current contents of the file at the path as a previous
+// version and removes the versions of the file that are no longer retained.
+// Does nothing if the retention policy keeps no versions.
+func (ss *SQLiteStore) saveVersion(
+	tx *sql.Tx, path string, data []byte, modified int64) error {
+	if !ss.retention.enabled() {
+		return nil
+	}
+
+	var err error
+	now := netTime.Now()
+	id := newVersionID(now, func(id int64) bool {
+		var exists bool
+		err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM versions "+
+			"WHERE path = ? AND id = ?)", path, id).Scan(&exists)
+		return exists && err == nil
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO versions (path, id, data, modified) "+
+		"VALUES (?, ?, ?, ?)", path, id, data, modified)
+	if err != nil {
+		return err
+	}
+	ss.versionBytes += int64(len(data))
+
+	versions, err := listSQLiteVersions(tx, path)
+	if err != nil {
+		return err
+	}
+	_, remove := ss.retention.apply(versions, now)
+	for _, v := range remove {
+		if err = ss.removeVersion(tx, path, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evictVersions removes the oldest previous versions of any file until the
+// files and their versions fit within the byte quota.
+func (ss *SQLiteStore) evictVersions(tx *sql.Tx) error {
+	excess := ss.quota.excessVersionBytes(ss.getUsage())
+	if excess == 0 {
+		return nil
+	}
+
+	rows, err := tx.Query("SELECT path, id, LENGTH(data) FROM versions")
+	if err != nil {
+		return err
+	}
+	var versions []storedVersion
+	for rows.Next() {
+		var v storedVersion
+		if err = rows.Scan(&v.path, &v.ID, &v.Size); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		versions = append(versions, v)
+	}
+	if err = rows.Close(); err != nil {
+		return err
+	} else if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, v := range oldestVersions(versions, excess) {
+		if err = ss.removeVersion(tx, v.path, v.Version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeVersion removes the previous version of the file at the path.
+func (ss *SQLiteStore) removeVersion(tx *sql.Tx, path string, v Version) error {
+	_, err := tx.Exec(
+		"DELETE FROM versions WHERE path = ? AND id = ?", path, v.ID)
+	if err != nil {
+		return err
+	}
+	ss.versionBytes -= v.Size
+	return nil
+}
+
+// listSQLiteVersions returns all previous versions of the file at the path in
+// no particular order.
+func listSQLiteVersions(q sqlQuerier, path string) ([]Version, error) {
+	rows, err := q.Query("SELECT id, modified, LENGTH(data) FROM versions "+
+		"WHERE path = ?", path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	versions := make([]Version, 0)
+	for rows.Next() {
+		var v Version
+		var modified int64
+		if err = rows.Scan(&v.ID, &modified, &v.Size); err != nil {
+			return nil, err
+		}
+		v.Modified, v.Replaced = time.Unix(0, modified), time.Unix(0, v.ID)
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// Close prevents any further modifications to the store, waits for all
+// in-progress modifications to complete, and closes the database. Unlike a
+// FileStore, reads also fail once the store is closed. Calling Close more than
+// once has no effect.
+func (ss *SQLiteStore) Close() error {
+	ss.mux.Lock()
+	if ss.closed {
+		ss.mux.Unlock()
+		return nil
+	}
+	ss.closed = true
+	ss.mux.Unlock()
+
+	ss.inProgress.Wait()
+	return ss.db.Close()
+}
+
+// startModification registers the start of a modification that Close must wait
+// on. The caller must call ss.inProgress.Done once the modification completes.
+// Returns [ClosedErr] if the store is closed.
+func (ss *SQLiteStore) startModification() error {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	if ss.closed {
+		return ClosedErr
+	}
+	ss.inProgress.Add(1)
+	return nil
+}
+
+// isDir returns true if the path is the base directory or a directory that
+// contains at least one file.
+func (ss *SQLiteStore) isDir(q sqlQuerier, path string) (bool, error) {
+	if path == "" {
+		return true, nil
+	}
+	var exists bool
+	err := q.QueryRow("SELECT EXISTS (SELECT 1 FROM files WHERE "+
+		"substr(path, 1, length(?)) = ?)", dirPrefix(path), dirPrefix(path)).
+		Scan(&exists)
+	return exists, err
+}
+
+// checkParents returns an error if any parent directory of the path is a
+// file.
+func (ss *SQLiteStore) checkParents(q sqlQuerier, path string) error {
+	for dir := filepath.ToSlash(filepath.Dir(path)); dir != "."; dir =
+		filepath.ToSlash(filepath.Dir(dir)) {
+		var exists bool
+		err := q.QueryRow("SELECT EXISTS (SELECT 1 FROM files WHERE path = ?)",
+			dir).Scan(&exists)
+		if err != nil {
+			return err
+		} else if exists {
+			return errors.Errorf("cannot write %s: %s is not a directory",
+				path, dir)
+		}
+	}
+	return nil
+}
+
+// fileNotFound returns the error for a file that does not exist at the path.
+func (ss *SQLiteStore) fileNotFound(q sqlQuerier, path string) error {
+	if isDir, err := ss.isDir(q, path); err != nil {
+		return errors.WithStack(err)
+	} else if isDir {
+		return errors.Errorf("cannot read directory %s as a file", path)
+	}
+	return notExistErr(path)
+}
+
+// dirNotFound returns the error for a directory that does not exist at the
+// path.
+func (ss *SQLiteStore) dirNotFound(q sqlQuerier, path string) error {
+	var exists bool
+	err := q.QueryRow("SELECT EXISTS (SELECT 1 FROM files WHERE path = ?)",
+		path).Scan(&exists)
+	if err != nil {
+		return errors.WithStack(err)
+	} else if exists {
+		return errors.Errorf("cannot read file %s as a directory", path)
+	}
+	return notExistErr(path)
+}
+
+// readyPath returns the path relative to the base directory with forward
+// slashes, as it is stored in the database. The base directory is the empty
+// string. Returns NonLocalFileErr if the file is outside the base path and
+// ReservedPathErr if the path is reserved for internal files.
+func (ss *SQLiteStore) readyPath(path string) (string, error) {
+	if isReservedPath(path) {
+		return "", ReservedPathErr
+	}
+	path, err := readyPath(ss.baseDir, path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(ss.baseDir, path)
+	if err != nil {
+		return "", err
+	} else if rel == "." {
+		return "", nil
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// dirPrefix returns the prefix of the paths of all files in the directory.
+func dirPrefix(path string) string {
+	if path == "" {
+		return ""
+	}
+	return path + "/"
+}
+
+// notExistErr returns an error for the path that matches os.ErrNotExist.
+func notExistErr(path string) error {
+	return errors.WithStack(&os.PathError{
+		Op: "open", Path: filepath.FromSlash(path), Err: os.ErrNotExist})
+}
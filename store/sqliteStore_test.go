@@ -0,0 +1,634 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package store
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Tests that SQLiteStore adheres to the Store interface.
+var _ Store = (*SQLiteStore)(nil)
+
+// Tests that SQLiteStore passes the store conformance tests.
+func TestSQLiteStore_Conformance(t *testing.T) {
+	RunConformanceTests(t, NewSQLiteStore)
+}
+
+// Tests that NewSQLiteStore creates the database in the base directory and
+// that the store can be reopened.
+func TestNewSQLiteStore(t *testing.T) {
+	testDir := "tmp"
+	defer removeTestFile(t, testDir)
+	ss := newTestSQLiteStore("baseDir", testDir, t)
+
+	dbPath := filepath.Join(testDir, "baseDir", sqliteFile)
+	if _, err := os.Stat(dbPath); err != nil {
+		t.Errorf("Failed to stat database %s: %+v", dbPath, err)
+	}
+
+	if err := ss.Write("file", []byte("data")); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	} else if err = ss.Close(); err != nil {
+		t.Fatalf("Failed to close: %+v", err)
+	}
+
+	ss = newTestSQLiteStore("baseDir", testDir, t)
+	defer func() { _ = ss.Close() }()
+	if data, err := ss.Read("file"); err != nil {
+		t.Errorf("Failed to read after reopening: %+v", err)
+	} else if !bytes.Equal([]byte("data"), data) {
+		t.Errorf("Unexpected data.\nexpected: %q\nreceived: %q", "data", data)
+	}
+}
+
+// Error path: Tests that NewSQLiteStore returns NonLocalFileErr when the base
+// directory is outside the storage directory.
+func TestNewSQLiteStore_NonLocalPathError(t *testing.T) {
+	_, err := NewSQLiteStore("tmp", "../baseDir")
+	if !errors.Is(err, NonLocalFileErr) {
+		t.Errorf("Unexpected error.\nexpected: %v\nreceived: %+v",
+			NonLocalFileErr, err)
+	}
+}
+
+// Tests that all the files written by SQLiteStore.Write can be properly read by
+// SQLiteStore.Read.
+func TestSQLiteStore_Write_Read(t *testing.T) {
+	prng := rand.New(rand.NewSource(4321))
+	testDir := "tmp"
+	defer removeTestFile(t, testDir)
+	ss := newTestSQLiteStore("baseDir", testDir, t)
+	defer func() { _ = ss.Close() }()
+
+	testFiles := map[string][]byte{
+		"hello.txt":                    []byte(randString(1+prng.Intn(12), prng)),
+		"dir/testFile.txt":             []byte(randString(1+prng.Intn(12), prng)),
+		filepath.Join("dir2", "f.txt"): []byte(randString(1+prng.Intn(12), prng)),
+		"/dir3/../empty":               {},
+	}
+
+	for path, data := range testFiles {
+		if err := ss.Write(path, data); err != nil {
+			t.Errorf("Failed to write data for path %s: %+v", path, err)
+		}
+	}
+
+	for path, expected := range testFiles {
+		data, err := ss.Read(path)
+		if err != nil {
+			t.Errorf("Failed to read data for path %s: %+v", path, err)
+		} else if !bytes.Equal(expected, data) {
+			t.Errorf("Read unexpected data for path %s."+
+				"\nexpected: %q\nreceived: %q", path, expected, data)
+		}
+	}
+}
+
+// Error path: Tests that SQLiteStore returns the same errors as FileStore for
+// invalid paths.
+func TestSQLiteStore_InvalidPathErrors(t *testing.T) {
+	testDir := "tmp"
+	defer removeTestFile(t, testDir)
+	ss := newTestSQLiteStore("baseDir", testDir, t)
+	defer func() { _ = ss.Close() }()
+
+	if err := ss.Write("dir/file", []byte("data")); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+
+	if _, err := ss.Read("../file"); !errors.Is(err, NonLocalFileErr) {
+		t.Errorf("Unexpected error for non-local path."+
+			"\nexpected: %v\nreceived: %+v", NonLocalFileErr, err)
+	}
+	if err := ss.Write(sqliteFile, nil); !errors.Is(err, ReservedPathErr) {
+		t.Errorf("Unexpected error for reserved path."+
+			"\nexpected: %v\nreceived: %+v", ReservedPathErr, err)
+	}
+	if _, err := ss.Read("missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error for missing file."+
+			"\nexpected: %v\nreceived: %+v", os.ErrNotExist, err)
+	}
+	if _, err := ss.ReadDir("missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error for missing directory."+
+			"\nexpected: %v\nreceived: %+v", os.ErrNotExist, err)
+	}
+	if _, err := ss.Read("dir"); err == nil {
+		t.Errorf("Did not fail to read directory as a file.")
+	}
+	if err := ss.Write("dir", []byte("data")); err == nil {
+		t.Errorf("Did not fail to write to a directory.")
+	}
+	if err := ss.Write("dir/file/child", []byte("data")); err == nil {
+		t.Errorf("Did not fail to write to a file's child.")
+	}
+	if err := ss.Delete("dir"); err == nil {
+		t.Errorf("Did not fail to delete directory as a file.")
+	}
+	if err := ss.DeleteDir("dir/file"); err == nil {
+		t.Errorf("Did not fail to delete file as a directory.")
+	}
+}
+
+// Tests that SQLiteStore.GetLastModified returns the time the file was written
+// and the latest time of the files in a directory.
+func TestSQLiteStore_GetLastModified(t *testing.T) {
+	testDir := "tmp"
+	defer removeTestFile(t, testDir)
+	ss := newTestSQLiteStore("baseDir", testDir, t)
+	defer func() { _ = ss.Close() }()
+
+	before := time.Now()
+	if err := ss.Write("dir/a", []byte("a")); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+	a, err := ss.GetLastModified("dir/a")
+	if err != nil {
+		t.Fatalf("Failed to get last modified: %+v", err)
+	} else if a.Before(before) || a.After(time.Now()) {
+		t.Errorf("Last modified %s not between %s and now.", a, before)
+	}
+
+	time.Sleep(time.Millisecond)
+	if err = ss.Write("dir/b", []byte("b")); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+	b, _ := ss.GetLastModified("dir/b")
+	dir, err := ss.GetLastModified("dir")
+	if err != nil {
+		t.Fatalf("Failed to get last modified of directory: %+v", err)
+	} else if !dir.Equal(b) || !b.After(a) {
+		t.Errorf("Unexpected directory modification time."+
+			"\nexpected: %s\nreceived: %s", b, dir)
+	}
+
+	if _, err = ss.GetLastModified("missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error for missing file."+
+			"\nexpected: %v\nreceived: %+v", os.ErrNotExist, err)
+	}
+}
+
+// Tests that SQLiteStore.GetLastWrite returns the time of the last
+// modification and that it persists when the store is reopened.
+func TestSQLiteStore_GetLastWrite(t *testing.T) {
+	testDir := "tmp"
+	defer removeTestFile(t, testDir)
+	ss := newTestSQLiteStore("baseDir", testDir, t)
+
+	if _, err := ss.GetLastWrite(); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error for new store."+
+			"\nexpected: %v\nreceived: %+v", os.ErrNotExist, err)
+	}
+
+	if err := ss.Write("file", []byte("data")); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	}
+	modified, _ := ss.GetLastModified("file")
+	lastWrite, err := ss.GetLastWrite()
+	if err != nil {
+		t.Fatalf("Failed to get last write: %+v", err)
+	} else if !lastWrite.Equal(modified) {
+		t.Errorf("Unexpected last write.\nexpected: %s\nreceived: %s",
+			modified, lastWrite)
+	}
+
+	if err = ss.Delete("file"); err != nil {
+		t.Fatalf("Failed to delete: %+v", err)
+	}
+	lastWrite, _ = ss.GetLastWrite()
+	_ = ss.Close()
+
+	ss = newTestSQLiteStore("baseDir", testDir, t)
+	defer func() { _ = ss.Close() }()
+	reopened, err := ss.GetLastWrite()
+	if err != nil {
+		t.Fatalf("Failed to get last write after reopening: %+v", err)
+	} else if !reopened.Equal(lastWrite) || ss.lastWritePath != "" {
+		t.Errorf("Unexpected last write after reopening."+
+			"\nexpected: %s\nreceived: %s (%q)",
+			lastWrite, reopened, ss.lastWritePath)
+	}
+}
+
+// Tests that SQLiteStore.ReadDir and SQLiteStore.ReadDirEntries return the
+// same results as FileStore for the same files.
+func TestSQLiteStore_ReadDir_ReadDirEntries_MatchFileStore(t *testing.T) {
+	testDir := "tmp"
+	defer removeTestFile(t, testDir)
+	fs := newTestFileStore("fileStore", testDir, t)
+	ss := newTestSQLiteStore("sqliteStore", testDir, t)
+	defer func() { _ = ss.Close() }()
+
+	for i, path := range []string{"file", "dir1/a", "dir1/file", "dir1/dirA/a",
+		"dir1/dirB/dirB1/a", "dir1/dirB/dirB2/a", "dir1/dirC/file",
+		"dir2/dirC/a", "dirD/a"} {
+		data := []byte(path)
+		if err := fs.Write(path, data); err != nil {
+			t.Fatalf("Failed to write %s to FileStore (%d): %+v", path, i, err)
+		} else if err = ss.Write(path, data); err != nil {
+			t.Fatalf("Failed to write %s to SQLiteStore (%d): %+v", path, i, err)
+		}
+	}
+
+	for i, path := range []string{
+		"", "dir1", "dir1/dirB", "dir1/dirB/dirB2", "dir2/"} {
+		expected, err := fs.ReadDir(path)
+		if err != nil {
+			t.Fatalf("Failed to read FileStore dir %s (%d): %+v", path, i, err)
+		}
+		dirs, err := ss.ReadDir(path)
+		if err != nil {
+			t.Errorf("Failed to read dir %s (%d): %+v", path, i, err)
+		} else if !reflect.DeepEqual(expected, dirs) {
+			t.Errorf("Unexpected dirs for %s (%d).\nexpected: %q\nreceived: %q",
+				path, i, expected, dirs)
+		}
+
+		expectedEntries, _ := fs.ReadDirEntries(path)
+		entries, err := ss.ReadDirEntries(path)
+		if err != nil {
+			t.Errorf("Failed to read dir entries %s (%d): %+v", path, i, err)
+		} else if len(expectedEntries) != len(entries) {
+			t.Errorf("Unexpected entries for %s (%d)."+
+				"\nexpected: %+v\nreceived: %+v",
+				path, i, expectedEntries, entries)
+		} else {
+			for j := range entries {
+				e, ee := entries[j], expectedEntries[j]
+				if e.Name != ee.Name || e.IsDir != ee.IsDir || e.Size != ee.Size {
+					t.Errorf("Unexpected entry %d for %s (%d)."+
+						"\nexpected: %+v\nreceived: %+v", j, path, i, ee, e)
+				}
+			}
+		}
+	}
+}
+
+// Tests that SQLiteStore.Manifest returns the path, size, and hash of every
+// file in the directory.
+func TestSQLiteStore_Manifest(t *testing.T) {
+	testDir := "tmp"
+	defer removeTestFile(t, testDir)
+	ss := newTestSQLiteStore("baseDir", testDir, t)
+	defer func() { _ = ss.Close() }()
+
+	files := map[string][]byte{
+		"a": []byte("aa"), "dir/b": []byte("b"), "dir/sub/c": []byte("ccc"),
+	}
+	for path, data := range files {
+		if err := ss.Write(path, data); err != nil {
+			t.Fatalf("Failed to write %s: %+v", path, err)
+		}
+	}
+
+	manifest, err := ss.Manifest("dir", time.Time{})
+	if err != nil {
+		t.Fatalf("Failed to get manifest: %+v", err)
+	}
+	expected := []string{"dir/b", "dir/sub/c"}
+	if len(manifest) != len(expected) {
+		t.Fatalf("Unexpected manifest.\nexpected: %q\nreceived: %+v",
+			expected, manifest)
+	}
+	for i, e := range manifest {
+		data := files[expected[i]]
+		if e.Path != filepath.FromSlash(expected[i]) ||
+			e.Size != int64(len(data)) ||
+			!bytes.Equal(ContentHash(data), e.Hash) {
+			t.Errorf("Unexpected manifest entry %d: %+v", i, e)
+		}
+	}
+
+	manifest, err = ss.Manifest("", time.Now().Add(time.Hour))
+	if err != nil || len(manifest) != 0 {
+		t.Errorf("Unexpected manifest for future since: %+v, %+v", manifest, err)
+	}
+
+	if _, err = ss.Manifest("missing", time.Time{}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error for missing directory."+
+			"\nexpected: %v\nreceived: %+v", os.ErrNotExist, err)
+	}
+}
+
+// Tests that SQLiteStore.Delete and SQLiteStore.DeleteDir remove files and
+// update the usage.
+func TestSQLiteStore_Delete_DeleteDir(t *testing.T) {
+	testDir := "tmp"
+	defer removeTestFile(t, testDir)
+	ss := newTestSQLiteStore("baseDir", testDir, t)
+	defer func() { _ = ss.Close() }()
+
+	for _, path := range []string{"a", "dir/b", "dir/sub/c", "dir2/d"} {
+		if err := ss.Write(path, []byte("data")); err != nil {
+			t.Fatalf("Failed to write %s: %+v", path, err)
+		}
+	}
+
+	if err := ss.Delete("a"); err != nil {
+		t.Errorf("Failed to delete file: %+v", err)
+	} else if _, err = ss.Read("a"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("File exists after delete: %+v", err)
+	}
+	if err := ss.Delete("a"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error deleting missing file."+
+			"\nexpected: %v\nreceived: %+v", os.ErrNotExist, err)
+	}
+
+	if err := ss.DeleteDir("dir"); err != nil {
+		t.Errorf("Failed to delete directory: %+v", err)
+	} else if _, err = ss.ReadDir("dir"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Directory exists after delete: %+v", err)
+	}
+	if err := ss.DeleteDir("dir"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error deleting missing directory."+
+			"\nexpected: %v\nreceived: %+v", os.ErrNotExist, err)
+	}
+
+	if usage := ss.GetUsage(); usage != (Usage{Bytes: 4, Files: 1}) {
+		t.Errorf("Unexpected usage.\nexpected: %+v\nreceived: %+v",
+			Usage{Bytes: 4, Files: 1}, usage)
+	}
+
+	if err := ss.DeleteDir(""); err != nil {
+		t.Errorf("Failed to delete base directory: %+v", err)
+	} else if dirs, err := ss.ReadDir(""); err != nil || len(dirs) != 0 {
+		t.Errorf("Base directory not empty after delete: %q, %+v", dirs, err)
+	}
+	if usage := ss.GetUsage(); usage != (Usage{}) {
+		t.Errorf("Unexpected usage.\nexpected: %+v\nreceived: %+v",
+			Usage{}, usage)
+	}
+}
+
+// Tests that SQLiteStore enforces its quota and that the usage is recovered
+// when the store is reopened.
+func TestSQLiteStore_SetQuota_GetUsage(t *testing.T) {
+	testDir := "tmp"
+	defer removeTestFile(t, testDir)
+	ss := newTestSQLiteStore("baseDir", testDir, t)
+	ss.SetQuota(Quota{MaxBytes: 10, MaxFiles: 2})
+
+	if err := ss.Write("a", []byte("12345")); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	} else if err = ss.Write("b", []byte("123456")); !errors.Is(err, QuotaExceededErr) {
+		t.Errorf("Unexpected error for byte quota."+
+			"\nexpected: %v\nreceived: %+v", QuotaExceededErr, err)
+	} else if err = ss.Write("b", []byte("12345")); err != nil {
+		t.Fatalf("Failed to write: %+v", err)
+	} else if err = ss.Write("c", nil); !errors.Is(err, QuotaExceededErr) {
+		t.Errorf("Unexpected error for file quota."+
+			"\nexpected: %v\nreceived: %+v", QuotaExceededErr, err)
+	}
+
+	expected := Usage{Bytes: 10, Files: 2}
+	if usage := ss.GetUsage(); usage != expected {
+		t.Errorf("Unexpected usage.\nexpected: %+v\nreceived: %+v",
+			expected, usage)
+	}
+	_ = ss.Close()
+
+	ss = newTestSQLiteStore("baseDir", testDir, t)
+	defer func() { _ = ss.Close() }()
+	if usage := ss.GetUsage(); usage != expected {
+		t.Errorf("Unexpected usage after reopening."+
+			"\nexpected: %+v\nreceived: %+v", expected, usage)
+	}
+}
+
+// Tests that SQLiteStore.WriteIf only writes when the precondition matches and
+// that exactly one of many concurrent conditional writes succeeds.
+func TestSQLiteStore_WriteIf(t *testing.T) {
+	testDir := "tmp"
+	defer removeTestFile(t, testDir)
+	ss := newTestSQLiteStore("baseDir", testDir, t)
+	defer func() { _ = ss.Close() }()
+
+	if err := ss.WriteIf("file", []byte("a"), Precondition{NotExist: true}); err != nil {
+		t.Fatalf("Failed to write new file: %+v", err)
+	}
+	err := ss.WriteIf("file", []byte("b"), Precondition{NotExist: true})
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("Unexpected error.\nexpected: %v\nreceived: %+v",
+			ConflictErr, err)
+	} else if !conflict.Exists || !bytes.Equal(ContentHash([]byte("a")), conflict.Hash) {
+		t.Errorf("Unexpected conflict: %+v", conflict)
+	}
+
+	const n = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	cond := Precondition{Hash: ContentHash([]byte("a"))}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- ss.WriteIf("file", []byte{byte(i)}, cond)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	var succeeded int
+	for err = range errs {
+		if err == nil {
+			succeeded++
+		} else if !errors.Is(err, ConflictErr) {
+			t.Errorf("Unexpected error: %+v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("Unexpected number of successful writes."+
+			"\nexpected: %d\nreceived: %d", 1, succeeded)
+	}
+}
+
+// Tests that SQLiteStore keeps previous versions of files according to the
+// retention policy and deletes them with their directory.
+func TestSQLiteStore_ListVersions_ReadVersion(t *testing.T) {
+	testDir := "tmp"
+	defer removeTestFile(t, testDir)
+	ss := newTestSQLiteStore("baseDir", testDir, t)
+	defer func() { _ = ss.Close() }()
+	ss.SetRetention(RetentionPolicy{MaxVersions: 2})
+
+	contents := []string{"v1", "v2", "v3", "v4"}
+	for _, data := range contents {
+		if err := ss.Write("dir/file", []byte(data)); err != nil {
+			t.Fatalf("Failed to write %s: %+v", data, err)
+		}
+	}
+
+	versions, err := ss.ListVersions("dir/file")
+	if err != nil {
+		t.Fatalf("Failed to list versions: %+v", err)
+	} else if len(versions) != 2 {
+		t.Fatalf("Unexpected number of versions."+
+			"\nexpected: %d\nreceived: %d", 2, len(versions))
+	}
+	for i, v := range versions {
+		expected := []byte(contents[len(contents)-2-i])
+		data, err := ss.ReadVersion("dir/file", v.ID)
+		if err != nil {
+			t.Errorf("Failed to read version %d: %+v", v.ID, err)
+		} else if !bytes.Equal(expected, data) || v.Size != int64(len(expected)) {
+			t.Errorf("Unexpected version %d.\nexpected: %q\nreceived: %q",
+				i, expected, data)
+		}
+	}
+
+	if err = ss.DeleteDir("dir"); err != nil {
+		t.Fatalf("Failed to delete directory: %+v", err)
+	}
+	_, err = ss.ReadVersion("dir/file", versions[0].ID)
+	if !errors.Is(err, VersionNotFoundErr) {
+		t.Errorf("Unexpected error reading deleted version."+
+			"\nexpected: %v\nreceived: %+v", VersionNotFoundErr, err)
+	}
+}
+
+// Tests that SQLiteStore.GetChanges returns every modification in order, that
+// the journal and its ID persist when the store is reopened, and that it is
+// compacted.
+func TestSQLiteStore_GetChanges(t *testing.T) {
+	testDir := "tmp"
+	defer removeTestFile(t, testDir)
+	ss := newTestSQLiteStore("baseDir", testDir, t)
+
+	ops := []struct {
+		op   func() error
+		ct   ChangeType
+		path string
+	}{
+		{func() error { return ss.Write("dir/a", []byte("a")) }, ChangeWrite, "dir/a"},
+		{func() error { return ss.Write("b", []byte("b")) }, ChangeWrite, "b"},
+		{func() error { return ss.Delete("b") }, ChangeDelete, "b"},
+		{func() error { return ss.DeleteDir("dir") }, ChangeDeleteDir, "dir"},
+		{func() error { return ss.DeleteDir("") }, ChangeDeleteDir, ""},
+	}
+	for i, op := range ops {
+		if err := op.op(); err != nil {
+			t.Fatalf("Operation %d failed: %+v", i, err)
+		}
+	}
+
+	journalID, _, err := ss.GetChanges("", 0)
+	if err != nil {
+		t.Fatalf("Failed to get journal ID: %+v", err)
+	}
+	check := func(ss *SQLiteStore) {
+		id, changes, err := ss.GetChanges(journalID, 0)
+		if err != nil {
+			t.Fatalf("Failed to get changes: %+v", err)
+		} else if id != journalID {
+			t.Errorf("Unexpected journal ID.\nexpected: %s\nreceived: %s",
+				journalID, id)
+		} else if len(changes) != len(ops) {
+			t.Fatalf("Unexpected number of changes."+
+				"\nexpected: %d\nreceived: %d", len(ops), len(changes))
+		}
+		for i, c := range changes {
+			if c.Seq != uint64(i+1) || c.Type != ops[i].ct ||
+				c.Path != filepath.FromSlash(ops[i].path) || c.Time.IsZero() {
+				t.Errorf("Unexpected change %d: %+v", i, c)
+			}
+		}
+	}
+	check(ss)
+	_ = ss.Close()
+
+	ss = newTestSQLiteStore("baseDir", testDir, t)
+	check(ss)
+
+	// Compact the journal with a small maximum
+	ss.journal.maxEntries = 2
+	for i := 0; i < 5; i++ {
+		if err := ss.Write("c", []byte{byte(i)}); err != nil {
+			t.Fatalf("Failed to write: %+v", err)
+		}
+	}
+	_, expected, _ := ss.GetChanges(journalID, ss.journal.changes[0].Seq-1)
+	_ = ss.Close()
+
+	ss = newTestSQLiteStore("baseDir", testDir, t)
+	defer func() { _ = ss.Close() }()
+	if _, _, err = ss.GetChanges(journalID, 0); !errors.Is(err, JournalCompactedErr) {
+		t.Errorf("Unexpected error for compacted changes."+
+			"\nexpected: %v\nreceived: %+v", JournalCompactedErr, err)
+	}
+	if len(expected) != len(ss.journal.changes) {
+		t.Fatalf("Unexpected journal after reopening."+
+			"\nexpected: %+v\nreceived: %+v", expected, ss.journal.changes)
+	}
+	for i, c := range ss.journal.changes {
+		if c.Seq != expected[i].Seq || !c.Time.Equal(expected[i].Time) {
+			t.Errorf("Unexpected change %d after reopening."+
+				"\nexpected: %+v\nreceived: %+v", i, expected[i], c)
+		}
+	}
+}
+
+// Tests that SQLiteStore.Close waits for in-progress modifications to complete
+// and that modifications made after closing return ClosedErr.
+func TestSQLiteStore_Close(t *testing.T) {
+	testDir := "tmp"
+	defer removeTestFile(t, testDir)
+	ss := newTestSQLiteStore("baseDir", testDir, t)
+
+	// Simulate an in-progress write
+	if err := ss.startModification(); err != nil {
+		t.Fatalf("Failed to start modification: %+v", err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		if err := ss.Close(); err != nil {
+			t.Errorf("Failed to close: %+v", err)
+		}
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		t.Fatalf("Close returned before in-progress modification finished.")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	ss.inProgress.Done()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for Close to return.")
+	}
+
+	if err := ss.Write("file", []byte("data")); !errors.Is(err, ClosedErr) {
+		t.Errorf("Unexpected error for write after close."+
+			"\nexpected: %v\nreceived: %+v", ClosedErr, err)
+	}
+	if err := ss.Close(); err != nil {
+		t.Errorf("Failed to close a second time: %+v", err)
+	}
+}
+
+// newTestSQLiteStore creates a new SQLiteStore for testing.
+func newTestSQLiteStore(baseDir, testDir string, t testing.TB) *SQLiteStore {
+	ss, err := NewSQLiteStore(testDir, baseDir)
+	if err != nil {
+		t.Fatalf("Failed to create new SQLiteStore: %+v", err)
+	}
+
+	return ss.(*SQLiteStore)
+}
@@ -0,0 +1,100 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package store
+
+import (
+	"sort"
+	"time"
+)
+
+// RetentionPolicy determines which previous versions of a file a store keeps
+// when the file is overwritten or deleted. A limit of zero means there is no
+// limit. If both limits are zero, then no new versions are kept.
+type RetentionPolicy struct {
+	// MaxVersions is the maximum number of previous versions kept for each
+	// file.
+	MaxVersions int
+
+	// MaxAge is the maximum time a previous version is kept after it was
+	// replaced.
+	MaxAge time.Duration
+}
+
+// Version describes a previous version of a file.
+type Version struct {
+	// ID uniquely identifies the version of the file. It is passed to
+	// ReadVersion to read the contents of the version.
+	ID int64
+
+	// Modified is the time the contents of the version were written.
+	Modified time.Time
+
+	// Replaced is the time the version was overwritten or deleted.
+	Replaced time.Time
+
+	// Size is the size of the version in bytes.
+	Size int64
+}
+
+// enabled returns true if the policy keeps any versions.
+func (p RetentionPolicy) enabled() bool {
+	return p.MaxVersions > 0 || p.MaxAge > 0
+}
+
+// apply sorts the versions from newest to oldest and splits them into those
+// retained by the policy and those that should be removed.
+func (p RetentionPolicy) apply(
+	versions []Version, now time.Time) (keep, remove []Version) {
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].ID > versions[j].ID
+	})
+
+	keep = make([]Version, 0, len(versions))
+	for i, v := range versions {
+		if (p.MaxVersions > 0 && i >= p.MaxVersions) ||
+			(p.MaxAge > 0 && now.Sub(v.Replaced) > p.MaxAge) {
+			remove = append(remove, v)
+		} else {
+			keep = append(keep, v)
+		}
+	}
+	return keep, remove
+}
+
+// newVersionID returns a version ID based on the time the version was
+// replaced. The ID is increased until it does not exist.
+func newVersionID(replaced time.Time, exists func(id int64) bool) int64 {
+	id := replaced.UnixNano()
+	for exists(id) {
+		id++
+	}
+	return id
+}
+
+// storedVersion is a previous version of the file at the path.
+type storedVersion struct {
+	path string
+	Version
+}
+
+// oldestVersions sorts the versions from oldest to newest and returns the
+// fewest of the oldest versions whose total size is at least n bytes.
+func oldestVersions(versions []storedVersion, n int64) []storedVersion {
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].ID < versions[j].ID
+	})
+
+	var size int64
+	for i, v := range versions {
+		if size >= n {
+			return versions[:i]
+		}
+		size += v.Size
+	}
+	return versions
+}
@@ -0,0 +1,135 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package store
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Tests that RetentionPolicy.enabled only returns false when both limits are
+// zero.
+func TestRetentionPolicy_enabled(t *testing.T) {
+	tests := map[RetentionPolicy]bool{
+		{}:                             false,
+		{MaxVersions: 1}:               true,
+		{MaxAge: time.Hour}:            true,
+		{MaxVersions: 3, MaxAge: 1000}: true,
+	}
+
+	for p, expected := range tests {
+		if enabled := p.enabled(); enabled != expected {
+			t.Errorf("Unexpected result for %+v.\nexpected: %t\nreceived: %t",
+				p, expected, enabled)
+		}
+	}
+}
+
+// Tests that RetentionPolicy.apply sorts the versions from newest to oldest and
+// removes versions past the maximum count or older than the maximum age.
+func TestRetentionPolicy_apply(t *testing.T) {
+	now := time.Unix(0, 10_000)
+	versions := func() []Version {
+		return []Version{
+			{ID: 7_000, Replaced: time.Unix(0, 7_000)},
+			{ID: 9_000, Replaced: time.Unix(0, 9_000)},
+			{ID: 1_000, Replaced: time.Unix(0, 1_000)},
+			{ID: 5_000, Replaced: time.Unix(0, 5_000)},
+		}
+	}
+
+	tests := []struct {
+		policy     RetentionPolicy
+		keep, drop []int64
+	}{
+		{RetentionPolicy{}, []int64{9_000, 7_000, 5_000, 1_000}, nil},
+		{RetentionPolicy{MaxVersions: 2},
+			[]int64{9_000, 7_000}, []int64{5_000, 1_000}},
+		{RetentionPolicy{MaxAge: 4_000},
+			[]int64{9_000, 7_000}, []int64{5_000, 1_000}},
+		{RetentionPolicy{MaxVersions: 1, MaxAge: 6_000},
+			[]int64{9_000}, []int64{7_000, 5_000, 1_000}},
+		{RetentionPolicy{MaxVersions: 10, MaxAge: 6_000},
+			[]int64{9_000, 7_000, 5_000}, []int64{1_000}},
+	}
+
+	ids := func(versions []Version) []int64 {
+		var list []int64
+		for _, v := range versions {
+			list = append(list, v.ID)
+		}
+		return list
+	}
+
+	for i, tt := range tests {
+		keep, remove := tt.policy.apply(versions(), now)
+		if !reflect.DeepEqual(tt.keep, ids(keep)) {
+			t.Errorf("Unexpected kept versions for %+v (%d)."+
+				"\nexpected: %v\nreceived: %v", tt.policy, i, tt.keep, ids(keep))
+		}
+		if !reflect.DeepEqual(tt.drop, ids(remove)) {
+			t.Errorf("Unexpected removed versions for %+v (%d)."+
+				"\nexpected: %v\nreceived: %v",
+				tt.policy, i, tt.drop, ids(remove))
+		}
+	}
+}
+
+// Tests that newVersionID returns the replaced time in nanoseconds, increased
+// until it does not collide with an existing ID.
+func Test_newVersionID(t *testing.T) {
+	replaced := time.Unix(0, 500)
+	existing := map[int64]bool{500: true, 501: true, 503: true}
+
+	id := newVersionID(replaced, func(id int64) bool { return existing[id] })
+	if id != 502 {
+		t.Errorf("Unexpected ID.\nexpected: %d\nreceived: %d", 502, id)
+	}
+
+	id = newVersionID(replaced, func(int64) bool { return false })
+	if id != 500 {
+		t.Errorf("Unexpected ID.\nexpected: %d\nreceived: %d", 500, id)
+	}
+}
+
+// Tests that oldestVersions returns the fewest of the oldest versions that
+// total at least the number of bytes.
+func Test_oldestVersions(t *testing.T) {
+	versions := func() []storedVersion {
+		return []storedVersion{
+			{"b", Version{ID: 3, Size: 10}},
+			{"a", Version{ID: 1, Size: 10}},
+			{"c", Version{ID: 4, Size: 10}},
+			{"a", Version{ID: 2, Size: 10}},
+		}
+	}
+	tests := []struct {
+		n        int64
+		expected []int64
+	}{
+		{0, []int64{}},
+		{1, []int64{1}},
+		{10, []int64{1}},
+		{11, []int64{1, 2}},
+		{35, []int64{1, 2, 3, 4}},
+		{100, []int64{1, 2, 3, 4}},
+	}
+
+	for i, tt := range tests {
+		oldest := oldestVersions(versions(), tt.n)
+		received := make([]int64, len(oldest))
+		for j, v := range oldest {
+			received[j] = v.ID
+		}
+		if !reflect.DeepEqual(tt.expected, received) {
+			t.Errorf("Unexpected versions for %d bytes (%d)."+
+				"\nexpected: %v\nreceived: %v", tt.n, i, tt.expected, received)
+		}
+	}
+}